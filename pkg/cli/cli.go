@@ -17,34 +17,46 @@ import (
 var log elog.View
 
 var (
-	flagJSON             bool
-	flagVerbose          bool
-	flagDebug            bool
-	flagDefault          bool
-	flagCompressionLevel uint
-	flagForce            bool
-	flagExcludeDefault   bool
-	flagFormat           string
-	flagOutput           string
-	flagPlatform         string
-	flagName             string
-	flagKey              string
-	flagGUI              bool
-	flagOS               bool
-	flagRecord           string
-	flagShell            bool
-	flagTouched          bool
+	flagJSON                    bool
+	flagVerbose                 bool
+	flagDebug                   bool
+	flagDefault                 bool
+	flagCompressionLevel        uint
+	flagForce                   bool
+	flagExcludeDefault          bool
+	flagFormat                  string
+	flagOutput                  string
+	flagPlatform                string
+	flagName                    string
+	flagKey                     string
+	flagGUI                     bool
+	flagOS                      bool
+	flagRecord                  string
+	flagShell                   bool
+	flagTouched                 bool
+	flagRecursive               bool
+	flagParents                 bool
+	flagReproducible            bool
+	flagSeed                    int64
+	flagFirecrackerTaps         []string
+	flagFirecrackerCNI          string
+	flagCloudHypervisorKernel   string
+	flagCloudHypervisorFirmware string
+	flagLibvirtURI              string
+	flagLibvirtNetwork          string
 
 	pushOrganisation string
 	pushBucket       string
 )
 
 const (
-	platformQEMU        = "qemu"
-	platformVirtualBox  = "virtualbox"
-	platformHyperV      = "hyper-v"
-	platformFirecracker = "firecracker"
-	platformVMware      = "vmware"
+	platformQEMU            = "qemu"
+	platformVirtualBox      = "virtualbox"
+	platformHyperV          = "hyper-v"
+	platformFirecracker     = "firecracker"
+	platformCloudHypervisor = "cloud-hypervisor"
+	platformLibvirt         = "libvirt"
+	platformVMware          = "vmware"
 )
 
 func InitializeCommands() {
@@ -56,6 +68,7 @@ func InitializeCommands() {
 	addModifyFlags(provisionCmd.Flags())
 	addModifyFlags(unpackCmd.Flags())
 	addModifyFlags(packCmd.Flags())
+	addModifyFlags(configureCmd.Flags())
 	// setup logging across all commands
 	RootCommand.PersistentFlags().BoolVarP(&flagVerbose, "verbose", "v", false, "enable verbose output")
 	RootCommand.PersistentFlags().BoolVarP(&flagDebug, "debug", "d", false, "enable debug output")
@@ -102,10 +115,21 @@ func InitializeCommands() {
 	RootCommand.AddCommand(projectsCmd)
 	RootCommand.AddCommand(provisionersCmd)
 	RootCommand.AddCommand(runCmd)
+	RootCommand.AddCommand(daemonCmd)
 
 	RootCommand.AddCommand(repositoriesCmd)
+	RootCommand.AddCommand(kernelsCmd)
 	// RootCommand.AddCommand(initFirecrackerCmd)
 
+	kernelsCmd.AddCommand(listKernelsCmd)
+	kernelsCmd.AddCommand(pullKernelCmd)
+	kernelsCmd.AddCommand(verifyKernelCmd)
+	kernelsCmd.AddCommand(pruneKernelsCmd)
+	kernelsCmd.AddCommand(pinKernelCmd)
+	kernelsCmd.AddCommand(unpinKernelCmd)
+	kernelsCmd.AddCommand(bundleKernelCmd)
+	kernelsCmd.AddCommand(mirrorKernelsCmd)
+
 	repositoriesCmd.AddCommand(pushCmd)
 	repositoriesCmd.AddCommand(keysCmd)
 
@@ -142,6 +166,7 @@ func addImagesCmd() {
 	imagesCmd.AddCommand(decompileCmd)
 	imagesCmd.AddCommand(provisionCmd)
 	imagesCmd.AddCommand(catCmd)
+	imagesCmd.AddCommand(configureCmd)
 	imagesCmd.AddCommand(cpCmd)
 	imagesCmd.AddCommand(duCmd)
 	imagesCmd.AddCommand(formatCmd)
@@ -150,6 +175,9 @@ func addImagesCmd() {
 	imagesCmd.AddCommand(gptCmd)
 	imagesCmd.AddCommand(lsCmd)
 	imagesCmd.AddCommand(md5Cmd)
+	imagesCmd.AddCommand(mkdirCmd)
+	imagesCmd.AddCommand(putCmd)
+	imagesCmd.AddCommand(rmCmd)
 	imagesCmd.AddCommand(statCmd)
 	imagesCmd.AddCommand(treeCmd)
 }
@@ -2,8 +2,10 @@ package cli
 
 import (
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
 
 	"github.com/vorteil/vorteil/pkg/vpkg"
@@ -51,3 +53,42 @@ func TestHandleFileInjections(t *testing.T) {
 	}
 
 }
+
+func TestRemoveStaleSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stale sockets are only detected on unix")
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "vorteil-test-")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "daemon.sock")
+
+	err = removeStaleSocket(path)
+	if err != nil {
+		t.Errorf("expected a missing socket to be ignored, got: %v", err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	err = removeStaleSocket(path)
+	if err == nil {
+		t.Errorf("expected an error for a socket being served on")
+	}
+
+	l.Close()
+
+	err = removeStaleSocket(path)
+	if err != nil {
+		t.Errorf("expected a stale socket to be removed, got: %v", err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the stale socket to be gone")
+	}
+}
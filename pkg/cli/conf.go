@@ -6,6 +6,9 @@ package cli
  */
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -21,15 +24,29 @@ type vorteildConf struct {
 		Directory          string   `toml:"directory"`
 		DropPath           string   `toml:"drop-path"`
 		RemoteRepositories []string `toml:"remote-repositories"`
+		Keyrings           []string `toml:"keyrings,omitempty"`
+		Default            string   `toml:"default,omitempty"`
 	} `toml:"kernel-sources"`
 }
 
 var ksrc vkern.Manager
 
 type vorteilConfig struct {
-	kernels string
-	watch   string
-	sources []string
+	kernels  string
+	watch    string
+	sources  []string
+	keyrings []string
+	pinned   string
+}
+
+// vorteilConfigPath returns the path of the vorteil config, ~/.vorteil/conf.toml
+func vorteilConfigPath() (string, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".vorteil", "conf.toml"), nil
 }
 
 // loadVorteilConfig : Load vorteil config from ~/.vorteild path.
@@ -38,13 +55,11 @@ type vorteilConfig struct {
 func loadVorteilConfig() (vorteilConfig, error) {
 	var vCfg vorteilConfig
 
-	home, err := homedir.Dir()
+	conf, err := vorteilConfigPath()
 	if err != nil {
 		return vCfg, err
 	}
-
-	vorteild := filepath.Join(home, ".vorteil")
-	conf := filepath.Join(vorteild, "conf.toml")
+	vorteild := filepath.Dir(conf)
 
 	confData, err := ioutil.ReadFile(conf)
 	if err != nil {
@@ -60,11 +75,41 @@ func loadVorteilConfig() (vorteilConfig, error) {
 		vCfg.kernels = vconf.KernelSources.Directory
 		vCfg.watch = vconf.KernelSources.DropPath
 		vCfg.sources = vconf.KernelSources.RemoteRepositories
+		vCfg.keyrings = vconf.KernelSources.Keyrings
+		vCfg.pinned = vconf.KernelSources.Default
 	}
 
 	return vCfg, nil
 }
 
+// saveVorteilConfig : Write vCfg to ~/.vorteil/conf.toml, creating it if needed.
+func saveVorteilConfig(vCfg vorteilConfig) error {
+	conf, err := vorteilConfigPath()
+	if err != nil {
+		return err
+	}
+
+	vconf := new(vorteildConf)
+	vconf.KernelSources.Directory = vCfg.kernels
+	vconf.KernelSources.DropPath = vCfg.watch
+	vconf.KernelSources.RemoteRepositories = vCfg.sources
+	vconf.KernelSources.Keyrings = vCfg.keyrings
+	vconf.KernelSources.Default = vCfg.pinned
+
+	buf := new(bytes.Buffer)
+	err = toml.NewEncoder(buf).Encode(vconf)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(conf), 0777)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(conf, buf.Bytes(), 0644)
+}
+
 // mkDirAllSlice - Utils : Create the directories in the 'dirs' slice with permissions of 'perm'
 func mkDirAllSlice(perm os.FileMode, dirs ...string) error {
 	for _, dir := range dirs {
@@ -92,6 +137,7 @@ func initKernels() error {
 		Directory:          vCfg.kernels,
 		DropPath:           vCfg.watch,
 		RemoteRepositories: vCfg.sources,
+		Keyrings:           vCfg.keyrings,
 	}, log)
 	if err != nil {
 		return err
@@ -101,6 +147,17 @@ func initKernels() error {
 	vimg.GetKernel = ksrc.Get
 	vimg.GetLatestKernel = vkern.ConstructGetLastestKernelsFunc(&ksrc)
 
+	// a pinned kernel replaces the latest one as the default
+	if vCfg.pinned != "" {
+		pinned, err := vkern.Parse(vCfg.pinned)
+		if err != nil {
+			return fmt.Errorf("invalid default kernel '%s' in vorteil config: %w", vCfg.pinned, err)
+		}
+		vimg.GetLatestKernel = func(ctx context.Context) (vkern.CalVer, error) {
+			return pinned, nil
+		}
+	}
+
 	return nil
 
 }
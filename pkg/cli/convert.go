@@ -6,8 +6,14 @@ package cli
  */
 
 import (
+	"context"
+	"errors"
+	"os"
+
 	"github.com/spf13/cobra"
 	"github.com/vorteil/vorteil/pkg/vconvert"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vpkg"
 )
 
 func init() {
@@ -15,24 +21,48 @@ func init() {
 	f.StringP("user", "u", "", "container registry user")
 	f.StringP("password", "p", "", "container registry password")
 	f.StringP("config", "c", "", "container registry configuration list")
+	f.Bool("package", false, "write a vorteil package to DEST instead of a project folder")
+	f.Bool("image", false, "write a disk image to DEST instead of a project folder")
+	f.String("format", "vmdk", "disk image format used with --image")
+	f.BoolP("force", "f", false, "force overwrite of an existing package or disk image")
+	f.StringP("mapping", "m", "", "file adjusting how image configurations are mapped onto the VCFG")
+	f.String("platform", vconvert.DefaultPlatform, "platform picked from multi-platform images (os/arch[/variant])")
 }
 
 var convertContainerCmd = &cobra.Command{
-	Use:   "convert-container REPO:APP DESTFOLDER",
+	Use:   "convert-container REPO:APP DEST",
 	Args:  cobra.ExactValidArgs(2),
 	Short: "Convert containers into vorteil.io virtual machines",
 	Long: `Convert containers into vorteil.io project folders. This command can convert
 containers from a remote repository as well as from local container runtimes.
-At the moment docker and containerd are supported.
+At the moment docker and containerd are supported. Images saved to disk as an OCI
+image layout or with 'docker save' can be converted without either.
 
 Local conversion examples:
 
 vorteil projects convert-container local.docker/nginx /target/directory
 vorteil projects convert-container local.containerd/docker.io/library/tomcat:latest /target/directory
 
+Image archive conversion examples:
+
+vorteil projects convert-container oci:/images/nginx /target/directory
+vorteil projects convert-container oci:/images/nginx:1.19 /target/directory
+vorteil projects convert-container docker-archive:/images/nginx.tar:nginx:1.19 /target/directory
+
+The reference after the path chooses an image by its org.opencontainers.image.ref.name
+annotation or digest for OCI layouts, or by its tag for 'docker save' tarballs. It can be
+left out if there is only one image.
+
 Remote conversion examples:
 
 ./vorteil projects convert-container --config=/vconvert.yaml nginx /tmp/nginx
+./vorteil projects convert-container nginx@sha256:<digest> /tmp/nginx
+./vorteil projects convert-container --platform=linux/arm64 nginx /tmp/nginx
+
+Images can be pinned to the digest of their manifest or manifest list. The image for the
+platform given with --platform, linux/amd64 by default, is picked from multi-platform images.
+Manifests and layers are checked against their digests, and the digest the image resolved to
+is recorded as info.source in the VCFG.
 
 The config file provided maps remote repository names to urls. If no file is provided
 docker.io, mcr.microsoft.com and gcr.io are automatically added. The following is an example
@@ -41,23 +71,169 @@ config yaml:
 repositories:
   myrepo:
    url: https://myurl
+
+Instead of a project folder, --package writes a vorteil package to DEST and --image writes
+a disk image in the format given by --format. The image's files are read straight from its
+layers into the package, and are never extracted to disk:
+
+vorteil projects convert-container --package nginx /tmp/nginx.vorteil
+vorteil projects convert-container --image --format=raw nginx /tmp/nginx.raw
+
+The image's command, ports, environment, user, volumes and labels are mapped onto the
+VCFG. A mapping file given with --mapping adjusts this per image. The mappings
+matching an image are applied in order:
+
+mappings:
+- images: ["nginx", "nginx:*"]
+  user: nginx
+  volumes:
+    /var/cache/nginx: 512 MiB
+  labels:
+    com.example.summary: summary
+  vcfg: |
+    [vm]
+    ram = "512 MiB"
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		// in case of an error we pass empty user/pwd/config in
 		user, _ := cmd.Flags().GetString("user")
 		pwd, _ := cmd.Flags().GetString("password")
 		config, _ := cmd.Flags().GetString("config")
+		toPackage, _ := cmd.Flags().GetBool("package")
+		toImage, _ := cmd.Flags().GetBool("image")
+		force, _ := cmd.Flags().GetBool("force")
+		formatName, _ := cmd.Flags().GetString("format")
+		mappingFile, _ := cmd.Flags().GetString("mapping")
+		platform, _ := cmd.Flags().GetString("platform")
+
+		if toPackage && toImage {
+			SetError(errors.New("--package and --image can not be used together"), 3)
+			return
+		}
+
+		var format vdisk.Format
+		if toImage {
+			var err error
+			format, err = parseImageFormat(formatName)
+			if err != nil {
+				SetError(err, 4)
+				return
+			}
+		}
+
+		if toPackage || toImage {
+			err := checkValidNewFileOutput(args[1], force, "DEST", "-f")
+			if err != nil {
+				SetError(err, 5)
+				return
+			}
+		}
+
+		var mappings vconvert.Mappings
+		if mappingFile != "" {
+			var err error
+			mappings, err = vconvert.LoadMappings(mappingFile)
+			if err != nil {
+				SetError(err, 6)
+				return
+			}
+		}
 
 		cc, err := vconvert.NewContainerConverter(args[0], config, log)
 		if err != nil {
 			SetError(err, 1)
 			return
 		}
+		cc.SetMappings(mappings)
 
-		err = cc.ConvertToProject(args[1], user, pwd)
+		err = cc.SetPlatform(platform)
+		if err != nil {
+			SetError(err, 7)
+			return
+		}
+
+		switch {
+		case toPackage:
+			err = convertContainerToPackage(cc, args[1], user, pwd)
+		case toImage:
+			err = convertContainerToImage(cc, args[1], user, pwd, format)
+		default:
+			err = cc.ConvertToProject(args[1], user, pwd)
+		}
 		if err != nil {
 			SetError(err, 2)
 			return
 		}
 	},
 }
+
+func convertContainerToPackage(cc *vconvert.ContainerConverter, path, user, pwd string) error {
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = cc.ConvertToPackage(f, user, pwd, vpkg.DefaultCompression)
+	if err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("created package: %s", path)
+
+	return nil
+
+}
+
+func convertContainerToImage(cc *vconvert.ContainerConverter, path, user, pwd string, format vdisk.Format) error {
+
+	defer cc.Close()
+
+	err := initKernels()
+	if err != nil {
+		return err
+	}
+
+	pkgBuilder, err := cc.PackageBuilder(user, pwd)
+	if err != nil {
+		return err
+	}
+
+	pkgReader, err := vpkg.ReaderFromBuilder(pkgBuilder)
+	if err != nil {
+		pkgBuilder.Close()
+		return err
+	}
+	defer pkgReader.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = vdisk.Build(context.Background(), f, &vdisk.BuildArgs{
+		PackageReader: pkgReader,
+		Format:        format,
+		Logger:        log,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("created image: %s", path)
+
+	return nil
+
+}
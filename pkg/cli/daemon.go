@@ -0,0 +1,178 @@
+package cli
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	// database driver used by the virtualizer manager
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/vorteil/vorteil/pkg/daemon"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+	"github.com/vorteil/vorteil/pkg/virtualizers/cloudhypervisor"
+	"github.com/vorteil/vorteil/pkg/virtualizers/firecracker"
+	"github.com/vorteil/vorteil/pkg/virtualizers/hyperv"
+	"github.com/vorteil/vorteil/pkg/virtualizers/libvirt"
+	"github.com/vorteil/vorteil/pkg/virtualizers/qemu"
+	"github.com/vorteil/vorteil/pkg/virtualizers/virtualbox"
+	"github.com/vorteil/vorteil/pkg/virtualizers/vmware"
+	"github.com/vorteil/vorteil/pkg/vpkg"
+)
+
+var (
+	flagDaemonSocket   string
+	flagDaemonDatabase string
+	flagDaemonVMDrive  string
+)
+
+// registerVirtualizers makes every virtualizer type available to the manager.
+func registerVirtualizers() {
+	virtualizers.Register(qemu.VirtualizerID, qemu.Allocator)
+	virtualizers.Register(firecracker.VirtualizerID, firecracker.Allocator)
+	virtualizers.Register(cloudhypervisor.VirtualizerID, cloudhypervisor.Allocator)
+	virtualizers.Register(libvirt.VirtualizerID, libvirt.Allocator)
+	virtualizers.Register(virtualbox.VirtualizerID, virtualbox.Allocator)
+	virtualizers.Register(vmware.VirtualizerID, vmware.Allocator)
+	virtualizers.Register(hyperv.VirtualizerID, hyperv.Allocator)
+}
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Serve a REST API for managing local virtual machines",
+	Long: `The daemon command serves a REST API over a unix socket, which other tools can
+use to create virtualizers and to build, run and monitor virtual machines with
+them. Virtualizers and running virtual machines are stored in a database, so a
+restarted daemon takes control of the virtual machines a previous one left
+running.
+
+Stopping the daemon closes every virtual machine it is managing.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		home, err := homedir.Dir()
+		if err != nil {
+			SetError(err, 1)
+			return
+		}
+		vorteild := filepath.Join(home, ".vorteil")
+
+		if flagDaemonSocket == "" {
+			flagDaemonSocket = filepath.Join(vorteild, "daemon.sock")
+		}
+		if flagDaemonDatabase == "" {
+			flagDaemonDatabase = filepath.Join(vorteild, "daemon.db")
+		}
+		if flagDaemonVMDrive == "" {
+			flagDaemonVMDrive = filepath.Join(vorteild, "vms")
+		}
+
+		err = os.MkdirAll(filepath.Dir(flagDaemonDatabase), 0700)
+		if err != nil {
+			SetError(err, 2)
+			return
+		}
+
+		err = initKernels()
+		if err != nil {
+			SetError(err, 3)
+			return
+		}
+
+		registerVirtualizers()
+
+		mgr, err := virtualizers.New(&virtualizers.ManagerArgs{
+			Logger:          log.Debugf,
+			DatabaseAddress: flagDaemonDatabase,
+			FirecrackerPath: filepath.Join(vorteild, "firecracker-vm"),
+			VMDrive:         flagDaemonVMDrive,
+			VMLogger:        log,
+		})
+		if err != nil {
+			SetError(err, 4)
+			return
+		}
+		defer mgr.Close()
+
+		srv := daemon.NewServer(&daemon.ServerArgs{
+			Manager: mgr,
+			Logger:  log,
+			Packages: func(src string) (vpkg.Reader, error) {
+				pkgBuilder, err := getPackageBuilder("PACKAGE", src)
+				if err != nil {
+					return nil, err
+				}
+				pkgReader, err := vpkg.ReaderFromBuilder(pkgBuilder)
+				if err != nil {
+					pkgBuilder.Close()
+					return nil, err
+				}
+				return pkgReader, nil
+			},
+		})
+		defer srv.Close()
+
+		err = removeStaleSocket(flagDaemonSocket)
+		if err != nil {
+			SetError(err, 5)
+			return
+		}
+
+		l, err := net.Listen("unix", flagDaemonSocket)
+		if err != nil {
+			SetError(err, 5)
+			return
+		}
+		defer os.Remove(flagDaemonSocket)
+
+		signalChannel, chBool := listenForInterrupt()
+		go func() {
+			select {
+			case <-signalChannel:
+			case <-chBool:
+			}
+			l.Close()
+		}()
+
+		log.Printf("Serving API on %s", flagDaemonSocket)
+
+		err = srv.Serve(l)
+		if err != nil {
+			SetError(fmt.Errorf("failed to serve API: %w", err), 6)
+			return
+		}
+
+		log.Printf("Closing virtual machines")
+
+	},
+}
+
+// removeStaleSocket removes a socket left behind by a daemon that didn't exit
+// cleanly, which refuses connections, but not one a daemon is serving on.
+func removeStaleSocket(path string) error {
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("a daemon is already serving on %s", path)
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return os.Remove(path)
+	}
+	return nil
+}
+
+func init() {
+	f := daemonCmd.Flags()
+	f.StringVar(&flagDaemonSocket, "socket", "", "path of the unix socket to serve the API on (default ~/.vorteil/daemon.sock)")
+	f.StringVar(&flagDaemonDatabase, "database", "", "path of the database storing virtualizers and vms (default ~/.vorteil/daemon.db)")
+	f.StringVar(&flagDaemonVMDrive, "vm-drive", "", "directory to store the disks of vms in (default ~/.vorteil/vms)")
+}
@@ -17,8 +17,10 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/vorteil/vorteil/pkg/ext"
 	"github.com/vorteil/vorteil/pkg/imagetools"
+	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vdecompiler"
 	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vio"
 	"github.com/vorteil/vorteil/pkg/vpkg"
 )
 
@@ -50,7 +52,13 @@ must be a valid Vorteil project.
 
 Supported disk formats include:
 
-	xva, raw, vmdk, stream-optimized-vmdk, vhd, vhd-dynamic
+	xva, raw, vmdk, stream-optimized-vmdk, vhd, vhd-dynamic, vhdx, qcow2,
+	qcow2-compressed
+
+The --reproducible flag makes building the same package twice produce an
+identical image. Every ID on the disk is derived from --seed, or from the
+package if no seed is given, and every timestamp is taken from the
+SOURCE_DATE_EPOCH environment variable, or the Unix epoch if it isn't set.
 `,
 	Aliases: []string{"new", "create", "make"},
 	Args:    cobra.MaximumNArgs(1),
@@ -109,6 +117,12 @@ Supported disk formats include:
 			return
 		}
 
+		timestamp, err := vdisk.SourceDateEpoch()
+		if err != nil {
+			SetError(err, 7)
+			return
+		}
+
 		f, err := os.Create(outputPath)
 		if err != nil {
 			SetError(err, 7)
@@ -122,7 +136,10 @@ Supported disk formats include:
 			KernelOptions: vdisk.KernelOptions{
 				Shell: flagShell,
 			},
-			Logger: log,
+			Logger:       log,
+			Reproducible: flagReproducible,
+			Seed:         flagSeed,
+			Timestamp:    timestamp,
 		})
 		if err != nil {
 			SetError(err, 8)
@@ -154,6 +171,8 @@ func init() {
 	f.StringVarP(&flagKey, "key", "k", "", "vrepo authentication key")
 	f.StringVar(&flagFormat, "format", "vmdk", "disk image format")
 	f.BoolVar(&flagShell, "shell", false, "add a busybox shell environment to the image")
+	f.BoolVar(&flagReproducible, "reproducible", false, "build an identical image every time the same package is built")
+	f.Int64Var(&flagSeed, "seed", 0, "seed for the IDs of a reproducible image (derived from the package by default)")
 }
 
 var decompileCmd = &cobra.Command{
@@ -220,6 +239,84 @@ func init() {
 	f.BoolVarP(&flagOS, "vpartition", "p", false, "Read files from the Vorteil OS partition instead of the file-system partition.")
 }
 
+var configureCmd = &cobra.Command{
+	Use:   "configure IMAGE",
+	Short: "Change the configuration of an image without rebuilding it.",
+	Long: `Replace the VCFG stored in an image's Vorteil OS partition. The image's current
+configuration is merged with any VCFG files passed with --vcfg, followed by any
+other VCFG flags, and the result is validated and written back to the image.
+
+Settings that were fixed when the image was built, like the kernel version and
+the file-system type, can't be changed this way. Use 'vorteil images put' to
+change the files on the image.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		img := args[0]
+
+		err := vcfgFlags.Validate()
+		if err != nil {
+			SetError(err, 1)
+			return
+		}
+
+		if len(filesMap) > 0 {
+			SetError(fmt.Errorf("the --files flag can't be used to configure an image, use 'vorteil images put' instead"), 1)
+			return
+		}
+
+		iio, err := vdecompiler.OpenWritable(img)
+		if err != nil {
+			SetError(err, 2)
+			return
+		}
+		defer iio.Close()
+
+		cfg, err := iio.VCFG()
+		if err != nil {
+			SetError(err, 3)
+			return
+		}
+
+		for _, path := range flagVCFG {
+			f, err := vio.Open(path)
+			if err != nil {
+				SetError(err, 4)
+				return
+			}
+
+			x, err := vcfg.LoadFile(f)
+			f.Close()
+			if err != nil {
+				SetError(err, 4)
+				return
+			}
+
+			err = cfg.Merge(x)
+			if err != nil {
+				SetError(err, 4)
+				return
+			}
+		}
+
+		err = cfg.Merge(&overrideVCFG)
+		if err != nil {
+			SetError(err, 4)
+			return
+		}
+
+		err = iio.ReplaceVCFG(cfg, log)
+		if err != nil {
+			SetError(err, 5)
+			return
+		}
+	},
+}
+
+func init() {
+	f := configureCmd.Flags()
+	f.StringSliceVar(&flagVCFG, "vcfg", nil, "Merge the contents of a VCFG file into the image's configuration.")
+}
+
 var cpCmd = &cobra.Command{
 	Use:   "cp IMAGE SRC_FILEPATH DEST_FILEPATH",
 	Short: "Copy files and directories from an image to your system.",
@@ -683,6 +780,92 @@ func init() {
 	f.StringP("numbers", "n", "short", "Number printing format")
 }
 
+var mkdirCmd = &cobra.Command{
+	Use:   "mkdir IMAGE FILEPATH...",
+	Short: "Create directories inside an image.",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		img := args[0]
+
+		iio, err := vdecompiler.OpenWritable(img)
+		if err != nil {
+			SetError(err, 1)
+			return
+		}
+		defer iio.Close()
+
+		for _, fpath := range args[1:] {
+			err = imagetools.MkdirImageFile(iio, fpath, flagParents)
+			if err != nil {
+				SetError(err, 2)
+				return
+			}
+		}
+	},
+}
+
+func init() {
+	f := mkdirCmd.Flags()
+	f.BoolVarP(&flagParents, "parents", "p", false, "No error if existing, make parent directories as needed.")
+}
+
+var putCmd = &cobra.Command{
+	Use:   "put IMAGE SRC_FILEPATH DEST_FILEPATH",
+	Short: "Copy files and directories from your system into an image.",
+	Long: `Copy files and directories from your system into the file-system partition of an
+existing image, replacing the contents of any files already there. This modifies
+the image in-place, and works on raw and sparse VMDK images.`,
+	Args: cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		img := args[0]
+
+		iio, err := vdecompiler.OpenWritable(img)
+		if err != nil {
+			SetError(err, 1)
+			return
+		}
+		defer iio.Close()
+
+		src := args[1]
+		fpath := args[2]
+
+		err = imagetools.PutImageFile(iio, src, fpath)
+		if err != nil {
+			SetError(err, 2)
+			return
+		}
+	},
+}
+
+var rmCmd = &cobra.Command{
+	Use:   "rm IMAGE FILEPATH...",
+	Short: "Remove files and directories from an image.",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		img := args[0]
+
+		iio, err := vdecompiler.OpenWritable(img)
+		if err != nil {
+			SetError(err, 1)
+			return
+		}
+		defer iio.Close()
+
+		for _, fpath := range args[1:] {
+			err = imagetools.RemoveImageFile(iio, fpath, flagRecursive)
+			if err != nil {
+				SetError(err, 2)
+				return
+			}
+		}
+	},
+}
+
+func init() {
+	f := rmCmd.Flags()
+	f.BoolVarP(&flagRecursive, "recursive", "r", false, "Remove directories and their contents recursively.")
+}
+
 var statCmd = &cobra.Command{
 	Use:   "stat IMAGE [FILEPATH]",
 	Short: "Print detailed metadata relating to the file at FILE_PATH.",
@@ -0,0 +1,673 @@
+package cli
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/vorteil/vorteil/pkg/vkern"
+)
+
+var kernelsCmd = &cobra.Command{
+	Use:   "kernels",
+	Short: "List, pull, verify, prune and pin vorteil kernels",
+	Long: `Manage the kernels available to builds. Kernels are found in the local drop path
+and fetched from remote repositories, which are cached on disk so builds can
+run without network access once the kernels they need have been pulled.`,
+}
+
+// kernelSource describes where a kernel from the kernel manager's list lives,
+// given the drop path local kernels are found in.
+func kernelSource(tuple vkern.Tuple, dropPath string) (string, string) {
+	if strings.HasSuffix(tuple.Location, " (cached)") {
+		return "cached", strings.TrimSuffix(tuple.Location, " (cached)")
+	}
+	if tuple.Location == dropPath {
+		return "local", tuple.Location
+	}
+	return "remote", tuple.Location
+}
+
+type kernelListEntry struct {
+	Version  string `json:"version"`
+	Type     string `json:"type"`
+	Source   string `json:"source"`
+	Released string `json:"released"`
+	Default  bool   `json:"default"`
+}
+
+var listKernelsCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Short:   "List local, remote and cached kernels",
+	Args:    cobra.NoArgs,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+
+		format, err := cmd.Flags().GetString("format")
+		if err != nil {
+			panic(err)
+		}
+
+		switch format {
+		case "json", "", "plain":
+			return nil
+		default:
+			return fmt.Errorf("invalid format '%s'", format)
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+
+		format, err := cmd.Flags().GetString("format")
+		if err != nil {
+			panic(err)
+		}
+
+		vCfg, err := loadVorteilConfig()
+		if err != nil {
+			SetError(err, 1)
+			return
+		}
+
+		err = initKernels()
+		if err != nil {
+			SetError(err, 2)
+			return
+		}
+
+		list, err := ksrc.List(context.Background())
+		if err != nil {
+			SetError(err, 3)
+			return
+		}
+
+		var pinned *vkern.Tuple
+		if vCfg.pinned != "" {
+			v, err := vkern.Parse(vCfg.pinned)
+			if err == nil {
+				pinned, _ = list.BestMatch(v)
+			}
+		}
+
+		entries := make([]kernelListEntry, 0)
+		for i := len(list) - 1; i >= 0; i-- {
+			typ, source := kernelSource(list[i], vCfg.watch)
+			entries = append(entries, kernelListEntry{
+				Version:  list[i].Version.String(),
+				Type:     typ,
+				Source:   source,
+				Released: list[i].ModTime.Format("2006-01-02"),
+				Default:  pinned != nil && *pinned == list[i],
+			})
+		}
+
+		if format == "json" {
+			data, err := json.MarshalIndent(entries, "", "  ")
+			if err != nil {
+				SetError(err, 4)
+				return
+			}
+			fmt.Println(string(data))
+			return
+		}
+
+		if len(entries) == 0 {
+			log.Printf("No kernels found")
+			return
+		}
+
+		table := [][]string{{"", "", "", "", ""}, {"VERSION", "TYPE", "SOURCE", "RELEASED", ""}}
+		for _, entry := range entries {
+			var def string
+			if entry.Default {
+				def = "(default)"
+			}
+			table = append(table, []string{entry.Version, entry.Type, entry.Source, entry.Released, def})
+		}
+		PlainTable(table)
+
+	},
+}
+
+func init() {
+	f := listKernelsCmd.Flags()
+	f.String("format", "", "specify output format (json, plain)")
+}
+
+var pullKernelCmd = &cobra.Command{
+	Use:   "pull VERSION",
+	Short: "Download a kernel and check its signature",
+	Long: `Download a kernel from the remote repositories into the kernel cache, checking
+it against its signature, so it is available to builds without network access.
+VERSION may be partial, like 20.9, in which case the latest matching patch is
+pulled.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		version, err := vkern.Parse(args[0])
+		if err != nil {
+			SetError(fmt.Errorf("invalid kernel version '%s': %w", args[0], err), 1)
+			return
+		}
+
+		err = initKernels()
+		if err != nil {
+			SetError(err, 2)
+			return
+		}
+
+		ctx := context.Background()
+
+		b, err := ksrc.Get(ctx, version)
+		if err != nil {
+			SetError(err, 3)
+			return
+		}
+		defer b.Close()
+
+		// the signature is checked on download, but a kernel that was already
+		// cached is checked again here
+		err = ksrc.(vkern.Verifier).Verify(ctx, b.Bundle().Version())
+		if errors.Is(err, vkern.ErrUnsigned) {
+			log.Warnf("%v", err)
+		} else if err != nil {
+			SetError(err, 4)
+			return
+		}
+
+		log.Printf("Pulled kernel %s to %s", b.Bundle().Version().String(), b.Location())
+
+	},
+}
+
+var verifyKernelCmd = &cobra.Command{
+	Use:   "verify VERSION",
+	Short: "Check a cached kernel against its signature",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		version, err := vkern.Parse(args[0])
+		if err != nil {
+			SetError(fmt.Errorf("invalid kernel version '%s': %w", args[0], err), 1)
+			return
+		}
+
+		err = initKernels()
+		if err != nil {
+			SetError(err, 2)
+			return
+		}
+
+		err = ksrc.(vkern.Verifier).Verify(context.Background(), version)
+		if err != nil {
+			SetError(err, 3)
+			return
+		}
+
+		log.Printf("Kernel %s is signed by a trusted key", version.String())
+
+	},
+}
+
+// kernelsToKeep returns a function reporting whether prune should keep a
+// cached kernel: the default kernel, the latest kernel, and those in keep. A
+// version without a patch number, like 20.9, keeps every patch of it.
+func kernelsToKeep(pinned, latest string, keep []string) (func(vkern.CalVer) bool, error) {
+
+	var versions []vkern.CalVer
+
+	for _, s := range append([]string{pinned, latest}, keep...) {
+		if s == "" {
+			continue
+		}
+		v, err := vkern.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid kernel version '%s': %w", s, err)
+		}
+		versions = append(versions, v)
+	}
+
+	return func(v vkern.CalVer) bool {
+		for _, k := range versions {
+			if k.String() == v.String() {
+				return true
+			}
+			if k.Patch() == -1 && k.Modifier() == "" && k.Major() == v.Major() && k.Minor() == v.Minor() {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+var pruneKernelsCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove unused kernels from the kernel cache",
+	Long: `Remove cached kernels other than the default kernel, the latest kernel and any
+kept with --keep. Kernels in the local drop path are never removed.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		keep, err := cmd.Flags().GetStringSlice("keep")
+		if err != nil {
+			panic(err)
+		}
+
+		vCfg, err := loadVorteilConfig()
+		if err != nil {
+			SetError(err, 1)
+			return
+		}
+
+		err = initKernels()
+		if err != nil {
+			SetError(err, 2)
+			return
+		}
+
+		latest, err := ksrc.Latest()
+		if err != nil {
+			SetError(err, 3)
+			return
+		}
+
+		fn, err := kernelsToKeep(vCfg.pinned, latest, keep)
+		if err != nil {
+			SetError(err, 4)
+			return
+		}
+
+		pruned, err := ksrc.(vkern.Pruner).Prune(fn)
+		for _, v := range pruned {
+			log.Printf("Removed kernel %s", v.String())
+		}
+		if err != nil {
+			SetError(err, 5)
+			return
+		}
+
+		if len(pruned) == 0 {
+			log.Printf("No kernels to remove")
+		}
+
+	},
+}
+
+func init() {
+	f := pruneKernelsCmd.Flags()
+	f.StringSlice("keep", []string{}, "kernel versions to keep in addition to the default and latest kernels")
+}
+
+var pinKernelCmd = &cobra.Command{
+	Use:   "pin [VERSION]",
+	Short: "View or set the default kernel",
+	Long: `Set the kernel used by builds that don't specify one, instead of the latest
+kernel, by saving it to ~/.vorteil/conf.toml. Without VERSION the current default
+is shown.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		vCfg, err := loadVorteilConfig()
+		if err != nil {
+			SetError(err, 1)
+			return
+		}
+
+		if len(args) == 0 {
+			if vCfg.pinned == "" {
+				log.Printf("No default kernel is pinned, the latest kernel is used")
+				return
+			}
+			fmt.Println(vCfg.pinned)
+			return
+		}
+
+		version, err := vkern.Parse(args[0])
+		if err != nil {
+			SetError(fmt.Errorf("invalid kernel version '%s': %w", args[0], err), 2)
+			return
+		}
+
+		err = initKernels()
+		if err != nil {
+			SetError(err, 3)
+			return
+		}
+
+		list, err := ksrc.List(context.Background())
+		if err != nil {
+			SetError(err, 4)
+			return
+		}
+
+		tuple, err := list.BestMatch(version)
+		if err != nil {
+			log.Warnf("Kernel %s isn't available from any kernel source yet", version.String())
+		} else if typ, _ := kernelSource(*tuple, vCfg.watch); typ == "remote" {
+			log.Warnf("Kernel %s hasn't been pulled, builds will need to download it", tuple.Version.String())
+		}
+
+		vCfg.pinned = version.String()
+		err = saveVorteilConfig(vCfg)
+		if err != nil {
+			SetError(err, 5)
+			return
+		}
+
+		log.Printf("Default kernel set to %s", version.String())
+
+	},
+}
+
+var unpinKernelCmd = &cobra.Command{
+	Use:   "unpin",
+	Short: "Use the latest kernel as the default kernel again",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		vCfg, err := loadVorteilConfig()
+		if err != nil {
+			SetError(err, 1)
+			return
+		}
+
+		if vCfg.pinned == "" {
+			return
+		}
+
+		vCfg.pinned = ""
+		err = saveVorteilConfig(vCfg)
+		if err != nil {
+			SetError(err, 2)
+			return
+		}
+
+		log.Printf("Default kernel unpinned, the latest kernel will be used")
+
+	},
+}
+
+// parseBundleFile splits a --file argument, PATH[:TAG,...], into its path and
+// tags.
+func parseBundleFile(s string) (string, []string) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 || strings.ContainsAny(s[i+1:], `/\`) {
+		return s, nil
+	}
+
+	var tags []string
+	for _, tag := range strings.Split(s[i+1:], ",") {
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	return s[:i], tags
+}
+
+var bundleKernelCmd = &cobra.Command{
+	Use:   "bundle VERSION",
+	Short: "Assemble a kernel bundle from a kernel, vinitd and extra files",
+	Long: `Assemble a kernel bundle from a kernel, vinitd and extra files, optionally
+signing it. The bundle is written to kernel-VERSION by default, which is the name
+kernel sources expect, so it can be placed straight into a drop path.
+
+Extra files are given as PATH[:TAG,...]. Builds only include tagged files when
+they need one of their tags, such as strace, logs or shell.
+
+A signed bundle can be served by a remote repository once its signing key is
+added to the keyrings trusted in ~/.vorteil/conf.toml.`,
+	Example: `  vorteil kernels bundle 20.9.3-patched --kernel bzImage --init vinitd \
+    --file strace:strace --file fluent-bit:logs --sign-key private.asc`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		version, err := vkern.Parse(args[0])
+		if err != nil {
+			SetError(fmt.Errorf("invalid kernel version '%s': %w", args[0], err), 1)
+			return
+		}
+
+		if version.Patch() == -1 {
+			SetError(fmt.Errorf("kernel version '%s' needs a patch number", args[0]), 2)
+			return
+		}
+
+		outputPath := "kernel-" + version.String()
+		if flagOutput != "" {
+			outputPath = flagOutput
+		}
+
+		err = checkValidNewFileOutput(outputPath, flagForce, "output", "-f")
+		if err != nil {
+			SetError(err, 3)
+			return
+		}
+
+		builder := vkern.NewBundleBuilder(version, flagBundleCompiler)
+
+		err = builder.AddFile("bzImage", flagBundleKernel)
+		if err != nil {
+			SetError(err, 4)
+			return
+		}
+
+		err = builder.AddFile("vinitd", flagBundleInit)
+		if err != nil {
+			SetError(err, 5)
+			return
+		}
+
+		for _, file := range flagBundleFiles {
+			path, tags := parseBundleFile(file)
+			err = builder.AddFile(filepath.Base(path), path, tags...)
+			if err != nil {
+				SetError(err, 6)
+				return
+			}
+		}
+
+		f, err := os.Create(outputPath)
+		if err != nil {
+			SetError(err, 7)
+			return
+		}
+		defer f.Close()
+
+		err = builder.Write(f)
+		if err != nil {
+			SetError(err, 8)
+			return
+		}
+
+		err = f.Close()
+		if err != nil {
+			SetError(err, 9)
+			return
+		}
+
+		log.Printf("created kernel bundle: %s", outputPath)
+
+		if flagBundleSignKey == "" {
+			return
+		}
+
+		err = signKernelBundle(outputPath, flagBundleSignKey, flagBundlePassphraseFile)
+		if err != nil {
+			SetError(err, 10)
+			return
+		}
+
+		log.Printf("created signature: %s.asc", outputPath)
+
+	},
+}
+
+// signKernelBundle writes a detached signature of the bundle at path to
+// path.asc using the private key in keyFile.
+func signKernelBundle(path, keyFile, passphraseFile string) error {
+
+	var passphrase []byte
+	if passphraseFile != "" {
+		data, err := ioutil.ReadFile(passphraseFile)
+		if err != nil {
+			return err
+		}
+		passphrase = []byte(strings.TrimRight(string(data), "\r\n"))
+	}
+
+	kf, err := os.Open(keyFile)
+	if err != nil {
+		return err
+	}
+	defer kf.Close()
+
+	key, err := vkern.ReadSigningKey(kf, passphrase)
+	if err != nil {
+		return err
+	}
+
+	bundle, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer bundle.Close()
+
+	sig, err := os.Create(path + ".asc")
+	if err != nil {
+		return err
+	}
+	defer sig.Close()
+
+	err = vkern.SignBundle(sig, bundle, key)
+	if err != nil {
+		return err
+	}
+
+	return sig.Close()
+}
+
+var (
+	flagBundleKernel         string
+	flagBundleInit           string
+	flagBundleFiles          []string
+	flagBundleCompiler       string
+	flagBundleSignKey        string
+	flagBundlePassphraseFile string
+)
+
+func init() {
+	f := bundleKernelCmd.Flags()
+	f.BoolVarP(&flagForce, "force", "f", false, "force overwrite of existing files")
+	f.StringVarP(&flagOutput, "output", "o", "", "path to put kernel bundle")
+	f.StringVar(&flagBundleKernel, "kernel", "bzImage", "path to the kernel image")
+	f.StringVar(&flagBundleInit, "init", "vinitd", "path to vinitd")
+	f.StringArrayVar(&flagBundleFiles, "file", []string{}, "extra file to bundle, as PATH[:TAG,...]")
+	f.StringVar(&flagBundleCompiler, "compiler", release, "earliest compiler version compatible with the kernel")
+	f.StringVar(&flagBundleSignKey, "sign-key", "", "armored private key to sign the bundle with")
+	f.StringVar(&flagBundlePassphraseFile, "passphrase-file", "", "file containing the passphrase of the signing key")
+}
+
+var mirrorKernelsCmd = &cobra.Command{
+	Use:   "mirror DIR [VERSION...]",
+	Short: "Copy kernels from a remote repository into a directory",
+	Long: `Copy kernels and their signatures from a remote repository into DIR, which is
+laid out the same way as the repository so it can be served over http, or read
+directly by adding file://DIR to the remote-repositories in ~/.vorteil/conf.toml.
+Kernels are checked against their signatures before they are mirrored, and those
+mirrored before are kept, so the same directory can be synced repeatedly.`,
+	Example: `  vorteil kernels mirror /srv/kernels 20.9 20.10.1
+  vorteil kernels mirror /srv/kernels --all --source https://downloads.vorteil.io/kernels`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		all, err := cmd.Flags().GetBool("all")
+		if err != nil {
+			panic(err)
+		}
+
+		source, err := cmd.Flags().GetString("source")
+		if err != nil {
+			panic(err)
+		}
+
+		if len(args) == 1 && !all {
+			SetError(errors.New("no kernel versions to mirror (use '--all' to mirror every kernel)"), 1)
+			return
+		}
+
+		var versions []vkern.CalVer
+		for _, arg := range args[1:] {
+			v, err := vkern.Parse(arg)
+			if err != nil {
+				SetError(fmt.Errorf("invalid kernel version '%s': %w", arg, err), 2)
+				return
+			}
+			versions = append(versions, v)
+		}
+
+		vCfg, err := loadVorteilConfig()
+		if err != nil {
+			SetError(err, 3)
+			return
+		}
+
+		if source == "" {
+			if len(vCfg.sources) == 0 {
+				SetError(errors.New("no remote repositories are configured (use '--source' to mirror one)"), 4)
+				return
+			}
+			source = vCfg.sources[0]
+		}
+
+		keyring, err := vkern.Keyring(vCfg.keyrings...)
+		if err != nil {
+			SetError(err, 5)
+			return
+		}
+
+		dir, err := filepath.Abs(args[0])
+		if err != nil {
+			SetError(err, 6)
+			return
+		}
+
+		mirrored, err := vkern.Mirror(context.Background(), vkern.MirrorArgs{
+			Source:   strings.TrimSuffix(source, "/"),
+			Dir:      dir,
+			Versions: versions,
+			Keyring:  keyring,
+			Logger:   log,
+		})
+		for _, v := range mirrored {
+			log.Printf("Mirrored kernel %s", v.String())
+		}
+		if err != nil {
+			SetError(err, 7)
+			return
+		}
+
+		u := filepath.ToSlash(dir)
+		if !strings.HasPrefix(u, "/") {
+			u = "/" + u
+		}
+		log.Printf("Kernels mirrored to %s, which can be used as file://%s", dir, u)
+
+	},
+}
+
+func init() {
+	f := mirrorKernelsCmd.Flags()
+	f.Bool("all", false, "mirror every kernel in the repository")
+	f.String("source", "", "url of the repository to mirror (defaults to the first remote repository)")
+}
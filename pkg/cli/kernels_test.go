@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/vkern"
+)
+
+func TestKernelSource(t *testing.T) {
+
+	tests := []struct {
+		location string
+		typ      string
+		source   string
+	}{
+		{"/home/user/.vorteil/kernels/watch", "local", "/home/user/.vorteil/kernels/watch"},
+		{"https://downloads.vorteil.io/kernels", "remote", "https://downloads.vorteil.io/kernels"},
+		{"https://downloads.vorteil.io/kernels (cached)", "cached", "https://downloads.vorteil.io/kernels"},
+	}
+
+	for _, test := range tests {
+		typ, source := kernelSource(vkern.Tuple{Location: test.location}, "/home/user/.vorteil/kernels/watch")
+		if typ != test.typ || source != test.source {
+			t.Errorf("kernelSource(%s) = %s, %s; expected %s, %s", test.location, typ, source, test.typ, test.source)
+		}
+	}
+
+}
+
+func TestKernelsToKeep(t *testing.T) {
+
+	keep, err := kernelsToKeep("20.9", "20.10.1", []string{"20.8.2"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for v, expect := range map[string]bool{
+		"20.9.1":  true,
+		"20.9.3":  true,
+		"20.10.1": true,
+		"20.10.2": false,
+		"20.8.2":  true,
+		"20.8.1":  false,
+	} {
+		if keep(vkern.CalVer(v)) != expect {
+			t.Errorf("keep(%s) = %v, expected %v", v, !expect, expect)
+		}
+	}
+
+	_, err = kernelsToKeep("", "20.10.1", []string{"latest"})
+	if err == nil {
+		t.Fatal("expected failure; 'latest' is not a kernel version")
+	}
+
+}
+
+func TestParseBundleFile(t *testing.T) {
+
+	tests := []struct {
+		arg  string
+		path string
+		tags []string
+	}{
+		{"strace", "strace", nil},
+		{"bin/strace:strace", "bin/strace", []string{"strace"}},
+		{"fluent-bit:logs,debug", "fluent-bit", []string{"logs", "debug"}},
+		{`C:\bin\strace`, `C:\bin\strace`, nil},
+	}
+
+	for _, test := range tests {
+		path, tags := parseBundleFile(test.arg)
+		if path != test.path || !reflect.DeepEqual(tags, test.tags) {
+			t.Errorf("parseBundleFile(%s) = %s, %v; expected %s, %v", test.arg, path, tags, test.path, test.tags)
+		}
+	}
+
+}
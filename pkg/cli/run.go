@@ -143,6 +143,18 @@ and cleaning up the instance when it's done.`,
 				SetError(err, 11)
 				return
 			}
+		case platformCloudHypervisor:
+			err = runCloudHypervisor(pkgReader, cfg, name)
+			if err != nil {
+				SetError(err, 14)
+				return
+			}
+		case platformLibvirt:
+			err = runLibvirt(pkgReader, cfg, name)
+			if err != nil {
+				SetError(err, 15)
+				return
+			}
 		default:
 			if flagPlatform == "not installed" {
 				SetError((fmt.Errorf("no virtualizers are currently installed")), 12)
@@ -156,11 +168,17 @@ and cleaning up the instance when it's done.`,
 
 func init() {
 	f := runCmd.Flags()
-	f.StringVar(&flagPlatform, "platform", defaultVirtualizer(), "run a virtual machine with appropriate hypervisor (qemu, firecracker, virtualbox, hyper-v)")
+	f.StringVar(&flagPlatform, "platform", defaultVirtualizer(), "run a virtual machine with appropriate hypervisor (qemu, firecracker, cloud-hypervisor, libvirt, virtualbox, hyper-v)")
 	f.StringVarP(&flagKey, "key", "k", "", "vrepo authentication key")
 	f.BoolVar(&flagGUI, "gui", false, "when running virtual machine show gui of hypervisor")
 	f.BoolVar(&flagShell, "shell", false, "add a busybox shell environment to the image")
 	f.StringVar(&flagRecord, "record", "", "")
+	f.StringSliceVar(&flagFirecrackerTaps, "firecracker-tap", nil, "pre-created tap device to use for a network interface instead of creating one on the vorteil-bridge (firecracker)")
+	f.StringVar(&flagFirecrackerCNI, "firecracker-cni", "", "path of a CNI network configuration list to network the vm with instead of the vorteil-bridge (firecracker)")
+	f.StringVar(&flagCloudHypervisorKernel, "cloud-hypervisor-kernel", "", "path of a vmlinux to boot the vm directly into, the vmlinux of the vm's kernel if empty (cloud-hypervisor)")
+	f.StringVar(&flagCloudHypervisorFirmware, "cloud-hypervisor-firmware", "", "path of firmware to boot the vm's disk with (cloud-hypervisor)")
+	f.StringVar(&flagLibvirtURI, "libvirt-uri", "", "libvirt connection URI, qemu:///system if empty (libvirt)")
+	f.StringVar(&flagLibvirtNetwork, "libvirt-network", "", "libvirt network to attach network interfaces to, default if empty (libvirt)")
 }
 
 func defaultVirtualizer() string {
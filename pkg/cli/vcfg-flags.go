@@ -297,6 +297,44 @@ var networkMTUFlagValidator = func(f flag.NStringFlag) error {
 	return nil
 }
 
+// --network.bandwidth
+var networkBandwidthFlag = flag.NewNStringFlag("network[<<N>>].bandwidth", "limit network interface throughput per second, if supported by the virtualizer", &maxNetworkFlags, hideFlags, networkBandwidthFlagValidator)
+var networkBandwidthFlagValidator = func(f flag.NStringFlag) error {
+	for i := 0; i < *f.Total; i++ {
+		initRequiredNetworks(len(f.Value), i)
+		s := f.Value[i]
+		if s == "" {
+			continue
+		}
+		x, err := vcfg.ParseBytes(s)
+		if err != nil {
+			return fmt.Errorf("--%s=%s: %v", f.Key, s, err)
+		}
+		nic := &overrideVCFG.Networks[i]
+		nic.Bandwidth = x
+	}
+	return nil
+}
+
+// --network.packet-rate
+var networkPacketRateFlag = flag.NewNStringFlag("network[<<N>>].packet-rate", "limit network interface packets per second, if supported by the virtualizer", &maxNetworkFlags, hideFlags, networkPacketRateFlagValidator)
+var networkPacketRateFlagValidator = func(f flag.NStringFlag) error {
+	for i := 0; i < *f.Total; i++ {
+		initRequiredNetworks(len(f.Value), i)
+		s := f.Value[i]
+		if s == "" {
+			continue
+		}
+		x, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		nic := &overrideVCFG.Networks[i]
+		nic.PacketRate = uint(x)
+	}
+	return nil
+}
+
 // --network.mask
 var networkMaskFlag = flag.NewNStringFlag("network[<<N>>].mask", "configure app's subnet mask", &maxNetworkFlags, hideFlags, networkMaskFlagValidator)
 var networkMaskFlagValidator = func(f flag.NStringFlag) error {
@@ -343,6 +381,19 @@ var systemFilesystemFlagValidator = func(f flag.StringFlag) error {
 	return nil
 }
 
+// --system.overlay
+var systemOverlayFlag = flag.NewStringFlag("system.overlay", "size of a writable tmpfs overlay on top of a read-only root filesystem", hideFlags, systemOverlayFlagValidator)
+var systemOverlayFlagValidator = func(f flag.StringFlag) error {
+	err := overwriteSizeFieldFromString(f, &overrideVCFG.System.Overlay)
+	if err != nil {
+		return err
+	}
+	if overrideVCFG.System.Overlay.IsDelta() && overrideVCFG.System.Overlay != 0 {
+		return fmt.Errorf("--%s=%s: must be an absolute size", f.Key, f.Value)
+	}
+	return nil
+}
+
 // --system.max-fds
 var systemMaxFDsFlag = flag.NewUintFlag("system.max-fds", "maximum file descriptors available to app", hideFlags, systemMaxFDsFlagValidator)
 var systemMaxFDsFlagValidator = func(f flag.UintFlag) error {
@@ -403,6 +454,19 @@ func overwriteSizeFieldFromString(f flag.StringFlag, field *vcfg.Bytes) error {
 	return nil
 }
 
+// --vm.disk-bandwidth
+var vmDiskBandwidthFlag = flag.NewStringFlag("vm.disk-bandwidth", "limit disk throughput per second, if supported by the virtualizer", hideFlags, vmDiskBandwidthFlagValidator)
+var vmDiskBandwidthFlagValidator = func(f flag.StringFlag) error {
+	return overwriteSizeFieldFromString(f, &overrideVCFG.VM.DiskBandwidth)
+}
+
+// --vm.disk-iops
+var vmDiskIOPSFlag = flag.NewUintFlag("vm.disk-iops", "limit disk operations per second, if supported by the virtualizer", hideFlags, vmDiskIOPSFlagValidator)
+var vmDiskIOPSFlagValidator = func(f flag.UintFlag) error {
+	overrideVCFG.VM.DiskIOPS = f.Value
+	return nil
+}
+
 // --vm.disk-size
 var vmDiskSizeFlag = flag.NewStringFlag("vm.disk-size", "disk image capacity to allocate to app", hideFlags, vmDiskSizeFlagValidator)
 var vmDiskSizeFlagValidator = func(f flag.StringFlag) error {
@@ -537,13 +601,14 @@ var programArgsFlagValidator = func(f flag.NStringFlag) error {
 
 var vcfgFlags = flag.FlagsList{
 	&vmCPUsFlag, &vmDiskSizeFlag, &vmInodesFlag, &vmKernelFlag, &vmRAMFlag,
+	&vmDiskBandwidthFlag, &vmDiskIOPSFlag,
 	&filesFlag, &infoAuthorFlag, &infoDateFlag, &infoDescriptionFlag,
 	&infoNameFlag, &infoSummaryFlag, &infoURLFlag, &infoVersionFlag,
 	&networkIPFlag, &networkMaskFlag, &networkGatewayFlag, &networkUDPFlag,
 	&networkTCPFlag, &networkHTTPFlag, &networkHTTPSFlag, &networkMTUFlag,
-	&networkTCPDumpFlag, &loggingConfigFlag, &loggingTypeFlag, &nfsMountFlag,
+	&networkTCPDumpFlag, &networkBandwidthFlag, &networkPacketRateFlag, &loggingConfigFlag, &loggingTypeFlag, &nfsMountFlag,
 	&nfsServerFlag, &nfsOptionsFlag, &systemKernelArgsFlag, &systemDNSFlag,
-	&systemHostnameFlag, &systemFilesystemFlag, &systemMaxFDsFlag,
+	&systemHostnameFlag, &systemFilesystemFlag, &systemOverlayFlag, &systemMaxFDsFlag,
 	&systemOutputModeFlag, &systemUserFlag, &programBinaryFlag,
 	&programPrivilegesFlag, &programArgsFlag, &programStdoutFlag,
 	&programStderrFlag, &programLogFilesFlag, &programBootstrapFlag,
@@ -543,6 +543,32 @@ func TestSystemFSFlag(t *testing.T) {
 
 }
 
+func TestSystemOverlayFlag(t *testing.T) {
+
+	testResetOverrideVCFG()
+
+	// set --system.overlay="32 MiB"
+	f := systemOverlayFlag
+	f.Value = "32 MiB"
+
+	err := systemOverlayFlagValidator(f)
+	assert.NoError(t, err)
+	assert.Equal(t, vcfg.Bytes(32*1024*1024), overrideVCFG.System.Overlay)
+
+	// set --system.overlay="bad"
+	f.Value = "bad"
+
+	err = systemOverlayFlagValidator(f)
+	assert.Error(t, err)
+
+	// set --system.overlay="+32 MiB"
+	f.Value = "+32 MiB"
+
+	err = systemOverlayFlagValidator(f)
+	assert.Error(t, err)
+
+}
+
 func TestSystemMaxFDsFlag(t *testing.T) {
 
 	testResetOverrideVCFG()
@@ -21,9 +21,11 @@ import (
 	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vdisk"
 	"github.com/vorteil/vorteil/pkg/vimg"
+	"github.com/vorteil/vorteil/pkg/virtualizers/cloudhypervisor"
 	"github.com/vorteil/vorteil/pkg/virtualizers/firecracker"
 	"github.com/vorteil/vorteil/pkg/virtualizers/hyperv"
 	"github.com/vorteil/vorteil/pkg/virtualizers/iputil"
+	"github.com/vorteil/vorteil/pkg/virtualizers/libvirt"
 	"github.com/vorteil/vorteil/pkg/virtualizers/qemu"
 	"github.com/vorteil/vorteil/pkg/virtualizers/virtualbox"
 	"github.com/vorteil/vorteil/pkg/virtualizers/vmware"
@@ -32,25 +34,28 @@ import (
 
 var ips *goque.Queue
 
-// buildFirecracker does the same thing as vdisk.Build but it returns me a calver of the kernel being used
-func buildFirecracker(ctx context.Context, w io.WriteSeeker, cfg *vcfg.VCFG, args *vdisk.BuildArgs) (string, error) {
+// buildFirecracker does the same thing as vdisk.Build but it returns me a calver of the kernel being used.
+// Network interfaces of vms on the vorteil-bridge are given static addresses.
+func buildFirecracker(ctx context.Context, w io.WriteSeeker, cfg *vcfg.VCFG, args *vdisk.BuildArgs, bridged bool) (string, error) {
 	var err error
-	for i := range cfg.Networks {
-		if ips == nil {
-			ips, err = iputil.NewIPStack()
+	if bridged {
+		for i := range cfg.Networks {
+			if ips == nil {
+				ips, err = iputil.NewIPStack()
+				if err != nil {
+					return "", err
+				}
+				defer ips.Close()
+
+			}
+			ip, err := ips.Dequeue()
 			if err != nil {
 				return "", err
 			}
-			defer ips.Close()
-
-		}
-		ip, err := ips.Dequeue()
-		if err != nil {
-			return "", err
+			cfg.Networks[i].IP = ip.ToString()
+			cfg.Networks[i].Gateway = iputil.BridgeIP
+			cfg.Networks[i].Mask = "255.255.255.0"
 		}
-		cfg.Networks[i].IP = ip.ToString()
-		cfg.Networks[i].Gateway = iputil.BridgeIP
-		cfg.Networks[i].Mask = "255.255.255.0"
 	}
 	vimgBuilder, err := vdisk.CreateBuilder(ctx, &vimg.BuilderArgs{
 		Kernel: vimg.KernelOptions{
@@ -162,12 +167,28 @@ func runFirecracker(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
 		return errors.New("firecracker is not installed on your system")
 	}
 
-	err = firecracker.FetchBridgeDevice()
+	config := firecracker.Config{
+		TapDevices: flagFirecrackerTaps,
+	}
+	if flagFirecrackerCNI != "" {
+		config.CNI = &firecracker.CNIConfig{
+			ConfList: flagFirecrackerCNI,
+		}
+	}
+
+	err = config.Validate()
 	if err != nil {
-		// Set bridge device to 10.26.10.1
-		err = firecracker.SetupBridge(log, iputil.BridgeIP)
+		return err
+	}
+
+	if config.UsesBridge() {
+		err = firecracker.FetchBridgeDevice()
 		if err != nil {
-			return err
+			// Set bridge device to 10.26.10.1
+			err = firecracker.SetupBridge(log, iputil.BridgeIP)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
@@ -204,7 +225,7 @@ func runFirecracker(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
 			Shell: flagShell,
 		},
 		Logger: log,
-	})
+	}, config.UsesBridge())
 	if err != nil {
 		return err
 	}
@@ -229,7 +250,98 @@ func runFirecracker(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
 		log.Warnf("firecracker does not support displaying a gui")
 	}
 
-	config := firecracker.Config{}
+	err = virt.Initialize(config.Marshal())
+	if err != nil {
+		return err
+	}
+
+	return run(virt, f.Name(), cfg, name)
+}
+
+// runCloudHypervisor networks the vm through the vorteil-bridge the same way
+// firecracker does, so it is built the same way too
+func runCloudHypervisor(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
+	var err error
+	if runtime.GOOS != "linux" {
+		return errors.New("cloud hypervisor is only available on linux")
+	}
+	if !cloudhypervisor.Allocator.IsAvailable() {
+		return errors.New("cloud hypervisor is not installed on your system")
+	}
+
+	config := cloudhypervisor.Config{
+		Kernel:   flagCloudHypervisorKernel,
+		Firmware: flagCloudHypervisorFirmware,
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = firecracker.FetchBridgeDevice()
+	if err != nil {
+		// Set bridge device to 10.26.10.1
+		err = firecracker.SetupBridge(log, iputil.BridgeIP)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Create base folder to store cloud hypervisor vms so the socket can be grouped
+	parent := fmt.Sprintf("%s-%s", cloudhypervisor.VirtualizerID, randstr.Hex(5))
+	parent = filepath.Join(os.TempDir(), parent)
+	defer os.RemoveAll(parent)
+
+	// Create parent directory as it doesn't exist
+	err = os.MkdirAll(parent, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(parent, "vorteil.disk")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = vcfg.WithDefaults(cfg, log)
+	if err != nil {
+		return err
+	}
+
+	kernelVer, err := buildFirecracker(context.Background(), f, cfg, &vdisk.BuildArgs{
+		WithVCFGDefaults: true,
+		PackageReader:    pkgReader,
+		Format:           cloudhypervisor.Allocator.DiskFormat(),
+		KernelOptions: vdisk.KernelOptions{
+			Shell: flagShell,
+		},
+		Logger: log,
+	}, true)
+	if err != nil {
+		return err
+	}
+
+	cfg.VM.Kernel = kernelVer
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = pkgReader.Close()
+	if err != nil {
+		return err
+	}
+
+	alloc := cloudhypervisor.Allocator
+	virt := alloc.Alloc()
+
+	if flagGUI {
+		log.Warnf("cloud hypervisor does not support displaying a gui")
+	}
 
 	err = virt.Initialize(config.Marshal())
 	if err != nil {
@@ -239,6 +351,71 @@ func runFirecracker(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
 	return run(virt, f.Name(), cfg, name)
 }
 
+func runLibvirt(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
+	// Create base folder to store libvirt vms so the disk can be grouped
+	parent := fmt.Sprintf("%s-%s", libvirt.VirtualizerID, randstr.Hex(5))
+	parent = filepath.Join(os.TempDir(), parent)
+	defer os.RemoveAll(parent)
+	// Create parent directory as it doesn't exist
+	err := os.MkdirAll(parent, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(parent, "vorteil.disk")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = vdisk.Build(context.Background(), f, &vdisk.BuildArgs{
+		WithVCFGDefaults: true,
+		PackageReader:    pkgReader,
+		Format:           libvirt.Allocator.DiskFormat(),
+		KernelOptions: vdisk.KernelOptions{
+			Shell: flagShell,
+		},
+		Logger: log,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = pkgReader.Close()
+	if err != nil {
+		return err
+	}
+
+	alloc := libvirt.Allocator
+	virt := alloc.Alloc()
+
+	if flagGUI {
+		log.Warnf("libvirt vms are headless, use virt-viewer to display them")
+	}
+
+	config := libvirt.Config{
+		URI:     flagLibvirtURI,
+		Network: flagLibvirtNetwork,
+	}
+
+	err = virt.Initialize(config.Marshal())
+	if err != nil {
+		return err
+	}
+
+	err = vcfg.WithDefaults(cfg, log)
+	if err != nil {
+		return err
+	}
+
+	return run(virt, f.Name(), cfg, name)
+}
+
 func runHyperV(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
 	if runtime.GOOS != "windows" {
 		return errors.New("hyper-v is only available on windows system")
@@ -0,0 +1,196 @@
+// Package daemon serves a REST API over the virtualizer Manager, so that
+// local tools can drive virtual machines without shelling out to the CLI.
+package daemon
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+	"github.com/vorteil/vorteil/pkg/vpkg"
+)
+
+// PackageLoader resolves the package source given when preparing a vm.
+type PackageLoader func(src string) (vpkg.Reader, error)
+
+// ServerArgs are the arguments required to create a Server.
+type ServerArgs struct {
+	Manager  *virtualizers.Manager
+	Logger   elog.View
+	Packages PackageLoader // resolves package sources, vpkg.Open if nil
+}
+
+// Server handles API requests.
+//
+//	GET    /virtualizers              list virtualizers
+//	POST   /virtualizers              create a virtualizer
+//	GET    /virtualizers/{name}       get a virtualizer
+//	DELETE /virtualizers/{name}       delete a virtualizer
+//	GET    /vms                       list active vms
+//	POST   /vms                       build a package and prepare a vm from it
+//	GET    /vms/{name}                get the details of a vm
+//	DELETE /vms/{name}[?force=true]   close a vm and delete its disk
+//	POST   /vms/{name}/start          start a vm
+//	POST   /vms/{name}/stop           stop a vm
+//	GET    /vms/{name}/serial         read serial output, see LogChunk
+//	GET    /instances                 list vms persisted by the manager
+type Server struct {
+	mgr      *virtualizers.Manager
+	log      elog.View
+	packages PackageLoader
+
+	lock      sync.Mutex
+	folders   map[string]string  // folders of the vms created by the server
+	cursors   map[string]*cursor // serial subscriptions by cursor
+	preparing map[string]bool    // names of vms being built and prepared
+}
+
+// NewServer creates a Server.
+func NewServer(args *ServerArgs) *Server {
+	srv := &Server{
+		mgr:       args.Manager,
+		log:       args.Logger,
+		packages:  args.Packages,
+		folders:   make(map[string]string),
+		cursors:   make(map[string]*cursor),
+		preparing: make(map[string]bool),
+	}
+	if srv.log == nil {
+		srv.log = &elog.CLI{DisableTTY: true}
+	}
+	if srv.packages == nil {
+		srv.packages = vpkg.Open
+	}
+	return srv
+}
+
+// Serve accepts connections on l until it is closed.
+func (srv *Server) Serve(l net.Listener) error {
+	err := http.Serve(l, srv)
+	if err != nil && strings.Contains(err.Error(), "use of closed network connection") {
+		return nil
+	}
+	return err
+}
+
+// Close ends every serial subscription.
+func (srv *Server) Close() error {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	for id, c := range srv.cursors {
+		c.sub.Close()
+		delete(srv.cursors, id)
+	}
+	return nil
+}
+
+// Error is returned by the API with an appropriate status code.
+type Error struct {
+	Code    int    `json:"-"`
+	Message string `json:"error"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func errorf(code int, format string, x ...interface{}) *Error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, x...),
+	}
+}
+
+type handler func(r *http.Request, name string) (int, interface{}, error)
+
+func (srv *Server) route(r *http.Request) (handler, string, error) {
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	methods := make(map[string]handler)
+	var name string
+	if len(path) > 1 {
+		name = path[1]
+	}
+
+	switch {
+	case len(path) == 1 && path[0] == "virtualizers":
+		methods[http.MethodGet] = srv.listVirtualizers
+		methods[http.MethodPost] = srv.createVirtualizer
+	case len(path) == 2 && path[0] == "virtualizers":
+		methods[http.MethodGet] = srv.getVirtualizer
+		methods[http.MethodDelete] = srv.deleteVirtualizer
+	case len(path) == 1 && path[0] == "vms":
+		methods[http.MethodGet] = srv.listVMs
+		methods[http.MethodPost] = srv.prepareVM
+	case len(path) == 2 && path[0] == "vms":
+		methods[http.MethodGet] = srv.getVM
+		methods[http.MethodDelete] = srv.deleteVM
+	case len(path) == 3 && path[0] == "vms" && path[2] == "start":
+		methods[http.MethodPost] = srv.startVM
+	case len(path) == 3 && path[0] == "vms" && path[2] == "stop":
+		methods[http.MethodPost] = srv.stopVM
+	case len(path) == 3 && path[0] == "vms" && path[2] == "serial":
+		methods[http.MethodGet] = srv.serialVM
+	case len(path) == 1 && path[0] == "instances":
+		methods[http.MethodGet] = srv.listInstances
+	default:
+		return nil, "", errorf(http.StatusNotFound, "no such endpoint: %s", r.URL.Path)
+	}
+
+	h, ok := methods[r.Method]
+	if !ok {
+		return nil, "", errorf(http.StatusMethodNotAllowed, "method %s not allowed on %s", r.Method, r.URL.Path)
+	}
+
+	return h, name, nil
+
+}
+
+// ServeHTTP implements http.Handler.
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	code := http.StatusOK
+	var body interface{}
+
+	h, name, err := srv.route(r)
+	if err == nil {
+		code, body, err = h(r, name)
+	}
+
+	if err != nil {
+		e, ok := err.(*Error)
+		if !ok {
+			e = errorf(http.StatusInternalServerError, "%v", err)
+		}
+		code = e.Code
+		body = e
+		srv.log.Debugf("%s %s: %v", r.Method, r.URL.Path, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if body != nil {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(body)
+	}
+
+}
+
+func decodeBody(r *http.Request, x interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(x)
+	if err != nil {
+		return errorf(http.StatusBadRequest, "invalid request body: %v", err)
+	}
+	return nil
+}
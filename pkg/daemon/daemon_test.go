@@ -0,0 +1,87 @@
+package daemon
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	logger "github.com/vorteil/vorteil/pkg/virtualizers/logging"
+)
+
+func TestRouteErrors(t *testing.T) {
+	srv := NewServer(&ServerArgs{})
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{http.MethodGet, "/nothing", http.StatusNotFound},
+		{http.MethodPut, "/vms", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/vms/missing", http.StatusNotFound},
+		{http.MethodGet, "/vms/missing/serial", http.StatusNotFound},
+		{http.MethodGet, "/vms/missing/serial?cursor=abc", http.StatusNotFound},
+		{http.MethodGet, "/vms/missing/serial?wait=x", http.StatusBadRequest},
+		{http.MethodPost, "/vms", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.path, tt.code, w.Code)
+		}
+		e := new(Error)
+		err := json.NewDecoder(w.Body).Decode(e)
+		if err != nil || e.Message == "" {
+			t.Errorf("%s %s: expected an error body: %v", tt.method, tt.path, err)
+		}
+	}
+}
+
+func TestPrepareVMReservedName(t *testing.T) {
+	srv := NewServer(&ServerArgs{})
+	srv.preparing["busy"] = true
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/vms", strings.NewReader(`{"name": "busy"}`)))
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status %d for a vm name being prepared, got %d", http.StatusConflict, w.Code)
+	}
+}
+
+func TestRead(t *testing.T) {
+	l := logger.NewLogger(2048)
+	l.Write([]byte("hello"))
+	sub := l.Subscribe()
+
+	data, more := read(sub, 0)
+	if string(data) != "hello" || !more {
+		t.Errorf("expected buffered output \"hello\", got \"%s\" (more: %v)", data, more)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l.Write([]byte("world"))
+	}()
+
+	data, more = read(sub, time.Second)
+	if string(data) != "world" || !more {
+		t.Errorf("expected to wait for \"world\", got \"%s\" (more: %v)", data, more)
+	}
+
+	l.Close()
+
+	data, more = read(sub, time.Second)
+	if len(data) != 0 || more {
+		t.Errorf("expected closed subscription, got \"%s\" (more: %v)", data, more)
+	}
+}
@@ -0,0 +1,157 @@
+package daemon
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/thanhpk/randstr"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+	logger "github.com/vorteil/vorteil/pkg/virtualizers/logging"
+)
+
+const (
+	// cursorTimeout is how long a serial subscription is kept after the last
+	// request that used its cursor.
+	cursorTimeout = time.Minute
+
+	// maxSerialWait limits how long a request for serial output can wait for
+	// new output to arrive.
+	maxSerialWait = time.Minute
+)
+
+// cursor tracks a serial subscription between requests.
+type cursor struct {
+	vm      string
+	sub     *logger.Subscription
+	expires time.Time
+}
+
+// expireCursors closes subscriptions nobody has read from in a while. It must
+// be called with the server locked.
+func (srv *Server) expireCursors() {
+	now := time.Now()
+	for id, c := range srv.cursors {
+		if now.After(c.expires) {
+			c.sub.Close()
+			delete(srv.cursors, id)
+		}
+	}
+}
+
+// read returns whatever output is waiting in the subscription, waiting up to
+// wait for some to arrive if there isn't any. It returns false once the
+// subscription has been closed and all of its output read.
+func read(sub *logger.Subscription, wait time.Duration) ([]byte, bool) {
+
+	var data []byte
+	inbox := sub.Inbox()
+
+	for {
+		select {
+		case x, more := <-inbox:
+			if !more {
+				return data, false
+			}
+			data = append(data, x...)
+			continue
+		default:
+		}
+
+		if len(data) > 0 || wait <= 0 {
+			return data, true
+		}
+
+		select {
+		case x, more := <-inbox:
+			if !more {
+				return data, false
+			}
+			data = append(data, x...)
+		case <-time.After(wait):
+			return data, true
+		}
+
+		wait = 0
+	}
+
+}
+
+// serialVM returns a LogChunk of serial output. A request without a cursor
+// starts a new subscription, which begins with the output the vm has buffered;
+// passing the returned cursor to later requests continues from where the last
+// one left off. The 'wait' query parameter is the number of seconds to wait
+// for new output if there isn't any. Once the vm is gone 'more' is false and
+// the cursor is discarded.
+func (srv *Server) serialVM(r *http.Request, name string) (int, interface{}, error) {
+
+	var wait time.Duration
+	if s := r.URL.Query().Get("wait"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return 0, nil, errorf(http.StatusBadRequest, "invalid wait: %s", s)
+		}
+		wait = time.Duration(n) * time.Second
+		if wait > maxSerialWait {
+			wait = maxSerialWait
+		}
+	}
+
+	id := r.URL.Query().Get("cursor")
+
+	srv.lock.Lock()
+	srv.expireCursors()
+	c, ok := srv.cursors[id]
+	if ok {
+		// keep other requests from expiring the cursor while we wait
+		delete(srv.cursors, id)
+	}
+	srv.lock.Unlock()
+
+	if id != "" && !ok {
+		return 0, nil, errorf(http.StatusNotFound, "unknown or expired cursor: %s", id)
+	}
+
+	if id != "" && c.vm != name {
+		srv.lock.Lock()
+		srv.cursors[id] = c
+		srv.lock.Unlock()
+		return 0, nil, errorf(http.StatusBadRequest, "cursor %s belongs to vm '%s'", id, c.vm)
+	}
+
+	if !ok {
+		v, err := activeVM(name)
+		if err != nil {
+			return 0, nil, err
+		}
+		c = &cursor{
+			vm:  name,
+			sub: v.Serial().Subscribe(),
+		}
+		id = randstr.Hex(16)
+	}
+
+	data, more := read(c.sub, wait)
+
+	chunk := &virtualizers.LogChunk{
+		More: more,
+		Data: base64.StdEncoding.EncodeToString(data),
+	}
+
+	if more {
+		chunk.Cursor = id
+		c.expires = time.Now().Add(cursorTimeout)
+		srv.lock.Lock()
+		srv.cursors[id] = c
+		srv.lock.Unlock()
+	}
+
+	return http.StatusOK, chunk, nil
+
+}
@@ -0,0 +1,126 @@
+package daemon
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+)
+
+// CreateVirtualizerRequest is the body of a request to create a virtualizer.
+type CreateVirtualizerRequest struct {
+	Name   string          `json:"name"`
+	Type   string          `json:"type"`
+	Config json.RawMessage `json:"config"` // configuration specific to the type of virtualizer
+}
+
+// VirtualizerResponse describes a virtualizer.
+type VirtualizerResponse struct {
+	Name   string          `json:"name"`
+	Type   string          `json:"type"`
+	Config json.RawMessage `json:"config"`
+}
+
+// lookupVirtualizer returns the type of the named virtualizer.
+func (srv *Server) lookupVirtualizer(name string) (string, error) {
+	list, err := srv.mgr.List()
+	if err != nil {
+		return "", err
+	}
+	for _, tuple := range list {
+		if tuple.Name == name {
+			return tuple.Type, nil
+		}
+	}
+	return "", errorf(http.StatusNotFound, "no virtualizer named '%s'", name)
+}
+
+func (srv *Server) listVirtualizers(r *http.Request, _ string) (int, interface{}, error) {
+	list, err := srv.mgr.List()
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, list, nil
+}
+
+func (srv *Server) createVirtualizer(r *http.Request, _ string) (int, interface{}, error) {
+
+	req := new(CreateVirtualizerRequest)
+	err := decodeBody(r, req)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if req.Name == "" {
+		return 0, nil, errorf(http.StatusBadRequest, "virtualizer name is required")
+	}
+
+	if _, ok := virtualizers.RegisteredVirtualizers()[req.Type]; !ok {
+		return 0, nil, errorf(http.StatusBadRequest, "unrecognized virtualizer type: %s", req.Type)
+	}
+
+	if len(req.Config) == 0 {
+		req.Config = json.RawMessage("{}")
+	}
+
+	if _, err = srv.lookupVirtualizer(req.Name); err == nil {
+		return 0, nil, errorf(http.StatusConflict, "virtualizer named '%s' already exists", req.Name)
+	}
+
+	err = srv.mgr.CreateVirtualizer(req.Name, req.Type, req.Config)
+	if err != nil {
+		return 0, nil, errorf(http.StatusBadRequest, "%v", err)
+	}
+
+	srv.log.Infof("Created %s virtualizer '%s'", req.Type, req.Name)
+
+	return http.StatusCreated, &VirtualizerResponse{
+		Name:   req.Name,
+		Type:   req.Type,
+		Config: req.Config,
+	}, nil
+
+}
+
+func (srv *Server) getVirtualizer(r *http.Request, name string) (int, interface{}, error) {
+
+	ptype, err := srv.lookupVirtualizer(name)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	data, err := srv.mgr.ReturnData(name)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return http.StatusOK, &VirtualizerResponse{
+		Name:   name,
+		Type:   ptype,
+		Config: data,
+	}, nil
+
+}
+
+func (srv *Server) deleteVirtualizer(r *http.Request, name string) (int, interface{}, error) {
+
+	_, err := srv.lookupVirtualizer(name)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = srv.mgr.DeleteVirtualizer(name)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	srv.log.Infof("Deleted virtualizer '%s'", name)
+
+	return http.StatusNoContent, nil, nil
+
+}
@@ -0,0 +1,416 @@
+package daemon
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/thanhpk/randstr"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+	"github.com/vorteil/vorteil/pkg/virtualizers/cloudhypervisor"
+	"github.com/vorteil/vorteil/pkg/virtualizers/firecracker"
+	"github.com/vorteil/vorteil/pkg/virtualizers/iputil"
+	"github.com/vorteil/vorteil/pkg/virtualizers/util"
+	"github.com/vorteil/vorteil/pkg/vpkg"
+)
+
+// PrepareVMRequest is the body of a request to prepare a vm.
+type PrepareVMRequest struct {
+	Name        string `json:"name"`
+	Virtualizer string `json:"virtualizer"` // name of the virtualizer to spawn the vm from
+	Package     string `json:"package"`     // package source, resolved by the server's PackageLoader
+	Start       bool   `json:"start"`       // start the vm once it has been prepared
+
+	// Reproducible and Seed build the disk the same way as 'vorteil images
+	// build --reproducible --seed', taking the timestamp from the server's
+	// SOURCE_DATE_EPOCH.
+	Reproducible bool  `json:"reproducible"`
+	Seed         int64 `json:"seed"`
+}
+
+func activeVM(name string) (virtualizers.Virtualizer, error) {
+	x, ok := virtualizers.ActiveVMs.Load(name)
+	if !ok {
+		return nil, errorf(http.StatusNotFound, "no active vm named '%s'", name)
+	}
+	v, ok := x.(virtualizers.Virtualizer)
+	if !ok {
+		return nil, fmt.Errorf("unable to assert to virtualizer")
+	}
+	return v, nil
+}
+
+func details(v virtualizers.Virtualizer) *virtualizers.VirtualMachine {
+	return util.ConvertToVM(v.Details()).(*virtualizers.VirtualMachine)
+}
+
+func (srv *Server) listVMs(r *http.Request, _ string) (int, interface{}, error) {
+
+	var list = make([]*virtualizers.VirtualMachine, 0)
+	virtualizers.ActiveVMs.Range(func(key, value interface{}) bool {
+		if v, ok := value.(virtualizers.Virtualizer); ok {
+			list = append(list, details(v))
+		}
+		return true
+	})
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+
+	return http.StatusOK, list, nil
+
+}
+
+func (srv *Server) getVM(r *http.Request, name string) (int, interface{}, error) {
+	v, err := activeVM(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, details(v), nil
+}
+
+func (srv *Server) startVM(r *http.Request, name string) (int, interface{}, error) {
+
+	v, err := activeVM(name)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if v.State() != virtualizers.Ready {
+		return 0, nil, errorf(http.StatusConflict, "vm not in a state to be started currently in: %s", v.State())
+	}
+
+	err = v.Start()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return http.StatusOK, details(v), nil
+
+}
+
+func (srv *Server) stopVM(r *http.Request, name string) (int, interface{}, error) {
+
+	v, err := activeVM(name)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if v.State() == virtualizers.Ready {
+		return 0, nil, errorf(http.StatusConflict, "vm is already stopped")
+	}
+
+	err = v.Stop()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return http.StatusOK, details(v), nil
+
+}
+
+func (srv *Server) deleteVM(r *http.Request, name string) (int, interface{}, error) {
+
+	v, err := activeVM(name)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = v.Close(r.URL.Query().Get("force") == "true")
+	if err != nil {
+		return 0, nil, err
+	}
+	v.Serial().Close()
+
+	srv.lock.Lock()
+	folder, ok := srv.folders[name]
+	delete(srv.folders, name)
+	srv.lock.Unlock()
+
+	if !ok {
+		if re, isReattacher := v.(virtualizers.Reattacher); isReattacher {
+			folder = re.Instance().Folder
+		}
+	}
+
+	if folder != "" {
+		err = os.RemoveAll(folder)
+		if err != nil {
+			srv.log.Warnf("Failed to remove folder of vm '%s': %v", name, err)
+		}
+	}
+
+	srv.log.Infof("Deleted vm '%s'", name)
+
+	return http.StatusNoContent, nil, nil
+
+}
+
+func (srv *Server) listInstances(r *http.Request, _ string) (int, interface{}, error) {
+	list, err := srv.mgr.ListVMs()
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, list, nil
+}
+
+// assignIPs gives each network interface a static address on the firecracker
+// bridge, as firecracker and cloud hypervisor vms aren't served by DHCP.
+func assignIPs(cfg *vcfg.VCFG) error {
+
+	if len(cfg.Networks) == 0 {
+		return nil
+	}
+
+	ips, err := iputil.NewIPStack()
+	if err != nil {
+		return err
+	}
+	defer ips.Close()
+
+	for i := range cfg.Networks {
+		ip, err := ips.Dequeue()
+		if err != nil {
+			return err
+		}
+		cfg.Networks[i].IP = ip.ToString()
+		cfg.Networks[i].Gateway = iputil.BridgeIP
+		cfg.Networks[i].Mask = "255.255.255.0"
+	}
+
+	return nil
+
+}
+
+// usesBridge returns true if the virtualizer networks its vms through the
+// vorteil-bridge, which the server has to set up.
+func (srv *Server) usesBridge(virtualizer, ptype string) (bool, error) {
+
+	if ptype == cloudhypervisor.VirtualizerID {
+		return true, nil
+	}
+
+	if ptype != firecracker.VirtualizerID {
+		return false, nil
+	}
+
+	data, err := srv.mgr.ReturnData(virtualizer)
+	if err != nil {
+		return false, err
+	}
+
+	c := new(firecracker.Config)
+	err = c.Unmarshal(data)
+	if err != nil {
+		return false, err
+	}
+
+	return c.UsesBridge(), nil
+
+}
+
+// buildDisk builds the package requested by req into a new folder in the
+// manager's VMDrive, returning the path of the disk and the vcfg it was built
+// with.
+func (srv *Server) buildDisk(req *PrepareVMRequest, ptype string) (string, *vcfg.VCFG, error) {
+
+	timestamp, err := vdisk.SourceDateEpoch()
+	if err != nil {
+		return "", nil, err
+	}
+
+	pkg, err := srv.packages(req.Package)
+	if err != nil {
+		return "", nil, errorf(http.StatusBadRequest, "failed to resolve package '%s': %v", req.Package, err)
+	}
+	defer pkg.Close()
+
+	pkg, err = vpkg.PeekVCFG(pkg)
+	if err != nil {
+		return "", nil, err
+	}
+
+	cfg, err := vcfg.LoadFile(pkg.VCFG())
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = vcfg.WithDefaults(cfg, srv.log)
+	if err != nil {
+		return "", nil, err
+	}
+
+	bridged, err := srv.usesBridge(req.Virtualizer, ptype)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if bridged {
+		err = firecracker.FetchBridgeDevice()
+		if err != nil {
+			err = firecracker.SetupBridge(srv.log, iputil.BridgeIP)
+			if err != nil {
+				return "", nil, err
+			}
+		}
+		err = assignIPs(cfg)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	format, err := srv.mgr.DiskFormat(req.Virtualizer)
+	if err != nil {
+		return "", nil, err
+	}
+
+	folder := filepath.Join(srv.mgr.VMDrive(), fmt.Sprintf("vorteil-%s", randstr.Hex(5)))
+	err = os.MkdirAll(folder, 0700)
+	if err != nil {
+		return "", nil, err
+	}
+
+	f, err := os.Create(filepath.Join(folder, "disk"+format.Suffix()))
+	if err != nil {
+		os.RemoveAll(folder)
+		return "", nil, err
+	}
+	defer f.Close()
+
+	err = vdisk.BuildVCFG(context.Background(), f, cfg, &vdisk.BuildArgs{
+		PackageReader: pkg,
+		Format:        format,
+		Logger:        srv.log,
+		Reproducible:  req.Reproducible,
+		Seed:          req.Seed,
+		Timestamp:     timestamp,
+	})
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		os.RemoveAll(folder)
+		return "", nil, err
+	}
+
+	return f.Name(), cfg, nil
+
+}
+
+// wait drains an operation's channels until they are closed, returning any
+// error it reported.
+func (srv *Server) wait(op *virtualizers.VirtualizeOperation) error {
+
+	var err error
+	logs, status, errs := op.Logs, op.Status, op.Error
+
+	for logs != nil || status != nil || errs != nil {
+		select {
+		case msg, ok := <-logs:
+			if !ok {
+				logs = nil
+				continue
+			}
+			srv.log.Debugf("%s", msg)
+		case _, ok := <-status:
+			if !ok {
+				status = nil
+			}
+		case e, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			err = e
+		}
+	}
+
+	return err
+
+}
+
+func (srv *Server) prepareVM(r *http.Request, _ string) (int, interface{}, error) {
+
+	req := new(PrepareVMRequest)
+	err := decodeBody(r, req)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if req.Name == "" {
+		return 0, nil, errorf(http.StatusBadRequest, "vm name is required")
+	}
+
+	// reserve the name so it can't be taken while the disk is built
+	srv.lock.Lock()
+	_, active := virtualizers.ActiveVMs.Load(req.Name)
+	if active || srv.preparing[req.Name] {
+		srv.lock.Unlock()
+		return 0, nil, errorf(http.StatusConflict, "vm named '%s' already exists", req.Name)
+	}
+	srv.preparing[req.Name] = true
+	srv.lock.Unlock()
+
+	defer func() {
+		srv.lock.Lock()
+		delete(srv.preparing, req.Name)
+		srv.lock.Unlock()
+	}()
+
+	ptype, err := srv.lookupVirtualizer(req.Virtualizer)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	srv.log.Infof("Building package '%s' for vm '%s'", req.Package, req.Name)
+
+	diskpath, cfg, err := srv.buildDisk(req, ptype)
+	if err != nil {
+		return 0, nil, err
+	}
+	folder := filepath.Dir(diskpath)
+
+	op, err := srv.mgr.Prepare(req.Virtualizer, &virtualizers.PrepareArgs{
+		Name:      req.Name,
+		Logger:    srv.log,
+		Context:   context.Background(),
+		Start:     req.Start,
+		Config:    cfg,
+		ImagePath: diskpath,
+	})
+	if err != nil {
+		os.RemoveAll(folder)
+		return 0, nil, err
+	}
+
+	err = srv.wait(op)
+	if err != nil {
+		os.RemoveAll(folder)
+		return 0, nil, err
+	}
+
+	srv.lock.Lock()
+	srv.folders[req.Name] = folder
+	srv.lock.Unlock()
+
+	v, err := activeVM(req.Name)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	srv.log.Infof("Prepared vm '%s'", req.Name)
+
+	return http.StatusCreated, details(v), nil
+
+}
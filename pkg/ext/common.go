@@ -36,17 +36,18 @@ const (
 
 	RootDirInode = 2
 
-	InodeTypeDirectory          = 0x4000
-	InodeTypeRegularFile        = 0x8000
-	InodeTypeSymlink            = 0xA000
-	InodeTypeMask               = 0xF000
-	InodePermissionsMask        = 0777
-	DefaultInodePermissions     = 0700
-	SuperUID                    = 1000
-	SuperGID                    = 1000
-	inodeDirectoryPermissions   = InodeTypeDirectory | DefaultInodePermissions
-	inodeRegularFilePermissions = InodeTypeRegularFile | DefaultInodePermissions
-	inodeSymlinkPermissions     = InodeTypeSymlink | DefaultInodePermissions
+	InodeTypeDirectory      = 0x4000
+	InodeTypeRegularFile    = 0x8000
+	InodeTypeSymlink        = 0xA000
+	InodeTypeMask           = 0xF000
+	InodePermissionsMask    = 0777
+	InodeSetUID             = 04000
+	InodeSetGID             = 02000
+	InodeSticky             = 01000
+	InodeModeMask           = InodePermissionsMask | InodeSetUID | InodeSetGID | InodeSticky
+	DefaultInodePermissions = 0700
+	SuperUID                = 1000
+	SuperGID                = 1000
 
 	IncompatFiletype = 0x2
 )
@@ -81,7 +82,7 @@ type Superblock struct {
 	_                   uint32
 	_                   uint16
 	_                   uint16
-	_                   uint32
+	CompatibleFeatures  uint32
 	RequiredFeatures    uint32
 }
 
@@ -122,6 +123,32 @@ type Inode struct {
 	OSStuff          [12]byte
 }
 
+// InodeAttributes returns the permission bits, UID and GID that the inode for
+// f should have. These are DefaultInodePermissions, SuperUID and SuperGID
+// unless f carries its own vio.Metadata.
+func InodeAttributes(f vio.File) (perms uint16, uid, gid uint32) {
+
+	perms = DefaultInodePermissions
+	uid = SuperUID
+	gid = SuperGID
+
+	md := vio.MetadataOf(f)
+	if md == nil {
+		return
+	}
+
+	perms = uint16(md.Mode & InodeModeMask)
+	if md.UID >= 0 {
+		uid = uint32(md.UID)
+	}
+	if md.GID >= 0 {
+		gid = uint32(md.GID)
+	}
+
+	return
+
+}
+
 func divide(a, b int64) int64 {
 	return (a + b - 1) / b
 }
@@ -6,11 +6,18 @@ package ext
  */
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"io"
 	"io/ioutil"
+	"os"
+	"os/exec"
 	"strings"
 	"testing"
 
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/internal/fstest"
 	"github.com/vorteil/vorteil/pkg/vio"
 )
 
@@ -294,3 +301,233 @@ func TestDirectorySizeCalculation(t *testing.T) {
 	// })
 
 }
+
+func TestInodeAttributes(t *testing.T) {
+
+	f := vio.CustomFile(vio.CustomFileArgs{
+		ReadCloser: ioutil.NopCloser(strings.NewReader("")),
+	})
+	defer f.Close()
+
+	perms, uid, gid := InodeAttributes(f)
+	if perms != DefaultInodePermissions || uid != SuperUID || gid != SuperGID {
+		t.Fatalf("InodeAttributes doesn't fall back to the defaults: got %o %d %d", perms, uid, gid)
+	}
+
+	f = vio.CustomFile(vio.CustomFileArgs{
+		Metadata: &vio.Metadata{
+			Mode: 0104755,
+			UID:  70000,
+			GID:  -1,
+		},
+		ReadCloser: ioutil.NopCloser(strings.NewReader("")),
+	})
+	defer f.Close()
+
+	perms, uid, gid = InodeAttributes(f)
+	if perms != 04755 || uid != 70000 || gid != SuperGID {
+		t.Fatalf("InodeAttributes handles metadata incorrectly: got %o %d %d", perms, uid, gid)
+	}
+
+}
+
+func TestXattrBlock(t *testing.T) {
+
+	block, err := generateXattrBlock("file", nil)
+	if err != nil || block != nil {
+		t.Fatalf("generateXattrBlock created a block for a file without metadata")
+	}
+
+	block, err = generateXattrBlock("file", &vio.Metadata{
+		Xattrs: map[string][]byte{
+			"system.posix_acl_access": []byte("unsupported"),
+		},
+	})
+	if err != nil || block != nil {
+		t.Fatalf("generateXattrBlock created a block for unsupported attributes")
+	}
+
+	block, err = generateXattrBlock("file", &vio.Metadata{
+		Xattrs: map[string][]byte{
+			"user.b":      []byte("bravo"),
+			"user.a":      []byte("alpha"),
+			"trusted.zzz": []byte(""),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(block) != BlockSize {
+		t.Fatalf("generateXattrBlock created a block of the wrong size: %d", len(block))
+	}
+
+	hdr := new(XattrHeader)
+	err = binary.Read(bytes.NewReader(block), binary.LittleEndian, hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr.Magic != XattrMagic || hdr.RefCount != 1 || hdr.Blocks != 1 {
+		t.Fatalf("generateXattrBlock created a bad header: %+v", hdr)
+	}
+
+	// entries must be sorted by index, then name length, then name
+	r := bytes.NewReader(block[xattrHeaderSize:])
+	for _, expect := range []string{"a", "b", "zzz"} {
+
+		entry := new(XattrEntry)
+		err = binary.Read(r, binary.LittleEndian, entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		name := make([]byte, align(int64(entry.NameLength), xattrAlignment))
+		_, err = io.ReadFull(r, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(name[:entry.NameLength]) != expect {
+			t.Fatalf("generateXattrBlock sorted entries incorrectly: expected %s but got %s", expect, name[:entry.NameLength])
+		}
+
+		value := block[entry.ValueOffset : int(entry.ValueOffset)+int(entry.ValueSize)]
+		if expect != "zzz" && string(value) != map[string]string{"a": "alpha", "b": "bravo"}[expect] {
+			t.Fatalf("generateXattrBlock stored the wrong value for %s: %s", expect, value)
+		}
+
+	}
+
+	_, err = generateXattrBlock("file", &vio.Metadata{
+		Xattrs: map[string][]byte{
+			"user.big": make([]byte, BlockSize),
+		},
+	})
+	if err == nil {
+		t.Fatalf("generateXattrBlock accepted attributes too large for a block")
+	}
+
+}
+
+func TestCompileLargeFileWithXattrs(t *testing.T) {
+
+	ctx := context.Background()
+
+	// big enough to need the singly indirect pointer block
+	data := make([]byte, 70000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	tree := vio.NewFileTree()
+	err := tree.Map("/big", vio.CustomFile(vio.CustomFileArgs{
+		Name: "big",
+		Size: len(data),
+		Metadata: &vio.Metadata{
+			Mode: 0100644,
+			Xattrs: map[string][]byte{
+				"user.a": []byte("alpha"),
+			},
+		},
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(data)),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCompiler(&CompilerArgs{
+		FileTree: tree,
+		Logger:   &elog.CLI{},
+	})
+
+	err = c.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := c.MinimumSize()
+	err = c.Precompile(ctx, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := new(fstest.WriteSeeker)
+	err = c.Compile(ctx, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := append(w.Buf, make([]byte, size-int64(len(w.Buf)))...)
+
+	var ino int64
+	for i, node := range c.inodeBlocks {
+		if node.node != nil && node.xattrs != nil {
+			ino = int64(i)
+		}
+	}
+	if ino == 0 {
+		t.Fatalf("no inode with extended attributes")
+	}
+
+	inode := new(Inode)
+	buf := new(bytes.Buffer)
+	err = c.writeInode(ino, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = binary.Read(buf, binary.LittleEndian, inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// read the file back through its block pointers
+	pointers := inode.DirectPointer[:]
+	indirect := img[int64(inode.SinglyIndirect)*BlockSize:][:BlockSize]
+	for i := 0; i < BlockSize; i += pointerSize {
+		p := binary.LittleEndian.Uint32(indirect[i:])
+		if p == 0 {
+			break
+		}
+		if p == inode.FileACL {
+			t.Fatalf("extended attribute block %d referenced as file data", p)
+		}
+		pointers = append(pointers, p)
+	}
+
+	var content []byte
+	for _, p := range pointers {
+		content = append(content, img[int64(p)*BlockSize:][:BlockSize]...)
+	}
+
+	if len(content) < len(data) || !bytes.Equal(content[:len(data)], data) {
+		t.Fatalf("file read back from its block pointers doesn't match")
+	}
+
+	if len(content)-len(data) >= BlockSize {
+		t.Fatalf("file has %d blocks, expected %d", len(content)/BlockSize, divide(int64(len(data)), BlockSize))
+	}
+
+	e2fsck, err := exec.LookPath("e2fsck")
+	if err != nil {
+		return
+	}
+
+	f, err := ioutil.TempFile("", "vtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err = f.Write(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command(e2fsck, "-fn", f.Name()).CombinedOutput()
+	if err != nil {
+		t.Fatalf("e2fsck found errors: %v\n%s", err, out)
+	}
+
+}
@@ -20,8 +20,9 @@ type compiler struct {
 	nodeTracker
 	blockUsage
 
-	tree vio.FileTree
-	size int64
+	tree      vio.FileTree
+	size      int64
+	timestamp time.Time
 
 	superblock Superblock
 	bgdt       []byte
@@ -120,6 +121,9 @@ retry:
 
 func (c *compiler) initSuperblock() {
 	now := time.Now()
+	if !c.timestamp.IsZero() {
+		now = c.timestamp
+	}
 	c.superblock.LastMountTime = uint32(now.Unix())
 	c.superblock.LastWrittenTime = uint32(now.Unix())
 	c.superblock.MountsCheckInterval = 20
@@ -138,6 +142,13 @@ func (c *compiler) initSuperblock() {
 	c.superblock.UnallocatedBlocks = uint32(c.unallocatedBlocks)
 	c.superblock.UnallocatedInodes = uint32(c.unallocatedInodes)
 	c.superblock.RequiredFeatures = IncompatFiletype
+
+	for _, node := range c.inodeBlocks {
+		if node.xattrs != nil {
+			c.superblock.CompatibleFeatures |= CompatExtAttr
+			break
+		}
+	}
 }
 
 func (c *compiler) generateBGDT() error {
@@ -294,6 +305,9 @@ func (c *compiler) setInodePointers(ino int64, inode *Inode) {
 	node := c.inodeBlocks[ino]
 	start := int64(node.start)
 	length := int64(node.fs)
+	if node.xattrs != nil {
+		length--
+	}
 
 	// direct pointers
 	for i := int64(0); i < maxDirectPointers && i < length; i++ {
@@ -337,15 +351,16 @@ func (c *compiler) writeInode(ino int64, w io.Writer) error {
 	}
 
 	node := c.inodeBlocks[ino]
+	perms, uid, gid := InodeAttributes(node.node.File)
 	if node.node.File.IsDir() {
 		inode.SizeLower = uint32(node.content * BlockSize)
-		inode.Permissions = inodeDirectoryPermissions
+		inode.Permissions = InodeTypeDirectory | perms
 	} else if node.node.File.IsSymlink() {
 		inode.SizeLower = uint32(node.node.File.Size())
-		inode.Permissions = inodeSymlinkPermissions
+		inode.Permissions = InodeTypeSymlink | perms
 	} else {
 		inode.SizeLower = uint32(node.node.File.Size())
-		inode.Permissions = inodeRegularFilePermissions
+		inode.Permissions = InodeTypeRegularFile | perms
 	}
 
 	inode.Links = 1
@@ -358,11 +373,17 @@ func (c *compiler) writeInode(ino int64, w io.Writer) error {
 		}
 	}
 
-	inode.UID = SuperUID
-	inode.GID = SuperGID
+	inode.UID = uint16(uid)
+	inode.GID = uint16(gid)
+	binary.LittleEndian.PutUint16(inode.OSStuff[4:], uint16(uid>>16))
+	binary.LittleEndian.PutUint16(inode.OSStuff[6:], uint16(gid>>16))
 	inode.Sectors = node.fs * (BlockSize / SectorSize)
 	c.setInodePointers(ino, inode)
 
+	if node.xattrs != nil {
+		inode.FileACL = uint32(c.mapDBtoBlockAddr(int64(node.start) + int64(node.fs) - 1))
+	}
+
 	err := binary.Write(w, binary.LittleEndian, inode)
 	if err != nil {
 		return err
@@ -9,6 +9,7 @@ import (
 	"context"
 	"io"
 	"path/filepath"
+	"time"
 
 	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/vio"
@@ -20,6 +21,10 @@ import (
 type CompilerArgs struct {
 	FileTree vio.FileTree
 	Logger   elog.Logger
+
+	// Timestamp, if set, is used in place of the current time, so that
+	// builds can be reproduced.
+	Timestamp time.Time
 }
 
 // Compiler keeps all variables and settings for a single file-system compile
@@ -50,6 +55,7 @@ func NewCompiler(args *CompilerArgs) *Compiler {
 	c := new(Compiler)
 	c.tree = args.FileTree
 	c.log = args.Logger
+	c.timestamp = args.Timestamp
 	return c
 }
 
@@ -124,6 +130,7 @@ type nodeBlocks struct {
 	start   int64
 	content uint32
 	fs      uint32
+	xattrs  []byte
 }
 
 // Commit is the second of the four steps necessary to compile a file-system
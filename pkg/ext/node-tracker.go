@@ -21,12 +21,14 @@ type nodeTracker struct {
 	activeNodeBlock  int64
 	activeNodeBlocks int64
 	activeNodeStart  int64
+	activeNodeXattrs []byte
 }
 
 func (c *nodeTracker) scanInodes(ctx context.Context, tree vio.FileTree) (int64, error) {
 
 	var err error
 	var ino, minInodes, contentDelta, fsDelta, filledDataBlocks int64
+	var xattrs []byte
 	ino = 9
 	minInodes = 9 + int64(tree.NodeCount())
 	c.inodeBlocks = make([]nodeBlocks, minInodes+1, minInodes+1) // +1 because inodes start counting at 1 rather than 0, and I don't want to correct for that in every array index.
@@ -47,10 +49,20 @@ func (c *nodeTracker) scanInodes(ctx context.Context, tree vio.FileTree) (int64,
 			contentDelta, fsDelta = calculateRegularFileBlocks(n.File)
 		}
 
+		// the extended attribute block goes after everything else
+		xattrs, err = generateXattrBlock(path, vio.MetadataOf(n.File))
+		if err != nil {
+			return err
+		}
+		if xattrs != nil {
+			fsDelta++
+		}
+
 		c.inodeBlocks[ino].start = filledDataBlocks
 		c.inodeBlocks[ino].node = n
 		c.inodeBlocks[ino].content = uint32(contentDelta)
 		c.inodeBlocks[ino].fs = uint32(fsDelta)
+		c.inodeBlocks[ino].xattrs = xattrs
 		n.NodeSequenceNumber = ino
 		filledDataBlocks += fsDelta
 
@@ -107,6 +119,7 @@ func (c *nodeTracker) prepNextDataBlock() error {
 		c.activeNodeBlock = 0
 		c.activeNodeBlocks = int64(node.fs)
 		c.activeNodeStart = int64(node.start)
+		c.activeNodeXattrs = node.xattrs
 
 		// generate dir data into args.objData
 		if node.node.File.IsDir() {
@@ -153,22 +166,34 @@ func (c *nodeTracker) writeBlock(w io.Writer, mapDBtoBlockAddr func(int64) int64
 
 	var j int64
 
+	// the extended attribute block is not part of the file, so it must never
+	// be referenced by the indirect pointer blocks
+	blocks := c.activeNodeBlocks
+	if c.activeNodeXattrs != nil {
+		blocks--
+		if c.activeNodeBlock == blocks {
+			btype = -1
+		}
+	}
+
 	switch btype {
+	case -1: // it is the extended attribute block
+		buffer.Write(c.activeNodeXattrs)
 	case 0: // it is a data block
 		_, err := io.CopyN(buffer, c.activeNodeReader, BlockSize)
 		if err != nil && err != io.EOF {
 			return err
 		}
 	case 1: // it is a single indirect pointer block
-		for j = c.activeNodeBlock + 1; j < c.activeNodeBlocks && j < refsPerBlock+c.activeNodeBlock+1; j++ {
+		for j = c.activeNodeBlock + 1; j < blocks && j < refsPerBlock+c.activeNodeBlock+1; j++ {
 			_ = binary.Write(buffer, binary.LittleEndian, uint32(mapDBtoBlockAddr(j+c.activeNodeStart)))
 		}
 	case 2: // it is a double indirect pointer block
-		for j = c.activeNodeBlock + 1; j < c.activeNodeBlocks && j < c.activeNodeBlock+1+(1+refsPerBlock)*refsPerBlock; j = j + (1 + refsPerBlock) {
+		for j = c.activeNodeBlock + 1; j < blocks && j < c.activeNodeBlock+1+(1+refsPerBlock)*refsPerBlock; j = j + (1 + refsPerBlock) {
 			_ = binary.Write(buffer, binary.LittleEndian, uint32(mapDBtoBlockAddr(j+c.activeNodeStart)))
 		}
 	case 3: // it is a triple indirect pointer block
-		for j = c.activeNodeBlock + 1; j < c.activeNodeBlocks && j < c.activeNodeBlock+1+(1+refsPerBlock)*refsPerBlock+refsPerBlock*refsPerBlock*refsPerBlock; j = j + (1+refsPerBlock)*refsPerBlock + 1 {
+		for j = c.activeNodeBlock + 1; j < blocks && j < c.activeNodeBlock+1+(1+refsPerBlock)*refsPerBlock+refsPerBlock*refsPerBlock*refsPerBlock; j = j + (1+refsPerBlock)*refsPerBlock + 1 {
 			_ = binary.Write(buffer, binary.LittleEndian, uint32(mapDBtoBlockAddr(j+c.activeNodeStart)))
 		}
 	}
@@ -0,0 +1,187 @@
+package ext
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// Extended attribute block constants. Attributes are stored in a single block
+// referenced by the inode's FileACL field, with a header and entry table
+// growing down from the start of the block and the values growing up from the
+// end of it.
+const (
+	XattrMagic           = 0xEA020000
+	CompatExtAttr        = 0x8
+	xattrHeaderSize      = 32
+	xattrEntrySize       = 16
+	xattrAlignment       = 4
+	xattrNameHashShift   = 5
+	xattrValueHashShift  = 16
+	xattrBlockHashShift  = 16
+	xattrIndexUser       = 1
+	xattrIndexTrusted    = 4
+	xattrIndexSecurity   = 6
+	xattrMaxNameLength   = 255
+	xattrEntryTerminator = 4
+)
+
+// XattrHeader is the structure at the start of an extended attribute block.
+type XattrHeader struct {
+	Magic    uint32
+	RefCount uint32
+	Blocks   uint32
+	Hash     uint32
+	_        [4]uint32
+}
+
+// XattrEntry is the structure of an entry in an extended attribute block. It
+// is followed by the attribute's name, without its namespace prefix.
+type XattrEntry struct {
+	NameLength  uint8
+	NameIndex   uint8
+	ValueOffset uint16
+	ValueInode  uint32
+	ValueSize   uint32
+	Hash        uint32
+}
+
+var xattrPrefixes = []struct {
+	prefix string
+	index  uint8
+}{
+	{"user.", xattrIndexUser},
+	{"trusted.", xattrIndexTrusted},
+	{"security.", xattrIndexSecurity},
+}
+
+type xattr struct {
+	index uint8
+	name  string
+	value []byte
+}
+
+func splitXattrName(name string) (uint8, string, bool) {
+	for _, p := range xattrPrefixes {
+		if strings.HasPrefix(name, p.prefix) {
+			return p.index, strings.TrimPrefix(name, p.prefix), true
+		}
+	}
+	return 0, "", false
+}
+
+func xattrEntryHash(x *xattr) uint32 {
+
+	var hash uint32
+
+	for _, c := range []byte(x.name) {
+		hash = (hash << xattrNameHashShift) ^ (hash >> (32 - xattrNameHashShift)) ^ uint32(c)
+	}
+
+	value := make([]byte, align(int64(len(x.value)), xattrAlignment))
+	copy(value, x.value)
+	for i := 0; i < len(value); i += 4 {
+		hash = (hash << xattrValueHashShift) ^ (hash >> (32 - xattrValueHashShift)) ^ binary.LittleEndian.Uint32(value[i:])
+	}
+
+	return hash
+
+}
+
+// generateXattrBlock returns the extended attribute block for a file, or nil
+// if it has none worth storing. Only the user, trusted and security
+// namespaces are supported; other attributes, such as POSIX ACLs, are
+// skipped.
+func generateXattrBlock(path string, md *vio.Metadata) ([]byte, error) {
+
+	if md == nil || len(md.Xattrs) == 0 {
+		return nil, nil
+	}
+
+	var xattrs []*xattr
+	for name, value := range md.Xattrs {
+		index, suffix, ok := splitXattrName(name)
+		if !ok {
+			continue
+		}
+		if len(suffix) == 0 || len(suffix) > xattrMaxNameLength {
+			return nil, fmt.Errorf("extended attribute '%s' on '%s' has an invalid name", name, path)
+		}
+		xattrs = append(xattrs, &xattr{
+			index: index,
+			name:  suffix,
+			value: value,
+		})
+	}
+
+	if len(xattrs) == 0 {
+		return nil, nil
+	}
+
+	sort.Slice(xattrs, func(i, j int) bool {
+		a, b := xattrs[i], xattrs[j]
+		if a.index != b.index {
+			return a.index < b.index
+		}
+		if len(a.name) != len(b.name) {
+			return len(a.name) < len(b.name)
+		}
+		return a.name < b.name
+	})
+
+	entries := new(bytes.Buffer)
+	values := int64(BlockSize)
+	block := make([]byte, BlockSize)
+	var blockHash uint32
+
+	for _, x := range xattrs {
+
+		values -= align(int64(len(x.value)), xattrAlignment)
+		entriesEnd := xattrHeaderSize + int64(entries.Len()) + xattrEntrySize + align(int64(len(x.name)), xattrAlignment) + xattrEntryTerminator
+		if values < entriesEnd {
+			return nil, fmt.Errorf("extended attributes of '%s' don't fit within a single %d byte block", path, BlockSize)
+		}
+		copy(block[values:], x.value)
+
+		entry := &XattrEntry{
+			NameLength:  uint8(len(x.name)),
+			NameIndex:   x.index,
+			ValueOffset: uint16(values),
+			ValueSize:   uint32(len(x.value)),
+			Hash:        xattrEntryHash(x),
+		}
+		if len(x.value) == 0 {
+			entry.ValueOffset = 0
+		}
+
+		_ = binary.Write(entries, binary.LittleEndian, entry)
+		entries.WriteString(x.name)
+		entries.Write(make([]byte, align(int64(len(x.name)), xattrAlignment)-int64(len(x.name))))
+
+		blockHash = (blockHash << xattrBlockHashShift) ^ (blockHash >> (32 - xattrBlockHashShift)) ^ entry.Hash
+
+	}
+
+	hdr := new(bytes.Buffer)
+	_ = binary.Write(hdr, binary.LittleEndian, &XattrHeader{
+		Magic:    XattrMagic,
+		RefCount: 1,
+		Blocks:   1,
+		Hash:     blockHash,
+	})
+
+	copy(block, hdr.Bytes())
+	copy(block[xattrHeaderSize:], entries.Bytes())
+
+	return block, nil
+
+}
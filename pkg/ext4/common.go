@@ -0,0 +1,410 @@
+package ext4
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// Various ext4 build constants.
+const (
+	Signature           = ext.Signature
+	SectorSize          = ext.SectorSize
+	BlockSize           = ext.BlockSize
+	SuperblockOffset    = ext.SuperblockOffset
+	InodeSize           = 256
+	InodeExtraSize      = 32
+	InodesPerBlock      = BlockSize / InodeSize
+	GroupDescriptorSize = 64
+	BlocksPerGroup      = BlockSize * 8 // 8 bits per byte in the bitmap
+	MaxInodesPerGroup   = BlockSize * 8
+	LogGroupsPerFlex    = 4
+	GroupsPerFlex       = 1 << LogGroupsPerFlex
+
+	RootDirInode = ext.RootDirInode
+	JournalInode = 8
+	FirstInode   = 11
+
+	CompatHasJournal      = 0x4
+	IncompatFiletype      = 0x2
+	IncompatExtents       = 0x40
+	Incompat64Bit         = 0x80
+	IncompatFlexBG        = 0x200
+	ROCompatSparseSuper   = 0x1
+	ROCompatLargeFile     = 0x2
+	ROCompatHugeFile      = 0x8
+	ROCompatDirNlink      = 0x20
+	ROCompatExtraIsize    = 0x40
+	FlagSignedDirHash     = 0x1
+	DefaultHashHalfMD4    = 0x1
+	JournalBackupBlocks   = 0x1
+	InodeFlagExtents      = 0x80000
+	ExtentMagic           = 0xF30A
+	maxExtentLength       = 32768
+	extentsPerInode       = 4
+	extentsPerBlock       = (BlockSize - extentHeaderSize) / extentSize
+	extentHeaderSize      = 12
+	extentSize            = 12
+	maxFastSymlinkLength  = 60
+	maxDirLinks           = 65000
+	inodeJournalMode      = ext.InodeTypeRegularFile | 0600
+	dentryNameAlignment   = 4
+	minimumJournalBlocks  = 1024
+	minimumBlocksJournal  = 2048
+	minimumGroupDataSpare = 50
+
+	compatFeatures   = 0
+	incompatFeatures = IncompatFiletype | IncompatExtents | Incompat64Bit | IncompatFlexBG
+	roCompatFeatures = ROCompatSparseSuper | ROCompatLargeFile | ROCompatHugeFile | ROCompatDirNlink | ROCompatExtraIsize
+)
+
+// Superblock is the structure of an ext4 superblock as written to the disk.
+// Unlike the ext2 equivalent it covers the full 1024 bytes reserved for it.
+type Superblock struct {
+	TotalInodes          uint32
+	TotalBlocksLo        uint32
+	ReservedBlocksLo     uint32
+	UnallocatedBlocksLo  uint32
+	UnallocatedInodes    uint32
+	FirstDataBlock       uint32
+	BlockSize            uint32
+	ClusterSize          uint32
+	BlocksPerGroup       uint32
+	ClustersPerGroup     uint32
+	InodesPerGroup       uint32
+	LastMountTime        uint32
+	LastWrittenTime      uint32
+	MountsSinceCheck     uint16
+	MountsCheckInterval  uint16
+	Signature            uint16
+	State                uint16
+	ErrorProtocol        uint16
+	VersionMinor         uint16
+	TimeLastCheck        uint32
+	TimeCheckInterval    uint32
+	OS                   uint32
+	VersionMajor         uint32
+	SuperUser            uint16
+	SuperGroup           uint16
+	FirstInode           uint32
+	InodeSize            uint16
+	BlockGroupNumber     uint16
+	CompatibleFeatures   uint32
+	IncompatibleFeatures uint32
+	ReadOnlyFeatures     uint32
+	UUID                 [16]byte
+	VolumeName           [16]byte
+	LastMounted          [64]byte
+	AlgorithmBitmap      uint32
+	PreallocBlocks       uint8
+	PreallocDirBlocks    uint8
+	ReservedGDTBlocks    uint16
+	JournalUUID          [16]byte
+	JournalInode         uint32
+	JournalDevice        uint32
+	LastOrphan           uint32
+	HashSeed             [4]uint32
+	DefaultHashVersion   uint8
+	JournalBackupType    uint8
+	DescriptorSize       uint16
+	DefaultMountOptions  uint32
+	FirstMetaBlockGroup  uint32
+	MkfsTime             uint32
+	JournalBlocks        [17]uint32
+	TotalBlocksHi        uint32
+	ReservedBlocksHi     uint32
+	UnallocatedBlocksHi  uint32
+	MinExtraInodeSize    uint16
+	WantExtraInodeSize   uint16
+	Flags                uint32
+	RAIDStride           uint16
+	MMPInterval          uint16
+	MMPBlock             uint64
+	RAIDStripeWidth      uint32
+	LogGroupsPerFlex     uint8
+	ChecksumType         uint8
+	_                    uint16
+	KBytesWritten        uint64
+	_                    [0x280]byte
+}
+
+// GroupDescriptor is the structure of a 64-bit ext4 block group descriptor.
+type GroupDescriptor struct {
+	BlockBitmapLo         uint32
+	InodeBitmapLo         uint32
+	InodeTableLo          uint32
+	UnallocatedBlocksLo   uint16
+	UnallocatedInodesLo   uint16
+	DirectoriesLo         uint16
+	Flags                 uint16
+	ExcludeBitmapLo       uint32
+	BlockBitmapChecksumLo uint16
+	InodeBitmapChecksumLo uint16
+	UnusedInodesLo        uint16
+	Checksum              uint16
+	BlockBitmapHi         uint32
+	InodeBitmapHi         uint32
+	InodeTableHi          uint32
+	UnallocatedBlocksHi   uint16
+	UnallocatedInodesHi   uint16
+	DirectoriesHi         uint16
+	UnusedInodesHi        uint16
+	ExcludeBitmapHi       uint32
+	BlockBitmapChecksumHi uint16
+	InodeBitmapChecksumHi uint16
+	_                     uint32
+}
+
+// Inode is the structure of a large ext4 inode as written to the disk. The
+// first 128 bytes are compatible with ext.Inode.
+type Inode struct {
+	Permissions           uint16
+	UID                   uint16
+	SizeLower             uint32
+	LastAccessTime        uint32
+	ChangeTime            uint32
+	ModificationTime      uint32
+	DeletionTime          uint32
+	GID                   uint16
+	Links                 uint16
+	SectorsLower          uint32
+	Flags                 uint32
+	Version               uint32
+	Block                 [60]byte
+	Generation            uint32
+	FileACLLower          uint32
+	SizeUpper             uint32
+	FragAddr              uint32
+	SectorsUpper          uint16
+	FileACLUpper          uint16
+	UIDUpper              uint16
+	GIDUpper              uint16
+	ChecksumLower         uint16
+	_                     uint16
+	ExtraSize             uint16
+	ChecksumUpper         uint16
+	ChangeTimeExtra       uint32
+	ModificationTimeExtra uint32
+	LastAccessTimeExtra   uint32
+	CreationTime          uint32
+	CreationTimeExtra     uint32
+	VersionUpper          uint32
+	ProjectID             uint32
+	_                     [InodeSize - 160]byte
+}
+
+// ExtentHeader precedes every node of an extent tree, whether stored in an
+// inode or in a block of its own.
+type ExtentHeader struct {
+	Magic      uint16
+	Entries    uint16
+	Max        uint16
+	Depth      uint16
+	Generation uint32
+}
+
+// ExtentIndex is an interior node of an extent tree.
+type ExtentIndex struct {
+	Block  uint32
+	LeafLo uint32
+	LeafHi uint16
+	_      uint16
+}
+
+// Extent is a leaf node of an extent tree, mapping a run of logical file
+// blocks to a run of physical blocks.
+type Extent struct {
+	Block   uint32
+	Len     uint16
+	StartHi uint16
+	StartLo uint32
+}
+
+func divide(a, b int64) int64 {
+	return (a + b - 1) / b
+}
+
+func align(a, b int64) int64 {
+	return divide(a, b) * b
+}
+
+func lo32(x int64) uint32 {
+	return uint32(x)
+}
+
+func hi32(x int64) uint32 {
+	return uint32(uint64(x) >> 32)
+}
+
+func lo16(x int64) uint16 {
+	return uint16(x)
+}
+
+func hi16(x int64) uint16 {
+	return uint16(uint64(x) >> 16)
+}
+
+func isPowerOf(x, base int64) bool {
+	for x > 1 && x%base == 0 {
+		x /= base
+	}
+	return x == 1
+}
+
+// groupHasSuperblock reports whether block group g carries a copy of the
+// superblock and group descriptor table under the sparse_super feature.
+func groupHasSuperblock(g int64) bool {
+	if g <= 1 {
+		return true
+	}
+	return isPowerOf(g, 3) || isPowerOf(g, 5) || isPowerOf(g, 7)
+}
+
+// defaultJournalBlocks mirrors the journal sizing rules used by mke2fs.
+func defaultJournalBlocks(blocks int64) int64 {
+	switch {
+	case blocks < minimumBlocksJournal:
+		return 0
+	case blocks < 32768:
+		return minimumJournalBlocks
+	case blocks < 256*1024:
+		return 4096
+	case blocks < 512*1024:
+		return 8192
+	case blocks < 4096*1024:
+		return 16384
+	case blocks < 8192*1024:
+		return 32768
+	case blocks < 16384*1024:
+		return 65536
+	case blocks < 32768*1024:
+		return 131072
+	default:
+		return 262144
+	}
+}
+
+func unixTime(t time.Time) uint32 {
+	if t.IsZero() || t.Unix() < 0 {
+		return 0
+	}
+	return uint32(t.Unix())
+}
+
+const (
+	ftypeRegularFile = 0x1
+	ftypeDir         = 0x2
+	ftypeSymlink     = 0x7
+)
+
+func fileType(f vio.File) uint8 {
+	if f.IsDir() {
+		return ftypeDir
+	} else if f.IsSymlink() {
+		return ftypeSymlink
+	}
+	return ftypeRegularFile
+}
+
+type dirTuple struct {
+	name  string
+	inode uint32
+	ftype uint8
+}
+
+func dirTuples(n *vio.TreeNode) []dirTuple {
+
+	parent := n.Parent
+	if parent == nil {
+		parent = n
+	}
+
+	tuples := make([]dirTuple, 0, len(n.Children)+2)
+	tuples = append(tuples, dirTuple{name: ".", inode: uint32(n.NodeSequenceNumber), ftype: ftypeDir})
+	tuples = append(tuples, dirTuple{name: "..", inode: uint32(parent.NodeSequenceNumber), ftype: ftypeDir})
+
+	for _, child := range n.Children {
+		tuples = append(tuples, dirTuple{
+			name:  path.Base(child.File.Name()),
+			inode: uint32(child.NodeSequenceNumber),
+			ftype: fileType(child.File),
+		})
+	}
+
+	return tuples
+
+}
+
+func direntLength(name string) int64 {
+	return 8 + align(int64(len(name)), dentryNameAlignment)
+}
+
+// packDirectory splits a list of directory entries into blocks, returning the
+// index of the first entry in each block. Entries never span blocks, and the
+// final entry in each block is stretched to fill any leftover space.
+func packDirectory(tuples []dirTuple) []int {
+
+	var starts []int
+	used := int64(BlockSize)
+
+	for i, t := range tuples {
+		l := direntLength(t.name)
+		if used+l > BlockSize {
+			starts = append(starts, i)
+			used = 0
+		}
+		used += l
+	}
+
+	return starts
+
+}
+
+func calculateDirectoryBlocks(n *vio.TreeNode) int64 {
+	return int64(len(packDirectory(dirTuples(n))))
+}
+
+func generateDirectoryData(n *vio.TreeNode) []byte {
+
+	tuples := dirTuples(n)
+	starts := packDirectory(tuples)
+	buf := new(bytes.Buffer)
+
+	for i, start := range starts {
+
+		end := len(tuples)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+
+		used := int64(0)
+		for j := start; j < end; j++ {
+			t := tuples[j]
+			l := direntLength(t.name)
+			if j == end-1 {
+				l = BlockSize - used
+			}
+			used += l
+
+			_ = binary.Write(buf, binary.LittleEndian, t.inode)            // inode
+			_ = binary.Write(buf, binary.LittleEndian, uint16(l))          // entry size
+			_ = binary.Write(buf, binary.LittleEndian, uint8(len(t.name))) // name length
+			_ = binary.Write(buf, binary.LittleEndian, t.ftype)            // file type
+			_, _ = buf.Write([]byte(t.name))                               // name
+			_, _ = buf.Write(make([]byte, int(l-8-int64(len(t.name)))))    // padding
+		}
+
+	}
+
+	return buf.Bytes()
+
+}
@@ -0,0 +1,248 @@
+package ext4
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/internal/fstest"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+func TestStructureSizes(t *testing.T) {
+
+	if x := binary.Size(&Superblock{}); x != 1024 {
+		t.Fatalf("superblock structure is the wrong size: %d", x)
+	}
+
+	if x := binary.Size(&GroupDescriptor{}); x != GroupDescriptorSize {
+		t.Fatalf("group descriptor structure is the wrong size: %d", x)
+	}
+
+	if x := binary.Size(&Inode{}); x != InodeSize {
+		t.Fatalf("inode structure is the wrong size: %d", x)
+	}
+
+	if x := binary.Size(&ExtentHeader{}); x != extentHeaderSize {
+		t.Fatalf("extent header structure is the wrong size: %d", x)
+	}
+
+	if x := binary.Size(&Extent{}); x != extentSize {
+		t.Fatalf("extent structure is the wrong size: %d", x)
+	}
+
+	if x := binary.Size(&ExtentIndex{}); x != extentSize {
+		t.Fatalf("extent index structure is the wrong size: %d", x)
+	}
+
+}
+
+func TestSparseSuperblockGroups(t *testing.T) {
+
+	for _, g := range []int64{0, 1, 3, 5, 7, 9, 25, 27, 49, 125, 343} {
+		if !groupHasSuperblock(g) {
+			t.Fatalf("groupHasSuperblock should be true for group %d", g)
+		}
+	}
+
+	for _, g := range []int64{2, 4, 6, 8, 10, 15, 21, 35, 100} {
+		if groupHasSuperblock(g) {
+			t.Fatalf("groupHasSuperblock should be false for group %d", g)
+		}
+	}
+
+}
+
+func TestDirectoryPacking(t *testing.T) {
+
+	root := &vio.TreeNode{NodeSequenceNumber: RootDirInode}
+
+	if x := calculateDirectoryBlocks(root); x != 1 {
+		t.Fatalf("calculateDirectoryBlocks calculates empty directory sizes incorrectly: %d", x)
+	}
+
+	// each of these entries needs 8 + 256 bytes, so 15 fit in one block
+	// alongside "." and ".."
+	for i := 0; i < 16; i++ {
+		root.Children = append(root.Children, &vio.TreeNode{
+			Parent:             root,
+			NodeSequenceNumber: int64(FirstInode + i),
+			File: vio.CustomFile(vio.CustomFileArgs{
+				Name: strings.Repeat("a", 252) + string(rune('a'+i)),
+			}),
+		})
+	}
+
+	if x := calculateDirectoryBlocks(root); x != 2 {
+		t.Fatalf("calculateDirectoryBlocks calculates multi-block directory sizes incorrectly: %d", x)
+	}
+
+	data := generateDirectoryData(root)
+	if len(data) != 2*BlockSize {
+		t.Fatalf("generateDirectoryData produced the wrong amount of data: %d", len(data))
+	}
+
+	// walk the entries to confirm that they exactly fill each block
+	for block := 0; block < 2; block++ {
+		var off int
+		for off < BlockSize {
+			l := binary.LittleEndian.Uint16(data[block*BlockSize+off+4:])
+			if l == 0 {
+				t.Fatalf("directory entry has zero length")
+			}
+			off += int(l)
+		}
+		if off != BlockSize {
+			t.Fatalf("directory entries overflow block %d", block)
+		}
+	}
+
+}
+
+func TestExtentCalculation(t *testing.T) {
+
+	extents := splitExtents([]run{
+		{start: 100, length: 10},
+		{start: 1 << 33, length: maxExtentLength + 1},
+	})
+
+	if len(extents) != 3 {
+		t.Fatalf("splitExtents produced the wrong number of extents: %d", len(extents))
+	}
+
+	if extents[1].Block != 10 || extentStart(extents[1]) != 1<<33 || extents[1].Len != maxExtentLength {
+		t.Fatalf("splitExtents produced a bad extent: %+v", extents[1])
+	}
+
+	if extents[2].Block != 10+maxExtentLength || extentStart(extents[2]) != 1<<33+maxExtentLength || extents[2].Len != 1 {
+		t.Fatalf("splitExtents produced a bad extent: %+v", extents[2])
+	}
+
+	if x, _ := leavesNeeded(extentsPerInode); x != 0 {
+		t.Fatalf("leavesNeeded should fit %d extents in the inode", extentsPerInode)
+	}
+
+	if x, _ := leavesNeeded(extentsPerInode + 1); x != 1 {
+		t.Fatalf("leavesNeeded should need one leaf for %d extents", extentsPerInode+1)
+	}
+
+	if _, err := leavesNeeded(extentsPerBlock*extentsPerInode + 1); err == nil {
+		t.Fatalf("leavesNeeded should fail on excessively fragmented files")
+	}
+
+}
+
+func TestCompile(t *testing.T) {
+
+	ctx := context.Background()
+
+	tree := vio.NewFileTree()
+	c := NewCompiler(&CompilerArgs{
+		FileTree: tree,
+		Logger:   &elog.CLI{},
+	})
+
+	err := c.Mkdir("/etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("hello, world\n")
+	err = c.AddFile("/etc/hello", vio.CustomFile(vio.CustomFileArgs{
+		Size:       len(data),
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(data)),
+	}), int64(len(data)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.IncreaseMinimumFreeSpace(16 * 1024 * 1024)
+
+	err = c.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := c.MinimumSize()
+	if size%BlockSize != 0 || size < 4*1024*1024 {
+		t.Fatalf("bad minimum size: %d", size)
+	}
+
+	err = c.Precompile(ctx, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.RegionIsHole(0, BlockSize) {
+		t.Fatalf("superblock region reported as a hole")
+	}
+
+	w := new(fstest.WriteSeeker)
+	err = c.Compile(ctx, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Pos != size {
+		t.Fatalf("compiled image is %d bytes, expected %d", w.Pos, size)
+	}
+
+	sb := new(Superblock)
+	err = binary.Read(bytes.NewReader(w.Buf[SuperblockOffset:]), binary.LittleEndian, sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sb.Signature != Signature {
+		t.Fatalf("bad superblock signature: %x", sb.Signature)
+	}
+
+	if sb.IncompatibleFeatures&IncompatExtents == 0 || sb.IncompatibleFeatures&Incompat64Bit == 0 {
+		t.Fatalf("superblock is missing ext4 features: %x", sb.IncompatibleFeatures)
+	}
+
+	if sb.CompatibleFeatures&CompatHasJournal == 0 || sb.JournalInode != JournalInode {
+		t.Fatalf("superblock has no journal")
+	}
+
+	if int64(sb.TotalBlocksLo)*BlockSize != size {
+		t.Fatalf("superblock block count is wrong: %d", sb.TotalBlocksLo)
+	}
+
+}
+
+func TestReproducibleCompile(t *testing.T) {
+
+	timestamp := time.Unix(1600000000, 0)
+
+	a := fstest.Reproducible(t, func(tree vio.FileTree, rnd io.Reader, timestamp time.Time) fstest.Compiler {
+		return NewCompiler(&CompilerArgs{
+			FileTree:  tree,
+			Logger:    &elog.CLI{},
+			Rand:      rnd,
+			Timestamp: timestamp,
+		})
+	}, timestamp)
+
+	sb := new(Superblock)
+	err := binary.Read(bytes.NewReader(a[SuperblockOffset:]), binary.LittleEndian, sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sb.MkfsTime != uint32(timestamp.Unix()) {
+		t.Fatalf("superblock has the wrong creation time: %d", sb.MkfsTime)
+	}
+
+}
@@ -0,0 +1,710 @@
+package ext4
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+const lostAndFound = "lost+found"
+
+type node struct {
+	node        *vio.TreeNode
+	ino         int64
+	content     int64
+	fastSymlink bool
+}
+
+type compiler struct {
+	tree   vio.FileTree
+	size   int64
+	nodes  []node
+	layout *layout
+
+	rng        io.Reader
+	timestamp  time.Time
+	uuid       [16]byte
+	hashSeed   [4]uint32
+	now        time.Time
+	superblock Superblock
+	gdt        []GroupDescriptor
+	dirs       []int64
+}
+
+func (c *compiler) ensureLostAndFound() error {
+
+	var found bool
+
+	err := c.tree.Walk(func(path string, f vio.File) error {
+		if path == "." {
+			return nil
+		}
+		if f.Name() == lostAndFound {
+			found = true
+		}
+		if f.IsDir() {
+			return vio.ErrSkip
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if found {
+		return nil
+	}
+
+	return c.tree.Map(lostAndFound, vio.CustomFile(vio.CustomFileArgs{
+		Name:  lostAndFound,
+		IsDir: true,
+	}))
+
+}
+
+func (c *compiler) scanInodes(ctx context.Context) error {
+
+	ino := int64(FirstInode)
+	c.nodes = make([]node, 0)
+
+	err := c.tree.WalkNode(func(path string, n *vio.TreeNode) error {
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		x := node{node: n}
+
+		if path == "." {
+			x.ino = RootDirInode
+		} else {
+			x.ino = ino
+			ino++
+		}
+		n.NodeSequenceNumber = x.ino
+
+		f := n.File
+		if f.IsDir() {
+			x.content = calculateDirectoryBlocks(n)
+		} else if f.IsSymlink() && f.SymlinkIsCached() && len(f.Symlink()) < maxFastSymlinkLength {
+			x.fastSymlink = true
+		} else {
+			x.content = divide(int64(f.Size()), BlockSize)
+		}
+
+		c.nodes = append(c.nodes, x)
+		return nil
+
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+func (c *compiler) usedInodes() int64 {
+	return FirstInode - 1 + int64(len(c.nodes)) - 1
+}
+
+func (c *compiler) nodeInodeGroup(x *node, ipg int64) int64 {
+	return (x.ino - 1) / ipg
+}
+
+// modTime returns the modification time of f, clamped to the compiler's
+// timestamp if it has one.
+func (c *compiler) modTime(f vio.File) time.Time {
+	t := f.ModTime()
+	if !c.timestamp.IsZero() && t.After(c.timestamp) {
+		return c.timestamp
+	}
+	return t
+}
+
+func (c *compiler) generateMetadata() error {
+
+	l := c.layout
+
+	_, err := io.ReadFull(c.rng, c.uuid[:])
+	if err != nil {
+		return err
+	}
+	c.uuid[6] = (c.uuid[6] & 0x0F) | 0x40
+	c.uuid[8] = (c.uuid[8] & 0x3F) | 0x80
+
+	err = binary.Read(c.rng, binary.LittleEndian, &c.hashSeed)
+	if err != nil {
+		return err
+	}
+
+	c.now = time.Now()
+	if !c.timestamp.IsZero() {
+		c.now = c.timestamp
+	}
+
+	c.dirs = make([]int64, l.groups)
+	for i := range c.nodes {
+		if c.nodes[i].node.File.IsDir() {
+			c.dirs[c.nodeInodeGroup(&c.nodes[i], l.inodesPerGroup)]++
+		}
+	}
+
+	c.generateGDT()
+	c.initSuperblock()
+
+	return nil
+
+}
+
+func (c *compiler) groupUnallocatedInodes(g int64) int64 {
+
+	l := c.layout
+	used := c.usedInodes() - g*l.inodesPerGroup
+	if used < 0 {
+		used = 0
+	} else if used > l.inodesPerGroup {
+		used = l.inodesPerGroup
+	}
+
+	return l.inodesPerGroup - used
+
+}
+
+func (c *compiler) generateGDT() {
+
+	l := c.layout
+	c.gdt = make([]GroupDescriptor, l.groups)
+
+	for g := int64(0); g < l.groups; g++ {
+		blocks := l.groupBlocks(g) - l.alloc.count(g*BlocksPerGroup, l.groupBlocks(g))
+		inodes := c.groupUnallocatedInodes(g)
+		c.gdt[g] = GroupDescriptor{
+			BlockBitmapLo:       lo32(l.blockBitmaps[g]),
+			BlockBitmapHi:       hi32(l.blockBitmaps[g]),
+			InodeBitmapLo:       lo32(l.inodeBitmaps[g]),
+			InodeBitmapHi:       hi32(l.inodeBitmaps[g]),
+			InodeTableLo:        lo32(l.inodeTables[g]),
+			InodeTableHi:        hi32(l.inodeTables[g]),
+			UnallocatedBlocksLo: lo16(blocks),
+			UnallocatedBlocksHi: hi16(blocks),
+			UnallocatedInodesLo: lo16(inodes),
+			UnallocatedInodesHi: hi16(inodes),
+			DirectoriesLo:       lo16(c.dirs[g]),
+			DirectoriesHi:       hi16(c.dirs[g]),
+		}
+	}
+
+}
+
+func (c *compiler) initSuperblock() {
+
+	l := c.layout
+	now := uint32(c.now.Unix())
+	sb := &c.superblock
+
+	sb.TotalInodes = uint32(l.inodesPerGroup * l.groups)
+	sb.TotalBlocksLo = lo32(l.blocks)
+	sb.TotalBlocksHi = hi32(l.blocks)
+	sb.UnallocatedBlocksLo = lo32(l.unallocatedBlock)
+	sb.UnallocatedBlocksHi = hi32(l.unallocatedBlock)
+	sb.UnallocatedInodes = uint32(l.inodesPerGroup*l.groups - c.usedInodes())
+	sb.BlockSize = 2
+	sb.ClusterSize = 2
+	sb.BlocksPerGroup = BlocksPerGroup
+	sb.ClustersPerGroup = BlocksPerGroup
+	sb.InodesPerGroup = uint32(l.inodesPerGroup)
+	sb.LastWrittenTime = now
+	sb.MountsCheckInterval = 0xFFFF
+	sb.Signature = Signature
+	sb.State = 1
+	sb.ErrorProtocol = 1
+	sb.TimeLastCheck = now
+	sb.VersionMajor = 1
+	sb.FirstInode = FirstInode
+	sb.InodeSize = InodeSize
+	sb.CompatibleFeatures = compatFeatures
+	sb.IncompatibleFeatures = incompatFeatures
+	sb.ReadOnlyFeatures = roCompatFeatures
+	sb.UUID = c.uuid
+	sb.HashSeed = c.hashSeed
+	sb.DefaultHashVersion = DefaultHashHalfMD4
+	sb.DescriptorSize = GroupDescriptorSize
+	sb.MkfsTime = now
+	sb.MinExtraInodeSize = InodeExtraSize
+	sb.WantExtraInodeSize = InodeExtraSize
+	sb.Flags = FlagSignedDirHash
+	sb.LogGroupsPerFlex = LogGroupsPerFlex
+
+	if l.journalBlocks > 0 {
+		sb.CompatibleFeatures |= CompatHasJournal
+		sb.JournalInode = JournalInode
+		sb.JournalBackupType = JournalBackupBlocks
+
+		inode := c.journalInode()
+		data := make([]uint32, 15)
+		_ = binary.Read(bytes.NewReader(inode.Block[:]), binary.LittleEndian, data)
+		copy(sb.JournalBlocks[:], data)
+		sb.JournalBlocks[15] = inode.SizeUpper
+		sb.JournalBlocks[16] = inode.SizeLower
+	}
+
+}
+
+func (c *compiler) regionIsHole(begin, size int64) bool {
+
+	first := begin / BlockSize
+	last := (begin + size - 1) / BlockSize
+
+	for bno := first; bno <= last; bno++ {
+		if c.layout.dirty.get(bno) {
+			return false
+		}
+	}
+
+	return true
+
+}
+
+func setExtents(inode *Inode, nl *nodeLayout) {
+
+	buf := new(bytes.Buffer)
+
+	if len(nl.leaves) == 0 {
+		_ = binary.Write(buf, binary.LittleEndian, &ExtentHeader{
+			Magic:   ExtentMagic,
+			Entries: uint16(len(nl.extents)),
+			Max:     extentsPerInode,
+		})
+		_ = binary.Write(buf, binary.LittleEndian, nl.extents)
+	} else {
+		_ = binary.Write(buf, binary.LittleEndian, &ExtentHeader{
+			Magic:   ExtentMagic,
+			Entries: uint16(len(nl.leaves)),
+			Max:     extentsPerInode,
+			Depth:   1,
+		})
+		for i, leaf := range nl.leaves {
+			_ = binary.Write(buf, binary.LittleEndian, &ExtentIndex{
+				Block:  nl.extents[i*extentsPerBlock].Block,
+				LeafLo: lo32(leaf),
+				LeafHi: uint16(hi32(leaf)),
+			})
+		}
+	}
+
+	copy(inode.Block[:], buf.Bytes())
+	inode.Flags |= InodeFlagExtents
+
+}
+
+func setSize(inode *Inode, size int64) {
+	inode.SizeLower = lo32(size)
+	inode.SizeUpper = hi32(size)
+}
+
+func setSectors(inode *Inode, blocks int64) {
+	sectors := blocks * (BlockSize / SectorSize)
+	inode.SectorsLower = lo32(sectors)
+	inode.SectorsUpper = uint16(hi32(sectors))
+}
+
+func setTimes(inode *Inode, t uint32) {
+	inode.LastAccessTime = t
+	inode.ChangeTime = t
+	inode.ModificationTime = t
+	inode.CreationTime = t
+}
+
+func (c *compiler) journalInode() *Inode {
+
+	l := c.layout
+	inode := &Inode{
+		Permissions: inodeJournalMode,
+		Links:       1,
+		ExtraSize:   InodeExtraSize,
+	}
+
+	setSize(inode, l.journalBlocks*BlockSize)
+	setSectors(inode, l.journal.blocks)
+	setExtents(inode, &l.journal)
+	setTimes(inode, uint32(c.now.Unix()))
+
+	return inode
+
+}
+
+func directoryLinks(n *vio.TreeNode) uint16 {
+
+	links := 2
+	for _, child := range n.Children {
+		if child.File.IsDir() {
+			links++
+		}
+	}
+
+	if links >= maxDirLinks {
+		return 1
+	}
+
+	return uint16(links)
+
+}
+
+func (c *compiler) nodeInode(x *node, nl *nodeLayout) *Inode {
+
+	f := x.node.File
+	perms, uid, gid := ext.InodeAttributes(f)
+	inode := &Inode{
+		UID:       uint16(uid),
+		GID:       uint16(gid),
+		UIDUpper:  uint16(uid >> 16),
+		GIDUpper:  uint16(gid >> 16),
+		Links:     1,
+		ExtraSize: InodeExtraSize,
+	}
+
+	switch {
+	case f.IsDir():
+		inode.Permissions = ext.InodeTypeDirectory | perms
+		inode.Links = directoryLinks(x.node)
+		setSize(inode, x.content*BlockSize)
+	case f.IsSymlink():
+		inode.Permissions = ext.InodeTypeSymlink | perms
+		setSize(inode, int64(f.Size()))
+	default:
+		inode.Permissions = ext.InodeTypeRegularFile | perms
+		setSize(inode, int64(f.Size()))
+	}
+
+	if x.fastSymlink {
+		copy(inode.Block[:], f.Symlink())
+		setSize(inode, int64(len(f.Symlink())))
+	} else {
+		setExtents(inode, nl)
+		setSectors(inode, nl.blocks)
+	}
+
+	setTimes(inode, unixTime(c.modTime(f)))
+
+	return inode
+
+}
+
+func (c *compiler) inodeByNumber(ino int64) *Inode {
+
+	if ino == JournalInode && c.layout.journalBlocks > 0 {
+		return c.journalInode()
+	}
+
+	var idx int64
+	switch {
+	case ino == RootDirInode:
+		idx = 0
+	case ino >= FirstInode && ino <= c.usedInodes():
+		idx = ino - FirstInode + 1
+	default:
+		return nil
+	}
+
+	return c.nodeInode(&c.nodes[idx], &c.layout.nodes[idx])
+
+}
+
+// region is a piece of the file-system image that needs to be written out.
+// Regions are sorted by their location and written in order so that the
+// compiler never needs to seek backwards.
+type region struct {
+	block  int64
+	offset int64
+	write  func(w io.Writer) error
+}
+
+func (c *compiler) superblockRegions(g int64) []region {
+
+	l := c.layout
+
+	var offset int64
+	if g == 0 {
+		offset = SuperblockOffset
+	}
+
+	sb := c.superblock
+	sb.BlockGroupNumber = uint16(g)
+
+	return []region{{
+		block:  g * BlocksPerGroup,
+		offset: offset,
+		write: func(w io.Writer) error {
+			return binary.Write(w, binary.LittleEndian, &sb)
+		},
+	}, {
+		block: g*BlocksPerGroup + 1,
+		write: func(w io.Writer) error {
+			buf := new(bytes.Buffer)
+			_ = binary.Write(buf, binary.LittleEndian, c.gdt)
+			_, err := io.CopyN(buf, vio.Zeroes, l.blocksPerGDT*BlockSize-int64(buf.Len()))
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(buf.Bytes())
+			return err
+		},
+	}}
+
+}
+
+func (c *compiler) writeBlockBitmap(w io.Writer, g int64) error {
+	first := g * BlocksPerGroup / 64
+	return binary.Write(w, binary.LittleEndian, c.layout.alloc[first:first+BlocksPerGroup/64])
+}
+
+func (c *compiler) writeInodeBitmap(w io.Writer, g int64) error {
+
+	l := c.layout
+	bm := newBitmap(MaxInodesPerGroup)
+
+	used := l.inodesPerGroup - c.groupUnallocatedInodes(g)
+	bm.setRange(0, used)
+
+	// padding at the end of the bitmap must be set
+	bm.setRange(l.inodesPerGroup, MaxInodesPerGroup-l.inodesPerGroup)
+
+	return binary.Write(w, binary.LittleEndian, bm)
+
+}
+
+func (c *compiler) writeInodeTable(w io.Writer, g int64) error {
+
+	l := c.layout
+	empty := new(Inode)
+
+	for i := int64(1); i <= l.inodesPerGroup; i++ {
+
+		ino := g*l.inodesPerGroup + i
+		if ino > c.usedInodes() {
+			break
+		}
+
+		inode := c.inodeByNumber(ino)
+		if inode == nil {
+			inode = empty
+		}
+
+		err := binary.Write(w, binary.LittleEndian, inode)
+		if err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
+
+func (c *compiler) groupRegions(g int64) []region {
+
+	l := c.layout
+	return []region{{
+		block: l.blockBitmaps[g],
+		write: func(w io.Writer) error { return c.writeBlockBitmap(w, g) },
+	}, {
+		block: l.inodeBitmaps[g],
+		write: func(w io.Writer) error { return c.writeInodeBitmap(w, g) },
+	}, {
+		block: l.inodeTables[g],
+		write: func(w io.Writer) error { return c.writeInodeTable(w, g) },
+	}}
+
+}
+
+func leafRegions(nl *nodeLayout) []region {
+
+	var regions []region
+
+	for i, leaf := range nl.leaves {
+		first := i * extentsPerBlock
+		last := first + extentsPerBlock
+		if last > len(nl.extents) {
+			last = len(nl.extents)
+		}
+		extents := nl.extents[first:last]
+		regions = append(regions, region{
+			block: leaf,
+			write: func(w io.Writer) error {
+				buf := new(bytes.Buffer)
+				_ = binary.Write(buf, binary.LittleEndian, &ExtentHeader{
+					Magic:   ExtentMagic,
+					Entries: uint16(len(extents)),
+					Max:     extentsPerBlock,
+				})
+				_ = binary.Write(buf, binary.LittleEndian, extents)
+				_, _ = io.CopyN(buf, vio.Zeroes, BlockSize-int64(buf.Len()))
+				_, err := w.Write(buf.Bytes())
+				return err
+			},
+		})
+	}
+
+	return regions
+
+}
+
+// dataStream tracks the sequential consumption of file contents across all
+// of the extents belonging to the nodes in the file-system.
+type dataStream struct {
+	c      *compiler
+	next   int
+	active int
+	r      io.Reader
+}
+
+func (s *dataStream) advance(idx int) error {
+
+	for s.next <= idx {
+		if s.next > 0 {
+			err := s.c.nodes[s.next-1].node.File.Close()
+			if err != nil {
+				return err
+			}
+		}
+
+		x := &s.c.nodes[s.next]
+		if x.node.File.IsDir() {
+			s.r = bytes.NewReader(generateDirectoryData(x.node))
+		} else {
+			s.r = x.node.File
+		}
+
+		s.active = s.next
+		s.next++
+	}
+
+	return nil
+
+}
+
+func (s *dataStream) finish() error {
+
+	first := s.next - 1
+	if first < 0 {
+		first = 0
+	}
+
+	for i := first; i < len(s.c.nodes); i++ {
+		err := s.c.nodes[i].node.File.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+func (s *dataStream) region(idx int, e Extent) region {
+	return region{
+		block: extentStart(e),
+		write: func(w io.Writer) error {
+
+			err := s.advance(idx)
+			if err != nil {
+				return err
+			}
+
+			length := int64(e.Len) * BlockSize
+			k, err := io.CopyN(w, s.r, length)
+			if err != nil && err != io.EOF {
+				return err
+			}
+
+			_, err = io.CopyN(w, vio.Zeroes, length-k)
+			return err
+
+		},
+	}
+}
+
+func (c *compiler) journalRegion() region {
+
+	l := c.layout
+
+	return region{
+		block: extentStart(l.journal.extents[0]),
+		write: func(w io.Writer) error {
+			return writeJournalSuperblock(w, l.journalBlocks, c.uuid)
+		},
+	}
+
+}
+
+func (c *compiler) regions(s *dataStream) []region {
+
+	l := c.layout
+	var regions []region
+
+	for g := int64(0); g < l.groups; g++ {
+		if groupHasSuperblock(g) {
+			regions = append(regions, c.superblockRegions(g)...)
+		}
+		regions = append(regions, c.groupRegions(g)...)
+	}
+
+	if l.journalBlocks > 0 {
+		regions = append(regions, leafRegions(&l.journal)...)
+		regions = append(regions, c.journalRegion())
+	}
+
+	for i := range c.nodes {
+		nl := &l.nodes[i]
+		regions = append(regions, leafRegions(nl)...)
+		for _, e := range nl.extents {
+			regions = append(regions, s.region(i, e))
+		}
+	}
+
+	sort.SliceStable(regions, func(i, j int) bool {
+		return regions[i].block < regions[j].block
+	})
+
+	return regions
+
+}
+
+func (c *compiler) writeRegions(ctx context.Context, w io.WriteSeeker) error {
+
+	s := &dataStream{c: c}
+
+	for _, r := range c.regions(s) {
+
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Seek(r.block*BlockSize+r.offset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		err = r.write(w)
+		if err != nil {
+			return err
+		}
+
+	}
+
+	return s.finish()
+
+}
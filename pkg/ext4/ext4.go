@@ -0,0 +1,247 @@
+package ext4
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// CompilerArgs organizes all inputs necessary to create a new Compiler. Because
+// the compiler is designed to be configured in stages by the caller very little
+// goes here.
+type CompilerArgs struct {
+	FileTree vio.FileTree
+	Logger   elog.Logger
+
+	// Rand, if set, replaces crypto/rand as the source of the file-system's
+	// UUID and any other random values, so that builds can be reproduced.
+	Rand io.Reader
+
+	// Timestamp, if set, is used in place of the current time, and clamps
+	// the modification time of every file so that none are later than it.
+	Timestamp time.Time
+}
+
+// Compiler keeps all variables and settings for a single ext4 file-system
+// compile operation. It follows the same staged approach as the ext2 compiler:
+// NewCompiler, Commit, Precompile, Compile. Unlike the ext2 compiler it maps
+// file contents using extents, packs group metadata using flex_bg, supports
+// 64-bit block numbers, and includes an internal journal.
+type Compiler struct {
+	log elog.Logger
+
+	minFreeInodes  int64
+	minFreeSpace   int64
+	minInodes      int64
+	minInodesPer64 int64
+	minSize        int64
+
+	compiler
+}
+
+// NewCompiler returns an initialized Compiler object. The next necessary step
+// is to call Commit on this Compiler, but before doing so it is possible to
+// modify its contents with functions like Mkdir, AddFile, and
+// IncreaseMinimumInodes (to name a few).
+func NewCompiler(args *CompilerArgs) *Compiler {
+	c := new(Compiler)
+	c.tree = args.FileTree
+	c.log = args.Logger
+	c.rng = args.Rand
+	if c.rng == nil {
+		c.rng = rand.Reader
+	}
+	c.timestamp = args.Timestamp
+	return c
+}
+
+// Mkdir allows the caller to add an empty directory to the file-system at
+// 'path' if no file or directory is already mapped there. This function must
+// be called before calling Commit, otherwise the behaviour is undefined.
+func (c *Compiler) Mkdir(path string) error {
+
+	_, base := filepath.Split(path)
+	err := c.tree.Map(path, vio.CustomFile(vio.CustomFileArgs{
+		Name:  base,
+		IsDir: true,
+	}))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddFile allows the caller to add a file to the file-system at 'path',
+// resolving any collisions by overwriting them if 'force' is true. This
+// function must be called before calling Commit, otherwise the behaviour is
+// undefined.
+func (c *Compiler) AddFile(path string, r io.ReadCloser, size int64, force bool) error {
+
+	_, base := filepath.Split(path)
+	err := c.tree.Map(path, vio.CustomFile(vio.CustomFileArgs{
+		Name:       base,
+		Size:       int(size),
+		ReadCloser: r,
+	}))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// IncreaseMinimumInodes allows the caller to force in some extra empty inodes
+// on top of whatever would have otherwise been there. This function can only be
+// called before calling Commit, otherwise the behaviour is undefined.
+func (c *Compiler) IncreaseMinimumInodes(inodes int64) {
+	c.minFreeInodes += inodes
+}
+
+// SetMinimumInodes allows the caller to specify the minimum number of inodes
+// that should be built onto the file-system. This function can only be called
+// before calling Commit, otherwise the behaviour is undefined.
+func (c *Compiler) SetMinimumInodes(inodes int64) {
+	c.minInodes = inodes
+}
+
+// SetMinimumInodesPer64MiB allows the caller to impose some minimum number of
+// inodes relative to the total file-system image size. This function can only
+// be called before calling Commit, otherwise the behaviour is undefined.
+func (c *Compiler) SetMinimumInodesPer64MiB(inodes int64) {
+	c.minInodesPer64 = inodes
+}
+
+// IncreaseMinimumFreeSpace allows the caller to add a minimum amount of extra
+// free space to the file-system image in bytes.
+func (c *Compiler) IncreaseMinimumFreeSpace(space int64) {
+	c.minFreeSpace += space
+}
+
+// Commit is the second of the four steps necessary to compile a file-system
+// image, and should be called sometime after NewCompiler and before Precompile.
+// It is responsible for locking-in the contents of the file-system and
+// searching for the minimum size that can hold them. Any calls to functions
+// that change the contents or capacity of the file-system must be done before
+// this function is called.
+func (c *Compiler) Commit(ctx context.Context) error {
+
+	err := c.ensureLostAndFound()
+	if err != nil {
+		return err
+	}
+
+	err = c.scanInodes(ctx)
+	if err != nil {
+		return err
+	}
+
+	minInodes := c.usedInodes() - FirstInode + 1
+	minInodes += c.minFreeInodes
+	if c.minInodes < minInodes {
+		c.minInodes = minInodes
+	}
+
+	blocks, err := minimumBlocks(c.planArgs(0))
+	if err != nil {
+		return err
+	}
+
+	c.minSize = blocks * BlockSize
+
+	return nil
+
+}
+
+func (c *Compiler) planArgs(blocks int64) *planArgs {
+
+	content := make([]int64, len(c.nodes))
+	for i := range c.nodes {
+		content[i] = c.nodes[i].content
+	}
+
+	return &planArgs{
+		blocks:        blocks,
+		minInodes:     c.minInodes,
+		minPer64:      c.minInodesPer64,
+		minFreeBlocks: divide(c.minFreeSpace, BlockSize),
+		usedInodes:    c.usedInodes(),
+		content:       content,
+	}
+
+}
+
+// MinimumSize returns the minimum number of bytes needed to contain the
+// file-system image. It can be called after a successful call to Commit.
+func (c *Compiler) MinimumSize() int64 {
+	return c.minSize
+}
+
+// Precompile locks in the file-system size and computes the entire structure of
+// the final file-system image so that RegionIsHole can be used. It must be
+// called only after a successful Commit and is necessary before calling the
+// final function: Compile.
+func (c *Compiler) Precompile(ctx context.Context, size int64) error {
+
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	c.size = size
+
+	c.layout, err = plan(c.planArgs(size / BlockSize))
+	if err != nil {
+		return err
+	}
+
+	err = c.generateMetadata()
+	if err != nil {
+		return err
+	}
+
+	c.log.Debugf("Total Inodes:  %v", c.layout.inodesPerGroup*c.layout.groups)
+
+	return nil
+
+}
+
+// RegionIsHole can be called after a successful Precompile. Its purpose is to
+// provide advance notice to sparse disk image formatting logic on regions
+// within the image that will be completely empty. The two args are measured in
+// bytes, and the function returns true if every byte starting at begin and
+// continuing for the full size is zeroed.
+func (c *Compiler) RegionIsHole(begin, size int64) bool {
+	return c.regionIsHole(begin, size)
+}
+
+// Compile is the final operation performed by the Compiler, and should only be
+// called after a successful call to the Precompile function. It writes the
+// file-system to the provided io.WriteSeeker, w, without ever seeking
+// backwards.
+func (c *Compiler) Compile(ctx context.Context, w io.WriteSeeker) error {
+
+	err := c.writeRegions(ctx, w)
+	if err != nil {
+		return err
+	}
+
+	// seek to the end of the image
+	_, err = w.Seek(c.size, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
@@ -0,0 +1,67 @@
+package ext4
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Journal (jbd2) constants. Unlike the rest of the file-system, the journal
+// is stored big-endian.
+const (
+	JournalMagic        = 0xC03B3998
+	JournalSuperblockV2 = 4
+)
+
+// JournalSuperblock is the structure of the superblock found in the first
+// block of the journal.
+type JournalSuperblock struct {
+	Magic             uint32
+	BlockType         uint32
+	Sequence          uint32
+	BlockSize         uint32
+	MaxLength         uint32
+	First             uint32
+	FirstSequence     uint32
+	Start             uint32
+	Errno             int32
+	CompatFeatures    uint32
+	IncompatFeatures  uint32
+	ROCompatFeatures  uint32
+	UUID              [16]byte
+	Users             uint32
+	DynamicSuperblock uint32
+	MaxTransaction    uint32
+	MaxTransData      uint32
+	ChecksumType      uint8
+	_                 [3]byte
+	_                 [0xA8]byte
+	Checksum          uint32
+	UserIDs           [768]byte
+}
+
+func writeJournalSuperblock(w io.Writer, blocks int64, uuid [16]byte) error {
+
+	jsb := &JournalSuperblock{
+		Magic:         JournalMagic,
+		BlockType:     JournalSuperblockV2,
+		BlockSize:     BlockSize,
+		MaxLength:     uint32(blocks),
+		First:         1,
+		FirstSequence: 1,
+		UUID:          uuid,
+		Users:         1,
+	}
+
+	err := binary.Write(w, binary.BigEndian, jsb)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
@@ -0,0 +1,487 @@
+package ext4
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+var errInsufficientSpace = errors.New("insufficient size to satisfy minimum data capacity requirements")
+
+type bitmap []uint64
+
+func newBitmap(bits int64) bitmap {
+	return make(bitmap, divide(bits, 64))
+}
+
+func (b bitmap) set(i int64) {
+	b[i/64] |= 1 << uint(i%64)
+}
+
+func (b bitmap) get(i int64) bool {
+	if int(i/64) >= len(b) {
+		return false
+	}
+	return b[i/64]&(1<<uint(i%64)) != 0
+}
+
+func (b bitmap) setRange(first, length int64) {
+	for i := first; i < first+length; i++ {
+		b.set(i)
+	}
+}
+
+func (b bitmap) count(first, length int64) int64 {
+	var n int64
+	for i := first; i < first+length; {
+		if i%64 == 0 && i+64 <= first+length {
+			n += int64(bits.OnesCount64(b[i/64]))
+			i += 64
+			continue
+		}
+		if b.get(i) {
+			n++
+		}
+		i++
+	}
+	return n
+}
+
+// run is a contiguous range of physical blocks.
+type run struct {
+	start  int64
+	length int64
+}
+
+// nodeLayout records where on disk the data belonging to a single inode ends
+// up once the file-system has been planned.
+type nodeLayout struct {
+	leaves  []int64
+	extents []Extent
+	blocks  int64
+}
+
+// layout is the product of planning a file-system of a specific size. It is
+// calculated during Commit to find the minimum size, and again during
+// Precompile to lock in the final structure.
+type layout struct {
+	blocks           int64
+	groups           int64
+	inodesPerGroup   int64
+	blocksPerGDT     int64
+	blocksPerITable  int64
+	journalBlocks    int64
+	blockBitmaps     []int64
+	inodeBitmaps     []int64
+	inodeTables      []int64
+	alloc            bitmap // blocks that are in use
+	dirty            bitmap // blocks that contain non-zero data
+	cursor           int64
+	journal          nodeLayout
+	nodes            []nodeLayout
+	unallocatedBlock int64
+}
+
+func (l *layout) groupBlocks(g int64) int64 {
+	if g == l.groups-1 {
+		return l.blocks - g*BlocksPerGroup
+	}
+	return BlocksPerGroup
+}
+
+func (l *layout) reserve(first, length int64, dirty bool) {
+	l.alloc.setRange(first, length)
+	if dirty {
+		l.dirty.setRange(first, length)
+	}
+}
+
+// scan walks forward from 'from' looking for 'n' free blocks, without
+// claiming them. It returns the runs it found and the block immediately after
+// the last one.
+func (l *layout) scan(from, n int64) ([]run, int64, error) {
+
+	var runs []run
+	pos := from
+
+	for n > 0 {
+
+		for pos < l.blocks && l.alloc.get(pos) {
+			pos++
+		}
+
+		if pos >= l.blocks {
+			return nil, 0, errInsufficientSpace
+		}
+
+		r := run{start: pos}
+		for pos < l.blocks && n > 0 && !l.alloc.get(pos) {
+			r.length++
+			pos++
+			n--
+		}
+
+		runs = append(runs, r)
+
+	}
+
+	return runs, pos, nil
+
+}
+
+// contiguous finds the first run of 'n' free blocks starting at or after
+// 'from', without claiming them.
+func (l *layout) contiguous(from, n int64) (int64, error) {
+
+	start := from
+	for {
+		if start+n > l.blocks {
+			return 0, errInsufficientSpace
+		}
+
+		ok := true
+		for i := start; i < start+n; i++ {
+			if l.alloc.get(i) {
+				start = i + 1
+				ok = false
+				break
+			}
+		}
+
+		if ok {
+			return start, nil
+		}
+	}
+
+}
+
+func splitExtents(runs []run) []Extent {
+
+	var extents []Extent
+	var logical int64
+
+	for _, r := range runs {
+		for off := int64(0); off < r.length; off += maxExtentLength {
+			length := r.length - off
+			if length > maxExtentLength {
+				length = maxExtentLength
+			}
+			start := r.start + off
+			extents = append(extents, Extent{
+				Block:   uint32(logical),
+				Len:     uint16(length),
+				StartHi: uint16(hi32(start)),
+				StartLo: lo32(start),
+			})
+			logical += length
+		}
+	}
+
+	return extents
+
+}
+
+func leavesNeeded(extents int) (int64, error) {
+
+	if extents <= extentsPerInode {
+		return 0, nil
+	}
+
+	leaves := divide(int64(extents), extentsPerBlock)
+	if leaves > extentsPerInode {
+		return 0, errors.New("file too fragmented for a two-level extent tree")
+	}
+
+	return leaves, nil
+
+}
+
+// allocate claims blocks for a file's data and any extent tree blocks needed
+// to index it. Blocks are claimed sequentially from the layout cursor so that
+// the data can be streamed to disk in the same order it is planned. If dirty
+// is false the data blocks are expected to be left empty.
+func (l *layout) allocate(content int64, dirty bool) (nodeLayout, error) {
+
+	var nl nodeLayout
+	if content == 0 {
+		return nl, nil
+	}
+
+	var leaves int64
+	for {
+		leafRuns, pos, err := l.scan(l.cursor, leaves)
+		if err != nil {
+			return nl, err
+		}
+
+		dataRuns, end, err := l.scan(pos, content)
+		if err != nil {
+			return nl, err
+		}
+
+		extents := splitExtents(dataRuns)
+		need, err := leavesNeeded(len(extents))
+		if err != nil {
+			return nl, err
+		}
+
+		if need > leaves {
+			leaves = need
+			continue
+		}
+
+		for _, r := range leafRuns {
+			for i := int64(0); i < r.length; i++ {
+				nl.leaves = append(nl.leaves, r.start+i)
+			}
+			l.reserve(r.start, r.length, true)
+		}
+
+		for _, r := range dataRuns {
+			l.reserve(r.start, r.length, dirty)
+		}
+
+		nl.extents = extents
+		nl.blocks = content + leaves
+		l.cursor = end
+		return nl, nil
+	}
+
+}
+
+type planArgs struct {
+	blocks        int64
+	minInodes     int64
+	minPer64      int64
+	minFreeBlocks int64
+	usedInodes    int64
+	content       []int64
+}
+
+func (l *layout) setGeometry(args *planArgs) error {
+
+	l.blocks = args.blocks
+	l.groups = divide(l.blocks, BlocksPerGroup)
+	if l.groups == 0 {
+		return errInsufficientSpace
+	}
+
+retry:
+	l.inodesPerGroup = divide(args.minInodes, l.groups)
+
+	// each block group is 128 MiB, so we double the per64 value if it's set
+	if l.inodesPerGroup < args.minPer64*2 {
+		l.inodesPerGroup = args.minPer64 * 2
+	}
+
+	l.inodesPerGroup = align(l.inodesPerGroup, InodesPerBlock)
+	if l.inodesPerGroup > MaxInodesPerGroup {
+		return errInsufficientSpace
+	}
+
+	l.blocksPerGDT = divide(l.groups*GroupDescriptorSize, BlockSize)
+	l.blocksPerITable = l.inodesPerGroup / InodesPerBlock
+
+	// drop the final block group if it's too small to be worth the overhead
+	if x := l.blocks % BlocksPerGroup; x > 0 && l.groups > 1 {
+		overhead := 2 + l.blocksPerITable + minimumGroupDataSpare
+		if groupHasSuperblock(l.groups - 1) {
+			overhead += 1 + l.blocksPerGDT
+		}
+		if x < overhead {
+			l.groups--
+			l.blocks = l.groups * BlocksPerGroup
+			goto retry
+		}
+	}
+
+	if l.groups*l.inodesPerGroup < args.usedInodes {
+		return errInsufficientSpace
+	}
+
+	l.journalBlocks = defaultJournalBlocks(l.blocks)
+
+	return nil
+
+}
+
+func (l *layout) placeFlexMetadata() error {
+
+	var err error
+
+	l.blockBitmaps = make([]int64, l.groups)
+	l.inodeBitmaps = make([]int64, l.groups)
+	l.inodeTables = make([]int64, l.groups)
+
+	for fg := int64(0); fg < l.groups; fg += GroupsPerFlex {
+
+		n := int64(GroupsPerFlex)
+		if fg+n > l.groups {
+			n = l.groups - fg
+		}
+
+		pos := fg * BlocksPerGroup
+
+		for g := fg; g < fg+n; g++ {
+			pos, err = l.contiguous(pos, 1)
+			if err != nil {
+				return err
+			}
+			l.blockBitmaps[g] = pos
+			l.reserve(pos, 1, true)
+		}
+
+		for g := fg; g < fg+n; g++ {
+			pos, err = l.contiguous(pos, 1)
+			if err != nil {
+				return err
+			}
+			l.inodeBitmaps[g] = pos
+			l.reserve(pos, 1, true)
+		}
+
+		for g := fg; g < fg+n; g++ {
+			pos, err = l.contiguous(pos, l.blocksPerITable)
+			if err != nil {
+				return err
+			}
+			l.inodeTables[g] = pos
+			l.reserve(pos, l.blocksPerITable, false)
+		}
+
+	}
+
+	return nil
+
+}
+
+func (l *layout) markUsedInodeTables(usedInodes int64) {
+
+	for g := int64(0); g < l.groups; g++ {
+		used := usedInodes - g*l.inodesPerGroup
+		if used <= 0 {
+			break
+		}
+		if used > l.inodesPerGroup {
+			used = l.inodesPerGroup
+		}
+		l.dirty.setRange(l.inodeTables[g], divide(used, InodesPerBlock))
+	}
+
+}
+
+// plan computes the complete structure of a file-system with the given
+// number of blocks, returning errInsufficientSpace if it cannot satisfy all
+// of the requirements.
+func plan(args *planArgs) (*layout, error) {
+
+	l := new(layout)
+
+	err := l.setGeometry(args)
+	if err != nil {
+		return nil, err
+	}
+
+	l.alloc = newBitmap(l.groups * BlocksPerGroup)
+	l.dirty = newBitmap(l.groups * BlocksPerGroup)
+
+	for g := int64(0); g < l.groups; g++ {
+		if groupHasSuperblock(g) {
+			l.reserve(g*BlocksPerGroup, 1+l.blocksPerGDT, true)
+		}
+	}
+
+	err = l.placeFlexMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	l.markUsedInodeTables(args.usedInodes)
+
+	if l.journalBlocks > 0 {
+		l.journal, err = l.allocate(l.journalBlocks, false)
+		if err != nil {
+			return nil, err
+		}
+
+		// only the journal superblock has any content
+		l.dirty.set(extentStart(l.journal.extents[0]))
+	}
+
+	l.nodes = make([]nodeLayout, len(args.content))
+	for i, content := range args.content {
+		l.nodes[i], err = l.allocate(content, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// mark the padding bits past the end of the final group
+	for bno := l.blocks; bno < l.groups*BlocksPerGroup; bno++ {
+		l.alloc.set(bno)
+	}
+
+	l.unallocatedBlock = l.blocks - l.alloc.count(0, l.blocks)
+	if l.unallocatedBlock < args.minFreeBlocks {
+		return nil, errInsufficientSpace
+	}
+
+	return l, nil
+
+}
+
+func extentStart(e Extent) int64 {
+	return int64(e.StartLo) | int64(e.StartHi)<<32
+}
+
+// minimumBlocks searches for the smallest number of blocks that satisfies the
+// planning requirements.
+func minimumBlocks(args *planArgs) (int64, error) {
+
+	var total int64
+	for _, x := range args.content {
+		total += x
+	}
+
+	lo := int64(0)
+	hi := total + args.minFreeBlocks + 64
+
+	for {
+		a := *args
+		a.blocks = hi
+		_, err := plan(&a)
+		if err == nil {
+			break
+		}
+		if err != errInsufficientSpace {
+			return 0, err
+		}
+		lo = hi
+		hi *= 2
+		if hi > 1<<48 {
+			return 0, fmt.Errorf("file-system requirements cannot be satisfied: %w", err)
+		}
+	}
+
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		a := *args
+		a.blocks = mid
+		_, err := plan(&a)
+		if err == nil {
+			hi = mid
+		} else if err == errInsufficientSpace {
+			lo = mid
+		} else {
+			return 0, err
+		}
+	}
+
+	return hi, nil
+
+}
@@ -43,9 +43,13 @@ func FSImageFile(vorteilImage *vdecompiler.IO) (FSFileReport, error) {
 		return fsOut, err
 	}
 
+	fsOut.Type, err = vorteilImage.FilesystemType()
+	if err != nil {
+		return fsOut, err
+	}
+
 	fsOut.FirstLBA = int(entry.FirstLBA)
 	fsOut.LastLBA = int(entry.LastLBA)
-	fsOut.Type = "ext2"
 	fsOut.BlockSize = 1024 << int(sb.BlockSize)
 	fsOut.BlocksAllocated = int(sb.TotalBlocks - sb.UnallocatedBlocks)
 	fsOut.BlocksAvaliable = int(sb.TotalBlocks)
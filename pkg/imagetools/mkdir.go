@@ -0,0 +1,54 @@
+package imagetools
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+)
+
+// MkdirImageFile creates a directory at imageFilePath inside the vorteilImage. If parents is true
+// any missing parent directories are created too, and it is not an error for the directory to
+// already exist. The vorteilImage must have been opened with vdecompiler.OpenWritable.
+func MkdirImageFile(vorteilImage *vdecompiler.IO, imageFilePath string, parents bool) error {
+
+	imageFilePath = path.Join("/", filepath.ToSlash(imageFilePath))
+	mode := os.FileMode(ext.DefaultInodePermissions)
+
+	if !parents {
+		return vorteilImage.Mkdir(imageFilePath, mode)
+	}
+
+	var dir string
+	for _, elem := range strings.Split(strings.TrimPrefix(imageFilePath, "/"), "/") {
+		dir = path.Join("/", dir, elem)
+
+		ino, err := vorteilImage.ResolvePathToInodeNo(dir)
+		if err != nil {
+			err = vorteilImage.Mkdir(dir, mode)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		inode, err := vorteilImage.ResolveInode(ino)
+		if err != nil {
+			return err
+		}
+
+		if !vdecompiler.InodeIsDirectory(inode) {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: os.ErrExist}
+		}
+	}
+
+	return nil
+}
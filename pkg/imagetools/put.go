@@ -0,0 +1,82 @@
+package imagetools
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+)
+
+// PutImageFile copies the file or directory at srcFilePath on the system to imageFilePath inside
+// the vorteilImage, replacing the contents of any regular files already there. If imageFilePath
+// is an existing directory the source is copied into it. The vorteilImage must have been opened
+// with vdecompiler.OpenWritable.
+func PutImageFile(vorteilImage *vdecompiler.IO, srcFilePath string, imageFilePath string) error {
+
+	imageFilePath = path.Join("/", filepath.ToSlash(imageFilePath))
+
+	ino, err := vorteilImage.ResolvePathToInodeNo(imageFilePath)
+	if err == nil {
+		inode, err := vorteilImage.ResolveInode(ino)
+		if err != nil {
+			return err
+		}
+
+		if vdecompiler.InodeIsDirectory(inode) {
+			imageFilePath = path.Join(imageFilePath, filepath.Base(srcFilePath))
+		}
+	}
+
+	return putImageFileRecursive(vorteilImage, srcFilePath, imageFilePath)
+}
+
+func putImageFileRecursive(vorteilImage *vdecompiler.IO, srcFilePath string, imageFilePath string) error {
+
+	fi, err := os.Lstat(srcFilePath)
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode().IsRegular() {
+		f, err := os.Open(srcFilePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return vorteilImage.WriteFile(imageFilePath, f, fi.Size(), fi.Mode())
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("\"%s\" is not a regular file or directory", srcFilePath)
+	}
+
+	if _, err = vorteilImage.ResolvePathToInodeNo(imageFilePath); err != nil {
+		err = vorteilImage.Mkdir(imageFilePath, fi.Mode())
+		if err != nil {
+			return err
+		}
+	}
+
+	fis, err := ioutil.ReadDir(srcFilePath)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range fis {
+		err = putImageFileRecursive(vorteilImage, filepath.Join(srcFilePath, child.Name()), path.Join(imageFilePath, child.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package imagetools
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"path"
+	"path/filepath"
+
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+)
+
+// RemoveImageFile removes the file at imageFilePath from inside the vorteilImage. Directories must
+// be empty unless recursive is true, in which case their contents are removed first. The
+// vorteilImage must have been opened with vdecompiler.OpenWritable.
+func RemoveImageFile(vorteilImage *vdecompiler.IO, imageFilePath string, recursive bool) error {
+
+	imageFilePath = path.Join("/", filepath.ToSlash(imageFilePath))
+
+	if recursive {
+		ino, err := vorteilImage.ResolvePathToInodeNo(imageFilePath)
+		if err != nil {
+			return err
+		}
+
+		inode, err := vorteilImage.ResolveInode(ino)
+		if err != nil {
+			return err
+		}
+
+		if vdecompiler.InodeIsDirectory(inode) {
+			entries, err := vorteilImage.Readdir(inode)
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range entries {
+				if entry.Name == "." || entry.Name == ".." {
+					continue
+				}
+
+				err = RemoveImageFile(vorteilImage, path.Join(imageFilePath, entry.Name), true)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return vorteilImage.Remove(imageFilePath)
+}
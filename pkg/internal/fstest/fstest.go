@@ -0,0 +1,120 @@
+// Package fstest holds helpers shared by the tests of the file-system
+// compilers.
+package fstest
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// WriteSeeker collects a compiled image in memory. Compilers only ever seek
+// forwards, over holes, so seeking backwards panics.
+type WriteSeeker struct {
+	Buf []byte
+	Pos int64
+}
+
+// Write implements io.Writer.
+func (w *WriteSeeker) Write(p []byte) (int, error) {
+	if need := w.Pos + int64(len(p)); need > int64(len(w.Buf)) {
+		w.Buf = append(w.Buf, make([]byte, need-int64(len(w.Buf)))...)
+	}
+	copy(w.Buf[w.Pos:], p)
+	w.Pos += int64(len(p))
+	return len(p), nil
+}
+
+// Seek implements io.Seeker.
+func (w *WriteSeeker) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart || offset < w.Pos {
+		panic("unexpected seek")
+	}
+	w.Pos = offset
+	return w.Pos, nil
+}
+
+// Compiler is the part of a file-system compiler used to build an image.
+type Compiler interface {
+	Commit(ctx context.Context) error
+	MinimumSize() int64
+	Precompile(ctx context.Context, size int64) error
+	Compile(ctx context.Context, w io.WriteSeeker) error
+}
+
+// NewCompiler returns a compiler for tree which takes its randomness from
+// rnd and its times from timestamp.
+type NewCompiler func(tree vio.FileTree, rnd io.Reader, timestamp time.Time) Compiler
+
+// Compile builds the smallest image c can compile.
+func Compile(t *testing.T, c Compiler) []byte {
+
+	ctx := context.Background()
+
+	err := c.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := c.MinimumSize()
+	err = c.Precompile(ctx, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := new(WriteSeeker)
+	err = c.Compile(ctx, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return w.Buf
+
+}
+
+func compileReproducible(t *testing.T, fn NewCompiler, timestamp time.Time) []byte {
+
+	tree := vio.NewFileTree()
+
+	data := []byte("hello, world\n")
+	err := tree.Map("/etc/hello", vio.CustomFile(vio.CustomFileArgs{
+		Name:       "hello",
+		Size:       len(data),
+		ModTime:    time.Now(),
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(data)),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Compile(t, fn(tree, rand.New(rand.NewSource(1)), timestamp))
+
+}
+
+// Reproducible compiles the same file-system twice, a second apart, and
+// fails unless both images are identical. The image is returned so that
+// callers can check the timestamp made it in.
+func Reproducible(t *testing.T, fn NewCompiler, timestamp time.Time) []byte {
+
+	a := compileReproducible(t, fn, timestamp)
+	time.Sleep(time.Second)
+	b := compileReproducible(t, fn, timestamp)
+
+	if !bytes.Equal(a, b) {
+		t.Fatalf("compiling the same file-system twice produced different images")
+	}
+
+	return a
+
+}
@@ -0,0 +1,309 @@
+package qcow2
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	Magic         = 0x514649FB
+	Version       = 3
+	ClusterBits   = 16
+	ClusterSize   = 1 << ClusterBits
+	SectorSize    = 0x200
+	HeaderSize    = 104
+	RefcountOrder = 4 // 16-bit refcounts
+	RefcountSize  = 1 << RefcountOrder / 8
+	TableRowSize  = 8
+	L2Entries     = ClusterSize / TableRowSize
+	RefcountRows  = ClusterSize / RefcountSize
+
+	// FlagCopied marks an L1 or L2 entry whose cluster has a refcount of
+	// exactly one, which tells QEMU it can write to it in place.
+	FlagCopied = 1 << 63
+	// FlagCompressed marks an L2 entry as a compressed cluster descriptor.
+	FlagCompressed = 1 << 62
+	// FlagZero marks an L2 entry whose cluster reads as zeroes.
+	FlagZero = 1
+
+	// OffsetMask extracts the host offset from an L1 entry or a standard L2
+	// entry.
+	OffsetMask = 0x00FFFFFFFFFFFE00
+
+	// A compressed cluster descriptor holds the host offset of the compressed
+	// data in its low CompressedOffsetBits bits, followed by the number of
+	// additional 512-byte sectors the data touches.
+	CompressedOffsetBits  = 62 - (ClusterBits - 8)
+	CompressedOffsetMask  = 1<<CompressedOffsetBits - 1
+	CompressedSectorsMask = 1<<(ClusterBits-8) - 1
+
+	// deflateWindow is the window QEMU inflates compressed clusters with,
+	// which is smaller than the one compress/flate produces.
+	deflateWindow = 0x1000
+)
+
+// Header is the version 3 qcow2 header, which is stored big-endian at the
+// start of the image.
+type Header struct {
+	Magic                 uint32 // 0
+	Version               uint32 // 4
+	BackingFileOffset     uint64 // 8
+	BackingFileSize       uint32 // 16
+	ClusterBits           uint32 // 20
+	Size                  uint64 // 24
+	CryptMethod           uint32 // 32
+	L1Size                uint32 // 36
+	L1TableOffset         uint64 // 40
+	RefcountTableOffset   uint64 // 48
+	RefcountTableClusters uint32 // 56
+	NbSnapshots           uint32 // 60
+	SnapshotsOffset       uint64 // 64
+	IncompatibleFeatures  uint64 // 72
+	CompatibleFeatures    uint64 // 80
+	AutoclearFeatures     uint64 // 88
+	RefcountOrder         uint32 // 96
+	HeaderLength          uint32 // 100
+}
+
+// HolePredictor is implemented by our vimg.Builder, and lets a writer lay out
+// the image before the first byte of data is written to it.
+type HolePredictor interface {
+	Size() int64
+	RegionIsHole(begin, size int64) bool
+}
+
+// Sizer should return the true and final RAW size of the image and be
+// callable before the first byte of data is written to the Writer.
+type Sizer interface {
+	Size() int64
+}
+
+func newHeader(size int64) *Header {
+	return &Header{
+		Magic:         Magic,
+		Version:       Version,
+		ClusterBits:   ClusterBits,
+		Size:          uint64(size),
+		L1Size:        uint32(l1Size(size)),
+		RefcountOrder: RefcountOrder,
+		HeaderLength:  HeaderSize,
+	}
+}
+
+func divide(x, y int64) int64 {
+	return (x + y - 1) / y
+}
+
+// l1Size returns the number of L1 entries, and therefore the number of L2
+// tables, needed to map an image of the given size.
+func l1Size(size int64) int64 {
+	return divide(divide(size, ClusterSize), L2Entries)
+}
+
+// metadata holds the L1 and L2 tables and refcounts of an image while it is
+// being written, and works out where to put them.
+type metadata struct {
+	hdr *Header
+	l2  [][]uint64
+
+	// refcounts holds the refcount of every host cluster
+	refcounts []uint16
+
+	l1Clusters            int64
+	refcountTableOffset   int64
+	refcountTableClusters int64
+	refcountBlocksOffset  int64
+	refcountBlocks        int64
+	l2Offset              int64
+	l2Tables              int64
+}
+
+func newMetadata(size int64) *metadata {
+	m := &metadata{
+		hdr: newHeader(size),
+	}
+	m.l2 = make([][]uint64, m.hdr.L1Size)
+	m.l1Clusters = divide(int64(m.hdr.L1Size)*TableRowSize, ClusterSize)
+	return m
+}
+
+// set maps a guest cluster, allocating its L2 table if necessary.
+func (m *metadata) set(cluster int64, entry uint64) {
+	table := cluster / L2Entries
+	if m.l2[table] == nil {
+		m.l2[table] = make([]uint64, L2Entries)
+		m.l2Tables++
+	}
+	m.l2[table][cluster%L2Entries] = entry
+}
+
+// place decides where the metadata goes. It starts at the cluster-aligned
+// offset, and is followed by another trailing clusters that must also be
+// covered by the refcount table.
+func (m *metadata) place(offset, trailing int64) {
+
+	m.hdr.L1TableOffset = uint64(offset)
+	m.refcountTableOffset = offset + m.l1Clusters*ClusterSize
+
+	// the refcount table and blocks must be counted too, so grow them until
+	// they're large enough to count themselves
+	m.refcountTableClusters = 1
+	m.refcountBlocks = 1
+	for {
+		total := offset/ClusterSize + m.l1Clusters + m.refcountTableClusters + m.refcountBlocks + m.l2Tables + trailing
+		blocks := divide(total, RefcountRows)
+		tableClusters := divide(blocks*TableRowSize, ClusterSize)
+		if blocks <= m.refcountBlocks && tableClusters <= m.refcountTableClusters {
+			m.refcounts = make([]uint16, total)
+			break
+		}
+		m.refcountBlocks = blocks
+		m.refcountTableClusters = tableClusters
+	}
+
+	m.refcountBlocksOffset = m.refcountTableOffset + m.refcountTableClusters*ClusterSize
+	m.l2Offset = m.refcountBlocksOffset + m.refcountBlocks*ClusterSize
+
+	m.hdr.RefcountTableOffset = uint64(m.refcountTableOffset)
+	m.hdr.RefcountTableClusters = uint32(m.refcountTableClusters)
+
+	m.reference(0, ClusterSize)
+	m.reference(offset, m.end()-offset)
+
+}
+
+// end returns the offset of the first cluster after the metadata.
+func (m *metadata) end() int64 {
+	return m.l2Offset + m.l2Tables*ClusterSize
+}
+
+// reference increments the refcount of every host cluster touched by the
+// region.
+func (m *metadata) reference(offset, size int64) {
+	for i := offset / ClusterSize; i <= (offset+size-1)/ClusterSize; i++ {
+		m.refcounts[i]++
+	}
+}
+
+// write writes the header and all of the metadata to w. The metadata must
+// have been placed, and every cluster referenced, before calling this.
+func (m *metadata) write(w io.WriteSeeker) error {
+
+	_, err := w.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(w, binary.BigEndian, m.hdr)
+	if err != nil {
+		return err
+	}
+
+	// L1 table
+	l1 := make([]uint64, m.l1Clusters*L2Entries)
+	offset := m.l2Offset
+	for i := range m.l2 {
+		if m.l2[i] == nil {
+			continue
+		}
+		l1[i] = uint64(offset) | FlagCopied
+		offset += ClusterSize
+	}
+
+	err = m.writeAt(w, int64(m.hdr.L1TableOffset), l1)
+	if err != nil {
+		return err
+	}
+
+	// refcount table
+	table := make([]uint64, m.refcountTableClusters*L2Entries)
+	for i := int64(0); i < m.refcountBlocks; i++ {
+		table[i] = uint64(m.refcountBlocksOffset + i*ClusterSize)
+	}
+
+	err = m.writeAt(w, m.refcountTableOffset, table)
+	if err != nil {
+		return err
+	}
+
+	// refcount blocks
+	blocks := make([]uint16, m.refcountBlocks*RefcountRows)
+	copy(blocks, m.refcounts)
+
+	err = m.writeAt(w, m.refcountBlocksOffset, blocks)
+	if err != nil {
+		return err
+	}
+
+	// L2 tables
+	_, err = w.Seek(m.l2Offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	for i := range m.l2 {
+		if m.l2[i] == nil {
+			continue
+		}
+		err = binary.Write(w, binary.BigEndian, m.l2[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+func (m *metadata) writeAt(w io.WriteSeeker, offset int64, data interface{}) error {
+
+	_, err := w.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.BigEndian, data)
+
+}
+
+// compress deflates a cluster the way QEMU expects it to be. QEMU inflates
+// with a 4 KiB window, so the cluster is compressed a piece at a time with a
+// fresh compressor that can't refer back any further than that, and the
+// pieces are concatenated into a single raw deflate stream.
+func compress(cluster []byte) ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+
+	for i := 0; i < len(cluster); i += deflateWindow {
+
+		w, err := flate.NewWriter(buf, flate.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = w.Write(cluster[i : i+deflateWindow])
+		if err != nil {
+			return nil, err
+		}
+
+		if i+deflateWindow < len(cluster) {
+			err = w.Flush()
+		} else {
+			err = w.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+	}
+
+	return buf.Bytes(), nil
+
+}
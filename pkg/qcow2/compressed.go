@@ -0,0 +1,226 @@
+package qcow2
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"io"
+)
+
+type extent struct {
+	offset int64
+	size   int64
+}
+
+// CompressedWriter implements io.Closer, io.Writer, and io.Seeker interfaces.
+// It produces a qcow2 image with every cluster compressed, which is much
+// smaller but slower to read than one produced by a Writer. Because the size
+// of each compressed cluster isn't known until it has been written, the data
+// is streamed out first and the metadata is appended when the writer is
+// closed, so the writer can't seek backwards.
+type CompressedWriter struct {
+	w io.WriteSeeker
+	h Sizer
+
+	meta    *metadata
+	buffer  []byte
+	cluster int64
+	dirty   bool
+	cursor  int64
+	offset  int64
+	extents []extent
+}
+
+func (w *CompressedWriter) init() error {
+
+	w.meta = newMetadata(w.h.Size())
+	w.buffer = make([]byte, ClusterSize)
+
+	// the first cluster is reserved for the header
+	w.offset = ClusterSize
+
+	return nil
+
+}
+
+func (w *CompressedWriter) flushCluster() error {
+
+	if !w.dirty {
+		return nil
+	}
+
+	defer func() {
+		for i := range w.buffer {
+			w.buffer[i] = 0
+		}
+		w.dirty = false
+	}()
+
+	empty := true
+	for _, x := range w.buffer {
+		if x != 0 {
+			empty = false
+			break
+		}
+	}
+
+	if empty {
+		return nil
+	}
+
+	compressed, err := compress(w.buffer)
+	if err != nil {
+		return err
+	}
+
+	data := compressed
+	if len(compressed) < ClusterSize {
+		sectors := (w.offset+int64(len(compressed))-1)/SectorSize - w.offset/SectorSize
+		w.meta.set(w.cluster, FlagCompressed|uint64(sectors)<<CompressedOffsetBits|uint64(w.offset))
+	} else {
+		// incompressible clusters are stored as they are, which requires
+		// them to be aligned
+		data = w.buffer
+		w.offset = divide(w.offset, ClusterSize) * ClusterSize
+		w.meta.set(w.cluster, uint64(w.offset)|FlagCopied)
+	}
+
+	_, err = w.w.Seek(w.offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.w.Write(data)
+	if err != nil {
+		return err
+	}
+
+	w.extents = append(w.extents, extent{offset: w.offset, size: int64(len(data))})
+	w.offset += int64(len(data))
+
+	return nil
+
+}
+
+// Write implements io.Writer.
+func (w *CompressedWriter) Write(p []byte) (int, error) {
+
+	var n int
+
+	for len(p) > 0 {
+
+		if w.cursor >= w.h.Size() {
+			return n, io.EOF
+		}
+
+		err := w.moveTo(w.cursor)
+		if err != nil {
+			return n, err
+		}
+
+		delta := w.cursor % ClusterSize
+		k := int64(copy(w.buffer[delta:], p))
+		if remaining := w.h.Size() - w.cursor; remaining < k {
+			k = remaining
+			for i := delta + k; i < ClusterSize; i++ {
+				w.buffer[i] = 0
+			}
+		}
+
+		w.dirty = true
+		w.cursor += k
+		n += int(k)
+		p = p[k:]
+
+	}
+
+	return n, nil
+
+}
+
+// moveTo flushes the buffered cluster if abs isn't inside it.
+func (w *CompressedWriter) moveTo(abs int64) error {
+
+	cluster := abs / ClusterSize
+	if cluster == w.cluster {
+		return nil
+	}
+
+	if cluster < w.cluster {
+		return errors.New("compressed qcow2 writer cannot seek backwards")
+	}
+
+	err := w.flushCluster()
+	if err != nil {
+		return err
+	}
+
+	w.cluster = cluster
+
+	return nil
+
+}
+
+// Seek implements io.Seeker.
+func (w *CompressedWriter) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = w.cursor + offset
+	case io.SeekEnd:
+		abs = w.h.Size() + offset
+	default:
+		panic("bad seek whence")
+	}
+
+	err := w.moveTo(abs)
+	if err != nil {
+		return w.cursor, err
+	}
+
+	w.cursor = abs
+
+	return abs, nil
+
+}
+
+// Close implements io.Closer.
+func (w *CompressedWriter) Close() error {
+
+	err := w.flushCluster()
+	if err != nil {
+		return err
+	}
+
+	w.meta.place(divide(w.offset, ClusterSize)*ClusterSize, 0)
+	for _, x := range w.extents {
+		w.meta.reference(x.offset, x.size)
+	}
+
+	return w.meta.write(w.w)
+
+}
+
+// NewCompressedWriter returns a CompressedWriter to which a RAW image can be
+// copied in order to create a compressed qcow2 format disk image. The Sizer
+// 'h' must accurately return the true and final RAW size of the image.
+func NewCompressedWriter(w io.WriteSeeker, h Sizer) (*CompressedWriter, error) {
+
+	x := &CompressedWriter{
+		w: w,
+		h: h,
+	}
+
+	err := x.init()
+	if err != nil {
+		return nil, err
+	}
+
+	return x, nil
+
+}
@@ -0,0 +1,182 @@
+package qcow2
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"io"
+)
+
+// Writer implements io.Closer, io.Writer, and io.Seeker interfaces. Creating a
+// qcow2 image is as simple as getting one of these writers and copying a raw
+// image into it. The layout of the image is decided up front using the
+// HolePredictor, so that every cluster predicted to be a hole is left out of
+// the image entirely.
+type Writer struct {
+	w io.WriteSeeker
+	h HolePredictor
+
+	meta           *metadata
+	cursor         int64
+	clusterOffsets []int64
+}
+
+func (w *Writer) init() error {
+
+	size := w.h.Size()
+	clusters := divide(size, ClusterSize)
+
+	w.meta = newMetadata(size)
+	w.clusterOffsets = make([]int64, clusters)
+
+	var dataClusters int64
+	for i := int64(0); i < clusters; i++ {
+		if w.h.RegionIsHole(i*ClusterSize, ClusterSize) {
+			w.clusterOffsets[i] = -1
+			continue
+		}
+		// reserve the L2 table before the metadata is placed
+		w.meta.set(i, 0)
+		dataClusters++
+	}
+
+	w.meta.place(ClusterSize, dataClusters)
+
+	offset := w.meta.end()
+	for i := range w.clusterOffsets {
+		if w.clusterOffsets[i] < 0 {
+			continue
+		}
+		w.clusterOffsets[i] = offset
+		w.meta.set(int64(i), uint64(offset)|FlagCopied)
+		w.meta.reference(offset, ClusterSize)
+		offset += ClusterSize
+	}
+
+	err := w.meta.write(w.w)
+	if err != nil {
+		return err
+	}
+
+	return w.seek(0)
+
+}
+
+// seek moves the underlying writer to the host offset of the guest offset abs,
+// if it is mapped.
+func (w *Writer) seek(abs int64) error {
+
+	w.cursor = abs
+
+	cluster := abs / ClusterSize
+	if cluster >= int64(len(w.clusterOffsets)) || w.clusterOffsets[cluster] < 0 {
+		return nil
+	}
+
+	_, err := w.w.Seek(w.clusterOffsets[cluster]+abs%ClusterSize, io.SeekStart)
+	return err
+
+}
+
+// Write implements io.Writer.
+func (w *Writer) Write(p []byte) (int, error) {
+
+	var n int
+
+	for len(p) > 0 {
+
+		if w.cursor >= w.h.Size() {
+			return n, io.EOF
+		}
+
+		cluster := w.cursor / ClusterSize
+		k := ClusterSize - w.cursor%ClusterSize
+		if remaining := w.h.Size() - w.cursor; remaining < k {
+			k = remaining
+		}
+		if int64(len(p)) < k {
+			k = int64(len(p))
+		}
+
+		if w.clusterOffsets[cluster] < 0 {
+			for _, x := range p[:k] {
+				if x != 0 {
+					return n, errors.New("qcow2 writer received data for a region that was predicted to be a hole")
+				}
+			}
+		} else {
+			_, err := w.w.Write(p[:k])
+			if err != nil {
+				return n, err
+			}
+		}
+
+		n += int(k)
+		p = p[k:]
+
+		// the next cluster isn't necessarily the next one in the file
+		if (w.cursor+k)%ClusterSize == 0 {
+			err := w.seek(w.cursor + k)
+			if err != nil {
+				return n, err
+			}
+		} else {
+			w.cursor += k
+		}
+
+	}
+
+	return n, nil
+
+}
+
+// Seek implements io.Seeker.
+func (w *Writer) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = w.cursor + offset
+	case io.SeekEnd:
+		abs = w.h.Size() + offset
+	default:
+		panic("bad seek whence")
+	}
+
+	err := w.seek(abs)
+	if err != nil {
+		return 0, err
+	}
+
+	return abs, nil
+
+}
+
+// Close implements io.Closer.
+func (w *Writer) Close() error {
+	return nil
+}
+
+// NewWriter returns a Writer to which a RAW image can be copied in order to
+// create a qcow2 format disk image. The HolePredictor 'h' must accurately
+// return the true and final RAW size of the image, and predict which regions
+// of it will be empty.
+func NewWriter(w io.WriteSeeker, h HolePredictor) (*Writer, error) {
+
+	x := &Writer{
+		w: w,
+		h: h,
+	}
+
+	err := x.init()
+	if err != nil {
+		return nil, err
+	}
+
+	return x, nil
+
+}
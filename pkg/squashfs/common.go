@@ -0,0 +1,222 @@
+package squashfs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"compress/zlib"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// Various squashfs build constants. Everything on disk is little-endian.
+const (
+	Magic             = 0x73717368 // hsqs
+	VersionMajor      = 4
+	VersionMinor      = 0
+	BlockSize         = 0x20000
+	BlockLog          = 17
+	MetadataBlockSize = 0x2000
+	SuperblockSize    = 96
+	DeviceBlockSize   = 0x1000
+
+	CompressionGzip = 1
+
+	FlagNoXattrs = 0x200
+
+	InodeTypeDirectory    = 1
+	InodeTypeRegularFile  = 2
+	InodeTypeSymlink      = 3
+	InodeTypeExtDirectory = 8
+	InodeTypeExtFile      = 9
+
+	NoFragment   = 0xffffffff
+	NoXattr      = 0xffffffff
+	NoTable      = 0xffffffffffffffff
+	MaxDirHeader = 256
+
+	metadataUncompressed = 0x8000
+	dataUncompressed     = 1 << 24
+	dirHeaderSize        = 12
+	dirEntrySize         = 8
+	fragmentEntrySize    = 16
+	idEntrySize          = 4
+)
+
+// Superblock is the structure of a squashfs superblock, which is found at the
+// very start of the file-system.
+type Superblock struct {
+	Magic               uint32
+	InodeCount          uint32
+	ModificationTime    uint32
+	BlockSize           uint32
+	FragmentCount       uint32
+	Compression         uint16
+	BlockLog            uint16
+	Flags               uint16
+	IDCount             uint16
+	VersionMajor        uint16
+	VersionMinor        uint16
+	RootInode           uint64
+	BytesUsed           uint64
+	IDTableStart        uint64
+	XattrTableStart     uint64
+	InodeTableStart     uint64
+	DirectoryTableStart uint64
+	FragmentTableStart  uint64
+	ExportTableStart    uint64
+}
+
+// InodeHeader is common to every type of inode.
+type InodeHeader struct {
+	Type        uint16
+	Permissions uint16
+	UIDIndex    uint16
+	GIDIndex    uint16
+	ModTime     uint32
+	Number      uint32
+}
+
+// DirectoryInode is the basic directory inode, used wherever the directory
+// listing is small enough for its fields.
+type DirectoryInode struct {
+	InodeHeader
+	StartBlock  uint32
+	Links       uint32
+	Size        uint16
+	Offset      uint16
+	ParentInode uint32
+}
+
+// ExtDirectoryInode is the extended directory inode, needed for directories
+// with very large listings.
+type ExtDirectoryInode struct {
+	InodeHeader
+	Links       uint32
+	Size        uint32
+	StartBlock  uint32
+	ParentInode uint32
+	IndexCount  uint16
+	Offset      uint16
+	Xattr       uint32
+}
+
+// FileInode is the basic regular file inode. It is followed by the size of
+// each of the file's data blocks.
+type FileInode struct {
+	InodeHeader
+	StartBlock     uint32
+	Fragment       uint32
+	FragmentOffset uint32
+	Size           uint32
+}
+
+// ExtFileInode is the extended regular file inode, needed for files that are
+// larger than 4 GiB or start beyond the first 4 GiB of the file-system. It is
+// followed by the size of each of the file's data blocks.
+type ExtFileInode struct {
+	InodeHeader
+	StartBlock     uint64
+	Size           uint64
+	Sparse         uint64
+	Links          uint32
+	Fragment       uint32
+	FragmentOffset uint32
+	Xattr          uint32
+}
+
+// SymlinkInode is the basic symlink inode. It is followed by the target.
+type SymlinkInode struct {
+	InodeHeader
+	Links      uint32
+	TargetSize uint32
+}
+
+// DirectoryHeader precedes a run of directory entries that all refer to
+// inodes within the same metadata block.
+type DirectoryHeader struct {
+	Count       uint32
+	StartBlock  uint32
+	InodeNumber uint32
+}
+
+// DirectoryEntry is a single entry in a directory listing. It is followed by
+// the entry's name.
+type DirectoryEntry struct {
+	Offset      uint16
+	InodeOffset int16
+	Type        uint16
+	NameSize    uint16
+}
+
+// FragmentEntry locates a fragment block on disk.
+type FragmentEntry struct {
+	Start  uint64
+	Size   uint32
+	Unused uint32
+}
+
+func divide(a, b int64) int64 {
+	return (a + b - 1) / b
+}
+
+func align(a, b int64) int64 {
+	return divide(a, b) * b
+}
+
+func timestamp(t time.Time) uint32 {
+	if t.IsZero() || t.Unix() < 0 {
+		return 0
+	}
+	return uint32(t.Unix())
+}
+
+func inodeType(f vio.File) uint16 {
+	if f.IsDir() {
+		return InodeTypeDirectory
+	} else if f.IsSymlink() {
+		return InodeTypeSymlink
+	}
+	return InodeTypeRegularFile
+}
+
+// compress returns the zlib compressed form of data, or nil if compressing it
+// doesn't save any space.
+func compress(data []byte) ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+	w, err := zlib.NewWriterLevel(buf, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if buf.Len() >= len(data) {
+		return nil, nil
+	}
+
+	return buf.Bytes(), nil
+
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,201 @@
+package squashfs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/internal/fstest"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+func TestStructureSizes(t *testing.T) {
+
+	for _, x := range []struct {
+		name string
+		v    interface{}
+		size int
+	}{
+		{"superblock", &Superblock{}, SuperblockSize},
+		{"inode header", &InodeHeader{}, 16},
+		{"directory inode", &DirectoryInode{}, 32},
+		{"extended directory inode", &ExtDirectoryInode{}, 40},
+		{"file inode", &FileInode{}, 32},
+		{"extended file inode", &ExtFileInode{}, 56},
+		{"symlink inode", &SymlinkInode{}, 24},
+		{"directory header", &DirectoryHeader{}, dirHeaderSize},
+		{"directory entry", &DirectoryEntry{}, dirEntrySize},
+		{"fragment entry", &FragmentEntry{}, fragmentEntrySize},
+	} {
+		if size := binary.Size(x.v); size != x.size {
+			t.Fatalf("%s structure is the wrong size: %d", x.name, size)
+		}
+	}
+
+}
+
+func TestMetadataWriter(t *testing.T) {
+
+	m := newMetadataWriter()
+
+	// highly compressible data should span two blocks
+	_, err := m.Write(make([]byte, MetadataBlockSize+100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, offset := m.position()
+	if block == 0 || offset != 100 {
+		t.Fatalf("metadata writer is at the wrong position: %d, %d", block, offset)
+	}
+
+	if ref := m.reference(); ref != uint64(block)<<16|100 {
+		t.Fatalf("metadata writer produced a bad reference: %x", ref)
+	}
+
+	data, err := m.bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := binary.LittleEndian.Uint16(data)
+	if header&metadataUncompressed != 0 || int64(header)+2 != block {
+		t.Fatalf("bad metadata block header: %x", header)
+	}
+
+	r, err := zlib.NewReader(bytes.NewReader(data[2 : 2+header]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(x) != MetadataBlockSize {
+		t.Fatalf("metadata block decompressed to the wrong size: %d", len(x))
+	}
+
+}
+
+func TestCompile(t *testing.T) {
+
+	ctx := context.Background()
+
+	tree := vio.NewFileTree()
+	c := NewCompiler(&CompilerArgs{
+		FileTree: tree,
+		Logger:   &elog.CLI{},
+	})
+	defer c.Close()
+
+	err := c.Mkdir("/etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte(strings.Repeat("hello, world\n", 20000))
+	err = c.AddFile("/etc/hello", ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.IncreaseMinimumFreeSpace(1024 * 1024)
+
+	err = c.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := c.MinimumSize()
+	if size%DeviceBlockSize != 0 || size >= int64(len(data))+1024*1024 {
+		t.Fatalf("bad minimum size: %d", size)
+	}
+
+	err = c.Precompile(ctx, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.RegionIsHole(0, DeviceBlockSize) {
+		t.Fatalf("superblock region reported as a hole")
+	}
+
+	if !c.RegionIsHole(size-1024*1024, 1024*1024) {
+		t.Fatalf("unused tail not reported as a hole")
+	}
+
+	w := new(fstest.WriteSeeker)
+	err = c.Compile(ctx, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Pos != size {
+		t.Fatalf("compiled image is %d bytes, expected %d", w.Pos, size)
+	}
+
+	sb := new(Superblock)
+	err = binary.Read(bytes.NewReader(w.Buf), binary.LittleEndian, sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sb.Magic != Magic || sb.VersionMajor != VersionMajor {
+		t.Fatalf("bad superblock: %x v%d", sb.Magic, sb.VersionMajor)
+	}
+
+	// root, etc, hello
+	if sb.InodeCount != 3 || sb.FragmentCount != 1 || sb.IDCount != 1 {
+		t.Fatalf("superblock has the wrong counts: %+v", sb)
+	}
+
+	if sb.InodeTableStart >= sb.DirectoryTableStart || sb.DirectoryTableStart >= sb.FragmentTableStart ||
+		sb.FragmentTableStart >= sb.IDTableStart || sb.IDTableStart >= sb.BytesUsed {
+		t.Fatalf("superblock tables are out of order: %+v", sb)
+	}
+
+	if int64(sb.BytesUsed) > size {
+		t.Fatalf("superblock claims more bytes than the image holds: %d", sb.BytesUsed)
+	}
+
+}
+
+func TestReproducibleCompile(t *testing.T) {
+
+	timestamp := time.Unix(1600000000, 0)
+
+	a := fstest.Reproducible(t, func(tree vio.FileTree, rnd io.Reader, timestamp time.Time) fstest.Compiler {
+		c := NewCompiler(&CompilerArgs{
+			FileTree:  tree,
+			Logger:    &elog.CLI{},
+			Timestamp: timestamp,
+		})
+		t.Cleanup(func() { c.Close() })
+		return c
+	}, timestamp)
+
+	sb := new(Superblock)
+	err := binary.Read(bytes.NewReader(a), binary.LittleEndian, sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sb.ModificationTime != uint32(timestamp.Unix()) {
+		t.Fatalf("superblock has the wrong modification time: %d", sb.ModificationTime)
+	}
+
+}
@@ -0,0 +1,653 @@
+package squashfs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+type node struct {
+	node           *vio.TreeNode
+	ino            uint32
+	ref            uint64
+	start          int64
+	blocks         []uint32
+	sparse         int64
+	fragment       uint32
+	fragmentOffset uint32
+	symlink        string
+}
+
+type compiler struct {
+	tree  vio.FileTree
+	size  int64
+	nodes []node
+	now   time.Time
+
+	timestamp time.Time
+
+	// the contents of every data block and fragment block are compressed
+	// and spooled to a temporary file during Commit, because there's no
+	// other way to find out how big the file-system will be
+	spool     *os.File
+	dataEnd   int64
+	fragment  []byte
+	fragments []FragmentEntry
+
+	ids        []uint32
+	inodes     *metadataWriter
+	dirs       *metadataWriter
+	tables     []byte
+	superblock Superblock
+}
+
+func (c *compiler) scanInodes(ctx context.Context) error {
+
+	c.nodes = make([]node, 0)
+
+	err := c.tree.WalkNode(func(path string, n *vio.TreeNode) error {
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n.NodeSequenceNumber = int64(len(c.nodes))
+		c.nodes = append(c.nodes, node{
+			node: n,
+			ino:  uint32(len(c.nodes) + 1),
+		})
+
+		return nil
+
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+func (c *compiler) writeData(data []byte) (int64, error) {
+
+	start := c.dataEnd
+
+	_, err := c.spool.Write(data)
+	if err != nil {
+		return 0, err
+	}
+
+	c.dataEnd += int64(len(data))
+
+	return start, nil
+
+}
+
+// writeBlock compresses and writes a single data block, returning its entry
+// for a file's block list.
+func (c *compiler) writeBlock(data []byte) (uint32, error) {
+
+	compressed, err := compress(data)
+	if err != nil {
+		return 0, err
+	}
+
+	size := uint32(len(compressed))
+	if compressed == nil {
+		compressed = data
+		size = uint32(len(data)) | dataUncompressed
+	}
+
+	_, err = c.writeData(compressed)
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+
+}
+
+func (c *compiler) flushFragment() error {
+
+	if len(c.fragment) == 0 {
+		return nil
+	}
+
+	start := c.dataEnd
+	size, err := c.writeBlock(c.fragment)
+	if err != nil {
+		return err
+	}
+
+	c.fragments = append(c.fragments, FragmentEntry{
+		Start: uint64(start),
+		Size:  size,
+	})
+	c.fragment = c.fragment[:0]
+
+	return nil
+
+}
+
+// addFragment packs the tail end of a file into the current fragment block.
+func (c *compiler) addFragment(tail []byte) (uint32, uint32, error) {
+
+	if len(c.fragment)+len(tail) > BlockSize {
+		err := c.flushFragment()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	idx := uint32(len(c.fragments))
+	offset := uint32(len(c.fragment))
+	c.fragment = append(c.fragment, tail...)
+
+	return idx, offset, nil
+
+}
+
+func (c *compiler) compressFile(x *node) error {
+
+	f := x.node.File
+	remaining := int64(f.Size())
+	buf := make([]byte, BlockSize)
+
+	x.start = c.dataEnd
+	x.fragment = NoFragment
+
+	for remaining > 0 {
+
+		k := int64(BlockSize)
+		if remaining < k {
+			k = remaining
+		}
+
+		data := buf[:k]
+		n, err := io.ReadFull(f, data)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		// pad out files that are shorter than they claim to be
+		for i := n; i < len(data); i++ {
+			data[i] = 0
+		}
+
+		remaining -= k
+
+		if k < BlockSize {
+			x.fragment, x.fragmentOffset, err = c.addFragment(data)
+			if err != nil {
+				return err
+			}
+			break
+		}
+
+		if isZero(data) {
+			x.blocks = append(x.blocks, 0)
+			x.sparse += k
+			continue
+		}
+
+		size, err := c.writeBlock(data)
+		if err != nil {
+			return err
+		}
+
+		x.blocks = append(x.blocks, size)
+
+	}
+
+	return nil
+
+}
+
+// compressData reads the contents of every file in the tree in order and
+// spools it to disk in its final compressed form.
+func (c *compiler) compressData(ctx context.Context) error {
+
+	var err error
+
+	c.spool, err = ioutil.TempFile("", "vorteil-squashfs-")
+	if err != nil {
+		return err
+	}
+
+	c.dataEnd = SuperblockSize
+	c.fragment = make([]byte, 0, BlockSize)
+
+	for i := range c.nodes {
+
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		x := &c.nodes[i]
+		f := x.node.File
+
+		switch {
+		case f.IsDir():
+		case f.IsSymlink():
+			if f.SymlinkIsCached() {
+				x.symlink = f.Symlink()
+			} else {
+				data, err := ioutil.ReadAll(f)
+				if err != nil {
+					return err
+				}
+				x.symlink = string(data)
+			}
+		default:
+			err = c.compressFile(x)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+
+	}
+
+	return c.flushFragment()
+
+}
+
+func (c *compiler) idIndex(id uint32) uint16 {
+
+	for i, x := range c.ids {
+		if x == id {
+			return uint16(i)
+		}
+	}
+
+	c.ids = append(c.ids, id)
+	return uint16(len(c.ids) - 1)
+
+}
+
+func (c *compiler) inodeHeader(x *node, typ uint16) InodeHeader {
+	perms, uid, gid := ext.InodeAttributes(x.node.File)
+	return InodeHeader{
+		Type:        typ,
+		Permissions: perms,
+		UIDIndex:    c.idIndex(uid),
+		GIDIndex:    c.idIndex(gid),
+		ModTime:     timestamp(c.modTime(x.node.File)),
+		Number:      x.ino,
+	}
+}
+
+func (c *compiler) writeFileInode(x *node) error {
+
+	size := uint64(x.node.File.Size())
+	large := size > math.MaxUint32 || x.start > math.MaxUint32 || x.sparse > 0
+
+	var err error
+
+	if large {
+		err = c.inodes.writeStruct(&ExtFileInode{
+			InodeHeader:    c.inodeHeader(x, InodeTypeExtFile),
+			StartBlock:     uint64(x.start),
+			Size:           size,
+			Sparse:         uint64(x.sparse),
+			Links:          1,
+			Fragment:       x.fragment,
+			FragmentOffset: x.fragmentOffset,
+			Xattr:          NoXattr,
+		})
+	} else {
+		err = c.inodes.writeStruct(&FileInode{
+			InodeHeader:    c.inodeHeader(x, InodeTypeRegularFile),
+			StartBlock:     uint32(x.start),
+			Fragment:       x.fragment,
+			FragmentOffset: x.fragmentOffset,
+			Size:           uint32(size),
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.inodes.writeStruct(x.blocks)
+
+}
+
+func (c *compiler) writeSymlinkInode(x *node) error {
+
+	err := c.inodes.writeStruct(&SymlinkInode{
+		InodeHeader: c.inodeHeader(x, InodeTypeSymlink),
+		Links:       1,
+		TargetSize:  uint32(len(x.symlink)),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.inodes.Write([]byte(x.symlink))
+	return err
+
+}
+
+type dirEntry struct {
+	name string
+	node *node
+}
+
+// writeDirectoryListing writes the entries of a directory to the directory
+// table, grouping them under a new header whenever they no longer share an
+// inode metadata block or are too far apart in inode number.
+func (c *compiler) writeDirectoryListing(entries []dirEntry) (int64, error) {
+
+	listing := new(bytes.Buffer)
+
+	for i := 0; i < len(entries); {
+
+		first := entries[i].node
+		block := first.ref >> 16
+
+		j := i + 1
+		for j < len(entries) && j-i < MaxDirHeader {
+			x := entries[j].node
+			diff := int64(x.ino) - int64(first.ino)
+			if x.ref>>16 != block || diff > math.MaxInt16 || diff < math.MinInt16 {
+				break
+			}
+			j++
+		}
+
+		_ = binary.Write(listing, binary.LittleEndian, &DirectoryHeader{
+			Count:       uint32(j - i - 1),
+			StartBlock:  uint32(block),
+			InodeNumber: first.ino,
+		})
+
+		for _, e := range entries[i:j] {
+			_ = binary.Write(listing, binary.LittleEndian, &DirectoryEntry{
+				Offset:      uint16(e.node.ref),
+				InodeOffset: int16(int64(e.node.ino) - int64(first.ino)),
+				Type:        inodeType(e.node.node.File),
+				NameSize:    uint16(len(e.name) - 1),
+			})
+			listing.WriteString(e.name)
+		}
+
+		i = j
+
+	}
+
+	_, err := c.dirs.Write(listing.Bytes())
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(listing.Len()), nil
+
+}
+
+func (c *compiler) writeDirectoryInode(x *node) error {
+
+	var entries []dirEntry
+	links := uint32(2)
+
+	for _, child := range x.node.Children {
+		y := &c.nodes[child.NodeSequenceNumber]
+		err := c.writeInode(y)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, dirEntry{
+			name: path.Base(child.File.Name()),
+			node: y,
+		})
+		if child.File.IsDir() {
+			links++
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+
+	for _, e := range entries {
+		if len(e.name) == 0 || len(e.name) > 256 {
+			return errors.New("invalid file name length")
+		}
+	}
+
+	block, offset := c.dirs.position()
+	length, err := c.writeDirectoryListing(entries)
+	if err != nil {
+		return err
+	}
+
+	// the size includes space for the implicit "." and ".." entries
+	size := length + 3
+
+	parent := uint32(len(c.nodes) + 1)
+	if x.node.Parent != nil {
+		parent = c.nodes[x.node.Parent.NodeSequenceNumber].ino
+	}
+
+	x.ref = c.inodes.reference()
+
+	if size > math.MaxUint16 {
+		return c.inodes.writeStruct(&ExtDirectoryInode{
+			InodeHeader: c.inodeHeader(x, InodeTypeExtDirectory),
+			Links:       links,
+			Size:        uint32(size),
+			StartBlock:  uint32(block),
+			ParentInode: parent,
+			Offset:      uint16(offset),
+			Xattr:       NoXattr,
+		})
+	}
+
+	return c.inodes.writeStruct(&DirectoryInode{
+		InodeHeader: c.inodeHeader(x, InodeTypeDirectory),
+		StartBlock:  uint32(block),
+		Links:       links,
+		Size:        uint16(size),
+		Offset:      uint16(offset),
+		ParentInode: parent,
+	})
+
+}
+
+// writeInode writes the inode for a node to the inode table. Directories are
+// written after all of their children, because a directory listing can only
+// be generated once the location of every inode it refers to is known.
+func (c *compiler) writeInode(x *node) error {
+
+	f := x.node.File
+
+	switch {
+	case f.IsDir():
+		return c.writeDirectoryInode(x)
+	case f.IsSymlink():
+		x.ref = c.inodes.reference()
+		return c.writeSymlinkInode(x)
+	default:
+		x.ref = c.inodes.reference()
+		return c.writeFileInode(x)
+	}
+
+}
+
+// modTime returns the modification time of f, clamped to the compiler's
+// timestamp if it has one.
+func (c *compiler) modTime(f vio.File) time.Time {
+	t := f.ModTime()
+	if !c.timestamp.IsZero() && t.After(c.timestamp) {
+		return c.timestamp
+	}
+	return t
+}
+
+// generateMetadata builds every table that follows the data in the
+// file-system, and the superblock that points to them.
+func (c *compiler) generateMetadata() error {
+
+	c.now = time.Now()
+	if !c.timestamp.IsZero() {
+		c.now = c.timestamp
+	}
+	c.ids = make([]uint32, 0)
+	c.inodes = newMetadataWriter()
+	c.dirs = newMetadataWriter()
+
+	root := &c.nodes[0]
+	err := c.writeInode(root)
+	if err != nil {
+		return err
+	}
+
+	inodeTable, err := c.inodes.bytes()
+	if err != nil {
+		return err
+	}
+
+	dirTable, err := c.dirs.bytes()
+	if err != nil {
+		return err
+	}
+
+	sb := Superblock{
+		Magic:            Magic,
+		InodeCount:       uint32(len(c.nodes)),
+		ModificationTime: timestamp(c.now),
+		BlockSize:        BlockSize,
+		FragmentCount:    uint32(len(c.fragments)),
+		Compression:      CompressionGzip,
+		BlockLog:         BlockLog,
+		Flags:            FlagNoXattrs,
+		IDCount:          uint16(len(c.ids)),
+		VersionMajor:     VersionMajor,
+		VersionMinor:     VersionMinor,
+		RootInode:        root.ref,
+		XattrTableStart:  NoTable,
+		ExportTableStart: NoTable,
+	}
+
+	tables := new(bytes.Buffer)
+	pos := func() int64 {
+		return c.dataEnd + int64(tables.Len())
+	}
+
+	sb.InodeTableStart = uint64(pos())
+	tables.Write(inodeTable)
+
+	sb.DirectoryTableStart = uint64(pos())
+	tables.Write(dirTable)
+
+	if len(c.fragments) > 0 {
+		entries := new(bytes.Buffer)
+		_ = binary.Write(entries, binary.LittleEndian, c.fragments)
+		table, index, err := lookupTable(entries.Bytes(), pos())
+		if err != nil {
+			return err
+		}
+		tables.Write(table)
+		sb.FragmentTableStart = uint64(pos())
+		tables.Write(index)
+	} else {
+		sb.FragmentTableStart = NoTable
+	}
+
+	ids := new(bytes.Buffer)
+	_ = binary.Write(ids, binary.LittleEndian, c.ids)
+	table, index, err := lookupTable(ids.Bytes(), pos())
+	if err != nil {
+		return err
+	}
+	tables.Write(table)
+	sb.IDTableStart = uint64(pos())
+	tables.Write(index)
+
+	sb.BytesUsed = uint64(pos())
+
+	c.tables = tables.Bytes()
+	c.superblock = sb
+
+	return nil
+
+}
+
+func (c *compiler) bytesUsed() int64 {
+	return align(int64(c.superblock.BytesUsed), DeviceBlockSize)
+}
+
+func (c *compiler) regionIsHole(begin, size int64) bool {
+	return begin >= c.bytesUsed()
+}
+
+func (c *compiler) writeImage(ctx context.Context, w io.Writer) error {
+
+	err := binary.Write(w, binary.LittleEndian, &c.superblock)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(w, c.spool, c.dataEnd-SuperblockSize)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(c.tables)
+	if err != nil {
+		return err
+	}
+
+	// pad the image out to a whole number of device blocks
+	_, err = io.CopyN(w, vio.Zeroes, c.bytesUsed()-int64(c.superblock.BytesUsed))
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+func (c *compiler) removeSpool() error {
+
+	if c.spool == nil {
+		return nil
+	}
+
+	name := c.spool.Name()
+	_ = c.spool.Close()
+	c.spool = nil
+
+	return os.Remove(name)
+
+}
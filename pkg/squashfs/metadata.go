@@ -0,0 +1,136 @@
+package squashfs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// metadataWriter packs data into a stream of compressed metadata blocks, which
+// is how squashfs stores its inode, directory, fragment and id tables. Because
+// blocks are compressed as soon as they fill up, the location of anything
+// written to the stream is known immediately.
+type metadataWriter struct {
+	out    bytes.Buffer
+	block  []byte
+	starts []int64
+}
+
+func newMetadataWriter() *metadataWriter {
+	return &metadataWriter{
+		block: make([]byte, 0, MetadataBlockSize),
+	}
+}
+
+// position returns the location of the next byte written to the stream, as
+// the offset of its metadata block within the table and the offset of the
+// byte within the uncompressed block.
+func (m *metadataWriter) position() (int64, int) {
+	return int64(m.out.Len()), len(m.block)
+}
+
+// reference packs the current position into the form used by inode
+// references.
+func (m *metadataWriter) reference() uint64 {
+	block, offset := m.position()
+	return uint64(block)<<16 | uint64(offset)
+}
+
+func (m *metadataWriter) Write(p []byte) (int, error) {
+
+	n := len(p)
+
+	for len(p) > 0 {
+
+		k := MetadataBlockSize - len(m.block)
+		if k > len(p) {
+			k = len(p)
+		}
+
+		m.block = append(m.block, p[:k]...)
+		p = p[k:]
+
+		if len(m.block) == MetadataBlockSize {
+			err := m.flush()
+			if err != nil {
+				return 0, err
+			}
+		}
+
+	}
+
+	return n, nil
+
+}
+
+func (m *metadataWriter) writeStruct(v interface{}) error {
+	return binary.Write(m, binary.LittleEndian, v)
+}
+
+func (m *metadataWriter) flush() error {
+
+	if len(m.block) == 0 {
+		return nil
+	}
+
+	data, err := compress(m.block)
+	if err != nil {
+		return err
+	}
+
+	header := uint16(len(data))
+	if data == nil {
+		data = m.block
+		header = uint16(len(data)) | metadataUncompressed
+	}
+
+	m.starts = append(m.starts, int64(m.out.Len()))
+	_ = binary.Write(&m.out, binary.LittleEndian, header)
+	m.out.Write(data)
+	m.block = m.block[:0]
+
+	return nil
+
+}
+
+// bytes flushes any partial block and returns the complete table.
+func (m *metadataWriter) bytes() ([]byte, error) {
+
+	err := m.flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return m.out.Bytes(), nil
+
+}
+
+// lookupTable generates a table of fixed-size entries, such as the fragment or
+// id tables, along with the index that points to each of its metadata blocks
+// assuming the table is written to disk at 'start'.
+func lookupTable(entries []byte, start int64) ([]byte, []byte, error) {
+
+	m := newMetadataWriter()
+
+	_, err := m.Write(entries)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	table, err := m.bytes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	index := make([]byte, 8*len(m.starts))
+	for i, x := range m.starts {
+		binary.LittleEndian.PutUint64(index[8*i:], uint64(start+x))
+	}
+
+	return table, index, nil
+
+}
@@ -0,0 +1,208 @@
+package squashfs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// CompilerArgs organizes all inputs necessary to create a new Compiler. Because
+// the compiler is designed to be configured in stages by the caller very little
+// goes here.
+type CompilerArgs struct {
+	FileTree vio.FileTree
+	Logger   elog.Logger
+
+	// Timestamp, if set, is used in place of the current time, and clamps
+	// the modification time of every file so that none are later than it.
+	Timestamp time.Time
+}
+
+// Compiler keeps all variables and settings for a single squashfs file-system
+// compile operation. It follows the same staged approach as the ext2 compiler:
+// NewCompiler, Commit, Precompile, Compile. The file-system it produces is
+// compressed and read-only, so its size is only known once every file has been
+// compressed during Commit, and the inode settings have no effect.
+type Compiler struct {
+	log elog.Logger
+
+	minFreeSpace int64
+	minSize      int64
+
+	compiler
+}
+
+// NewCompiler returns an initialized Compiler object. The next necessary step
+// is to call Commit on this Compiler, but before doing so it is possible to
+// modify its contents with functions like Mkdir and AddFile.
+func NewCompiler(args *CompilerArgs) *Compiler {
+	c := new(Compiler)
+	c.tree = args.FileTree
+	c.log = args.Logger
+	c.timestamp = args.Timestamp
+	return c
+}
+
+// Mkdir allows the caller to add an empty directory to the file-system at
+// 'path' if no file or directory is already mapped there. This function must
+// be called before calling Commit, otherwise the behaviour is undefined.
+func (c *Compiler) Mkdir(path string) error {
+
+	_, base := filepath.Split(path)
+	err := c.tree.Map(path, vio.CustomFile(vio.CustomFileArgs{
+		Name:  base,
+		IsDir: true,
+	}))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddFile allows the caller to add a file to the file-system at 'path',
+// resolving any collisions by overwriting them if 'force' is true. This
+// function must be called before calling Commit, otherwise the behaviour is
+// undefined.
+func (c *Compiler) AddFile(path string, r io.ReadCloser, size int64, force bool) error {
+
+	_, base := filepath.Split(path)
+	err := c.tree.Map(path, vio.CustomFile(vio.CustomFileArgs{
+		Name:       base,
+		Size:       int(size),
+		ReadCloser: r,
+	}))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// IncreaseMinimumInodes does nothing, because a read-only file-system has no
+// use for free inodes. It exists to satisfy the vimg.FSCompiler interface.
+func (c *Compiler) IncreaseMinimumInodes(inodes int64) {
+}
+
+// SetMinimumInodes does nothing, because a read-only file-system has no use
+// for free inodes. It exists to satisfy the vimg.FSCompiler interface.
+func (c *Compiler) SetMinimumInodes(inodes int64) {
+}
+
+// SetMinimumInodesPer64MiB does nothing, because a read-only file-system has
+// no use for free inodes. It exists to satisfy the vimg.FSCompiler interface.
+func (c *Compiler) SetMinimumInodesPer64MiB(inodes int64) {
+}
+
+// IncreaseMinimumFreeSpace allows the caller to add a minimum amount of extra
+// space to the end of the file-system partition in bytes. The file-system
+// can't use this space, but it will be reported as a hole.
+func (c *Compiler) IncreaseMinimumFreeSpace(space int64) {
+	c.minFreeSpace += space
+}
+
+// Commit is the second of the four steps necessary to compile a file-system
+// image, and should be called sometime after NewCompiler and before Precompile.
+// It is responsible for locking-in the contents of the file-system, which
+// involves reading and compressing every file in it. Any calls to functions
+// that change the contents or capacity of the file-system must be done before
+// this function is called.
+func (c *Compiler) Commit(ctx context.Context) error {
+
+	err := c.scanInodes(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = c.compressData(ctx)
+	if err != nil {
+		_ = c.removeSpool()
+		return err
+	}
+
+	err = c.generateMetadata()
+	if err != nil {
+		_ = c.removeSpool()
+		return err
+	}
+
+	c.minSize = c.bytesUsed() + align(c.minFreeSpace, DeviceBlockSize)
+
+	c.log.Debugf("Compressed File-system: %v bytes", c.superblock.BytesUsed)
+
+	return nil
+
+}
+
+// MinimumSize returns the minimum number of bytes needed to contain the
+// file-system image. It can be called after a successful call to Commit.
+func (c *Compiler) MinimumSize() int64 {
+	return c.minSize
+}
+
+// Precompile locks in the file-system size. It must be called only after a
+// successful Commit and is necessary before calling the final function:
+// Compile.
+func (c *Compiler) Precompile(ctx context.Context, size int64) error {
+
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	if size < c.bytesUsed() {
+		return fmt.Errorf("squashfs file-system needs %d bytes but only %d are available", c.bytesUsed(), size)
+	}
+
+	c.size = size
+
+	return nil
+
+}
+
+// RegionIsHole can be called after a successful Precompile. Its purpose is to
+// provide advance notice to sparse disk image formatting logic on regions
+// within the image that will be completely empty. The two args are measured in
+// bytes, and the function returns true if every byte starting at begin and
+// continuing for the full size is zeroed.
+func (c *Compiler) RegionIsHole(begin, size int64) bool {
+	return c.regionIsHole(begin, size)
+}
+
+// Compile is the final operation performed by the Compiler, and should only be
+// called after a successful call to the Precompile function. It writes the
+// file-system to the provided io.WriteSeeker, w, without ever seeking
+// backwards.
+func (c *Compiler) Compile(ctx context.Context, w io.WriteSeeker) error {
+
+	err := c.writeImage(ctx, w)
+	if err != nil {
+		return err
+	}
+
+	// seek to the end of the image
+	_, err = w.Seek(c.size, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return c.Close()
+
+}
+
+// Close removes the temporary file holding the compressed file contents. It
+// is called automatically at the end of Compile, but should also be called if
+// the build is abandoned after Commit.
+func (c *Compiler) Close() error {
+	return c.removeSpool()
+}
@@ -371,9 +371,10 @@ type Filesystem string
 
 // Supported filesystem types
 var (
-	Ext2FS = Filesystem("ext2")
-	Ext4FS = Filesystem("ext4")
-	XFS    = Filesystem("xfs")
+	Ext2FS   = Filesystem("ext2")
+	Ext4FS   = Filesystem("ext4")
+	XFS      = Filesystem("xfs")
+	SquashFS = Filesystem("squashfs")
 )
 
 //
@@ -72,6 +72,8 @@ type NetworkInterface struct {
 	MTU                              uint     `toml:"mtu,omitzero" json:"mtu,omitempty"`
 	DisableTCPSegmentationOffloading bool     `toml:"disable-tso,omitempty" json:"disable-tso,omitempty"`
 	TCPDUMP                          bool     `toml:"tcpdump,omitempty" json:"tcpdump"`
+	Bandwidth                        Bytes    `toml:"bandwidth,omitzero" json:"bandwidth,omitempty"`     // per second, in each direction
+	PacketRate                       uint     `toml:"packet-rate,omitzero" json:"packet-rate,omitempty"` // packets per second, in each direction
 }
 
 // NFSSettings ..
@@ -97,7 +99,8 @@ type SystemSettings struct {
 	StdoutMode StdoutMode `toml:"output-mode,omitzero" json:"stdout-mode,omitempty"`
 	KernelArgs string     `toml:"kernel-args,omitempty" json:"kernel-args,omitempty"`
 	Filesystem Filesystem `toml:"filesystem,omitempty" json:"filesystem,omitempty"`
-	User       string     `toml:"user,omitempty" json:"user,omitempty"` // Note: should we validate against regex ^[a-z]*$
+	Overlay    Bytes      `toml:"overlay,omitzero" json:"overlay,omitempty"` // size of a tmpfs overlay that makes a read-only root writable
+	User       string     `toml:"user,omitempty" json:"user,omitempty"`      // Note: should we validate against regex ^[a-z]*$
 }
 
 // PackageInfo ..
@@ -109,6 +112,10 @@ type PackageInfo struct {
 	URL         URL       `toml:"url,omitempty" json:"url,omitempty"`
 	Date        Timestamp `toml:"date,omitempty,omitzero" json:"date,omitempty"`
 	Version     string    `toml:"version,omitempty" json:"version,omitempty"`
+
+	// Source records what the package was built from, e.g. the container
+	// image it was converted from, pinned to a digest.
+	Source string `toml:"source,omitempty" json:"source,omitempty"`
 }
 
 // VMSettings ..
@@ -118,6 +125,10 @@ type VMSettings struct {
 	Inodes   InodesQuota `toml:"inodes,omitzero" json:"inodes,omitempty"`
 	Kernel   string      `toml:"kernel,omitempty" json:"kernel,omitempty"`
 	DiskSize Bytes       `toml:"disk-size,omitzero" json:"disk-size,omitempty"`
+
+	// limits enforced by virtualizers that support them
+	DiskBandwidth Bytes `toml:"disk-bandwidth,omitzero" json:"disk-bandwidth,omitempty"` // per second
+	DiskIOPS      uint  `toml:"disk-iops,omitzero" json:"disk-iops,omitempty"`
 }
 
 // Logging ..
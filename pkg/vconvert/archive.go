@@ -0,0 +1,258 @@
+package vconvert
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	ociPrefix           = "oci:"
+	dockerArchivePrefix = "docker-archive:"
+
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+)
+
+// isArchiveSource returns true if app refers to an image on disk rather than
+// in a registry or container runtime.
+func isArchiveSource(app string) bool {
+	return strings.HasPrefix(app, ociPrefix) || strings.HasPrefix(app, dockerArchivePrefix)
+}
+
+// splitArchiveSource splits an oci: or docker-archive: source into the path
+// of the image layout or tarball and an optional reference to one of the
+// images in it, e.g. oci:/images/app:v1 or
+// docker-archive:/images/app.tar:app:v1. The path ends at the first colon
+// that leaves a path which exists.
+func splitArchiveSource(s string) (string, string) {
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != ':' {
+			continue
+		}
+		// windows drive letters, as in C:\images
+		if runtime.GOOS == "windows" && i == 1 {
+			continue
+		}
+		if _, err := os.Stat(s[:i]); err == nil {
+			return s[:i], s[i+1:]
+		}
+	}
+
+	return s, ""
+}
+
+// newArchiveConverter returns a ContainerConverter for an OCI image layout
+// directory or a `docker save` tarball.
+func newArchiveConverter(app string) (*ContainerConverter, error) {
+
+	cc := new(ContainerConverter)
+
+	var src string
+	if strings.HasPrefix(app, ociPrefix) {
+		cc.registryType = OCIRegistry
+		src = strings.TrimPrefix(app, ociPrefix)
+	} else {
+		cc.registryType = DockerArchiveRegistry
+		src = strings.TrimPrefix(app, dockerArchivePrefix)
+	}
+
+	cc.archivePath, cc.archiveRef = splitArchiveSource(src)
+	if cc.archivePath == "" {
+		return nil, fmt.Errorf("no path in image source '%s'", app)
+	}
+
+	if _, err := os.Stat(cc.archivePath); err != nil {
+		return nil, err
+	}
+
+	cc.fetchReader = localGetReader
+
+	return cc, nil
+
+}
+
+// downloadInformationOCI reads the image from an OCI image layout directory.
+// Its index.json is searched for the manifest annotated with ref, or which
+// has ref as its digest, and may be left out if there is only one manifest.
+// Manifests for other platforms are skipped unless ref is a digest, which
+// picks out a manifest whatever its platform.
+func (cc *ContainerConverter) downloadInformationOCI(path, ref string) error {
+
+	cc.logger.Printf("getting image from oci layout %s", path)
+
+	p, err := layout.FromPath(path)
+	if err != nil {
+		return err
+	}
+
+	idx, err := p.ImageIndex()
+	if err != nil {
+		return err
+	}
+
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return err
+	}
+
+	manifests := im.Manifests
+	if _, err := digest.Parse(ref); err != nil {
+		manifests = cc.platformManifests(manifests)
+	}
+
+	desc, err := findOCIManifest(manifests, ref)
+	if err != nil {
+		return fmt.Errorf("%w in oci layout %s", err, path)
+	}
+
+	var img v1.Image
+
+	switch desc.MediaType {
+	case types.OCIImageIndex, types.DockerManifestList:
+		child, err := idx.ImageIndex(desc.Digest)
+		if err != nil {
+			return err
+		}
+
+		cim, err := child.IndexManifest()
+		if err != nil {
+			return err
+		}
+
+		candidates := make([]specs.Platform, len(cim.Manifests))
+		for i, m := range cim.Manifests {
+			if m.Platform != nil {
+				candidates[i] = specs.Platform{
+					OS:           m.Platform.OS,
+					Architecture: m.Platform.Architecture,
+					Variant:      m.Platform.Variant,
+				}
+			}
+		}
+
+		i, err := cc.selectPlatform(candidates)
+		if err != nil {
+			return fmt.Errorf("%w in oci layout %s", err, path)
+		}
+
+		desc = &cim.Manifests[i]
+		img, err = child.Image(desc.Digest)
+		if err != nil {
+			return err
+		}
+	default:
+		img, err = idx.Image(desc.Digest)
+		if err != nil {
+			return err
+		}
+	}
+
+	cc.digest = digest.Digest(desc.Digest.String())
+
+	return cc.imageHandler(img)
+
+}
+
+// platformManifests drops the manifests of an OCI index which are for other
+// platforms, so layouts holding an image per platform side by side work like
+// multi-platform images.
+func (cc *ContainerConverter) platformManifests(manifests []v1.Descriptor) []v1.Descriptor {
+
+	m := platforms.NewMatcher(cc.platform())
+
+	var x []v1.Descriptor
+	for _, d := range manifests {
+		if d.Platform != nil && !m.Match(specs.Platform{
+			OS:           d.Platform.OS,
+			Architecture: d.Platform.Architecture,
+			Variant:      d.Platform.Variant,
+		}) {
+			continue
+		}
+		x = append(x, d)
+	}
+
+	return x
+
+}
+
+// findOCIManifest returns the manifest in an OCI index matching ref.
+func findOCIManifest(manifests []v1.Descriptor, ref string) (*v1.Descriptor, error) {
+
+	if ref == "" {
+		if len(manifests) == 0 {
+			return nil, fmt.Errorf("no images found")
+		}
+		if len(manifests) == 1 {
+			return &manifests[0], nil
+		}
+
+		var refs []string
+		for _, m := range manifests {
+			if r, ok := m.Annotations[ociRefNameAnnotation]; ok {
+				refs = append(refs, r)
+			}
+		}
+		return nil, fmt.Errorf("%d images found, one must be chosen from: %s", len(manifests), strings.Join(refs, ", "))
+	}
+
+	for i, m := range manifests {
+		if m.Annotations[ociRefNameAnnotation] == ref || m.Digest.String() == ref {
+			return &manifests[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("image '%s' not found", ref)
+
+}
+
+// downloadInformationDockerArchive reads the image from a tarball written by
+// `docker save`. Its manifest.json is searched for the image tagged ref,
+// which may be left out if there is only one image.
+func (cc *ContainerConverter) downloadInformationDockerArchive(path, ref string) error {
+
+	cc.logger.Printf("getting image from docker archive %s", path)
+
+	var tag *name.Tag
+	if ref != "" {
+		t, err := name.NewTag(ref)
+		if err != nil {
+			return err
+		}
+		tag = &t
+	}
+
+	img, err := tarball.ImageFromPath(path, tag)
+	if err != nil {
+		return err
+	}
+
+	d, err := img.Digest()
+	if err != nil {
+		d, err = img.ConfigName()
+		if err != nil {
+			return err
+		}
+	}
+
+	cc.digest = digest.Digest(d.String())
+
+	return cc.imageHandler(img)
+
+}
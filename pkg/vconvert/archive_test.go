@@ -0,0 +1,309 @@
+package vconvert
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/assert"
+)
+
+// testImage returns an image whose only layer holds the files in files, and
+// which runs /bin/app.
+func testImage(t *testing.T, files map[string]string) v1.Image {
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0755,
+			Size:     int64(len(content)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tarball.LayerFromReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := mutate.AppendLayers(empty.Image, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err = mutate.Config(img, v1.Config{
+		Cmd:          []string{"/bin/app", "--serve"},
+		ExposedPorts: map[string]struct{}{"8080/tcp": {}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return img
+
+}
+
+func TestSplitArchiveSource(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "vtest")
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "app.tar")
+	ioutil.WriteFile(archive, []byte{}, 0644)
+
+	var cc = []struct {
+		src  string
+		path string
+		ref  string
+	}{
+		{dir, dir, ""},
+		{dir + ":v1", dir, "v1"},
+		{archive, archive, ""},
+		{archive + ":app:v1", archive, "app:v1"},
+		{dir + "/missing:v1", dir + "/missing:v1", ""},
+	}
+
+	for _, c := range cc {
+		path, ref := splitArchiveSource(c.src)
+		assert.Equal(t, c.path, path)
+		assert.Equal(t, c.ref, ref)
+	}
+
+}
+
+func TestConvertOCI(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "vtest")
+	defer os.RemoveAll(dir)
+
+	oci := filepath.Join(dir, "oci")
+	p, err := layout.Write(oci, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.AppendImage(testImage(t, map[string]string{"bin/app": "v1"}), layout.WithAnnotations(map[string]string{
+		ociRefNameAnnotation: "v1",
+	}))
+	assert.NoError(t, err)
+	err = p.AppendImage(testImage(t, map[string]string{"bin/app": "v2"}), layout.WithAnnotations(map[string]string{
+		ociRefNameAnnotation: "v2",
+	}))
+	assert.NoError(t, err)
+
+	_, err = NewContainerConverter("oci:"+filepath.Join(dir, "missing"), "", nil)
+	assert.Error(t, err)
+
+	// there is more than one image to choose from
+	cc, err := NewContainerConverter("oci:"+oci, "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, OCIRegistry, cc.RegistryType())
+	err = cc.ConvertToProject(filepath.Join(dir, "none"), "", "")
+	assert.Error(t, err)
+
+	cc, err = NewContainerConverter("oci:"+oci+":v2", "", nil)
+	assert.NoError(t, err)
+
+	dst := filepath.Join(dir, "project")
+	err = cc.ConvertToProject(dst, "", "")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dst, "bin", "app"))
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", string(b))
+
+	b, err = ioutil.ReadFile(filepath.Join(dst, "default.vcfg"))
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(string(b), "/bin/app --serve"))
+	assert.True(t, strings.Contains(string(b), "8080"))
+
+}
+
+func TestConvertDockerArchive(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "vtest")
+	defer os.RemoveAll(dir)
+
+	tag, err := name.NewTag("app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(dir, "app.tar")
+	err = tarball.WriteToFile(archive, tag, testImage(t, map[string]string{"bin/app": "v1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, src := range []string{archive, archive + ":app:v1"} {
+		cc, err := NewContainerConverter("docker-archive:"+src, "", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, DockerArchiveRegistry, cc.RegistryType())
+
+		dst, _ := ioutil.TempDir(dir, "project")
+		err = cc.ConvertToProject(dst, "", "")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(dst, "bin", "app"))
+		assert.NoError(t, err)
+		assert.Equal(t, "v1", string(b))
+	}
+
+	cc, err := NewContainerConverter("docker-archive:"+archive+":app:v2", "", nil)
+	assert.NoError(t, err)
+	err = cc.ConvertToProject(filepath.Join(dir, "none"), "", "")
+	assert.Error(t, err)
+
+	// the digest of the image's manifest is recorded
+	img, err := tarball.ImageFromPath(archive, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _ := img.Digest()
+
+	cc, err = NewContainerConverter("docker-archive:"+archive, "", nil)
+	assert.NoError(t, err)
+	err = cc.downloadImageInformation(nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, d.String(), cc.digest.String())
+
+}
+
+func TestConvertOCIPlatform(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "vtest")
+	defer os.RemoveAll(dir)
+
+	amd64 := testImage(t, map[string]string{"bin/app": "amd64"})
+	arm64 := testImage(t, map[string]string{"bin/app": "arm64"})
+
+	idx := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{
+			Add: arm64,
+			Descriptor: v1.Descriptor{
+				Platform: &v1.Platform{OS: "linux", Architecture: "arm64"},
+			},
+		},
+		mutate.IndexAddendum{
+			Add: amd64,
+			Descriptor: v1.Descriptor{
+				Platform: &v1.Platform{OS: "linux", Architecture: "amd64"},
+			},
+		},
+	)
+
+	oci := filepath.Join(dir, "oci")
+	p, err := layout.Write(oci, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.AppendIndex(idx, layout.WithAnnotations(map[string]string{
+		ociRefNameAnnotation: "multi",
+	}))
+	assert.NoError(t, err)
+
+	for platform, exp := range map[string]v1.Image{"": amd64, "linux/arm64": arm64} {
+
+		cc, err := NewContainerConverter("oci:"+oci+":multi", "", nil)
+		assert.NoError(t, err)
+
+		if platform != "" {
+			err = cc.SetPlatform(platform)
+			assert.NoError(t, err)
+		}
+
+		err = cc.downloadImageInformation(nil)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		// the digest of the manifest picked is recorded
+		d, _ := exp.Digest()
+		assert.Equal(t, d.String(), cc.digest.String())
+		assert.Equal(t, "oci:"+oci+"@"+d.String(), cc.source())
+
+		l, _ := exp.Layers()
+		ld, _ := l[0].Digest()
+		assert.Equal(t, ld.String(), cc.layers[0].digest.String())
+	}
+
+	cc, err := NewContainerConverter("oci:"+oci+":multi", "", nil)
+	assert.NoError(t, err)
+	err = cc.SetPlatform("linux/s390x")
+	assert.NoError(t, err)
+	err = cc.downloadImageInformation(nil)
+	assert.Error(t, err)
+
+	err = cc.SetPlatform("linux/*")
+	assert.Error(t, err)
+
+}
+
+func TestConvertOCIDigestOtherPlatform(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "vtest")
+	defer os.RemoveAll(dir)
+
+	s390x := testImage(t, map[string]string{"bin/app": "s390x"})
+
+	oci := filepath.Join(dir, "oci")
+	p, err := layout.Write(oci, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.AppendImage(s390x, layout.WithPlatform(v1.Platform{OS: "linux", Architecture: "s390x"}))
+	assert.NoError(t, err)
+
+	// the platform filters out the only image when it is asked for by name
+	cc, err := NewContainerConverter("oci:"+oci, "", nil)
+	assert.NoError(t, err)
+	err = cc.downloadImageInformation(nil)
+	assert.Error(t, err)
+
+	// but a digest picks it out whatever its platform
+	d, _ := s390x.Digest()
+	cc, err = NewContainerConverter("oci:"+oci+":"+d.String(), "", nil)
+	assert.NoError(t, err)
+	err = cc.downloadImageInformation(nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, d.String(), cc.digest.String())
+
+}
@@ -0,0 +1,651 @@
+package vconvert
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	unixpath "path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// whiteouts mark files deleted from lower layers, as described in the OCI
+// image spec
+const (
+	whiteoutPrefix     = ".wh."
+	whiteoutMetaPrefix = ".wh..wh."
+	whiteoutOpaqueDir  = ".wh..wh..opq"
+
+	xattrPAXPrefix = "SCHILY.xattr."
+)
+
+// layerFile reads the entries of a layer tarball on disk. Entries are
+// expected to be read mostly in order, and the layer is only decompressed
+// again from the start if an earlier entry is asked for.
+type layerFile struct {
+	path   string
+	number int
+
+	lock   sync.Mutex
+	refs   int
+	f      *os.File
+	rc     io.ReadCloser
+	tr     *tar.Reader
+	index  int   // entry tr is positioned at, or -1 before the first
+	offset int64 // bytes already read from that entry
+}
+
+func (l *layerFile) reset() error {
+
+	l.close()
+
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+
+	rc, err := compression.DecompressStream(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.f = f
+	l.rc = rc
+	l.tr = tar.NewReader(rc)
+	l.index = -1
+	l.offset = 0
+
+	return nil
+
+}
+
+func (l *layerFile) close() error {
+
+	if l.f == nil {
+		return nil
+	}
+
+	l.rc.Close()
+	err := l.f.Close()
+	l.f, l.rc, l.tr = nil, nil, nil
+
+	return err
+
+}
+
+// readAt reads the entry numbered index, starting offset bytes into it.
+func (l *layerFile) readAt(index int, offset int64, p []byte) (int, error) {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.tr == nil || index < l.index || (index == l.index && offset < l.offset) {
+		err := l.reset()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for l.index < index {
+		_, err := l.tr.Next()
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		l.index++
+		l.offset = 0
+	}
+
+	if offset > l.offset {
+		n, err := io.CopyN(ioutil.Discard, l.tr, offset-l.offset)
+		l.offset += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := l.tr.Read(p)
+	l.offset += int64(n)
+
+	return n, err
+
+}
+
+// hold and release count the files still able to read from the layer, so it
+// can be closed once the last of them is.
+func (l *layerFile) hold() {
+	l.lock.Lock()
+	l.refs++
+	l.lock.Unlock()
+}
+
+func (l *layerFile) release() error {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.refs--
+	if l.refs > 0 {
+		return nil
+	}
+
+	return l.close()
+
+}
+
+// layerContent is the data of a regular file, which stays in its layer until
+// it is read. Hardlinks share the layerContent of the file they link to.
+type layerContent struct {
+	layer *layerFile
+	index int
+	size  int64
+}
+
+type entryReader struct {
+	layer  *layerFile
+	index  int
+	offset int64
+}
+
+func (r *entryReader) Read(p []byte) (int, error) {
+	n, err := r.layer.readAt(r.index, r.offset, p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (c *layerContent) reader() io.Reader {
+	return &entryReader{
+		layer: c.layer,
+		index: c.index,
+	}
+}
+
+func (c *layerContent) readCloser() io.ReadCloser {
+	c.layer.hold()
+	return vio.LazyReadCloser(func() (io.Reader, error) {
+		return c.reader(), nil
+	}, c.layer.release)
+}
+
+// layerNode is a file or directory in the flattened file-system, which
+// remembers the layer that last changed it.
+type layerNode struct {
+	hdr      *tar.Header
+	layer    int
+	content  *layerContent
+	children map[string]*layerNode
+}
+
+func (n *layerNode) isDir() bool {
+	return n.hdr.Typeflag == tar.TypeDir
+}
+
+// prune removes everything below n that was added by a layer lower than
+// layer.
+func (n *layerNode) prune(layer int) {
+	for name, child := range n.children {
+		if child.layer < layer {
+			delete(n.children, name)
+		} else {
+			child.prune(layer)
+		}
+	}
+}
+
+// walk visits n and everything below it, with children in order of their
+// names.
+func (n *layerNode) walk(path string, fn func(path string, n *layerNode) error) error {
+
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		child := n.children[name]
+		p := unixpath.Join(path, name)
+
+		err := fn(p, child)
+		if err != nil {
+			return err
+		}
+
+		if child.isDir() {
+			err = child.walk(p, fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+
+}
+
+func (n *layerNode) metadata() *vio.Metadata {
+
+	md := &vio.Metadata{
+		Mode: uint32(n.hdr.Mode) & 07777,
+		UID:  n.hdr.Uid,
+		GID:  n.hdr.Gid,
+	}
+
+	for k, v := range n.hdr.PAXRecords {
+		if strings.HasPrefix(k, xattrPAXPrefix) {
+			if md.Xattrs == nil {
+				md.Xattrs = make(map[string][]byte)
+			}
+			md.Xattrs[strings.TrimPrefix(k, xattrPAXPrefix)] = []byte(v)
+		}
+	}
+
+	return md
+
+}
+
+func (n *layerNode) file(name string) vio.File {
+
+	args := vio.CustomFileArgs{
+		Name:     name,
+		ModTime:  n.hdr.ModTime,
+		Metadata: n.metadata(),
+	}
+
+	switch {
+	case n.isDir():
+		args.IsDir = true
+		args.ReadCloser = ioutil.NopCloser(strings.NewReader(""))
+	case n.hdr.Typeflag == tar.TypeSymlink:
+		args.IsSymlink = true
+		args.Symlink = n.hdr.Linkname
+		args.Size = len(n.hdr.Linkname)
+		args.ReadCloser = ioutil.NopCloser(strings.NewReader(n.hdr.Linkname))
+	default:
+		args.Size = int(n.content.size)
+		args.ReadCloser = n.content.readCloser()
+	}
+
+	return vio.CustomFile(args)
+
+}
+
+// flattener applies container image layers one after the other, the way an
+// overlay file-system stacks them, without extracting any of them.
+type flattener struct {
+	root   *layerNode
+	layers []*layerFile
+	log    elog.View
+}
+
+func newFlattener(log elog.View) *flattener {
+	return &flattener{
+		root: &layerNode{
+			hdr: &tar.Header{
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+			},
+			children: make(map[string]*layerNode),
+		},
+		log: log,
+	}
+}
+
+// cleanEntryName turns the name of a tar entry into a path relative to the
+// root of the file-system, which is empty for the root itself.
+func cleanEntryName(name string) string {
+	return strings.TrimPrefix(unixpath.Clean("/"+name), "/")
+}
+
+// skipped returns true for anything in the folders the kernel mounts over.
+func skipped(path string) bool {
+	top := strings.SplitN(path, "/", 2)[0]
+	for _, f := range folders {
+		if top == f {
+			return true
+		}
+	}
+	return false
+}
+
+func (fl *flattener) lookup(path string) *layerNode {
+
+	n := fl.root
+	for _, name := range strings.Split(path, "/") {
+		if !n.isDir() {
+			return nil
+		}
+		n = n.children[name]
+		if n == nil {
+			return nil
+		}
+	}
+
+	return n
+
+}
+
+// exists returns true if there is anything at path, which may be absolute.
+func (fl *flattener) exists(path string) bool {
+	return fl.lookup(cleanEntryName(path)) != nil
+}
+
+func (fl *flattener) readFile(path string) ([]byte, error) {
+
+	n := fl.lookup(cleanEntryName(path))
+	if n == nil || n.content == nil {
+		return nil, fmt.Errorf("%s: %w", path, os.ErrNotExist)
+	}
+
+	return ioutil.ReadAll(n.content.reader())
+
+}
+
+// mkdirAll returns the directory at path, creating it and any parents that
+// don't exist yet. Anything in the way that isn't a directory is replaced.
+func (fl *flattener) mkdirAll(path string, layer int, modTime time.Time) *layerNode {
+
+	n := fl.root
+	if path == "" {
+		return n
+	}
+
+	for _, name := range strings.Split(path, "/") {
+		child := n.children[name]
+		if child == nil || !child.isDir() {
+			child = &layerNode{
+				hdr: &tar.Header{
+					Typeflag: tar.TypeDir,
+					Name:     name,
+					Mode:     0755,
+					ModTime:  modTime,
+				},
+				layer:    layer,
+				children: make(map[string]*layerNode),
+			}
+			n.children[name] = child
+		}
+		n = child
+	}
+
+	return n
+
+}
+
+// apply adds the layer tarball at path on top of the layers applied so far.
+func (fl *flattener) apply(path string) error {
+
+	l := &layerFile{
+		path:   path,
+		number: len(fl.layers),
+		index:  -1,
+	}
+	fl.layers = append(fl.layers, l)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := compression.DecompressStream(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading layer %s: %w", path, err)
+		}
+
+		err = fl.applyEntry(l, index, hdr)
+		if err != nil {
+			return fmt.Errorf("error applying layer %s: %w", path, err)
+		}
+	}
+
+	return nil
+
+}
+
+func (fl *flattener) applyEntry(l *layerFile, index int, hdr *tar.Header) error {
+
+	path := cleanEntryName(hdr.Name)
+	if path == "" {
+		return nil
+	}
+
+	if skipped(path) {
+		fl.log.Debugf("skipping file/dir %s", hdr.Name)
+		return nil
+	}
+
+	dir, name := unixpath.Split(path)
+	dir = strings.TrimSuffix(dir, "/")
+
+	if strings.HasPrefix(name, whiteoutPrefix) {
+		parent := fl.mkdirAll(dir, l.number, hdr.ModTime)
+		switch {
+		case name == whiteoutOpaqueDir:
+			parent.prune(l.number)
+		case strings.HasPrefix(name, whiteoutMetaPrefix):
+			// other aufs metadata, not part of the file-system
+		default:
+			name = strings.TrimPrefix(name, whiteoutPrefix)
+			child := parent.children[name]
+			if child == nil {
+				break
+			}
+			if child.layer < l.number {
+				delete(parent.children, name)
+			} else {
+				child.prune(l.number)
+			}
+		}
+		return nil
+	}
+
+	n := &layerNode{
+		hdr:   hdr,
+		layer: l.number,
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		n.children = make(map[string]*layerNode)
+	case tar.TypeReg:
+		n.content = &layerContent{
+			layer: l,
+			index: index,
+			size:  hdr.Size,
+		}
+	case tar.TypeSymlink:
+	case tar.TypeLink:
+		target := fl.lookup(cleanEntryName(hdr.Linkname))
+		if target == nil || target.isDir() {
+			return fmt.Errorf("hardlink %s points to missing file %s", hdr.Name, hdr.Linkname)
+		}
+		// the link shares its target's inode, owner and mode included
+		h := *target.hdr
+		h.Name = hdr.Name
+		n.hdr = &h
+		n.content = target.content
+	default:
+		fl.log.Debugf("skipping %s, unsupported file type '%c'", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+
+	parent := fl.mkdirAll(dir, l.number, hdr.ModTime)
+
+	// a directory over a directory merges the two
+	if old := parent.children[name]; old != nil && old.isDir() && n.isDir() {
+		n.children = old.children
+	}
+
+	parent.children[name] = n
+
+	return nil
+
+}
+
+// tree returns the flattened file-system as a FileTree.
+func (fl *flattener) tree() (vio.FileTree, error) {
+
+	t := vio.NewFileTree()
+
+	err := fl.root.walk("", func(path string, n *layerNode) error {
+		return t.Map(path, n.file(unixpath.Base(path)))
+	})
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	return t, nil
+
+}
+
+// writeDir extracts the flattened file-system into dir. Files are owned by
+// the user running the conversion, unless that is root.
+func (fl *flattener) writeDir(dir string) error {
+
+	links := make(map[*layerContent]string)
+	var dirs []*layerNode
+	var dirPaths []string
+
+	root := os.Geteuid() == 0
+
+	err := fl.root.walk("", func(path string, n *layerNode) error {
+
+		var err error
+		dst := filepath.Join(dir, filepath.FromSlash(path))
+
+		switch {
+		case n.isDir():
+			// permissions are set once the directory has been filled
+			dirs = append(dirs, n)
+			dirPaths = append(dirPaths, dst)
+			return os.Mkdir(dst, 0755)
+		case n.hdr.Typeflag == tar.TypeSymlink:
+			err = os.Symlink(n.hdr.Linkname, dst)
+			if err == nil && root {
+				err = os.Lchown(dst, n.hdr.Uid, n.hdr.Gid)
+			}
+			return err
+		}
+
+		if link, ok := links[n.content]; ok {
+			return os.Link(link, dst)
+		}
+		links[n.content] = dst
+
+		f, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(f, n.content.reader())
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		return setAttributes(dst, n.hdr, root)
+
+	})
+
+	for _, l := range fl.layers {
+		l.close()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err = setAttributes(dirPaths[i], dirs[i].hdr, root)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+func setAttributes(path string, hdr *tar.Header, root bool) error {
+
+	if root {
+		err := os.Lchown(path, hdr.Uid, hdr.Gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := os.Chmod(path, hdr.FileInfo().Mode())
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+
+}
+
+func flattenLayers(files []string, log elog.View) (*flattener, error) {
+
+	fl := newFlattener(log)
+
+	for _, file := range files {
+		log.Printf("apply layer %s", file)
+		err := fl.apply(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return fl, nil
+
+}
+
+// FlattenLayers stacks the layer tarballs in files, lowest first, and
+// returns the file-system they make up. Whiteouts and opaque directories
+// delete files from lower layers, and hardlinks, owners and modes are kept.
+// Files aren't extracted; their contents are read from the layers as they
+// are needed, so files must not be removed until the tree has been closed.
+func FlattenLayers(files []string, log elog.View) (vio.FileTree, error) {
+
+	if log == nil {
+		log = &elog.CLI{}
+	}
+
+	fl, err := flattenLayers(files, log)
+	if err != nil {
+		return nil, err
+	}
+
+	return fl.tree()
+
+}
@@ -0,0 +1,291 @@
+package vconvert
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+type testEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	link     string
+	mode     int64
+	uid      int
+}
+
+// writeLayer writes entries as a layer tarball, gzipped if compress is set.
+func writeLayer(t *testing.T, path string, compress bool, entries ...testEntry) {
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	if compress {
+		gw := gzip.NewWriter(f)
+		defer gw.Close()
+		w = gw
+	}
+
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Typeflag: e.typeflag,
+			Name:     e.name,
+			Linkname: e.link,
+			Mode:     e.mode,
+			Uid:      e.uid,
+			Gid:      e.uid,
+			Size:     int64(len(e.content)),
+		}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if e.name == "usr/bin/app" {
+			hdr.PAXRecords = map[string]string{
+				"SCHILY.xattr.user.test": "value",
+			}
+		}
+
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write([]byte(e.content[:hdr.Size]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+}
+
+func testLayers(t *testing.T, dir string) []string {
+
+	lower := filepath.Join(dir, "lower.tar.gz")
+	writeLayer(t, lower, true,
+		testEntry{name: "etc/", typeflag: tar.TypeDir, mode: 0755},
+		testEntry{name: "etc/passwd", content: "root"},
+		testEntry{name: "etc/shadow", content: "secret", mode: 0600},
+		testEntry{name: "opt/app/", typeflag: tar.TypeDir, mode: 0755},
+		testEntry{name: "opt/app/old.conf", content: "old"},
+		testEntry{name: "opt/app/data/cache", content: "cache"},
+		testEntry{name: "usr/bin/app", content: "app", mode: 04755, uid: 1000},
+		testEntry{name: "usr/bin/app-link", typeflag: tar.TypeLink, link: "usr/bin/app"},
+		testEntry{name: "usr/bin/sh", typeflag: tar.TypeSymlink, link: "app"},
+		testEntry{name: "dev/null", content: "skipped"},
+	)
+
+	upper := filepath.Join(dir, "upper.tar")
+	writeLayer(t, upper, false,
+		testEntry{name: "etc/.wh.shadow"},
+		testEntry{name: "etc/hosts", content: "localhost"},
+		testEntry{name: "opt/app/new.conf", content: "new"},
+		testEntry{name: "opt/app/.wh..wh..opq"},
+		testEntry{name: "usr/bin/alias", typeflag: tar.TypeLink, link: "usr/bin/app"},
+		testEntry{name: "usr/bin/.wh.app"},
+		testEntry{name: ".wh.missing"},
+	)
+
+	return []string{lower, upper}
+
+}
+
+func TestFlattenLayers(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "vtest")
+	defer os.RemoveAll(dir)
+
+	tree, err := FlattenLayers(testLayers(t, dir), &elog.CLI{})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer tree.Close()
+
+	var paths []string
+	contents := make(map[string]string)
+	metadata := make(map[string]*vio.Metadata)
+
+	err = tree.Walk(func(path string, f vio.File) error {
+		paths = append(paths, path)
+		metadata[path] = vio.MetadataOf(f)
+		if !f.IsDir() && !f.IsSymlink() {
+			b, err := ioutil.ReadAll(f)
+			if err != nil {
+				return err
+			}
+			contents[path] = string(b)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{
+		".",
+		"./etc",
+		"./etc/hosts",
+		"./etc/passwd",
+		"./opt",
+		"./opt/app",
+		"./opt/app/new.conf",
+		"./usr",
+		"./usr/bin",
+		"./usr/bin/alias",
+		"./usr/bin/app-link",
+		"./usr/bin/sh",
+	}, paths)
+
+	assert.Equal(t, map[string]string{
+		"./etc/hosts":        "localhost",
+		"./etc/passwd":       "root",
+		"./opt/app/new.conf": "new",
+		"./usr/bin/alias":    "app",
+		"./usr/bin/app-link": "app",
+	}, contents)
+
+	// hardlinks keep the owner and mode of the file they point to
+	for _, path := range []string{"./usr/bin/alias", "./usr/bin/app-link"} {
+		md := metadata[path]
+		assert.Equal(t, uint32(04755), md.Mode)
+		assert.Equal(t, 1000, md.UID)
+		assert.Equal(t, 1000, md.GID)
+		assert.Equal(t, []byte("value"), md.Xattrs["user.test"])
+	}
+
+	assert.Equal(t, uint32(0644), metadata["./etc/passwd"].Mode)
+	assert.Equal(t, 0, metadata["./etc/passwd"].UID)
+
+}
+
+func TestFlattenLayersReadOrder(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "vtest")
+	defer os.RemoveAll(dir)
+
+	layer := filepath.Join(dir, "layer.tar.gz")
+	writeLayer(t, layer, true,
+		testEntry{name: "a", content: "aaaa"},
+		testEntry{name: "b", content: "bbbb"},
+		testEntry{name: "c", content: "cccc"},
+	)
+
+	fl, err := flattenLayers([]string{layer}, &elog.CLI{})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	read := func(name string, n int) string {
+		r := fl.root.children[name].content.reader()
+		b := make([]byte, n)
+		_, err := io.ReadFull(r, b)
+		assert.NoError(t, err)
+		return string(b)
+	}
+
+	// going backwards reopens the layer
+	assert.Equal(t, "cccc", read("c", 4))
+	assert.Equal(t, "aa", read("a", 2))
+	assert.Equal(t, "bbbb", read("b", 4))
+	assert.Equal(t, "aaaa", read("a", 4))
+
+	// readers keep their place even if another moves the layer on
+	ra := fl.root.children["a"].content.reader()
+	rb := fl.root.children["b"].content.reader()
+	b := make([]byte, 2)
+	io.ReadFull(ra, b)
+	io.ReadFull(rb, b)
+	io.ReadFull(ra, b)
+	assert.Equal(t, "aa", string(b))
+	b, _ = ioutil.ReadAll(rb)
+	assert.Equal(t, "bb", string(b))
+
+	for _, l := range fl.layers {
+		l.close()
+	}
+
+}
+
+func TestFlattenLayersWriteDir(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks and modes are not supported")
+	}
+
+	dir, _ := ioutil.TempDir("", "vtest")
+	defer os.RemoveAll(dir)
+
+	fl, err := flattenLayers(testLayers(t, dir), &elog.CLI{})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	dst := filepath.Join(dir, "root")
+	err = os.Mkdir(dst, 0755)
+	assert.NoError(t, err)
+
+	err = fl.writeDir(dst)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	var paths []string
+	filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+		rel, _ := filepath.Rel(dst, path)
+		paths = append(paths, filepath.ToSlash(rel))
+		return nil
+	})
+	sort.Strings(paths)
+
+	assert.Equal(t, []string{
+		".",
+		"etc",
+		"etc/hosts",
+		"etc/passwd",
+		"opt",
+		"opt/app",
+		"opt/app/new.conf",
+		"usr",
+		"usr/bin",
+		"usr/bin/alias",
+		"usr/bin/app-link",
+		"usr/bin/sh",
+	}, paths)
+
+	fa, err := os.Stat(filepath.Join(dst, "usr/bin/alias"))
+	assert.NoError(t, err)
+	fb, err := os.Stat(filepath.Join(dst, "usr/bin/app-link"))
+	assert.NoError(t, err)
+	assert.True(t, os.SameFile(fa, fb))
+	assert.Equal(t, os.FileMode(0755)|os.ModeSetuid, fa.Mode())
+
+	link, err := os.Readlink(filepath.Join(dst, "usr/bin/sh"))
+	assert.NoError(t, err)
+	assert.Equal(t, "app", link)
+
+}
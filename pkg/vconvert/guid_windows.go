@@ -1,11 +0,0 @@
-// +build windows
-package vconvert
-
-/**
- * SPDX-License-Identifier: Apache-2.0
- * Copyright 2020 vorteil.io Pty Ltd
- */
-
-func fetchUIDandGID() (int, int) {
-	return 1000, 1000
-}
@@ -19,6 +19,7 @@ import (
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/heroku/docker-registry-client/registry"
+	godigest "github.com/opencontainers/go-digest"
 )
 
 const (
@@ -48,9 +49,22 @@ func (cc *ContainerConverter) downloadInformationContainerd(image, tag string) e
 
 	cc.tmpLocalTar = o
 
-	img := fmt.Sprintf("%s:%s", image, tag)
+	img := localImageName(image, tag)
 
-	err = client.Export(ctx, cc.tmpLocalTar, archive.WithPlatform(platforms.Default()), archive.WithImage(client.ImageService(), img))
+	if d, err := godigest.Parse(tag); err == nil {
+		// containerd only finds pinned images by the digest of their target
+		imgs, err := client.ImageService().List(ctx, "target.digest=="+d.String())
+		if err != nil {
+			return err
+		}
+		if len(imgs) == 0 {
+			return fmt.Errorf("image %s not found", img)
+		}
+		img = imgs[0].Name
+		cc.digest = d
+	}
+
+	err = client.Export(ctx, cc.tmpLocalTar, archive.WithPlatform(platforms.Only(cc.platform())), archive.WithImage(client.ImageService(), img))
 	if err != nil {
 		return err
 	}
@@ -74,7 +88,11 @@ func (cc *ContainerConverter) downloadInformationDocker(image, tag string) error
 	}
 	cli.NegotiateAPIVersion(ctx)
 
-	r, err := cli.ImageSave(ctx, []string{image})
+	if d, err := godigest.Parse(tag); err == nil {
+		cc.digest = d
+	}
+
+	r, err := cli.ImageSave(ctx, []string{localImageName(image, tag)})
 	if err != nil {
 		return err
 	}
@@ -95,6 +113,18 @@ func (cc *ContainerConverter) downloadInformationDocker(image, tag string) error
 
 }
 
+// localImageName returns the name of an image in a container runtime, which
+// is pinned if tag is a digest.
+func localImageName(image, tag string) string {
+
+	if _, err := godigest.Parse(tag); err == nil {
+		return fmt.Sprintf("%s@%s", image, tag)
+	}
+
+	return fmt.Sprintf("%s:%s", image, tag)
+
+}
+
 func (cc *ContainerConverter) localHandler(path string) error {
 
 	img, err := tarball.ImageFromPath(path, nil)
@@ -102,6 +132,13 @@ func (cc *ContainerConverter) localHandler(path string) error {
 		return err
 	}
 
+	return cc.imageHandler(img)
+}
+
+// imageHandler stores the layers and config of an image read from disk, whose
+// layers are read with localGetReader.
+func (cc *ContainerConverter) imageHandler(img v1.Image) error {
+
 	layers, err := img.Layers()
 	if err != nil {
 		return err
@@ -118,14 +155,25 @@ func (cc *ContainerConverter) localHandler(path string) error {
 			return err
 		}
 		ifs[i] = &layer{
-			layer: d,
-			size:  s,
-			hash:  digest.Hex[7:15],
+			layer:  d,
+			size:   s,
+			hash:   digest.Hex[7:15],
+			digest: godigest.Digest(digest.String()),
 		}
 
 	}
 	cc.layers = ifs
 
+	// images with a known manifest keep its digest, others are identified
+	// by their image id
+	if cc.digest == "" {
+		id, err := img.ConfigName()
+		if err != nil {
+			return err
+		}
+		cc.digest = godigest.Digest(id.String())
+	}
+
 	config, err := img.ConfigFile()
 	if err != nil {
 		return err
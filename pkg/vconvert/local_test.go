@@ -7,6 +7,7 @@ package vconvert
 
 import (
 	"io/ioutil"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -65,3 +66,12 @@ func TestDownloadInformationContainerd(t *testing.T) {
 	assert.NoError(t, err)
 
 }
+
+func TestLocalImageName(t *testing.T) {
+
+	d := "sha256:" + strings.Repeat("a", 64)
+
+	assert.Equal(t, "hello-world:latest", localImageName("hello-world", "latest"))
+	assert.Equal(t, "hello-world@"+d, localImageName("hello-world", d))
+
+}
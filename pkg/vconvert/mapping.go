@@ -0,0 +1,456 @@
+package vconvert
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	unixpath "path"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultVolumeSize = "64 MiB"
+
+	infoName        = "name"
+	infoAuthor      = "author"
+	infoSummary     = "summary"
+	infoDescription = "description"
+	infoURL         = "url"
+	infoVersion     = "version"
+	infoDate        = "date"
+)
+
+// defaultLabels maps the labels of an image onto the info fields of its
+// VCFG. The OCI annotations come first, so they win over the older
+// label-schema ones.
+var defaultLabels = map[string]string{
+	"org.opencontainers.image.title":       infoName,
+	"org.opencontainers.image.authors":     infoAuthor,
+	"org.opencontainers.image.description": infoDescription,
+	"org.opencontainers.image.url":         infoURL,
+	"org.opencontainers.image.version":     infoVersion,
+	"org.opencontainers.image.created":     infoDate,
+	"org.label-schema.name":                infoName,
+	"org.label-schema.description":         infoDescription,
+	"org.label-schema.url":                 infoURL,
+	"org.label-schema.version":             infoVersion,
+	"org.label-schema.build-date":          infoDate,
+	"maintainer":                           infoAuthor,
+}
+
+// Mapping adjusts how the configuration of an image is turned into a VCFG.
+type Mapping struct {
+
+	// Images holds patterns matched against the image being converted,
+	// as given or as a full reference, e.g. "nginx:*" or
+	// "docker.io/library/*". A mapping without images applies to all of
+	// them.
+	Images []string `yaml:"images,omitempty"`
+
+	// User replaces the user the image runs as. An empty user runs the
+	// program as root.
+	User *string `yaml:"user,omitempty"`
+
+	// Privilege replaces the privilege derived from the user.
+	Privilege vcfg.Privilege `yaml:"privilege,omitempty"`
+
+	// Volumes sets the space set aside for the image's volumes, e.g.
+	// "1 GiB", instead of the default. Volumes are part of the root
+	// file-system, so the space is added to the disk, or to the overlay
+	// if the file-system is read-only.
+	Volumes map[string]string `yaml:"volumes,omitempty"`
+
+	// Labels maps labels onto info fields (name, author, summary,
+	// description, url, version or date), adding to the OCI annotations
+	// mapped by default. Mapping a label to "" ignores it.
+	Labels map[string]string `yaml:"labels,omitempty"`
+
+	// VCFG is merged over the generated VCFG. Its info only fills in
+	// fields not set from labels.
+	VCFG string `yaml:"vcfg,omitempty"`
+}
+
+// Mappings are applied in order, so later mappings override earlier ones
+// matching the same image.
+type Mappings []Mapping
+
+type mappingsFile struct {
+	Mappings Mappings `yaml:"mappings"`
+}
+
+// LoadMappings reads a YAML file listing mappings under "mappings", e.g.
+//
+//	mappings:
+//	- images: ["nginx", "nginx:*"]
+//	  user: nginx
+//	  volumes:
+//	    /var/cache/nginx: 512 MiB
+//	  vcfg: |
+//	    [vm]
+//	    ram = "512 MiB"
+func LoadMappings(path string) (Mappings, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := new(mappingsFile)
+	err = yaml.UnmarshalStrict(data, f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mapping file '%s': %w", path, err)
+	}
+
+	for i, m := range f.Mappings {
+		for _, p := range m.Images {
+			if _, err := unixpath.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("invalid image pattern '%s' in mapping %d: %w", p, i, err)
+			}
+		}
+		for label, field := range m.Labels {
+			if field != "" && !isInfoField(field) {
+				return nil, fmt.Errorf("label '%s' in mapping %d maps to unknown info field '%s'", label, i, field)
+			}
+		}
+	}
+
+	return f.Mappings, nil
+
+}
+
+func isInfoField(s string) bool {
+	switch s {
+	case infoName, infoAuthor, infoSummary, infoDescription, infoURL, infoVersion, infoDate:
+		return true
+	}
+	return false
+}
+
+// matches returns true if the mapping applies to an image known by any of
+// names.
+func (m *Mapping) matches(names []string) bool {
+
+	if len(m.Images) == 0 {
+		return true
+	}
+
+	for _, p := range m.Images {
+		for _, name := range names {
+			if ok, _ := unixpath.Match(p, name); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+
+}
+
+// forImage combines the mappings that apply to an image known by any of
+// names.
+func (ms Mappings) forImage(names []string) *Mapping {
+
+	x := &Mapping{
+		Volumes: make(map[string]string),
+		Labels:  make(map[string]string),
+	}
+
+	for k, v := range defaultLabels {
+		x.Labels[k] = v
+	}
+
+	for _, m := range ms {
+
+		if !m.matches(names) {
+			continue
+		}
+
+		if m.User != nil {
+			x.User = m.User
+		}
+
+		if m.Privilege != "" {
+			x.Privilege = m.Privilege
+		}
+
+		for k, v := range m.Volumes {
+			x.Volumes[k] = v
+		}
+
+		for k, v := range m.Labels {
+			x.Labels[k] = v
+		}
+
+		if m.VCFG != "" {
+			x.VCFG += m.VCFG + "\n"
+		}
+	}
+
+	return x
+
+}
+
+// mapUser sets the user and privilege of the program from the user the
+// image runs as, which may be a name or a uid, optionally followed by a
+// group. A uid which isn't in the image's /etc/passwd is an error, as the
+// program would otherwise end up running as root.
+func (cc *ContainerConverter) mapUser(v *vcfg.VCFG, user string, privilege vcfg.Privilege, fsys imageFS) error {
+
+	name, group := user, ""
+	if i := strings.Index(user, ":"); i >= 0 {
+		name, group = user[:i], user[i+1:]
+	}
+
+	var entry []string
+	if name != "" {
+		entry = lookupEntry(fsys, "/etc/passwd", name)
+	}
+
+	if uid, err := strconv.Atoi(name); err == nil {
+		switch {
+		case uid == 0:
+			name = ""
+		case entry != nil:
+			name = entry[0]
+		default:
+			return fmt.Errorf("user %d not found in the image's /etc/passwd, a mapping can set the user instead", uid)
+		}
+	}
+
+	// programs run in the primary group of their user
+	if group != "" && (entry == nil || lookupGID(fsys, group) != entry[3]) {
+		cc.logger.Warnf("ignoring group %s of user %s, programs run in the primary group of their user", group, user)
+	}
+
+	if name != "" && name != "root" {
+		v.System.User = name
+		v.Programs[0].Privilege = vcfg.UserPrivilege
+	}
+
+	if privilege != "" {
+		v.Programs[0].Privilege = privilege
+	}
+
+	return nil
+
+}
+
+// lookupEntry returns the fields of the entry with the name or id in the
+// image's /etc/passwd or /etc/group, if it has one.
+func lookupEntry(fsys imageFS, path, id string) []string {
+
+	data, err := fsys.readFile(path)
+	if err != nil {
+		return nil
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		fields := strings.Split(s.Text(), ":")
+		if len(fields) > 3 && (fields[0] == id || fields[2] == id) {
+			return fields
+		}
+	}
+
+	return nil
+
+}
+
+// lookupGID returns the gid of a group given as a name or gid.
+func lookupGID(fsys imageFS, group string) string {
+
+	if _, err := strconv.Atoi(group); err == nil {
+		return group
+	}
+
+	if entry := lookupEntry(fsys, "/etc/group", group); entry != nil {
+		return entry[2]
+	}
+
+	return ""
+
+}
+
+// mapLabels fills in the info of a VCFG from the labels of an image.
+func mapLabels(v *vcfg.VCFG, labels map[string]string, mapping map[string]string) error {
+
+	// OCI annotations before label-schema ones, and those before any others
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := labelOrder(keys[i]), labelOrder(keys[j])
+		if a != b {
+			return a < b
+		}
+		return keys[i] < keys[j]
+	})
+
+	set := make(map[string]bool)
+
+	for _, k := range keys {
+
+		field := mapping[k]
+		if field == "" || set[field] {
+			continue
+		}
+		set[field] = true
+
+		value := labels[k]
+
+		switch field {
+		case infoName:
+			v.Info.Name = value
+		case infoAuthor:
+			v.Info.Author = value
+		case infoSummary:
+			v.Info.Summary = value
+		case infoDescription:
+			v.Info.Description = value
+		case infoVersion:
+			v.Info.Version = value
+		case infoURL:
+			u, err := vcfg.URLFromString(value)
+			if err != nil {
+				return fmt.Errorf("invalid url in label %s: %w", k, err)
+			}
+			v.Info.URL = u
+		case infoDate:
+			t, err := vcfg.TimestampFromString(value)
+			if err != nil {
+				return fmt.Errorf("invalid date in label %s: %w", k, err)
+			}
+			v.Info.Date = t
+		}
+	}
+
+	return nil
+
+}
+
+func labelOrder(label string) int {
+	switch {
+	case strings.HasPrefix(label, "org.opencontainers.image."):
+		return 0
+	case strings.HasPrefix(label, "org.label-schema."):
+		return 1
+	}
+	return 2
+}
+
+// mapVolumes sets space aside for the volumes of an image. There are no
+// separate volumes in a vorteil VM, so they are part of the root
+// file-system, which is given room for them on disk, or in its tmpfs overlay
+// if the file-system is read-only.
+func mapVolumes(v *vcfg.VCFG, volumes map[string]struct{}, sizes map[string]string) error {
+
+	var total vcfg.Bytes
+
+	for volume := range volumes {
+
+		s, ok := sizes[volume]
+		if !ok {
+			s = defaultVolumeSize
+		}
+
+		size, err := vcfg.ParseBytes(s)
+		if err != nil {
+			return fmt.Errorf("invalid size for volume %s: %w", volume, err)
+		}
+		if size.IsDelta() && size != 0 {
+			return fmt.Errorf("invalid size for volume %s: '%s' is relative", volume, s)
+		}
+
+		total += size
+	}
+
+	if total == 0 {
+		return nil
+	}
+
+	if v.System.Filesystem == vcfg.SquashFS {
+		v.System.Overlay += total
+	} else if v.VM.DiskSize.IsDelta() {
+		v.VM.DiskSize -= total
+	}
+
+	return nil
+
+}
+
+// mapConfig applies the parts of the image's configuration besides its
+// command, ports and environment to v.
+func (cc *ContainerConverter) mapConfig(v *vcfg.VCFG, config v1.Config, fsys imageFS) error {
+
+	m := cc.mappings.forImage(cc.imageNames())
+
+	user := config.User
+	if m.User != nil {
+		user = *m.User
+	}
+	err := cc.mapUser(v, user, m.Privilege, fsys)
+	if err != nil {
+		return err
+	}
+
+	// vms are shut down rather than having their programs signalled
+	if config.StopSignal != "" && config.StopSignal != "SIGTERM" {
+		cc.logger.Warnf("ignoring stop signal %s of the image, vorteil programs can't be given one", config.StopSignal)
+	}
+
+	err = mapLabels(v, config.Labels, m.Labels)
+	if err != nil {
+		return err
+	}
+
+	// merged before the volumes are, as it may change the file-system
+	if m.VCFG != "" {
+		x, err := vcfg.Load([]byte(m.VCFG))
+		if err != nil {
+			return fmt.Errorf("invalid vcfg in mapping: %w", err)
+		}
+
+		err = v.Merge(x)
+		if err != nil {
+			return err
+		}
+	}
+
+	return mapVolumes(v, config.Volumes, m.Volumes)
+
+}
+
+// SetMappings sets the mappings used to adjust the VCFG of the image.
+func (cc *ContainerConverter) SetMappings(mappings Mappings) {
+	cc.mappings = mappings
+}
+
+// imageNames returns the names mappings are matched against.
+func (cc *ContainerConverter) imageNames() []string {
+
+	names := []string{cc.app}
+
+	if cc.imageRef != nil {
+		names = append(names, cc.imageRef.Name(), cc.imageRef.Remote(), cc.imageRef.Repository())
+	}
+
+	if cc.archiveRef != "" {
+		names = append(names, cc.archiveRef)
+	}
+
+	return names
+
+}
@@ -0,0 +1,293 @@
+package vconvert
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+// testRoot creates an extracted image with an app binary and users.
+func testRoot(t *testing.T, dir string) dirFS {
+
+	for path, content := range map[string]string{
+		"bin/app":    "app",
+		"etc/passwd": "root:x:0:0:root:/root:/bin/sh\nnginx:x:101:101:nginx:/var/cache/nginx:/sbin/nologin\n",
+		"etc/group":  "root:x:0:\nnginx:x:101:\n",
+	} {
+		path = filepath.Join(dir, filepath.FromSlash(path))
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path, []byte(content), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dirFS(dir)
+
+}
+
+func TestLoadMappings(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "vtest")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mappings.yaml")
+
+	ioutil.WriteFile(path, []byte(`
+mappings:
+- images: ["nginx", "nginx:*"]
+  user: nginx
+  volumes:
+    /var/cache/nginx: 512 MiB
+  labels:
+    com.example.summary: summary
+  vcfg: |
+    [vm]
+    ram = "512 MiB"
+`), 0644)
+
+	ms, err := LoadMappings(path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Len(t, ms, 1)
+	assert.Equal(t, []string{"nginx", "nginx:*"}, ms[0].Images)
+	assert.Equal(t, "nginx", *ms[0].User)
+	assert.Equal(t, map[string]string{"/var/cache/nginx": "512 MiB"}, ms[0].Volumes)
+
+	for _, s := range []string{
+		"mappings:\n- unknown: true\n",
+		"mappings:\n- images: [\"[\"]\n",
+		"mappings:\n- labels:\n    a: nope\n",
+	} {
+		ioutil.WriteFile(path, []byte(s), 0644)
+		_, err = LoadMappings(path)
+		assert.Error(t, err, s)
+	}
+
+	_, err = LoadMappings(filepath.Join(dir, "missing.yaml"))
+	assert.Error(t, err)
+
+}
+
+func TestMappingsForImage(t *testing.T) {
+
+	root, nginx := "", "nginx"
+
+	ms := Mappings{
+		{User: &root, Labels: map[string]string{"maintainer": ""}},
+		{Images: []string{"nginx:*"}, User: &nginx, Volumes: map[string]string{"/data": "1 GiB"}},
+		{Images: []string{"docker.io/library/*"}, VCFG: "[vm]"},
+		{Images: []string{"redis"}, Privilege: vcfg.SuperuserPrivilege},
+	}
+
+	m := ms.forImage([]string{"nginx:1.19", "docker.io/library/nginx"})
+	assert.Equal(t, "nginx", *m.User)
+	assert.Equal(t, vcfg.Privilege(""), m.Privilege)
+	assert.Equal(t, map[string]string{"/data": "1 GiB"}, m.Volumes)
+	assert.Equal(t, "[vm]\n", m.VCFG)
+	assert.Equal(t, "", m.Labels["maintainer"])
+	assert.Equal(t, infoName, m.Labels["org.opencontainers.image.title"])
+
+	m = ms.forImage([]string{"alpine"})
+	assert.Equal(t, "", *m.User)
+	assert.Empty(t, m.Volumes)
+
+	// the default label mapping is left alone
+	assert.Equal(t, infoAuthor, defaultLabels["maintainer"])
+
+}
+
+func TestMapUser(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "vtest")
+	defer os.RemoveAll(dir)
+
+	fsys := testRoot(t, dir)
+
+	cc := &ContainerConverter{
+		logger: &elog.CLI{},
+	}
+
+	for _, c := range []struct {
+		user      string
+		privilege vcfg.Privilege
+		expUser   string
+		expPriv   vcfg.Privilege
+	}{
+		{"", "", "", ""},
+		{"root", "", "", ""},
+		{"0:0", "", "", ""},
+		{"nginx", "", "nginx", vcfg.UserPrivilege},
+		{"nginx:nginx", "", "nginx", vcfg.UserPrivilege},
+		{"nginx:root", "", "nginx", vcfg.UserPrivilege},
+		{"101", "", "nginx", vcfg.UserPrivilege},
+		{"101:101", vcfg.SuperuserPrivilege, "nginx", vcfg.SuperuserPrivilege},
+	} {
+		v := new(vcfg.VCFG)
+		v.Programs = make([]vcfg.Program, 1)
+		err := cc.mapUser(v, c.user, c.privilege, fsys)
+		assert.NoError(t, err, c.user)
+		assert.Equal(t, c.expUser, v.System.User, c.user)
+		assert.Equal(t, c.expPriv, v.Programs[0].Privilege, c.user)
+	}
+
+	// unknown uids don't fall back to root
+	v := new(vcfg.VCFG)
+	v.Programs = make([]vcfg.Program, 1)
+	err := cc.mapUser(v, "999", "", fsys)
+	assert.Error(t, err)
+
+}
+
+func TestLookupGID(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "vtest")
+	defer os.RemoveAll(dir)
+
+	fsys := testRoot(t, dir)
+
+	assert.Equal(t, "101", lookupGID(fsys, "nginx"))
+	assert.Equal(t, "101", lookupGID(fsys, "101"))
+	assert.Equal(t, "", lookupGID(fsys, "www-data"))
+
+}
+
+func TestMapLabels(t *testing.T) {
+
+	v := new(vcfg.VCFG)
+
+	err := mapLabels(v, map[string]string{
+		"org.opencontainers.image.title":   "oci",
+		"org.label-schema.name":            "schema",
+		"org.label-schema.version":         "1.0",
+		"org.opencontainers.image.url":     "https://example.com",
+		"org.opencontainers.image.created": "2020-06-01T10:00:00Z",
+		"maintainer":                       "someone",
+		"com.example.summary":              "summary",
+	}, defaultLabels)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "oci", v.Info.Name)
+	assert.Equal(t, "1.0", v.Info.Version)
+	assert.Equal(t, "someone", v.Info.Author)
+	assert.Equal(t, "https://example.com", string(v.Info.URL))
+	assert.Equal(t, 2020, v.Info.Date.Time().Year())
+	assert.Equal(t, "", v.Info.Summary)
+
+	err = mapLabels(new(vcfg.VCFG), map[string]string{
+		"org.opencontainers.image.created": "yesterday",
+	}, defaultLabels)
+	assert.Error(t, err)
+
+}
+
+func TestMapVolumes(t *testing.T) {
+
+	volumes := map[string]struct{}{
+		"/data":  {},
+		"/cache": {},
+	}
+
+	v := new(vcfg.VCFG)
+	v.VM.DiskSize, _ = vcfg.ParseBytes("+256 MiB")
+
+	err := mapVolumes(v, volumes, map[string]string{"/data": "1 GiB"})
+	assert.NoError(t, err)
+	exp, _ := vcfg.ParseBytes("+1344 MiB")
+	assert.Equal(t, exp, v.VM.DiskSize)
+
+	// read-only file-systems get room in the overlay instead
+	v = new(vcfg.VCFG)
+	v.System.Filesystem = vcfg.SquashFS
+	err = mapVolumes(v, volumes, nil)
+	assert.NoError(t, err)
+	exp, _ = vcfg.ParseBytes("128 MiB")
+	assert.Equal(t, exp, v.System.Overlay)
+
+	// fixed disk sizes are left alone
+	v = new(vcfg.VCFG)
+	v.VM.DiskSize, _ = vcfg.ParseBytes("1 GiB")
+	err = mapVolumes(v, volumes, nil)
+	assert.NoError(t, err)
+	exp, _ = vcfg.ParseBytes("1 GiB")
+	assert.Equal(t, exp, v.VM.DiskSize)
+
+	err = mapVolumes(new(vcfg.VCFG), volumes, map[string]string{"/data": "+1 GiB"})
+	assert.Error(t, err)
+
+}
+
+func TestNewVCFGMapping(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "vtest")
+	defer os.RemoveAll(dir)
+
+	fsys := testRoot(t, dir)
+
+	cc := &ContainerConverter{
+		app:    "nginx:1.19",
+		logger: &elog.CLI{},
+	}
+
+	ram := "512 MiB"
+	cc.SetMappings(Mappings{
+		{
+			Images: []string{"nginx:*"},
+			VCFG:   "[vm]\nram = \"" + ram + "\"\n[system]\nfilesystem = \"squashfs\"\n",
+		},
+	})
+
+	var config v1.Config
+	config.WorkingDir = "/"
+	config.Entrypoint = []string{"/bin/app"}
+	config.Cmd = []string{"-c", "echo 'hello world'", "", "x"}
+	config.User = "101"
+	config.StopSignal = "SIGQUIT"
+	config.Volumes = map[string]struct{}{"/var/cache/nginx": {}}
+	config.Labels = map[string]string{"org.opencontainers.image.title": "nginx"}
+
+	v, err := cc.newVCFG(config, fsys)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// arguments come back unchanged
+	args, err := v.Programs[0].ProgramArgs()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/bin/app", "-c", "echo 'hello world'", "", "x"}, args)
+
+	assert.Equal(t, "nginx", v.System.User)
+	assert.Equal(t, vcfg.UserPrivilege, v.Programs[0].Privilege)
+	assert.Equal(t, "nginx", v.Info.Name)
+
+	exp, _ := vcfg.ParseBytes(ram)
+	assert.Equal(t, exp, v.VM.RAM)
+	exp, _ = vcfg.ParseBytes(defaultVolumeSize)
+	assert.Equal(t, exp, v.System.Overlay)
+
+}
+
+func TestShellQuote(t *testing.T) {
+
+	assert.Equal(t, "''", shellQuote(""))
+	assert.Equal(t, "--port=8080", shellQuote("--port=8080"))
+	assert.Equal(t, "'a b'", shellQuote("a b"))
+	assert.Equal(t, `'it'\''s'`, shellQuote("it's"))
+	assert.Equal(t, "'$HOME'", shellQuote("$HOME"))
+
+}
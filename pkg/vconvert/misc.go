@@ -10,6 +10,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	unixpath "path"
 	"path/filepath"
 	"strings"
 
@@ -35,6 +36,8 @@ func writeFile(name string, r io.Reader) error {
 	if err != nil {
 		return err
 	}
+	defer f.Close()
+
 	for {
 		n, err := r.Read(buf)
 		if err != nil && err != io.EOF {
@@ -52,11 +55,60 @@ func writeFile(name string, r io.Reader) error {
 	return nil
 }
 
+// imageFS gives access to the file-system of an image, whether it has been
+// extracted or not. Paths are absolute paths in the image.
+type imageFS interface {
+	exists(path string) bool
+	readFile(path string) ([]byte, error)
+}
+
+// dirFS is an image extracted into a directory.
+type dirFS string
+
+func (dir dirFS) exists(path string) bool {
+	_, err := os.Lstat(filepath.Join(string(dir), filepath.FromSlash(path)))
+	return err == nil
+}
+
+func (dir dirFS) readFile(path string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(string(dir), filepath.FromSlash(path)))
+}
+
+// shellQuote quotes s so that it is read back as a single argument,
+// leaving it as it is if that is unnecessary.
+func shellQuote(s string) string {
+
+	if s == "" {
+		return "''"
+	}
+
+	safe := true
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_./:=@%+,", c)) {
+			safe = false
+			break
+		}
+	}
+
+	if safe {
+		return s
+	}
+
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 // findBinary tries to find the executable in the expanded container image
 func findBinary(name string, env []string, cwd string, targetDir string, log elog.View) (string, error) {
 
 	log.Debugf("finding %s in %s (cwd: %s, env %v)", name, targetDir, cwd, env)
 
+	return lookupBinary(name, env, cwd, dirFS(targetDir).exists, log)
+}
+
+// lookupBinary tries to find the executable in an image's file-system, using
+// exists to check if a path is in it
+func lookupBinary(name string, env []string, cwd string, exists func(path string) bool, log elog.View) (string, error) {
+
 	if strings.HasPrefix(name, "./") {
 		abs, err := filepath.Abs(name)
 		if err != nil {
@@ -73,35 +125,34 @@ func findBinary(name string, env []string, cwd string, targetDir string, log elo
 			log.Printf("can not get relative path for %s: %s", name, err.Error())
 			return name, nil
 		}
-		name = rel
+		name = filepath.ToSlash(rel)
 	}
 
 	// absolute
 	if strings.HasPrefix(name, "/") {
-		fp := filepath.Join(targetDir, name)
-		log.Debugf("checking %s", fp)
-		if _, err := os.Lstat(fp); err == nil {
+		log.Debugf("checking %s", name)
+		if exists(name) {
 			return name, nil
 		}
 		return "", fmt.Errorf("can not find binary %s", name)
 	}
 
+	name = strings.ReplaceAll(name, "\"", "")
+
 	for _, e := range env {
 		elems := strings.SplitN(e, "=", 2)
 		if elems[0] == "PATH" {
 			elems = strings.Split(elems[1], ":")
 			for _, p := range elems {
-				path := filepath.Join(targetDir, p, strings.ReplaceAll(name, "\"", ""))
-				if _, err := os.Stat(path); err == nil {
-					return filepath.Join(p, strings.ReplaceAll(name, "\"", "")), nil
+				if exists(unixpath.Join(p, name)) {
+					return unixpath.Join(p, name), nil
 				}
 			}
 		}
 	}
 
-	path := filepath.Join(targetDir, cwd, strings.ReplaceAll(name, "\"", ""))
-	if _, err := os.Stat(path); err == nil {
-		return filepath.Join(cwd, strings.ReplaceAll(name, "\"", "")), nil
+	if exists(unixpath.Join(cwd, name)) {
+		return unixpath.Join(cwd, name), nil
 	}
 
 	return "", fmt.Errorf("can not find binary %s", name)
@@ -0,0 +1,120 @@
+package vconvert
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"io"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vpkg"
+)
+
+// PackageBuilder returns a vpkg.Builder holding the file-system of the image
+// and a VCFG generated from its configuration. Nothing is extracted to disk:
+// files are read straight from the downloaded layers as the package is built,
+// so the builder must be closed before the ContainerConverter is.
+func (cc *ContainerConverter) PackageBuilder(user, pwd string) (vpkg.Builder, error) {
+
+	err := cc.fetchLayers(user, pwd)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := cc.layerFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	fl, err := flattenLayers(files, cc.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	vcfgFile, err := cc.newVCFG(cc.imageConfig, fl)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := vcfgFile.File()
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := fl.tree()
+	if err != nil {
+		return nil, err
+	}
+
+	b := vpkg.NewBuilder()
+
+	err = b.AddSubTreeToFS("/", tree)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	err = b.SetVCFG(f)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	return b, nil
+
+}
+
+// ConvertToPackage writes a container image to w as a vorteil.io package.
+func (cc *ContainerConverter) ConvertToPackage(w io.Writer, user, pwd string, compressionLevel int) error {
+
+	defer cc.Close()
+
+	b, err := cc.PackageBuilder(user, pwd)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	p := &packProgress{
+		log: cc.logger,
+	}
+
+	b.SetCompressionLevel(compressionLevel)
+	b.SetMonitoringOptions(vpkg.MonitoringOptions{
+		PreProcessCompleteCallback: p.start,
+		PreCompressionWriter:       p,
+	})
+
+	err = b.Pack(w)
+	p.finish(err == nil)
+
+	return err
+
+}
+
+// packProgress reports how much of a package has been packed, once the size
+// of the package is known.
+type packProgress struct {
+	log elog.View
+	p   elog.Progress
+}
+
+func (pp *packProgress) start(report vpkg.PreProcessReport) error {
+	pp.p = pp.log.NewProgress("Packing", "KiB", int64(report.PackageSize))
+	return nil
+}
+
+func (pp *packProgress) Write(p []byte) (int, error) {
+	if pp.p == nil {
+		return len(p), nil
+	}
+	return pp.p.Write(p)
+}
+
+func (pp *packProgress) finish(success bool) {
+	if pp.p != nil {
+		pp.p.Finish(success)
+	}
+}
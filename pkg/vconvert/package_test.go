@@ -0,0 +1,83 @@
+package vconvert
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/stretchr/testify/assert"
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+	"github.com/vorteil/vorteil/pkg/vpkg"
+)
+
+func TestConvertToPackage(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "vtest")
+	defer os.RemoveAll(dir)
+
+	oci := filepath.Join(dir, "oci")
+	p, err := layout.Write(oci, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.AppendImage(testImage(t, map[string]string{"bin/app": "app"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := NewContainerConverter("oci:"+oci, "", &elog.CLI{DisableTTY: true})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	buf := new(bytes.Buffer)
+	err = cc.ConvertToPackage(buf, "", "", vpkg.DefaultCompression)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// the downloaded layers are gone again
+	assert.Equal(t, "", cc.layersDir)
+
+	pkg, err := vpkg.Load(buf)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer pkg.Close()
+
+	v := new(vcfg.VCFG)
+	err = v.LoadFile(pkg.VCFG())
+	assert.NoError(t, err)
+	assert.Equal(t, "/bin/app --serve", v.Programs[0].Args)
+	assert.Equal(t, []string{"8080"}, v.Networks[0].TCP)
+
+	files := make(map[string]string)
+	err = pkg.FS().Walk(func(path string, f vio.File) error {
+		if f.IsDir() {
+			files[path] = ""
+			return nil
+		}
+		b, err := ioutil.ReadAll(f)
+		files[path] = string(b)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		".":         "",
+		"./bin":     "",
+		"./bin/app": "app",
+	}, files)
+
+}
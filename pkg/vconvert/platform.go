@@ -0,0 +1,64 @@
+package vconvert
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DefaultPlatform is the platform picked from multi-platform images, unless
+// another one is set with SetPlatform.
+const DefaultPlatform = "linux/amd64"
+
+// SetPlatform sets the platform picked from multi-platform images, as
+// os/arch[/variant], e.g. linux/arm64.
+func (cc *ContainerConverter) SetPlatform(platform string) error {
+
+	p, err := platforms.Parse(platform)
+	if err != nil {
+		return err
+	}
+
+	cc.platformSpec = &p
+
+	return nil
+
+}
+
+// platform returns the platform picked from multi-platform images.
+func (cc *ContainerConverter) platform() specs.Platform {
+
+	if cc.platformSpec != nil {
+		return *cc.platformSpec
+	}
+
+	p, _ := platforms.Parse(DefaultPlatform)
+
+	return p
+
+}
+
+// selectPlatform returns the index of the first of candidates matching the
+// platform of the ContainerConverter.
+func (cc *ContainerConverter) selectPlatform(candidates []specs.Platform) (int, error) {
+
+	m := platforms.NewMatcher(cc.platform())
+
+	var found []string
+	for i, p := range candidates {
+		if m.Match(p) {
+			return i, nil
+		}
+		found = append(found, platforms.Format(p))
+	}
+
+	return -1, fmt.Errorf("no %s image found, available platforms: %s", platforms.Format(cc.platform()), strings.Join(found, ", "))
+
+}
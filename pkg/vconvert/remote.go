@@ -7,16 +7,21 @@ package vconvert
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
 
-	cmanifest "github.com/containers/image/manifest"
+	"github.com/containerd/containerd/platforms"
 	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/ocischema"
 	"github.com/docker/distribution/manifest/schema2"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/heroku/docker-registry-client/registry"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // RegistryConfig contains the url of the remote registry.
@@ -46,22 +51,63 @@ func (cc *ContainerConverter) downloadInformationRemote(config *registryConfig)
 
 	cc.registry = r
 
-	manifest, err := r.ManifestV2(cc.imageRef.ShortName(), cc.imageRef.Tag())
+	manifest, desc, err := cc.fetchManifest(cc.imageRef.Tag())
 	if err != nil {
 		return err
 	}
 
-	_, err = cc.downloadManifest(manifest.Manifest)
+	if list, ok := manifest.(*manifestlist.DeserializedManifestList); ok {
+
+		cc.logger.Printf("selecting %s image from %s", platforms.Format(cc.platform()), desc.Digest)
+
+		candidates := make([]specs.Platform, len(list.Manifests))
+		for i, m := range list.Manifests {
+			candidates[i] = specs.Platform{
+				OS:           m.Platform.OS,
+				Architecture: m.Platform.Architecture,
+				Variant:      m.Platform.Variant,
+			}
+		}
+
+		i, err := cc.selectPlatform(candidates)
+		if err != nil {
+			return err
+		}
+
+		manifest, desc, err = cc.fetchManifest(list.Manifests[i].Digest.String())
+		if err != nil {
+			return err
+		}
+	}
+
+	var (
+		configDesc distribution.Descriptor
+		layers     []distribution.Descriptor
+	)
+
+	switch m := manifest.(type) {
+	case *schema2.DeserializedManifest:
+		configDesc, layers = m.Config, m.Layers
+	case *ocischema.DeserializedManifest:
+		configDesc, layers = m.Config, m.Layers
+	default:
+		return fmt.Errorf("unsupported manifest type %s", desc.MediaType)
+	}
+
+	cc.digest = desc.Digest
+
+	err = cc.downloadConfig(configDesc)
 	if err != nil {
 		return err
 	}
 
-	var ifs = make([]*layer, len(manifest.Layers))
-	for i, d := range manifest.Layers {
+	var ifs = make([]*layer, len(layers))
+	for i, d := range layers {
 		ifs[i] = &layer{
-			layer: d,
-			hash:  string(d.Digest[7:15]),
-			size:  d.Size,
+			layer:  d,
+			hash:   string(d.Digest[7:15]),
+			size:   d.Size,
+			digest: d.Digest,
 		}
 	}
 	cc.layers = ifs
@@ -70,42 +116,84 @@ func (cc *ContainerConverter) downloadInformationRemote(config *registryConfig)
 
 }
 
-func (cc *ContainerConverter) downloadManifest(manifest schema2.Manifest) (*cmanifest.Schema2V1Image, error) {
+// fetchManifest downloads the manifest or manifest list of the image by tag
+// or digest. Manifests fetched by digest are verified against it.
+func (cc *ContainerConverter) fetchManifest(reference string) (distribution.Manifest, distribution.Descriptor, error) {
 
-	cc.logger.Printf("downloading manifest file")
+	url := fmt.Sprintf("%s/v2/%s/manifests/%s", cc.registry.URL, cc.imageRef.ShortName(), reference)
+	cc.logger.Debugf("downloading manifest %s", url)
 
-	reader, err := cc.registry.DownloadBlob(cc.imageRef.ShortName(), manifest.Target().Digest)
-	defer reader.Close()
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return nil, err
+		return nil, distribution.Descriptor{}, err
+	}
+
+	for _, mt := range []string{
+		schema2.MediaTypeManifest,
+		manifestlist.MediaTypeManifestList,
+		specs.MediaTypeImageManifest,
+		specs.MediaTypeImageIndex,
+	} {
+		req.Header.Add("Accept", mt)
 	}
 
-	buf := new(bytes.Buffer)
-	n, err := buf.ReadFrom(reader)
+	resp, err := cc.registry.Client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, distribution.Descriptor{}, err
 	}
+	defer resp.Body.Close()
 
-	img := &cmanifest.Schema2V1Image{}
-	err = json.Unmarshal(buf.Bytes()[:n], img)
+	if resp.StatusCode != http.StatusOK {
+		return nil, distribution.Descriptor{}, fmt.Errorf("can not get manifest %s: %s", reference, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, distribution.Descriptor{}, err
+	}
+
+	manifest, desc, err := distribution.UnmarshalManifest(resp.Header.Get("Content-Type"), body)
+	if err != nil {
+		return nil, distribution.Descriptor{}, err
 	}
 
-	cc.imageConfig.Cmd = make([]string, len(img.Config.Cmd))
-	cc.imageConfig.Entrypoint = make([]string, len(img.Config.Entrypoint))
-	cc.imageConfig.Env = make([]string, len(img.Config.Env))
-	cc.imageConfig.ExposedPorts = make(map[string]struct{})
-	for k, v := range img.Config.ExposedPorts {
-		cc.imageConfig.ExposedPorts[string(k)] = v
+	if d, err := digest.Parse(reference); err == nil && d != desc.Digest {
+		return nil, distribution.Descriptor{}, fmt.Errorf("manifest %s has digest %s", reference, desc.Digest)
 	}
 
-	copy(cc.imageConfig.Cmd, img.Config.Cmd)
-	copy(cc.imageConfig.Entrypoint, img.Config.Entrypoint)
-	copy(cc.imageConfig.Env, img.Config.Env)
-	cc.imageConfig.WorkingDir = img.Config.WorkingDir
+	return manifest, desc, nil
+
+}
+
+// downloadConfig downloads the configuration of the image.
+func (cc *ContainerConverter) downloadConfig(desc distribution.Descriptor) error {
+
+	cc.logger.Printf("downloading image configuration")
+
+	reader, err := cc.registry.DownloadBlob(cc.imageRef.ShortName(), desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	if d := digest.FromBytes(data); d != desc.Digest {
+		return fmt.Errorf("image configuration has digest %s instead of %s", d, desc.Digest)
+	}
+
+	config, err := v1.ParseConfigFile(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	cc.imageConfig = config.Config
+
+	return nil
 
-	return img, nil
 }
 
 // although there is a New(...) function in the registry
@@ -6,9 +6,20 @@ package vconvert
  */
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/assert"
+	"github.com/vorteil/vorteil/pkg/elog"
 )
 
 func TestDownloadInformationRemoteFailure(t *testing.T) {
@@ -46,3 +57,177 @@ func TestDownloadInformationRemoteSuccess(t *testing.T) {
 	assert.NotNil(t, r.imageConfig.Cmd)
 
 }
+
+// testRegistry serves an image for linux/amd64 and linux/arm64 as test/app,
+// and returns the digests of its manifest list and manifests.
+func testRegistry(t *testing.T) (*httptest.Server, map[string]digest.Digest) {
+
+	content := make(map[string][]byte)
+	types := make(map[string]string)
+	digests := make(map[string]digest.Digest)
+
+	blob := func(data []byte, mediaType string) distribution.Descriptor {
+		d := digest.FromBytes(data)
+		content["/v2/test/app/blobs/"+d.String()] = data
+		return distribution.Descriptor{
+			MediaType: mediaType,
+			Digest:    d,
+			Size:      int64(len(data)),
+		}
+	}
+
+	manifest := func(v interface{}, mediaType string) distribution.Descriptor {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := digest.FromBytes(data)
+		path := "/v2/test/app/manifests/" + d.String()
+		content[path] = data
+		types[path] = mediaType
+		return distribution.Descriptor{
+			MediaType: mediaType,
+			Digest:    d,
+			Size:      int64(len(data)),
+		}
+	}
+
+	var descs []manifestlist.ManifestDescriptor
+	for _, arch := range []string{"arm64", "amd64"} {
+		config := blob([]byte(`{"architecture":"`+arch+`","os":"linux","config":{"Cmd":["/bin/app"],"User":"app"}}`), schema2.MediaTypeImageConfig)
+		layer := blob([]byte("layer "+arch), schema2.MediaTypeLayer)
+		desc := manifest(schema2.Manifest{
+			Versioned: schema2.SchemaVersion,
+			Config:    config,
+			Layers:    []distribution.Descriptor{layer},
+		}, schema2.MediaTypeManifest)
+		digests[arch] = desc.Digest
+		descs = append(descs, manifestlist.ManifestDescriptor{
+			Descriptor: desc,
+			Platform: manifestlist.PlatformSpec{
+				OS:           "linux",
+				Architecture: arch,
+			},
+		})
+	}
+
+	list := manifest(manifestlist.ManifestList{
+		Versioned: manifestlist.SchemaVersion,
+		Manifests: descs,
+	}, manifestlist.MediaTypeManifestList)
+	digests["list"] = list.Digest
+
+	content["/v2/test/app/manifests/latest"] = content["/v2/test/app/manifests/"+list.Digest.String()]
+	types["/v2/test/app/manifests/latest"] = manifestlist.MediaTypeManifestList
+
+	// a manifest served under the wrong digest
+	bad := digest.FromString("bad")
+	content["/v2/test/app/manifests/"+bad.String()] = content["/v2/test/app/manifests/"+digests["amd64"].String()]
+	types["/v2/test/app/manifests/"+bad.String()] = schema2.MediaTypeManifest
+	digests["bad"] = bad
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		data, ok := content[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if mt, ok := types[r.URL.Path]; ok {
+			w.Header().Set("Content-Type", mt)
+		}
+		w.Write(data)
+	}))
+
+	return srv, digests
+
+}
+
+func TestDownloadInformationRemotePlatform(t *testing.T) {
+
+	srv, digests := testRegistry(t)
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	config := &registryConfig{url: srv.URL}
+
+	var cc = []struct {
+		ref      string
+		platform string
+		digest   digest.Digest
+		success  bool
+	}{
+		{"test/app", "", digests["amd64"], true},
+		{"test/app:latest", "linux/arm64", digests["arm64"], true},
+		{"test/app@" + digests["list"].String(), "", digests["amd64"], true},
+		{"test/app@" + digests["arm64"].String(), "", digests["arm64"], true},
+		{"test/app", "linux/s390x", "", false},
+		{"test/app@" + digests["bad"].String(), "", "", false},
+		{"test/app:missing", "", "", false},
+	}
+
+	for _, c := range cc {
+
+		r, err := NewContainerConverter(host+"/"+c.ref, "", &elog.CLI{})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		if c.platform != "" {
+			err = r.SetPlatform(c.platform)
+			assert.NoError(t, err)
+		}
+
+		err = r.downloadImageInformation(config)
+		if !c.success {
+			assert.Error(t, err, c.ref)
+			continue
+		}
+		if !assert.NoError(t, err, c.ref) {
+			continue
+		}
+
+		assert.Equal(t, c.digest, r.digest, c.ref)
+		assert.Equal(t, host+"/test/app@"+c.digest.String(), r.source())
+		assert.Equal(t, []string{"/bin/app"}, []string(r.imageConfig.Cmd))
+		assert.Equal(t, "app", r.imageConfig.User)
+		assert.Len(t, r.layers, 1)
+	}
+
+}
+
+func TestDownloadBlobsVerify(t *testing.T) {
+
+	srv, _ := testRegistry(t)
+	defer srv.Close()
+
+	dir, _ := ioutil.TempDir("", "vtest")
+	defer os.RemoveAll(dir)
+
+	r, err := NewContainerConverter(strings.TrimPrefix(srv.URL, "http://")+"/test/app", "", &elog.CLI{})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	err = r.downloadImageInformation(&registryConfig{url: srv.URL})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	err = r.downloadBlobs(dir)
+	assert.NoError(t, err)
+
+	b, err := ioutil.ReadFile(r.layers[0].file)
+	assert.NoError(t, err)
+	assert.Equal(t, "layer amd64", string(b))
+
+	// a layer which does not match its digest is an error
+	r.layers[0].digest = digest.FromString("other")
+
+	err = r.downloadBlobs(dir)
+	assert.Error(t, err)
+	assert.NoFileExists(t, r.layers[0].file)
+
+}
@@ -6,26 +6,22 @@ package vconvert
  */
 
 import (
-	"archive/tar"
-	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"regexp"
+	"sort"
 	"strings"
 
-	"github.com/sirupsen/logrus"
 	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/vcfg"
 
-	"github.com/containerd/containerd/archive"
-	"github.com/containerd/containerd/archive/compression"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 
-	clog "github.com/containerd/containerd/log"
 	"github.com/heroku/docker-registry-client/registry"
 	parser "github.com/novln/docker-parser"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 const (
@@ -53,6 +49,10 @@ var (
 	ContainerdRegistry RegistryType = "containerd"
 	RemoteRegistry     RegistryType = "remote"
 	NullRegistry       RegistryType = ""
+
+	// images on disk, which need neither a registry nor a container runtime
+	OCIRegistry           RegistryType = "oci"
+	DockerArchiveRegistry RegistryType = "docker-archive"
 )
 
 type job struct {
@@ -67,21 +67,37 @@ type job struct {
 
 // compat struct for layers from local runtimes and remote image repos
 type layer struct {
-	layer interface{}
-	size  int64
-	hash  string
+	layer  interface{}
+	size   int64
+	hash   string
+	digest digest.Digest
 
 	file string
 }
 
 // ContainerConverter is the base object. Create a client with NewContainerConverter.
 type ContainerConverter struct {
+	app      string
 	imageRef *parser.Reference
 
 	imageConfig  v1.Config
 	registry     *registry.Registry
 	registryType RegistryType
 
+	// oci layout directory or docker archive, and the image in it
+	archivePath string
+	archiveRef  string
+
+	// temporary directory holding the downloaded layers
+	layersDir string
+
+	// platform picked from multi-platform images, and the digest the
+	// image resolved to
+	platformSpec *specs.Platform
+	digest       digest.Digest
+
+	mappings Mappings
+
 	layers      []*layer
 	fetchReader func(string, *layer, *registry.Registry) (io.ReadCloser, error)
 	jobsCh      chan *job
@@ -101,6 +117,21 @@ func NewContainerConverter(app, config string, log elog.View) (*ContainerConvert
 
 	initConfig(config, log)
 
+	if isArchiveSource(app) {
+		cc, err := newArchiveConverter(app)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Printf("convert image: %s", app)
+
+		cc.app = app
+		cc.logger = log
+		cc.jobsDoneCh = make(chan *job, workers)
+
+		return cc, nil
+	}
+
 	// get the ref first
 	ref, err := parser.Parse(app)
 	if err != nil {
@@ -110,6 +141,7 @@ func NewContainerConverter(app, config string, log elog.View) (*ContainerConvert
 	log.Printf("convert image: %s", ref.Name())
 
 	cc := &ContainerConverter{
+		app:      app,
 		imageRef: ref,
 	}
 
@@ -150,6 +182,43 @@ func (cc *ContainerConverter) ConvertToProject(dst, user, pwd string) error {
 		return err
 	}
 
+	err = cc.fetchLayers(user, pwd)
+	defer cc.Close()
+	if err != nil {
+		return err
+	}
+
+	err = cc.untarLayers(dst)
+	if err != nil {
+		return err
+	}
+
+	err = cc.createVCFG(cc.imageConfig, dst)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Close removes the layers downloaded for the image.
+func (cc *ContainerConverter) Close() error {
+
+	if cc.layersDir == "" {
+		return nil
+	}
+
+	err := os.RemoveAll(cc.layersDir)
+	cc.layersDir = ""
+
+	return err
+
+}
+
+// fetchLayers downloads the image information and its layers, which are kept
+// in a temporary directory until the ContainerConverter is closed.
+func (cc *ContainerConverter) fetchLayers(user, pwd string) error {
+
 	var (
 		url string
 	)
@@ -171,7 +240,7 @@ func (cc *ContainerConverter) ConvertToProject(dst, user, pwd string) error {
 		cc.logger.Printf("registry %s", cc.RegistryType())
 	}
 
-	err = cc.downloadImageInformation(&registryConfig{
+	err := cc.downloadImageInformation(&registryConfig{
 		url:  url,
 		user: user,
 		pwd:  pwd,
@@ -181,25 +250,52 @@ func (cc *ContainerConverter) ConvertToProject(dst, user, pwd string) error {
 		return err
 	}
 
-	dir, _ := ioutil.TempDir("", "vtest")
-	defer os.RemoveAll(dir)
+	if cc.digest != "" {
+		cc.logger.Printf("image digest %s", cc.digest)
+	}
 
-	err = cc.downloadBlobs(dir)
+	cc.layersDir, err = ioutil.TempDir("", "vconvert")
 	if err != nil {
 		return err
 	}
 
-	err = cc.untarLayers(dst)
-	if err != nil {
-		return err
+	return cc.downloadBlobs(cc.layersDir)
+
+}
+
+// layerFiles returns the downloaded layers, lowest first.
+func (cc *ContainerConverter) layerFiles() ([]string, error) {
+
+	var files []string
+	for _, layer := range cc.layers {
+
+		if layer.file == "" {
+			return nil, fmt.Errorf("no file associated with layer %s", layer.hash)
+		}
+
+		files = append(files, layer.file)
 	}
 
-	err = cc.createVCFG(cc.imageConfig, dst)
-	if err != nil {
-		return err
+	return files, nil
+
+}
+
+// source returns the image pinned to the digest it resolved to, if known.
+func (cc *ContainerConverter) source() string {
+
+	if cc.digest == "" {
+		return ""
 	}
 
-	return nil
+	name := cc.app
+	if cc.imageRef != nil {
+		name = cc.imageRef.Repository()
+	} else if cc.archivePath != "" {
+		name = fmt.Sprintf("%s:%s", cc.registryType, cc.archivePath)
+	}
+
+	return fmt.Sprintf("%s@%s", name, cc.digest)
+
 }
 
 // RegistryType returns the type of registry: local, remote or none
@@ -224,6 +320,13 @@ func (cc *ContainerConverter) RegistryName() string {
 // For remote registries the config needs to be provided with at least the url of the registry.
 func (cc *ContainerConverter) downloadImageInformation(config *registryConfig) error {
 
+	switch cc.registryType {
+	case OCIRegistry:
+		return cc.downloadInformationOCI(cc.archivePath, cc.archiveRef)
+	case DockerArchiveRegistry:
+		return cc.downloadInformationDockerArchive(cc.archivePath, cc.archiveRef)
+	}
+
 	if cc.imageRef == nil {
 		return fmt.Errorf("image reference missing")
 	}
@@ -269,11 +372,15 @@ func (cc *ContainerConverter) downloadBlobs(dir string) error {
 
 	cc.logger.Debugf("all %d jobs sent", len(cc.layers))
 	r := 0
+	var err error
 	for {
 
 		j := <-cc.jobsDoneCh
 		if j.err != nil {
 			cc.logger.Errorf("error downloading layer: %s", j.err.Error())
+			if err == nil {
+				err = j.err
+			}
 		}
 		r++
 		cc.logger.Debugf("received %d from %d jobs finished", r, len(cc.layers))
@@ -284,7 +391,6 @@ func (cc *ContainerConverter) downloadBlobs(dir string) error {
 		}
 	}
 
-	cc.logger.Printf("all layers downloaded")
 	close(cc.jobsCh)
 
 	if cc.tmpLocalTar != nil {
@@ -292,6 +398,12 @@ func (cc *ContainerConverter) downloadBlobs(dir string) error {
 		cc.tmpLocalTar = nil
 	}
 
+	if err != nil {
+		return err
+	}
+
+	cc.logger.Printf("all layers downloaded")
+
 	return nil
 }
 
@@ -302,52 +414,21 @@ func (cc *ContainerConverter) untarLayers(targetDir string) error {
 		return err
 	}
 
-	for _, layer := range cc.layers {
-
-		if layer.file == "" {
-			return fmt.Errorf("no file associated with layer %s", layer.hash)
-		}
-
-		cc.logger.Printf("unpack layer %s into %s", layer.file, targetDir)
-
-		fn, err := os.Open(layer.file)
-		if err != nil {
-			return err
-		}
-
-		// suppressing containerd logs
-		clog.L.Logger.SetLevel(logrus.ErrorLevel)
+	files, err := cc.layerFiles()
+	if err != nil {
+		return err
+	}
 
-		r, err := compression.DecompressStream(fn)
-		if err != nil {
-			return err
-		}
+	fl, err := flattenLayers(files, cc.logger)
+	if err != nil {
+		return err
+	}
 
-		if _, err := archive.Apply(context.TODO(), targetDir, r, archive.WithFilter(func(hdr *tar.Header) (bool, error) {
-
-			// fetching uid, gid
-			hdr.Uid, hdr.Gid = fetchUIDandGID()
-
-			// check if in our skip list
-			for _, f := range folders {
-				// check 3 different variations of the folder
-				// /folder folder /folder/
-				fmts := []string{"/%s", "/%s/", "%s"}
-				for _, f1 := range fmts {
-					if strings.HasPrefix(hdr.Name, fmt.Sprintf(f1, f)) {
-						cc.logger.Debugf("skipping file/dir %s", hdr.Name)
-						return false, nil
-					}
-				}
-			}
-			return true, nil
+	cc.logger.Printf("unpack layers into %s", targetDir)
 
-		})); err != nil {
-			r.Close()
-			return err
-		}
-		clog.L.Logger.SetLevel(logrus.InfoLevel)
-		r.Close()
+	err = fl.writeDir(targetDir)
+	if err != nil {
+		return err
 	}
 
 	cc.logger.Printf("files created into %s", targetDir)
@@ -361,6 +442,37 @@ func (cc *ContainerConverter) createVCFG(config v1.Config, targetDir string) err
 		return fmt.Errorf("directory %s does not exist", targetDir)
 	}
 
+	vcfgFile, err := cc.newVCFG(config, dirFS(targetDir))
+	if err != nil {
+		return err
+	}
+
+	b, err := vcfgFile.Marshal()
+	if err != nil {
+		return err
+	}
+
+	// write default.vcfg and .projectfile
+	err = ioutil.WriteFile(fmt.Sprintf("%s/.vorteilproject", targetDir), []byte(defaultProjectFile), 0644)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(fmt.Sprintf("%s/default.vcfg", targetDir), b, 0644)
+	if err != nil {
+		return err
+	}
+
+	cc.logger.Debugf("vcfg file:\n%v\n", string(b))
+
+	return nil
+
+}
+
+// newVCFG generates the VCFG for an image from its configuration, adjusted
+// by any mappings for it. The program to run is looked up in fsys.
+func (cc *ContainerConverter) newVCFG(config v1.Config, fsys imageFS) (*vcfg.VCFG, error) {
+
 	vcfgFile := new(vcfg.VCFG)
 
 	ds, _ := vcfg.ParseBytes(defaultDiskSize)
@@ -386,32 +498,24 @@ func (cc *ContainerConverter) createVCFG(config v1.Config, targetDir string) err
 	vcfgFile.Programs[0].Cwd = config.WorkingDir
 
 	if len(finalCmd) == 0 {
-		return fmt.Errorf("can not generate command: %s", finalCmd)
+		return nil, fmt.Errorf("can not generate command: %s", finalCmd)
 	}
 
-	bin, err := findBinary(finalCmd[0], config.Env, config.WorkingDir, targetDir, cc.logger)
+	cc.logger.Debugf("finding %s in image (cwd: %s, env %v)", finalCmd[0], config.WorkingDir, config.Env)
+
+	bin, err := lookupBinary(finalCmd[0], config.Env, config.WorkingDir, fsys.exists, cc.logger)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var args []string
-	args = append(args, bin)
+	args = append(args, shellQuote(bin))
 
 	for _, arg := range finalCmd[1:] {
-		if len(arg) == 1 {
-			continue
-		}
-		if strings.Index(arg, " ") > 0 {
-			args = append(args, fmt.Sprintf("'%s'", arg))
-		} else {
-			args = append(args, arg)
-		}
+		args = append(args, shellQuote(arg))
 	}
 
-	argsString := strings.Join(args, " ")
-	space := regexp.MustCompile(`\s+`)
-	s := space.ReplaceAllString(argsString, " ")
-	vcfgFile.Programs[0].Args = s
+	vcfgFile.Programs[0].Args = strings.Join(args, " ")
 
 	// environment variables
 	vcfgFile.Programs[0].Env = config.Env
@@ -430,40 +534,38 @@ func (cc *ContainerConverter) createVCFG(config v1.Config, targetDir string) err
 			portTCP = append(portTCP, p[0])
 		}
 	}
+	sort.Strings(portTCP)
+	sort.Strings(portUDP)
 	vcfgFile.Networks[0].TCP = portTCP
 	vcfgFile.Networks[0].UDP = portUDP
 
-	b, err := vcfgFile.Marshal()
-	if err != nil {
-		return err
-	}
-
-	// write default.vcfg and .projectfile
-	err = ioutil.WriteFile(fmt.Sprintf("%s/.vorteilproject", targetDir), []byte(defaultProjectFile), 0644)
-	if err != nil {
-		return err
-	}
+	vcfgFile.Info.Source = cc.source()
 
-	err = ioutil.WriteFile(fmt.Sprintf("%s/default.vcfg", targetDir), b, 0644)
+	err = cc.mapConfig(vcfgFile, config, fsys)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	cc.logger.Debugf("vcfg file:\n%v\n", string(b))
-
-	return nil
+	return vcfgFile, nil
 
 }
 
 func (cc *ContainerConverter) blobDownloadWorker() {
 
 	var (
-		err    error
-		reader io.ReadCloser
-		pr     io.ReadCloser
-		p      elog.Progress
+		err      error
+		reader   io.ReadCloser
+		pr       io.ReadCloser
+		p        elog.Progress
+		verifier digest.Verifier
 	)
 
+	// images on disk have no reference
+	var image string
+	if cc.imageRef != nil {
+		image = cc.imageRef.ShortName()
+	}
+
 	for {
 
 		job, opened := <-cc.jobsCh
@@ -471,7 +573,17 @@ func (cc *ContainerConverter) blobDownloadWorker() {
 			break
 		}
 
-		reader, err = cc.fetchReader(cc.imageRef.ShortName(), job.layer, cc.registry)
+		p, pr, verifier = nil, nil, nil
+
+		if job.layer.digest != "" {
+			err = job.layer.digest.Validate()
+			if err != nil {
+				goto cont
+			}
+			verifier = job.layer.digest.Verifier()
+		}
+
+		reader, err = cc.fetchReader(image, job.layer, cc.registry)
 		if err != nil {
 			goto cont
 		}
@@ -481,18 +593,28 @@ func (cc *ContainerConverter) blobDownloadWorker() {
 
 		job.name = fmt.Sprintf(tarExpression, job.dir, job.layer.hash)
 
-		err = writeFile(job.name, pr)
+		if verifier != nil {
+			err = writeFile(job.name, io.TeeReader(pr, verifier))
+		} else {
+			err = writeFile(job.name, pr)
+		}
+
+		// layers are checked against their digests as they are downloaded
+		if err == nil && verifier != nil && !verifier.Verified() {
+			err = fmt.Errorf("layer %s does not match its digest", job.layer.digest)
+			os.Remove(job.name)
+		}
 
 	cont:
 		job.err = err
 
-		if err != nil {
-			p.Finish(false)
-		} else {
-			p.Finish(true)
+		if p != nil {
+			p.Finish(err == nil)
 		}
 
-		pr.Close()
+		if pr != nil {
+			pr.Close()
+		}
 
 		// set the file to the layer
 		cc.layers[job.number].file = job.name
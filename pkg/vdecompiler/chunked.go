@@ -0,0 +1,135 @@
+package vdecompiler
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"io"
+)
+
+// chunkedIO provides random access to a virtual disk image format that stores
+// the raw image as a series of fixed-size chunks, like VMDK grains or VHD
+// blocks. The most recently loaded chunk is cached, since most reads are
+// small and sequential.
+type chunkedIO struct {
+	size      int64
+	chunkSize int64
+	cursor    int64
+	chunk     int64
+	data      []byte
+
+	// load returns the contents of a chunk. It may return less than a
+	// full chunk of data, or nil, in which case the rest of the chunk is
+	// zeroes.
+	load func(chunk int64) ([]byte, error)
+}
+
+func newChunkedIO(size, chunkSize int64, load func(chunk int64) ([]byte, error)) *chunkedIO {
+	return &chunkedIO{
+		size:      size,
+		chunkSize: chunkSize,
+		chunk:     -1,
+		load:      load,
+	}
+}
+
+func (cio *chunkedIO) Read(p []byte) (n int, err error) {
+
+	if cio.cursor >= cio.size {
+		return 0, io.EOF
+	}
+
+	chunk := cio.cursor / cio.chunkSize
+	if chunk != cio.chunk {
+		cio.data, err = cio.load(chunk)
+		if err != nil {
+			cio.chunk = -1
+			return 0, err
+		}
+		cio.chunk = chunk
+	}
+
+	offset := cio.cursor % cio.chunkSize
+	end := cio.chunkSize
+	if remaining := cio.size - chunk*cio.chunkSize; remaining < end {
+		end = remaining
+	}
+
+	if int64(len(p)) > end-offset {
+		p = p[:end-offset]
+	}
+
+	if offset < int64(len(cio.data)) {
+		n = copy(p, cio.data[offset:])
+	}
+
+	for i := n; i < len(p); i++ {
+		p[i] = 0
+	}
+
+	n = len(p)
+	cio.cursor += int64(n)
+
+	return n, nil
+
+}
+
+func (cio *chunkedIO) Seek(offset int64, whence int) (int64, error) {
+
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = cio.cursor + offset
+	case io.SeekEnd:
+		abs = cio.size + offset
+	default:
+		panic("unexpected 'whence' value")
+	}
+
+	if abs < 0 {
+		return cio.cursor, errors.New("cannot seek to a negative offset")
+	}
+
+	cio.cursor = abs
+	return abs, nil
+
+}
+
+func (cio *chunkedIO) Write(p []byte) (n int, err error) {
+	return 0, errors.New("writing not supported")
+}
+
+// chunkedPartialIO wraps a chunkedIO to make it usable as the image IO object
+// for iio.
+func (iio *IO) chunkedPartialIO(cio *chunkedIO) *partialIO {
+	pio := new(partialIO)
+	pio.name = iio.src.name
+	pio.size = int(cio.size)
+	pio.closer = iio.src.closer
+	pio.reader = cio
+	pio.seeker = cio
+	pio.writer = cio
+	return pio
+}
+
+// readSrcAt reads exactly len(p) bytes from the source image at offset.
+func (iio *IO) readSrcAt(p []byte, offset int64) error {
+
+	_, err := iio.src.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.ReadFull(iio.src, p)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
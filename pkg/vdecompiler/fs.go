@@ -11,38 +11,63 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"path/filepath"
 	"strings"
 
 	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/ext4"
 	"github.com/vorteil/vorteil/pkg/vimg"
 )
 
 type fsInfo struct {
 	superblock *ext.Superblock
+	extended   *ext4.Superblock
 	bgdt       []*ext.BlockGroupDescriptorTableEntry
 }
 
-func (iio *IO) readSuperblock(index int) (*ext.Superblock, error) {
+// superblockOffset returns the absolute disk offset of the copy of the
+// superblock in block group 'index'. Backup copies live at the start of the
+// first block of their group, which is only 1024 bytes in when the block size
+// is 1024.
+func (iio *IO) superblockOffset(index int) (int64, error) {
 
 	entry, err := iio.GPTEntry(UTF16toString(vimg.RootPartitionName))
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	var bpg, bs int64
+	offset := int64(entry.FirstLBA)*vimg.SectorSize + ext.SuperblockOffset
 	if index > 0 {
-		bpg = int64(iio.fs.superblock.BlocksPerGroup)
-		bs = int64(1024 << iio.fs.superblock.BlockSize)
+		sb := iio.fs.superblock
+		bs := int64(1024 << sb.BlockSize)
+		offset = int64(entry.FirstLBA)*vimg.SectorSize + (int64(sb.SuperblockNumber)+int64(sb.BlocksPerGroup)*int64(index))*bs
 	}
 
-	_, err = iio.img.Seek(int64(int64(entry.FirstLBA)*vimg.SectorSize+ext.SuperblockOffset+(bs*bpg*int64(index))), io.SeekStart)
+	return offset, nil
+
+}
+
+func (iio *IO) readSuperblock(index int) (*ext.Superblock, error) {
+
+	offset, err := iio.superblockOffset(index)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = iio.img.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.Size(ext4.Superblock{}))
+	_, err = io.ReadFull(iio.img, buf)
 	if err != nil {
 		return nil, err
 	}
 
 	sb := new(ext.Superblock)
-	err = binary.Read(iio.img, binary.LittleEndian, sb)
+	err = binary.Read(bytes.NewReader(buf), binary.LittleEndian, sb)
 	if err != nil {
 		return nil, err
 	}
@@ -51,10 +76,51 @@ func (iio *IO) readSuperblock(index int) (*ext.Superblock, error) {
 		return nil, errors.New("superblock doesn't contain a valid ext file-system signature (magic number)")
 	}
 
+	if index == 0 {
+		iio.fs.extended = new(ext4.Superblock)
+		_ = binary.Read(bytes.NewReader(buf), binary.LittleEndian, iio.fs.extended)
+	}
+
 	return sb, nil
 
 }
 
+// FilesystemType identifies the flavour of ext file-system on the root
+// partition by examining the features recorded in its superblock.
+func (iio *IO) FilesystemType() (string, error) {
+
+	_, err := iio.Superblock(0)
+	if err != nil {
+		return "", err
+	}
+
+	sb := iio.fs.extended
+	switch {
+	case sb.VersionMajor > 0 && sb.IncompatibleFeatures&ext4.IncompatExtents != 0:
+		return "ext4", nil
+	case sb.VersionMajor > 0 && sb.CompatibleFeatures&ext4.CompatHasJournal != 0:
+		return "ext3", nil
+	default:
+		return "ext2", nil
+	}
+
+}
+
+func (iio *IO) inodeSize() int {
+	if iio.fs.extended == nil || iio.fs.extended.VersionMajor == 0 {
+		return ext.InodeSize
+	}
+	return int(iio.fs.extended.InodeSize)
+}
+
+func (iio *IO) descriptorSize() int {
+	sb := iio.fs.extended
+	if sb == nil || sb.VersionMajor == 0 || sb.IncompatibleFeatures&ext4.Incompat64Bit == 0 {
+		return ext.BlockGroupDescriptorSize
+	}
+	return int(sb.DescriptorSize)
+}
+
 // Superblock loads the ext superblock from block group 'index'.
 func (iio *IO) Superblock(index int) (*ext.Superblock, error) {
 
@@ -106,6 +172,7 @@ func (iio *IO) readBGDT(index int) ([]*ext.BlockGroupDescriptorTableEntry, error
 
 	bgs := (sb.TotalBlocks + sb.BlocksPerGroup - 1) / sb.BlocksPerGroup
 	bgdt := make([]*ext.BlockGroupDescriptorTableEntry, bgs)
+	padding := int64(iio.descriptorSize() - ext.BlockGroupDescriptorSize)
 	for i := 0; i < int(bgs); i++ {
 		bgdte := new(ext.BlockGroupDescriptorTableEntry)
 		err = binary.Read(iio.img, binary.LittleEndian, bgdte)
@@ -113,6 +180,11 @@ func (iio *IO) readBGDT(index int) ([]*ext.BlockGroupDescriptorTableEntry, error
 			return nil, err
 		}
 		bgdt[i] = bgdte
+
+		_, err = io.CopyN(ioutil.Discard, iio.img, padding)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return bgdt, nil
@@ -161,26 +233,39 @@ func (iio *IO) superblockAndBGDT() (*ext.Superblock, []*ext.BlockGroupDescriptor
 
 }
 
-// ResolveInode looks up an inode on the file-system.
-func (iio *IO) ResolveInode(ino int) (*ext.Inode, error) {
+func (iio *IO) inodeOffset(ino int) (int64, error) {
 
 	sb, bgdt, err := iio.superblockAndBGDT()
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+
+	if ino < 1 || ino > int(sb.TotalInodes) {
+		return 0, fmt.Errorf("inode out of bounds: %d", ino)
 	}
 
 	bgno := (ino - 1) / int(sb.InodesPerGroup)
 	inodeOffset := (ino - 1) % int(sb.InodesPerGroup)
 	firstInodeTableBlock := int(bgdt[bgno].InodeTableBlockAddr)
 
-	// TODO: check for out of bounds
-
 	lba, err := iio.BlockToLBA(firstInodeTableBlock)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(lba*vimg.SectorSize + inodeOffset*iio.inodeSize()), nil
+
+}
+
+// ResolveInode looks up an inode on the file-system.
+func (iio *IO) ResolveInode(ino int) (*ext.Inode, error) {
+
+	offset, err := iio.inodeOffset(ino)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = iio.img.Seek(int64(lba*vimg.SectorSize+inodeOffset*ext.InodeSize), io.SeekStart)
+	_, err = iio.img.Seek(offset, io.SeekStart)
 	if err != nil {
 		return nil, err
 	}
@@ -365,18 +450,16 @@ func (iio *IO) emptyInode(inode *ext.Inode) (io.Reader, error) {
 	}, nil
 }
 
-func (iio *IO) exploreExtentsTree(hdr *ext4ExtentHeader, blockSize int64, data []byte, blockAddrs *[]int, c *int) error {
-
-	r := bytes.NewReader(data)
-	_ = binary.Read(r, binary.LittleEndian, hdr)
+func (iio *IO) exploreExtentsTree(hdr *ext4ExtentHeader, r io.Reader, blockAddrs []int) error {
 
 	for i := 0; i < int(hdr.Entries); i++ {
 
 		index := new(ext4ExtentIdx)
-		binary.Read(r, binary.LittleEndian, index)
-		if index.Block != 0 {
-			return errors.New("extent index data unaccounted for")
+		err := binary.Read(r, binary.LittleEndian, index)
+		if err != nil {
+			return err
 		}
+
 		baddr := int(index.LeafLo) + (int(index.LeafHi) << 32)
 
 		block, err := iio.loadBlock(baddr)
@@ -384,7 +467,7 @@ func (iio *IO) exploreExtentsTree(hdr *ext4ExtentHeader, blockSize int64, data [
 			return err
 		}
 
-		err = iio.recurseExtentsTree(blockSize, block, blockAddrs, c)
+		err = iio.recurseExtentsTree(block, blockAddrs)
 		if err != nil {
 			return err
 		}
@@ -395,7 +478,7 @@ func (iio *IO) exploreExtentsTree(hdr *ext4ExtentHeader, blockSize int64, data [
 
 }
 
-func (iio *IO) recurseExtentsTree(blockSize int64, data []byte, blockAddrs *[]int, c *int) error {
+func (iio *IO) recurseExtentsTree(data []byte, blockAddrs []int) error {
 
 	// read header
 	hdr := new(ext4ExtentHeader)
@@ -406,20 +489,28 @@ func (iio *IO) recurseExtentsTree(blockSize int64, data []byte, blockAddrs *[]in
 	}
 
 	if hdr.Depth != 0 {
-		return iio.exploreExtentsTree(hdr, blockSize, data, blockAddrs, c)
+		return iio.exploreExtentsTree(hdr, r, blockAddrs)
 	}
 
 	for i := 0; i < int(hdr.Entries); i++ {
 		extent := new(ext4Extent)
-		binary.Read(r, binary.LittleEndian, extent)
-		if extent.Block != 0 && i == 0 {
-			return errors.New("extent data unaccounted for")
+		err := binary.Read(r, binary.LittleEndian, extent)
+		if err != nil {
+			return err
+		}
+
+		// uninitialized extents read back as zeroes
+		if extent.Len > 32768 {
+			continue
 		}
 
 		baddr := int(extent.Lo) + (int(extent.Hi) << 32)
-		l := int(extent.Len)
-		for j := 0; j < int(l) && *c < len(*blockAddrs); (*c), j = (*c + 1), j+1 {
-			(*blockAddrs)[*c] = baddr + j // TODO: catch corruption
+		for j := 0; j < int(extent.Len); j++ {
+			k := int(extent.Block) + j
+			if k >= len(blockAddrs) {
+				return errors.New("extent maps data beyond the end of the file")
+			}
+			blockAddrs[k] = baddr + j
 		}
 	}
 
@@ -437,11 +528,11 @@ func (iio *IO) dataFromExtentsTree(inode *ext.Inode) (io.Reader, error) {
 	blockSize := int64(1024 << sb.BlockSize)
 	blockAddrs := make([]int, (InodeSize(inode)+blockSize-1)/blockSize)
 
-	i := 0
-
+	// the extent tree root occupies all 60 bytes of the block pointers
 	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, inode.DirectPointer[:])
-	err = iio.recurseExtentsTree(blockSize, buf.Bytes(), &blockAddrs, &i)
+	_ = binary.Write(buf, binary.LittleEndian, inode.DirectPointer[:])
+	_ = binary.Write(buf, binary.LittleEndian, []uint32{inode.SinglyIndirect, inode.DoublyIndirect, inode.TriplyIndirect})
+	err = iio.recurseExtentsTree(buf.Bytes(), blockAddrs)
 	if err != nil {
 		return nil, err
 	}
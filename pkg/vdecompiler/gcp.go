@@ -0,0 +1,119 @@
+package vdecompiler
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+const (
+	gcpDiskName   = "disk.raw"
+	gcpSpoolChunk = 0x100000
+)
+
+// isGzip returns true if buf starts with the gzip magic number.
+func isGzip(buf []byte) bool {
+	return len(buf) >= 2 && buf[0] == 0x1f && buf[1] == 0x8b
+}
+
+// gcpIO extracts the raw image from a GCP archive into a temporary file,
+// because a gzip stream can't be read out of order. The temporary file is
+// written sparsely, so empty regions of the disk don't take up space, and is
+// removed when the IO is closed.
+func (iio *IO) gcpIO() (*partialIO, error) {
+
+	_, err := iio.src.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	gz, err := gzip.NewReader(iio.src)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+
+	var hdr *tar.Header
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("GCP archive does not contain '%s'", gcpDiskName)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == gcpDiskName {
+			break
+		}
+	}
+
+	f, err := ioutil.TempFile("", "vorteil-decompile-")
+	if err != nil {
+		return nil, err
+	}
+	iio.spool = f
+
+	err = spoolSparse(f, tr, hdr.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	pio := new(partialIO)
+	pio.name = iio.src.name
+	pio.size = int(hdr.Size)
+	pio.closer = iio.src.closer
+	pio.reader = f
+	pio.seeker = f
+
+	return pio, nil
+
+}
+
+// spoolSparse copies size bytes from r to f, seeking over any chunks that are
+// entirely zeroes instead of writing them.
+func spoolSparse(f *os.File, r io.Reader, size int64) error {
+
+	buf := make([]byte, gcpSpoolChunk)
+	zeroes := make([]byte, gcpSpoolChunk)
+
+	var written int64
+	for written < size {
+
+		n := int64(len(buf))
+		if size-written < n {
+			n = size - written
+		}
+
+		_, err := io.ReadFull(r, buf[:n])
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(buf[:n], zeroes[:n]) {
+			_, err = f.Seek(n, io.SeekCurrent)
+		} else {
+			_, err = f.Write(buf[:n])
+		}
+		if err != nil {
+			return err
+		}
+
+		written += n
+
+	}
+
+	return f.Truncate(size)
+
+}
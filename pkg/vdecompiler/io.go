@@ -15,7 +15,9 @@ import (
 	"os"
 	"unicode/utf16"
 
+	"github.com/vorteil/vorteil/pkg/qcow2"
 	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vhd"
 	"github.com/vorteil/vorteil/pkg/vimg"
 	"github.com/vorteil/vorteil/pkg/vio"
 	"github.com/vorteil/vorteil/pkg/vmdk"
@@ -139,12 +141,27 @@ type IO struct {
 	vmdk       *vmdk.Header
 	vpart      vpartInfo
 	fs         fsInfo
+	spool      *os.File
+	writable   bool
 }
 
 // Close closes the underlying IO object and cleans up any other resources
 // in use.
 func (iio *IO) Close() error {
-	return iio.src.Close()
+
+	err := iio.src.Close()
+
+	if iio.spool != nil {
+		_ = iio.spool.Close()
+		e := os.Remove(iio.spool.Name())
+		if err == nil {
+			err = e
+		}
+		iio.spool = nil
+	}
+
+	return err
+
 }
 
 type imageIOLoader struct {
@@ -207,14 +224,35 @@ func newIO(srcName string, srcSize int, img interface{}) (*IO, error) {
 
 // Open returns an image IO object from a file at path.
 func Open(path string) (*IO, error) {
+	return openFile(path, os.O_RDONLY)
+}
+
+// OpenWritable returns an image IO object from a file at path that can be used
+// to modify the image's file-system in-place, with functions like WriteFile,
+// Mkdir, and Remove.
+func OpenWritable(path string) (*IO, error) {
 
-	f, err := os.Open(path)
+	iio, err := openFile(path, os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+
+	iio.writable = true
+
+	return iio, nil
+
+}
+
+func openFile(path string, flag int) (*IO, error) {
+
+	f, err := os.OpenFile(path, flag, 0)
 	if err != nil {
 		return nil, err
 	}
 
 	fi, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
 
@@ -244,7 +282,7 @@ func (iio *IO) resolveVMDKFormat(buf []byte) error {
 		iio.img, err = iio.vmdkSparseIO()
 	case 3:
 		iio.format = vdisk.VMDKStreamOptimizedFormat
-		err = fmt.Errorf("stream-optimized VMDK not yet supported")
+		iio.img, err = iio.vmdkStreamOptimizedIO()
 	default:
 		err = fmt.Errorf("unsupported VMDK version: %d", iio.vmdk.Version)
 	}
@@ -253,6 +291,28 @@ func (iio *IO) resolveVMDKFormat(buf []byte) error {
 
 }
 
+// resolveRAWFormat handles images without a header, which are either raw or a
+// fixed VHD, which is a raw image with a footer appended.
+func (iio *IO) resolveRAWFormat() error {
+
+	footer, err := iio.readVHDFixedFooter()
+	if err != nil {
+		return err
+	}
+
+	if footer != nil {
+		iio.format = vdisk.VHDFixedFormat
+		iio.img, err = iio.vhdFixedIO(footer)
+		return err
+	}
+
+	iio.format = vdisk.RAWFormat
+	iio.img = iio.src
+
+	return nil
+
+}
+
 func (iio *IO) determineImageFormat() error {
 
 	_, err := iio.src.Seek(0, io.SeekStart)
@@ -273,12 +333,26 @@ func (iio *IO) determineImageFormat() error {
 		return err
 	}
 
-	switch magic {
-	case uint32(vmdk.Magic):
+	switch {
+	case magic == uint32(vmdk.Magic):
 		err = iio.resolveVMDKFormat(buf.Bytes())
+	case binary.BigEndian.Uint64(buf.Bytes()) == vhd.FooterCookie:
+		iio.format = vdisk.VHDDynamicFormat
+		iio.img, err = iio.vhdDynamicIO(buf.Bytes())
+	case binary.BigEndian.Uint32(buf.Bytes()) == qcow2.Magic:
+		iio.format = vdisk.QCOW2Format
+		iio.img, err = iio.qcow2IO(buf.Bytes())
+	case isVHDX(buf.Bytes()):
+		iio.format = vdisk.VHDXFormat
+		iio.img, err = iio.vhdxIO()
+	case isXVA(buf.Bytes()):
+		iio.format = vdisk.XVAFormat
+		iio.img, err = iio.xvaIO()
+	case isGzip(buf.Bytes()):
+		iio.format = vdisk.GCPFArchiveFormat
+		iio.img, err = iio.gcpIO()
 	default:
-		iio.format = vdisk.RAWFormat
-		iio.img = iio.src
+		err = iio.resolveRAWFormat()
 	}
 
 	return err
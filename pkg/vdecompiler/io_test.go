@@ -0,0 +1,744 @@
+package vdecompiler
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/gcparchive"
+	"github.com/vorteil/vorteil/pkg/qcow2"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vhd"
+	"github.com/vorteil/vorteil/pkg/vhdx"
+	"github.com/vorteil/vorteil/pkg/vimg"
+	"github.com/vorteil/vorteil/pkg/vio"
+	"github.com/vorteil/vorteil/pkg/vmdk"
+	"github.com/vorteil/vorteil/pkg/xva"
+)
+
+// testRawImage is a raw image with data scattered between large holes, so
+// that every format has to handle both.
+type testRawImage struct {
+	data []byte
+}
+
+func newTestRawImage(size int64) *testRawImage {
+
+	img := &testRawImage{
+		data: make([]byte, size),
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for _, offset := range []int64{0, 0x1234, 0x2ff000, size / 2, size - 0x800} {
+		r.Read(img.data[offset : offset+0x800])
+	}
+
+	return img
+
+}
+
+func (img *testRawImage) Size() int64 {
+	return int64(len(img.data))
+}
+
+func (img *testRawImage) RegionIsHole(begin, size int64) bool {
+	end := begin + size
+	if end > int64(len(img.data)) {
+		end = int64(len(img.data))
+	}
+	for _, b := range img.data[begin:end] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type testFileWriteSeeker struct {
+	f      *os.File
+	cursor int64
+}
+
+func (w *testFileWriteSeeker) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.cursor)
+	w.cursor += int64(n)
+	return n, err
+}
+
+func (w *testFileWriteSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		w.cursor = offset
+	case io.SeekCurrent:
+		w.cursor += offset
+	case io.SeekEnd:
+		fi, err := w.f.Stat()
+		if err != nil {
+			return w.cursor, err
+		}
+		w.cursor = fi.Size() + offset
+	}
+	return w.cursor, nil
+}
+
+func writeTestImage(t *testing.T, format vdisk.Format, img *testRawImage) string {
+
+	f, err := ioutil.TempFile("", "vdecompiler-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ws := &testFileWriteSeeker{f: f}
+
+	var w io.WriteSeeker
+	switch format {
+	case vdisk.RAWFormat:
+		w = ws
+	case vdisk.VMDKSparseFormat:
+		w, err = vmdk.NewSparseWriter(ws, img)
+	case vdisk.VMDKStreamOptimizedFormat:
+		w, err = vmdk.NewStreamOptimizedWriter(ws, img)
+	case vdisk.VHDFixedFormat:
+		w, err = vhd.NewFixedWriter(ws, img)
+	case vdisk.VHDDynamicFormat:
+		w, err = vhd.NewDynamicWriter(ws, img)
+	case vdisk.XVAFormat:
+		w, err = xva.NewWriter(ws, img, new(vcfg.VCFG))
+	case vdisk.GCPFArchiveFormat:
+		w, err = gcparchive.NewWriter(ws, img)
+	case vdisk.VHDXFormat:
+		w, err = vhdx.NewWriter(ws, img)
+	case vdisk.QCOW2Format:
+		w, err = qcow2.NewWriter(ws, img)
+	case vdisk.QCOW2CompressedFormat:
+		w, err = qcow2.NewCompressedWriter(ws, img)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// write the raw image the way the builder does, seeking over holes but
+	// always finishing with the last block (the secondary GPT header)
+	for offset := int64(0); offset < img.Size(); offset += 0x1000 {
+		if img.RegionIsHole(offset, 0x1000) && offset+0x1000 < img.Size() {
+			continue
+		}
+		_, err = w.Seek(offset, io.SeekStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write(img.data[offset : offset+0x1000])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if closer, ok := w.(io.Closer); ok {
+		err = closer.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return f.Name()
+
+}
+
+func TestImageFormats(t *testing.T) {
+
+	img := newTestRawImage(0x800000)
+
+	for _, format := range []vdisk.Format{
+		vdisk.RAWFormat,
+		vdisk.VMDKStreamOptimizedFormat,
+		vdisk.VHDFixedFormat,
+		vdisk.VHDDynamicFormat,
+		vdisk.XVAFormat,
+		vdisk.GCPFArchiveFormat,
+		vdisk.VHDXFormat,
+		vdisk.QCOW2Format,
+		vdisk.QCOW2CompressedFormat,
+	} {
+
+		path := writeTestImage(t, format, img)
+		defer os.Remove(path)
+
+		iio, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer iio.Close()
+
+		got, err := iio.ImageFormat()
+		if err != nil {
+			t.Fatalf("failed to open %s image: %v", format, err)
+		}
+
+		// compression is a property of each cluster, not the whole image
+		expected := format
+		if format == vdisk.QCOW2CompressedFormat {
+			expected = vdisk.QCOW2Format
+		}
+
+		if got != expected {
+			t.Fatalf("%s image detected as %s", format, got)
+		}
+
+		if int64(iio.img.size) != img.Size() {
+			t.Fatalf("%s image has the wrong size: expected %d but got %d", format, img.Size(), iio.img.size)
+		}
+
+		// read backwards, to make sure the image supports random access
+		buf := make([]byte, 0x3000)
+		for offset := img.Size() - int64(len(buf)); offset >= 0; offset -= int64(len(buf)) {
+
+			_, err = iio.img.Seek(offset, io.SeekStart)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = io.ReadFull(iio.img, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(buf, img.data[offset:offset+int64(len(buf))]) {
+				t.Fatalf("%s image has the wrong data at offset %#x", format, offset)
+			}
+
+		}
+
+		_, err = iio.img.Seek(img.Size()-1, io.SeekStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n, err := io.Copy(ioutil.Discard, iio.img)
+		if err != nil || n != 1 {
+			t.Fatalf("%s image doesn't end where expected: read %d bytes (%v)", format, n, err)
+		}
+
+	}
+
+}
+
+// testBufferWriteSeeker writes into a fixed region of a byte slice.
+type testBufferWriteSeeker struct {
+	data   []byte
+	cursor int64
+}
+
+func (w *testBufferWriteSeeker) Write(p []byte) (int, error) {
+	n := copy(w.data[w.cursor:], p)
+	w.cursor += int64(n)
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+func (w *testBufferWriteSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		w.cursor = offset
+	case io.SeekCurrent:
+		w.cursor += offset
+	case io.SeekEnd:
+		w.cursor = int64(len(w.data)) + offset
+	}
+	return w.cursor, nil
+}
+
+// newTestExtImage returns a raw image containing a GPT with a single root
+// partition holding an ext2 file-system.
+func newTestExtImage(t *testing.T) *testRawImage {
+
+	ctx := context.Background()
+
+	c := ext.NewCompiler(&ext.CompilerArgs{
+		FileTree: vio.NewFileTree(),
+		Logger:   &elog.CLI{},
+	})
+
+	err := c.Mkdir("/etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("hello, world\n")
+	err = c.AddFile("/etc/hello", vio.CustomFile(vio.CustomFileArgs{
+		Size:       len(data),
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(data)),
+	}), int64(len(data)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.IncreaseMinimumFreeSpace(16 * 1024 * 1024)
+	c.IncreaseMinimumInodes(256)
+
+	err = c.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := c.MinimumSize()
+	err = c.Precompile(ctx, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := int64(2048)
+	img := &testRawImage{
+		data: make([]byte, (first*2)*vimg.SectorSize+size),
+	}
+
+	hdr := &vimg.GPTHeader{
+		StartLBAParts: vimg.PrimaryGPTEntriesLBA,
+		NoOfParts:     1,
+		SizePartEntry: vimg.GPTEntrySize,
+	}
+	entry := &vimg.GPTEntry{
+		FirstLBA: uint64(first),
+		LastLBA:  uint64(first + size/vimg.SectorSize - 1),
+	}
+	copy(entry.Name[:], vimg.RootPartitionName)
+
+	w := &testBufferWriteSeeker{data: img.data[vimg.PrimaryGPTHeaderOffset:]}
+	_ = binary.Write(w, binary.LittleEndian, hdr)
+	_ = binary.Write(w, binary.LittleEndian, entry)
+
+	err = c.Compile(ctx, &testBufferWriteSeeker{data: img.data[first*vimg.SectorSize:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return img
+
+}
+
+func readTestImageFile(t *testing.T, iio *IO, path string) []byte {
+
+	ino, err := iio.ResolvePathToInodeNo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inode, err := iio.ResolveInode(ino)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := iio.InodeReader(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+
+}
+
+func TestWriteFileSystem(t *testing.T) {
+
+	img := newTestExtImage(t)
+
+	big := make([]byte, 5*1024*1024+123)
+	rand.New(rand.NewSource(2)).Read(big)
+
+	for _, format := range []vdisk.Format{
+		vdisk.RAWFormat,
+		vdisk.VMDKSparseFormat,
+	} {
+
+		path := writeTestImage(t, format, img)
+		defer os.Remove(path)
+
+		ro, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ro.Mkdir("/var", 0755)
+		if err == nil {
+			t.Fatalf("%s image modified without being opened for writing", format)
+		}
+
+		sb, err := ro.Superblock(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks, inodes := sb.UnallocatedBlocks, sb.UnallocatedInodes
+		ro.Close()
+
+		iio, err := OpenWritable(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hello := []byte("goodbye, world\n")
+		err = iio.WriteFile("/etc/hello", bytes.NewReader(hello), int64(len(hello)), 0644)
+		if err != nil {
+			t.Fatalf("failed to replace file on %s image: %v", format, err)
+		}
+
+		err = iio.Mkdir("/var", 0755)
+		if err != nil {
+			t.Fatalf("failed to create directory on %s image: %v", format, err)
+		}
+
+		err = iio.WriteFile("/var/big", bytes.NewReader(big), int64(len(big)), 0600)
+		if err != nil {
+			t.Fatalf("failed to write file to %s image: %v", format, err)
+		}
+
+		// enough long names to need more than one directory block
+		var names []string
+		for i := 0; i < 200; i++ {
+			name := fmt.Sprintf("/var/a-file-with-a-fairly-long-name-to-fill-directory-blocks-%03d", i)
+			err = iio.WriteFile(name, bytes.NewReader([]byte(name)), int64(len(name)), 0644)
+			if err != nil {
+				t.Fatalf("failed to write file to %s image: %v", format, err)
+			}
+			names = append(names, name)
+		}
+
+		err = iio.Remove("/var")
+		if err == nil {
+			t.Fatalf("removed non-empty directory from %s image", format)
+		}
+
+		err = iio.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		iio, err = OpenWritable(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if data := readTestImageFile(t, iio, "/etc/hello"); !bytes.Equal(data, hello) {
+			t.Fatalf("%s image has the wrong contents for a replaced file: %q", format, data)
+		}
+
+		if data := readTestImageFile(t, iio, "/var/big"); !bytes.Equal(data, big) {
+			t.Fatalf("%s image has the wrong contents for a large file", format)
+		}
+
+		for _, name := range names {
+			if data := readTestImageFile(t, iio, name); string(data) != name {
+				t.Fatalf("%s image has the wrong contents for %s: %q", format, name, data)
+			}
+			err = iio.Remove(name)
+			if err != nil {
+				t.Fatalf("failed to remove file from %s image: %v", format, err)
+			}
+		}
+
+		for _, name := range []string{"/var/big", "/var"} {
+			err = iio.Remove(name)
+			if err != nil {
+				t.Fatalf("failed to remove %s from %s image: %v", name, format, err)
+			}
+		}
+
+		err = iio.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ro, err = Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ro.Close()
+
+		_, err = ro.ResolvePathToInodeNo("/var")
+		if err == nil {
+			t.Fatalf("%s image still contains a removed directory", format)
+		}
+
+		// everything but the replaced file has been removed again, so the
+		// free counts should be back where they started
+		sb, err = ro.Superblock(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sb.UnallocatedBlocks != blocks || sb.UnallocatedInodes != inodes {
+			t.Fatalf("%s image has %d free blocks and %d free inodes after cleaning up, expected %d and %d",
+				format, sb.UnallocatedBlocks, sb.UnallocatedInodes, blocks, inodes)
+		}
+
+	}
+
+}
+
+// freeBlocksInBitmaps counts the blocks the block bitmaps mark as free.
+func freeBlocksInBitmaps(t *testing.T, iio *IO) uint32 {
+
+	sb, bgdt, err := iio.superblockAndBGDT()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var free uint32
+	for g, bgdte := range bgdt {
+		bitmap, err := iio.loadBlock(int(bgdte.BlockBitmapBlockAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := int(sb.SuperblockNumber) + g*int(sb.BlocksPerGroup)
+		for i := 0; i < int(sb.BlocksPerGroup) && first+i < int(sb.TotalBlocks); i++ {
+			if bitmap[i/8]&(1<<(i%8)) == 0 {
+				free++
+			}
+		}
+	}
+
+	return free
+
+}
+
+func TestWriteFileFailure(t *testing.T) {
+
+	path := writeTestImage(t, vdisk.RAWFormat, newTestExtImage(t))
+	defer os.Remove(path)
+
+	iio, err := OpenWritable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sb, err := iio.Superblock(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, inodes := sb.UnallocatedBlocks, sb.UnallocatedInodes
+	bs := int64(iio.blockSize())
+
+	hello := readTestImageFile(t, iio, "/etc/hello")
+
+	// one too big to fit, and one whose reader comes up short
+	err = iio.WriteFile("/etc/hello", bytes.NewReader(nil), int64(blocks)*bs+1, 0644)
+	if err != ErrNoSpace {
+		t.Fatalf("expected writing a file larger than the free space to fail with %v but got %v", ErrNoSpace, err)
+	}
+
+	for _, name := range []string{"/etc/hello", "/etc/new"} {
+		err = iio.WriteFile(name, bytes.NewReader([]byte("short")), 3*bs, 0644)
+		if err == nil {
+			t.Fatalf("expected writing %s from a short reader to fail", name)
+		}
+	}
+
+	err = iio.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+
+	if data := readTestImageFile(t, ro, "/etc/hello"); !bytes.Equal(data, hello) {
+		t.Fatalf("failed writes changed the contents of the file: %q", data)
+	}
+
+	sb, err = ro.Superblock(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if free := freeBlocksInBitmaps(t, ro); sb.UnallocatedBlocks != blocks || free != blocks {
+		t.Fatalf("failed writes left %d free blocks in the superblock and %d in the bitmaps, expected %d",
+			sb.UnallocatedBlocks, free, blocks)
+	}
+
+	if sb.UnallocatedInodes != inodes {
+		t.Fatalf("failed writes left %d free inodes, expected %d", sb.UnallocatedInodes, inodes)
+	}
+
+	_, err = ro.ResolvePathToInodeNo("/etc/new")
+	if err == nil {
+		t.Fatalf("a failed write created a file")
+	}
+
+}
+
+// newTestOSImage returns an image that holds only an os partition, with the
+// bootloader config and VCFG laid out the way vimg.Builder writes them.
+func newTestOSImage(t *testing.T, cfg *vcfg.VCFG) *testRawImage {
+
+	kc, err := vimg.GenerateKernelConfig(cfg, &elog.CLI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := int64(vimg.P0FirstLBA)
+	sectors := int64(vimg.KernelConfigSpaceSectors + 8)
+	img := &testRawImage{
+		data: make([]byte, 0x100000),
+	}
+
+	hdr := &vimg.GPTHeader{
+		StartLBAParts: vimg.PrimaryGPTEntriesLBA,
+		NoOfParts:     1,
+		SizePartEntry: vimg.GPTEntrySize,
+	}
+	entry := &vimg.GPTEntry{
+		FirstLBA: uint64(first),
+		LastLBA:  uint64(first + sectors - 1),
+	}
+
+	w := &testBufferWriteSeeker{data: img.data[vimg.PrimaryGPTHeaderOffset:]}
+	_ = binary.Write(w, binary.LittleEndian, hdr)
+	_ = binary.Write(w, binary.LittleEndian, entry)
+
+	conf := &vimg.BootloaderConfig{
+		LinuxArgsLen:   uint16(len(kc.LinuxArgs)),
+		ConfigOffset:   vimg.KernelConfigSpaceSectors * vimg.SectorSize,
+		ConfigLen:      uint64(len(kc.Data)),
+		ConfigCapacity: uint64(sectors-vimg.KernelConfigSpaceSectors) * vimg.SectorSize,
+	}
+	copy(conf.LinuxArgs[:], kc.LinuxArgs)
+
+	w = &testBufferWriteSeeker{data: img.data[first*vimg.SectorSize:]}
+	_ = binary.Write(w, binary.LittleEndian, conf)
+	copy(img.data[first*vimg.SectorSize+int64(conf.ConfigOffset):], kc.Data)
+
+	return img
+
+}
+
+func TestReplaceVCFG(t *testing.T) {
+
+	cfg := &vcfg.VCFG{
+		Programs: []vcfg.Program{{
+			Binary: "/hello",
+			Args:   "hello",
+		}},
+	}
+	cfg.VM.Kernel = "20.9.1"
+
+	img := newTestOSImage(t, cfg)
+
+	for _, format := range []vdisk.Format{
+		vdisk.RAWFormat,
+		vdisk.VMDKSparseFormat,
+	} {
+
+		path := writeTestImage(t, format, img)
+		defer os.Remove(path)
+
+		ro, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ro.ReplaceVCFG(cfg, &elog.CLI{})
+		if err == nil {
+			t.Errorf("%s: replaced the VCFG of an image opened read-only", format)
+		}
+		ro.Close()
+
+		iio, err := OpenWritable(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		old, err := iio.VCFG()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if old.Programs[0].Binary != "/hello" {
+			t.Errorf("%s: read the wrong VCFG from the image: %v", format, old.Programs)
+		}
+
+		bad := new(vcfg.VCFG)
+		*bad = *old
+		bad.VM.Kernel = "20.10.1"
+		err = iio.ReplaceVCFG(bad, &elog.CLI{})
+		if err == nil {
+			t.Errorf("%s: changed the kernel of a built image", format)
+		}
+
+		bad = new(vcfg.VCFG)
+		*bad = *old
+		bad.System.NTP = []string{"pool.ntp.org"}
+		err = iio.ReplaceVCFG(bad, &elog.CLI{})
+		if err == nil {
+			t.Errorf("%s: added a kernel feature to a built image", format)
+		}
+
+		bad = new(vcfg.VCFG)
+		*bad = *old
+		bad.Programs = []vcfg.Program{old.Programs[0]}
+		bad.Programs[0].Env = []string{"BIG=" + string(bytes.Repeat([]byte("x"), 8*vimg.SectorSize))}
+		err = iio.ReplaceVCFG(bad, &elog.CLI{})
+		if err == nil {
+			t.Errorf("%s: wrote a VCFG that doesn't fit in the image", format)
+		}
+
+		cfg := new(vcfg.VCFG)
+		*cfg = *old
+		cfg.VM.RAM = vcfg.Bytes(256 * 1024 * 1024)
+		cfg.System.KernelArgs = "quiet"
+		err = iio.ReplaceVCFG(cfg, &elog.CLI{})
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		iio.Close()
+
+		iio, err = Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		x, err := iio.VCFG()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if x.VM.RAM != cfg.VM.RAM || x.Programs[0].Binary != "/hello" {
+			t.Errorf("%s: VCFG was not replaced: %v", format, x.VM)
+		}
+
+		conf, err := iio.BootloaderConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		args := string(conf.LinuxArgs[:conf.LinuxArgsLen])
+		if !bytes.HasPrefix([]byte(args), []byte("quiet ")) {
+			t.Errorf("%s: kernel args were not replaced: %s", format, args)
+		}
+
+		iio.Close()
+
+	}
+
+}
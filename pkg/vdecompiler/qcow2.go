@@ -0,0 +1,201 @@
+package vdecompiler
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/vorteil/vorteil/pkg/qcow2"
+)
+
+type qcow2IO struct {
+	iio         *IO
+	header      *qcow2.Header
+	clusterSize int64
+	l1          []uint64
+	l2          map[int64][]uint64
+}
+
+func (qio *qcow2IO) readHeader(buf []byte) error {
+
+	err := binary.Read(bytes.NewReader(buf), binary.BigEndian, qio.header)
+	if err != nil {
+		return err
+	}
+
+	hdr := qio.header
+
+	if hdr.Version < 2 || hdr.Version > 3 {
+		return fmt.Errorf("unsupported qcow2 version: %d", hdr.Version)
+	}
+
+	if hdr.ClusterBits < 9 || hdr.ClusterBits > 21 {
+		return fmt.Errorf("qcow2 image has an invalid cluster size: %d bits", hdr.ClusterBits)
+	}
+
+	if hdr.BackingFileOffset != 0 {
+		return fmt.Errorf("qcow2 images with a backing file are not supported")
+	}
+
+	if hdr.CryptMethod != 0 {
+		return fmt.Errorf("encrypted qcow2 images are not supported")
+	}
+
+	if hdr.Version == 3 && hdr.IncompatibleFeatures&^0x1 != 0 {
+		// bit 0 only means the image wasn't closed cleanly
+		return fmt.Errorf("qcow2 image uses unsupported incompatible features: %#x", hdr.IncompatibleFeatures)
+	}
+
+	qio.clusterSize = 1 << hdr.ClusterBits
+
+	return nil
+
+}
+
+func (qio *qcow2IO) readL1() error {
+
+	qio.l1 = make([]uint64, qio.header.L1Size)
+	buf := make([]byte, 8*len(qio.l1))
+	err := qio.iio.readSrcAt(buf, int64(qio.header.L1TableOffset))
+	if err != nil {
+		return err
+	}
+
+	return binary.Read(bytes.NewReader(buf), binary.BigEndian, qio.l1)
+
+}
+
+// l2Entry returns the L2 table entry of a guest cluster, loading its table if
+// necessary, or zero if it isn't allocated.
+func (qio *qcow2IO) l2Entry(cluster int64) (uint64, error) {
+
+	entries := qio.clusterSize / 8
+	index := cluster / entries
+	if index >= int64(len(qio.l1)) {
+		return 0, nil
+	}
+
+	offset := int64(qio.l1[index] & qcow2.OffsetMask)
+	if offset == 0 {
+		return 0, nil
+	}
+
+	table, ok := qio.l2[index]
+	if !ok {
+		table = make([]uint64, entries)
+		buf := make([]byte, qio.clusterSize)
+		err := qio.iio.readSrcAt(buf, offset)
+		if err != nil {
+			return 0, err
+		}
+		err = binary.Read(bytes.NewReader(buf), binary.BigEndian, table)
+		if err != nil {
+			return 0, err
+		}
+		qio.l2[index] = table
+	}
+
+	return table[cluster%entries], nil
+
+}
+
+func (qio *qcow2IO) loadCluster(cluster int64) ([]byte, error) {
+
+	entry, err := qio.l2Entry(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry&qcow2.FlagCompressed != 0 {
+		return qio.loadCompressedCluster(entry)
+	}
+
+	offset := int64(entry & qcow2.OffsetMask)
+	if offset == 0 || entry&qcow2.FlagZero != 0 {
+		return nil, nil
+	}
+
+	data := make([]byte, qio.clusterSize)
+	err = qio.readSrcAt(data, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+
+}
+
+func (qio *qcow2IO) loadCompressedCluster(entry uint64) ([]byte, error) {
+
+	offsetBits := 62 - (qio.header.ClusterBits - 8)
+	offset := int64(entry & (1<<offsetBits - 1))
+	sectors := int64(entry>>offsetBits) & (1<<(qio.header.ClusterBits-8) - 1)
+	size := (sectors+1)*qcow2.SectorSize - offset%qcow2.SectorSize
+
+	compressed := make([]byte, size)
+	err := qio.readSrcAt(compressed, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, qio.clusterSize)
+	r := flate.NewReader(bytes.NewReader(compressed))
+	defer r.Close()
+
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing qcow2 cluster at %#x: %w", offset, err)
+	}
+
+	return data, nil
+
+}
+
+// readSrcAt reads from the source image, treating anything beyond the end of
+// the file as zeroes, because QEMU doesn't always extend the file to cover the
+// last cluster it has written to.
+func (qio *qcow2IO) readSrcAt(p []byte, offset int64) error {
+
+	if remaining := int64(qio.iio.src.size) - offset; remaining < int64(len(p)) {
+		if remaining <= 0 {
+			return nil
+		}
+		p = p[:remaining]
+	}
+
+	return qio.iio.readSrcAt(p, offset)
+
+}
+
+func (iio *IO) qcow2IO(buf []byte) (*partialIO, error) {
+
+	if iio.src.seeker == nil {
+		return nil, fmt.Errorf("reading a qcow2 image from %s: %w", iio.src.name, ErrSeek)
+	}
+
+	qio := &qcow2IO{
+		iio:    iio,
+		header: new(qcow2.Header),
+		l2:     make(map[int64][]uint64),
+	}
+
+	err := qio.readHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	err = qio.readL1()
+	if err != nil {
+		return nil, err
+	}
+
+	return iio.chunkedPartialIO(newChunkedIO(int64(qio.header.Size), qio.clusterSize, qio.loadCluster)), nil
+
+}
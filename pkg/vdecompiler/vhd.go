@@ -0,0 +1,176 @@
+package vdecompiler
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/vorteil/vorteil/pkg/vhd"
+)
+
+const vhdFixedChunkSize = 0x200000
+
+func parseVHDFooter(buf []byte) (*vhd.Footer, error) {
+
+	footer := new(vhd.Footer)
+	err := binary.Read(bytes.NewReader(buf), binary.BigEndian, footer)
+	if err != nil {
+		return nil, err
+	}
+
+	if footer.Cookie != vhd.FooterCookie {
+		return nil, errors.New("VHD footer not found")
+	}
+
+	return footer, nil
+
+}
+
+// readVHDFixedFooter returns the footer at the end of the source image if it
+// is a fixed VHD, or nil if it isn't.
+func (iio *IO) readVHDFixedFooter() (*vhd.Footer, error) {
+
+	if iio.src.seeker == nil || iio.src.size < 2*vhd.FooterSize {
+		return nil, nil
+	}
+
+	buf := make([]byte, vhd.FooterSize)
+	err := iio.readSrcAt(buf, int64(iio.src.size-vhd.FooterSize))
+	if err != nil {
+		return nil, err
+	}
+
+	footer, err := parseVHDFooter(buf)
+	if err != nil || footer.DiskType != vhd.DiskTypeFixed {
+		return nil, nil
+	}
+
+	return footer, nil
+
+}
+
+func (iio *IO) vhdFixedIO(footer *vhd.Footer) (*partialIO, error) {
+
+	size := int64(footer.CurrentSize)
+	if size > int64(iio.src.size-vhd.FooterSize) {
+		return nil, fmt.Errorf("fixed VHD claims to hold %d bytes but only contains %d", size, iio.src.size-vhd.FooterSize)
+	}
+
+	load := func(chunk int64) ([]byte, error) {
+		data := make([]byte, vhdFixedChunkSize)
+		if remaining := size - chunk*vhdFixedChunkSize; remaining < vhdFixedChunkSize {
+			data = data[:remaining]
+		}
+		err := iio.readSrcAt(data, chunk*vhdFixedChunkSize)
+		if err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+
+	return iio.chunkedPartialIO(newChunkedIO(size, vhdFixedChunkSize, load)), nil
+
+}
+
+type vhdDynamicIO struct {
+	iio        *IO
+	footer     *vhd.Footer
+	header     *vhd.Header
+	bat        []uint32
+	bitmapSize int64
+}
+
+func (dio *vhdDynamicIO) readHeader() error {
+
+	buf := make([]byte, binary.Size(dio.header))
+	err := dio.iio.readSrcAt(buf, int64(dio.footer.DataOffset))
+	if err != nil {
+		return err
+	}
+
+	err = binary.Read(bytes.NewReader(buf), binary.BigEndian, dio.header)
+	if err != nil {
+		return err
+	}
+
+	if dio.header.Cookie != vhd.HeaderCookie {
+		return errors.New("dynamic VHD header not found")
+	}
+
+	if dio.header.BlockSize == 0 || dio.header.BlockSize%vhd.SectorSize != 0 {
+		return fmt.Errorf("dynamic VHD has an invalid block size: %d", dio.header.BlockSize)
+	}
+
+	// each block is preceded by a sector bitmap, padded to a whole sector
+	sectors := int64(dio.header.BlockSize) / vhd.SectorSize
+	dio.bitmapSize = ((sectors+7)/8 + vhd.SectorSize - 1) / vhd.SectorSize * vhd.SectorSize
+
+	return nil
+
+}
+
+func (dio *vhdDynamicIO) readBAT() error {
+
+	dio.bat = make([]uint32, dio.header.MaxTableEntries)
+	buf := make([]byte, 4*len(dio.bat))
+	err := dio.iio.readSrcAt(buf, int64(dio.header.TableOffset))
+	if err != nil {
+		return err
+	}
+
+	return binary.Read(bytes.NewReader(buf), binary.BigEndian, dio.bat)
+
+}
+
+func (dio *vhdDynamicIO) loadBlock(block int64) ([]byte, error) {
+
+	if block >= int64(len(dio.bat)) || dio.bat[block] == vhd.UnusedBATEntry {
+		return nil, nil
+	}
+
+	data := make([]byte, dio.header.BlockSize)
+	err := dio.iio.readSrcAt(data, int64(dio.bat[block])*vhd.SectorSize+dio.bitmapSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+
+}
+
+func (iio *IO) vhdDynamicIO(buf []byte) (*partialIO, error) {
+
+	footer, err := parseVHDFooter(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if footer.DiskType != vhd.DiskTypeDynamic {
+		return nil, fmt.Errorf("unsupported VHD disk type: %d", footer.DiskType)
+	}
+
+	dio := &vhdDynamicIO{
+		iio:    iio,
+		footer: footer,
+		header: new(vhd.Header),
+	}
+
+	err = dio.readHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	err = dio.readBAT()
+	if err != nil {
+		return nil, err
+	}
+
+	return iio.chunkedPartialIO(newChunkedIO(int64(footer.CurrentSize), int64(dio.header.BlockSize), dio.loadBlock)), nil
+
+}
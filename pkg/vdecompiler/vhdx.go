@@ -0,0 +1,263 @@
+package vdecompiler
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/vorteil/vorteil/pkg/vhdx"
+)
+
+// isVHDX returns true if buf starts with the VHDX file identifier.
+func isVHDX(buf []byte) bool {
+	return len(buf) >= 8 && binary.LittleEndian.Uint64(buf) == vhdx.FileSignature
+}
+
+type vhdxIO struct {
+	iio        *IO
+	header     *vhdx.Header
+	regions    map[[16]byte]vhdx.RegionTableEntry
+	blockSize  int64
+	size       int64
+	chunkRatio int64
+	bat        []uint64
+}
+
+// readHeader finds the current header, which is the valid one with the
+// highest sequence number.
+func (xio *vhdxIO) readHeader() error {
+
+	for _, offset := range []int64{vhdx.Header1Offset, vhdx.Header2Offset} {
+
+		buf := make([]byte, vhdx.HeaderSize)
+		err := xio.iio.readSrcAt(buf, offset)
+		if err != nil {
+			return err
+		}
+
+		hdr := new(vhdx.Header)
+		err = binary.Read(bytes.NewReader(buf), binary.LittleEndian, hdr)
+		if err != nil {
+			return err
+		}
+
+		if hdr.Signature != vhdx.HeaderSignature || hdr.Checksum != vhdx.Checksum(buf) {
+			continue
+		}
+
+		if xio.header == nil || hdr.SequenceNumber > xio.header.SequenceNumber {
+			xio.header = hdr
+		}
+
+	}
+
+	if xio.header == nil {
+		return errors.New("VHDX has no valid header")
+	}
+
+	if xio.header.LogGUID != [16]byte{} {
+		return errors.New("VHDX has a log that must be replayed, which is not supported")
+	}
+
+	return nil
+
+}
+
+func (xio *vhdxIO) readRegionTable() error {
+
+	for _, offset := range []int64{vhdx.RegionTable1Offset, vhdx.RegionTable2Offset} {
+
+		buf := make([]byte, vhdx.RegionTableSize)
+		err := xio.iio.readSrcAt(buf, offset)
+		if err != nil {
+			return err
+		}
+
+		r := bytes.NewReader(buf)
+		hdr := new(vhdx.RegionTableHeader)
+		err = binary.Read(r, binary.LittleEndian, hdr)
+		if err != nil {
+			return err
+		}
+
+		if hdr.Signature != vhdx.RegionSignature || hdr.Checksum != vhdx.Checksum(buf) {
+			continue
+		}
+
+		entries := make([]vhdx.RegionTableEntry, hdr.EntryCount)
+		err = binary.Read(r, binary.LittleEndian, entries)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			xio.regions[entry.GUID] = entry
+		}
+
+		for _, guid := range [][16]byte{vhdx.BATRegionGUID, vhdx.MetadataRegionGUID} {
+			if _, ok := xio.regions[guid]; !ok {
+				return errors.New("VHDX region table is missing a required region")
+			}
+		}
+
+		return nil
+
+	}
+
+	return errors.New("VHDX has no valid region table")
+
+}
+
+func (xio *vhdxIO) readMetadata() error {
+
+	region := xio.regions[vhdx.MetadataRegionGUID]
+	buf := make([]byte, region.Length)
+	err := xio.iio.readSrcAt(buf, int64(region.FileOffset))
+	if err != nil {
+		return err
+	}
+
+	r := bytes.NewReader(buf)
+	hdr := new(vhdx.MetadataTableHeader)
+	err = binary.Read(r, binary.LittleEndian, hdr)
+	if err != nil {
+		return err
+	}
+
+	if hdr.Signature != vhdx.MetadataSignature {
+		return errors.New("VHDX metadata table not found")
+	}
+
+	entries := make([]vhdx.MetadataTableEntry, hdr.EntryCount)
+	err = binary.Read(r, binary.LittleEndian, entries)
+	if err != nil {
+		return err
+	}
+
+	items := make(map[[16]byte][]byte)
+	for _, entry := range entries {
+		end := int64(entry.Offset) + int64(entry.Length)
+		if end > int64(len(buf)) {
+			return errors.New("VHDX metadata item is outside of the metadata region")
+		}
+		items[entry.ItemID] = buf[entry.Offset:end]
+	}
+
+	params := new(vhdx.FileParameters)
+	sectorSize := uint32(0)
+	for guid, x := range map[[16]byte]interface{}{
+		vhdx.FileParametersGUID:    params,
+		vhdx.VirtualDiskSizeGUID:   &xio.size,
+		vhdx.LogicalSectorSizeGUID: &sectorSize,
+	} {
+		item, ok := items[guid]
+		if !ok {
+			return errors.New("VHDX metadata is missing a required item")
+		}
+		err = binary.Read(bytes.NewReader(item), binary.LittleEndian, x)
+		if err != nil {
+			return err
+		}
+	}
+
+	if params.Flags&vhdx.FileParametersFlagHasParent != 0 {
+		return errors.New("differencing VHDX images are not supported")
+	}
+
+	if params.BlockSize < vhdx.MiB || params.BlockSize%vhdx.MiB != 0 {
+		return fmt.Errorf("VHDX has an invalid block size: %d", params.BlockSize)
+	}
+
+	if sectorSize != 512 && sectorSize != 4096 {
+		return fmt.Errorf("VHDX has an invalid logical sector size: %d", sectorSize)
+	}
+
+	xio.blockSize = int64(params.BlockSize)
+	xio.chunkRatio = vhdx.ChunkRatio(xio.blockSize, int64(sectorSize))
+
+	return nil
+
+}
+
+func (xio *vhdxIO) readBAT() error {
+
+	blocks := (xio.size + xio.blockSize - 1) / xio.blockSize
+	xio.bat = make([]uint64, blocks+(blocks-1)/xio.chunkRatio)
+
+	region := xio.regions[vhdx.BATRegionGUID]
+	if int64(region.Length) < int64(8*len(xio.bat)) {
+		return errors.New("VHDX BAT region is too small for the virtual disk")
+	}
+
+	buf := make([]byte, 8*len(xio.bat))
+	err := xio.iio.readSrcAt(buf, int64(region.FileOffset))
+	if err != nil {
+		return err
+	}
+
+	return binary.Read(bytes.NewReader(buf), binary.LittleEndian, xio.bat)
+
+}
+
+func (xio *vhdxIO) loadBlock(block int64) ([]byte, error) {
+
+	entry := xio.bat[block+block/xio.chunkRatio]
+
+	switch entry & vhdx.BATStateMask {
+	case vhdx.PayloadBlockFullyPresent:
+	case vhdx.PayloadBlockPartiallyPresent:
+		return nil, errors.New("VHDX contains a partially present block, which is only valid in differencing images")
+	default:
+		return nil, nil
+	}
+
+	data := make([]byte, xio.blockSize)
+	err := xio.iio.readSrcAt(data, int64(entry>>vhdx.BATOffsetShift)*vhdx.MiB)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+
+}
+
+func (iio *IO) vhdxIO() (*partialIO, error) {
+
+	if iio.src.seeker == nil {
+		return nil, fmt.Errorf("reading a VHDX from %s: %w", iio.src.name, ErrSeek)
+	}
+
+	xio := &vhdxIO{
+		iio:     iio,
+		regions: make(map[[16]byte]vhdx.RegionTableEntry),
+	}
+
+	err := xio.readHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	err = xio.readRegionTable()
+	if err != nil {
+		return nil, err
+	}
+
+	err = xio.readMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	err = xio.readBAT()
+	if err != nil {
+		return nil, err
+	}
+
+	return iio.chunkedPartialIO(newChunkedIO(xio.size, xio.blockSize, xio.loadBlock)), nil
+
+}
@@ -6,14 +6,22 @@ package vdecompiler
  */
 
 import (
+	"bytes"
+	"compress/zlib"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 
+	"github.com/vorteil/vorteil/pkg/vio"
 	"github.com/vorteil/vorteil/pkg/vmdk"
 )
 
+// vmdkRedundantGrainTable is the header flag indicating that a sparse VMDK
+// keeps a redundant copy of its grain directory and tables.
+const vmdkRedundantGrainTable = 0x2
+
 type vmdkSparseIO struct {
 	iio         *IO
 	grain       int
@@ -22,6 +30,7 @@ type vmdkSparseIO struct {
 	offset      int
 	remainder   int
 	gdes        []uint32
+	rgdes       []uint32
 	grains      []uint32
 	buffer      io.Reader
 }
@@ -32,6 +41,11 @@ func (sio *vmdkSparseIO) loadGrain(grain int) (io.Reader, error) {
 	}
 
 	offset := sio.grains[grain]
+	if offset == 0 {
+		// unallocated grains read back as zeroes
+		return io.LimitReader(vio.Zeroes, int64(sio.grainSize)), nil
+	}
+
 	_, err := sio.iio.src.Seek(int64(offset)*vmdk.SectorSize, io.SeekStart)
 	if err != nil {
 		return nil, err
@@ -107,8 +121,120 @@ func (sio *vmdkSparseIO) Seek(offset int64, whence int) (off int64, err error) {
 	return int64(sio.offset), nil
 }
 
+// Write modifies the image in-place. Writing into an unallocated grain
+// allocates it at the end of the file and updates the grain tables.
 func (sio *vmdkSparseIO) Write(p []byte) (n int, err error) {
-	return 0, errors.New("writing not supported")
+
+	offset := int64(sio.offset)
+
+	for n < len(p) {
+
+		grain := int(offset / int64(sio.grainSize))
+		if grain >= len(sio.grains) {
+			err = errors.New("cannot write beyond the end of the disk")
+			break
+		}
+
+		if sio.grains[grain] == 0 {
+			err = sio.allocateGrain(grain)
+			if err != nil {
+				break
+			}
+		}
+
+		delta := offset % int64(sio.grainSize)
+		k := len(p) - n
+		if int64(k) > int64(sio.grainSize)-delta {
+			k = int(int64(sio.grainSize) - delta)
+		}
+
+		_, err = sio.iio.src.Seek(int64(sio.grains[grain])*vmdk.SectorSize+delta, io.SeekStart)
+		if err != nil {
+			break
+		}
+
+		_, err = sio.iio.src.Write(p[n : n+k])
+		if err != nil {
+			break
+		}
+
+		n += k
+		offset += int64(k)
+
+	}
+
+	// reposition the reader after the data that was written
+	_, e := sio.Seek(offset, io.SeekStart)
+	if err == nil {
+		err = e
+	}
+
+	return
+
+}
+
+func (sio *vmdkSparseIO) readRedundantGrainDirectory() error {
+
+	sio.rgdes = make([]uint32, len(sio.gdes))
+
+	_, err := sio.iio.src.Seek(int64(sio.iio.vmdk.RGDOffset)*vmdk.SectorSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return binary.Read(sio.iio.src, binary.LittleEndian, &sio.rgdes)
+
+}
+
+// allocateGrain appends a new zeroed grain to the end of the image and points
+// the grain table entries for grain at it, in both the primary and redundant
+// grain tables.
+func (sio *vmdkSparseIO) allocateGrain(grain int) error {
+
+	if sio.rgdes == nil && sio.iio.vmdk.Flags&vmdkRedundantGrainTable != 0 {
+		err := sio.readRedundantGrainDirectory()
+		if err != nil {
+			return err
+		}
+	}
+
+	sector := (int64(sio.iio.src.size) + vmdk.SectorSize - 1) / vmdk.SectorSize
+
+	_, err := sio.iio.src.Seek(sector*vmdk.SectorSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(sio.iio.src, vio.Zeroes, int64(sio.grainSize))
+	if err != nil {
+		return err
+	}
+
+	sio.iio.src.size = int(sector*vmdk.SectorSize) + sio.grainSize
+
+	for _, gdes := range [][]uint32{sio.gdes, sio.rgdes} {
+
+		if gdes == nil {
+			continue
+		}
+
+		table := gdes[grain/vmdk.TableMaxRows]
+		_, err = sio.iio.src.Seek(int64(table)*vmdk.SectorSize+int64(grain%vmdk.TableMaxRows)*4, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		err = binary.Write(sio.iio.src, binary.LittleEndian, uint32(sector))
+		if err != nil {
+			return err
+		}
+
+	}
+
+	sio.grains[grain] = uint32(sector)
+
+	return nil
+
 }
 
 func (sio *vmdkSparseIO) readGrainTable(i int) error {
@@ -193,3 +319,156 @@ func (iio *IO) vmdkSparseIO() (*partialIO, error) {
 	return pio, nil
 
 }
+
+// vmdkStreamOptimizedIO reads a stream-optimized VMDK using the grain
+// directory in its footer, since the one in its header is left unset by
+// anything that writes the image as a stream.
+type vmdkStreamOptimizedIO struct {
+	iio    *IO
+	footer *vmdk.Header
+	grains []uint32
+}
+
+func (sio *vmdkStreamOptimizedIO) readFooter() error {
+
+	// the footer is followed by an end-of-stream marker, and preceded by
+	// a footer marker
+	offset := int64(sio.iio.src.size) - 2*vmdk.SectorSize
+	if offset < vmdk.SectorSize {
+		return errors.New("stream-optimized VMDK is too small to have a footer")
+	}
+
+	buf := make([]byte, vmdk.SectorSize)
+	err := sio.iio.readSrcAt(buf, offset)
+	if err != nil {
+		return err
+	}
+
+	footer := new(vmdk.Header)
+	err = binary.Read(bytes.NewReader(buf), binary.LittleEndian, footer)
+	if err != nil {
+		return err
+	}
+
+	if footer.MagicNumber != vmdk.Magic {
+		return errors.New("stream-optimized VMDK footer not found")
+	}
+
+	sio.footer = footer
+
+	return nil
+
+}
+
+func (sio *vmdkStreamOptimizedIO) readGrainTables() error {
+
+	grainSize := int64(sio.footer.GrainSize) * vmdk.SectorSize
+	totalGrains := (int64(sio.footer.Capacity)*vmdk.SectorSize + grainSize - 1) / grainSize
+	tables := (totalGrains + vmdk.TableMaxRows - 1) / vmdk.TableMaxRows
+
+	gdes := make([]uint32, tables)
+	buf := make([]byte, 4*tables)
+	err := sio.iio.readSrcAt(buf, int64(sio.footer.GDOffset)*vmdk.SectorSize)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Read(bytes.NewReader(buf), binary.LittleEndian, gdes)
+	if err != nil {
+		return err
+	}
+
+	sio.grains = make([]uint32, 0, tables*vmdk.TableMaxRows)
+	gtes := make([]uint32, vmdk.TableMaxRows)
+	buf = make([]byte, vmdk.TableMaxRows*vmdk.TableRowSize)
+
+	for _, gde := range gdes {
+
+		if gde == 0 {
+			// no grains in this table were written
+			for i := range gtes {
+				gtes[i] = 0
+			}
+		} else {
+			err = sio.iio.readSrcAt(buf, int64(gde)*vmdk.SectorSize)
+			if err != nil {
+				return err
+			}
+
+			err = binary.Read(bytes.NewReader(buf), binary.LittleEndian, gtes)
+			if err != nil {
+				return err
+			}
+		}
+
+		sio.grains = append(sio.grains, gtes...)
+
+	}
+
+	sio.grains = sio.grains[:totalGrains]
+
+	return nil
+
+}
+
+func (sio *vmdkStreamOptimizedIO) loadGrain(grain int64) ([]byte, error) {
+
+	if grain >= int64(len(sio.grains)) {
+		return nil, errors.New("grain out of bounds")
+	}
+
+	offset := sio.grains[grain]
+	if offset == 0 {
+		return nil, nil
+	}
+
+	// grain marker: LBA (uint64) followed by compressed size (uint32)
+	marker := make([]byte, 12)
+	err := sio.iio.readSrcAt(marker, int64(offset)*vmdk.SectorSize)
+	if err != nil {
+		return nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(marker[8:])
+	compressed := make([]byte, size)
+	_, err = io.ReadFull(sio.iio.src, compressed)
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress VMDK grain %d: %w", grain, err)
+	}
+	defer zr.Close()
+
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress VMDK grain %d: %w", grain, err)
+	}
+
+	return data, nil
+
+}
+
+func (iio *IO) vmdkStreamOptimizedIO() (*partialIO, error) {
+
+	sio := new(vmdkStreamOptimizedIO)
+	sio.iio = iio
+
+	err := sio.readFooter()
+	if err != nil {
+		return nil, err
+	}
+
+	err = sio.readGrainTables()
+	if err != nil {
+		return nil, err
+	}
+
+	size := int64(sio.footer.Capacity) * vmdk.SectorSize
+	grainSize := int64(sio.footer.GrainSize) * vmdk.SectorSize
+
+	return iio.chunkedPartialIO(newChunkedIO(size, grainSize, sio.loadGrain)), nil
+
+}
@@ -7,9 +7,13 @@ package vdecompiler
 
 import (
 	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 
+	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vimg"
 	"github.com/vorteil/vorteil/pkg/vmdk"
@@ -126,3 +130,205 @@ func (iio *IO) KernelFile(name string) (io.Reader, error) {
 	return r, nil
 
 }
+
+func (iio *IO) bootloaderConfigOffset() (int64, error) {
+
+	partitions, err := iio.GPTEntries()
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(partitions[0].FirstLBA * vmdk.SectorSize), nil
+
+}
+
+// BootloaderConfig returns the bootloader config at the start of the os
+// partition, which records where the VCFG is stored.
+func (iio *IO) BootloaderConfig() (*vimg.BootloaderConfig, error) {
+
+	offset, err := iio.bootloaderConfigOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = iio.img.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := new(vimg.BootloaderConfig)
+	err = binary.Read(iio.img, binary.LittleEndian, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+
+}
+
+func (iio *IO) readVCFG() (*vcfg.VCFG, error) {
+
+	conf, err := iio.BootloaderConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.ConfigLen > conf.ConfigCapacity {
+		return nil, fmt.Errorf("bootloader config claims a %d byte VCFG in %d bytes of space", conf.ConfigLen, conf.ConfigCapacity)
+	}
+
+	offset, err := iio.bootloaderConfigOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = iio.img.Seek(offset+int64(conf.ConfigOffset), io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, conf.ConfigLen)
+	_, err = io.ReadFull(iio.img, data)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := new(vcfg.VCFG)
+	err = json.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the image's VCFG: %w", err)
+	}
+
+	return cfg, nil
+
+}
+
+// VCFG returns the configuration stored in the os partition, which is the
+// VCFG the image was built with after defaults were applied.
+func (iio *IO) VCFG() (*vcfg.VCFG, error) {
+
+	if iio.vpart.vcfg != nil {
+		return iio.vpart.vcfg, nil
+	}
+
+	cfg, err := iio.readVCFG()
+	if err != nil {
+		return nil, err
+	}
+
+	iio.vpart.vcfg = cfg
+
+	return iio.vpart.vcfg, nil
+
+}
+
+func normalizeFilesystem(fs vcfg.Filesystem) vcfg.Filesystem {
+	if fs == "" || fs == "ext" {
+		return vcfg.Ext2FS
+	}
+	return fs
+}
+
+// checkVCFGCompatible returns an error if the config in kc can't be used
+// without rebuilding the image, because it depends on things that were fixed
+// when the image was built.
+func checkVCFGCompatible(old, cfg *vcfg.VCFG, kc *vimg.KernelConfig) error {
+
+	if old.VM.Kernel != cfg.VM.Kernel {
+		return fmt.Errorf("changing vm.kernel from '%s' to '%s' requires rebuilding the image", old.VM.Kernel, cfg.VM.Kernel)
+	}
+
+	if normalizeFilesystem(old.System.Filesystem) != normalizeFilesystem(cfg.System.Filesystem) {
+		return fmt.Errorf("changing system.filesystem from '%s' to '%s' requires rebuilding the image", old.System.Filesystem, cfg.System.Filesystem)
+	}
+
+	tags := make(map[string]bool)
+	for _, tag := range vimg.KernelTags(old) {
+		tags[tag] = true
+	}
+
+	for _, tag := range kc.KernelTags {
+		if !tags[tag] {
+			return fmt.Errorf("the new configuration needs the '%s' kernel feature, which requires rebuilding the image", tag)
+		}
+	}
+
+	return nil
+
+}
+
+// ReplaceVCFG rewrites the configuration stored in the os partition, so that
+// an image can be reconfigured without being rebuilt. The new config is given
+// defaults and validated the same way the image builder does, and must fit
+// within the space the builder reserved for it. Settings that were fixed when
+// the image was built, like the kernel and the file-system, can't be changed.
+func (iio *IO) ReplaceVCFG(cfg *vcfg.VCFG, logger elog.View) error {
+
+	err := iio.checkWritable()
+	if err != nil {
+		return err
+	}
+
+	old, err := iio.readVCFG()
+	if err != nil {
+		return err
+	}
+
+	conf, err := iio.BootloaderConfig()
+	if err != nil {
+		return err
+	}
+
+	kc, err := vimg.GenerateKernelConfig(cfg, logger)
+	if err != nil {
+		return err
+	}
+
+	err = checkVCFGCompatible(old, cfg, kc)
+	if err != nil {
+		return err
+	}
+
+	if uint64(len(kc.Data)) > conf.ConfigCapacity {
+		return fmt.Errorf("the new configuration needs %d bytes but the image only has room for %d", len(kc.Data), conf.ConfigCapacity)
+	}
+
+	if len(kc.LinuxArgs) > len(conf.LinuxArgs) {
+		return fmt.Errorf("the new kernel arguments need %d bytes but the image only has room for %d", len(kc.LinuxArgs), len(conf.LinuxArgs))
+	}
+
+	offset, err := iio.bootloaderConfigOffset()
+	if err != nil {
+		return err
+	}
+
+	// overwrite whatever is left of a longer old config with zeroes
+	data := kc.Data
+	if uint64(len(data)) < conf.ConfigLen {
+		data = make([]byte, conf.ConfigLen)
+		copy(data, kc.Data)
+	}
+
+	err = iio.writeImageAt(data, offset+int64(conf.ConfigOffset))
+	if err != nil {
+		return err
+	}
+
+	conf.ConfigLen = uint64(len(kc.Data))
+	conf.LinuxArgsLen = uint16(len(kc.LinuxArgs))
+	conf.LinuxArgs = [len(conf.LinuxArgs)]byte{}
+	copy(conf.LinuxArgs[:], kc.LinuxArgs)
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, conf)
+
+	err = iio.writeImageAt(buf.Bytes(), offset)
+	if err != nil {
+		return err
+	}
+
+	iio.vpart.vcfg = cfg
+
+	return nil
+
+}
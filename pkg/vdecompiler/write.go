@@ -0,0 +1,1284 @@
+package vdecompiler
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/ext4"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vimg"
+)
+
+// Directory entry file types, as used by file-systems with the filetype
+// feature.
+const (
+	direntTypeRegularFile = 0x1
+	direntTypeDirectory   = 0x2
+)
+
+const (
+	direntHeaderSize      = 8
+	direntMaxNameLength   = 255
+	firstNonReservedInode = 11
+	inodeFlagIndex        = 0x1000
+	inodeFlagExtents      = 0x80000
+)
+
+// Feature flags that don't prevent a file-system from being modified in-place.
+const (
+	writableIncompatFeatures = ext4.IncompatFiletype
+	writableROCompatFeatures = ext4.ROCompatSparseSuper | ext4.ROCompatLargeFile
+)
+
+// ErrNoSpace is returned when there aren't enough free blocks or inodes on the
+// file-system to complete a modification.
+var ErrNoSpace = errors.New("no space left on file-system")
+
+func (iio *IO) checkWritable() error {
+
+	if !iio.writable {
+		return fmt.Errorf("%s was not opened for writing: %w", iio.src.name, ErrWrite)
+	}
+
+	format, err := iio.ImageFormat()
+	if err != nil {
+		return err
+	}
+
+	if format != vdisk.RAWFormat && format != vdisk.VMDKSparseFormat {
+		return fmt.Errorf("modifying %s images is not supported", format)
+	}
+
+	return nil
+
+}
+
+func (iio *IO) checkWritableFS() error {
+
+	err := iio.checkWritable()
+	if err != nil {
+		return err
+	}
+
+	fstype, err := iio.FilesystemType()
+	if err != nil {
+		return err
+	}
+
+	sb := iio.fs.extended
+	if fstype != "ext2" || (sb.VersionMajor > 0 && (sb.IncompatibleFeatures&^writableIncompatFeatures != 0 ||
+		sb.ReadOnlyFeatures&^writableROCompatFeatures != 0)) {
+		return fmt.Errorf("modifying %s file-systems with these features is not supported", fstype)
+	}
+
+	return nil
+
+}
+
+func (iio *IO) blockSize() int {
+	return 1024 << iio.fs.superblock.BlockSize
+}
+
+func (iio *IO) firstInode() int {
+	if iio.fs.extended.VersionMajor == 0 {
+		return firstNonReservedInode
+	}
+	return int(iio.fs.extended.FirstInode)
+}
+
+func (iio *IO) writeImageAt(data []byte, offset int64) error {
+
+	_, err := iio.img.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = iio.img.Write(data)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+func (iio *IO) writeBlock(blockNo int, data []byte) error {
+
+	lba, err := iio.BlockToLBA(blockNo)
+	if err != nil {
+		return err
+	}
+
+	return iio.writeImageAt(data, int64(lba*vimg.SectorSize))
+
+}
+
+func (iio *IO) writeInode(ino int, inode *ext.Inode) error {
+
+	offset, err := iio.inodeOffset(ino)
+	if err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, inode)
+
+	return iio.writeImageAt(buf.Bytes(), offset)
+
+}
+
+// initInode clears the entire on-disk inode, including anything beyond the
+// fields in ext.Inode, before writing inode to it.
+func (iio *IO) initInode(ino int, inode *ext.Inode) error {
+
+	offset, err := iio.inodeOffset(ino)
+	if err != nil {
+		return err
+	}
+
+	err = iio.writeImageAt(make([]byte, iio.inodeSize()), offset)
+	if err != nil {
+		return err
+	}
+
+	return iio.writeInode(ino, inode)
+
+}
+
+func (iio *IO) hasSuperblockBackup(group int) bool {
+
+	if group <= 1 || iio.fs.extended.VersionMajor == 0 ||
+		iio.fs.extended.ReadOnlyFeatures&ext4.ROCompatSparseSuper == 0 {
+		return true
+	}
+
+	for _, base := range []int{3, 5, 7} {
+		x := base
+		for x < group {
+			x *= base
+		}
+		if x == group {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// flushFSMetadata writes the cached superblock and block group descriptor
+// table over every copy of them on the file-system, so that the free block and
+// inode counts stay consistent after a modification.
+func (iio *IO) flushFSMetadata() error {
+
+	sb, bgdt, err := iio.superblockAndBGDT()
+	if err != nil {
+		return err
+	}
+
+	sb.LastWrittenTime = uint32(time.Now().Unix())
+
+	for g := 0; g < len(bgdt); g++ {
+
+		if !iio.hasSuperblockBackup(g) {
+			continue
+		}
+
+		// backups keep their own values for everything but the counts
+		backup := sb
+		if g > 0 {
+			backup, err = iio.readSuperblock(g)
+			if err != nil {
+				return err
+			}
+			backup.UnallocatedBlocks = sb.UnallocatedBlocks
+			backup.UnallocatedInodes = sb.UnallocatedInodes
+			backup.LastWrittenTime = sb.LastWrittenTime
+		}
+
+		offset, err := iio.superblockOffset(g)
+		if err != nil {
+			return err
+		}
+
+		buf := new(bytes.Buffer)
+		_ = binary.Write(buf, binary.LittleEndian, backup)
+		err = iio.writeImageAt(buf.Bytes(), offset)
+		if err != nil {
+			return err
+		}
+
+		buf.Reset()
+		for _, bgdte := range bgdt {
+			_ = binary.Write(buf, binary.LittleEndian, bgdte)
+			_, _ = buf.Write(make([]byte, iio.descriptorSize()-ext.BlockGroupDescriptorSize))
+		}
+
+		block := 1
+		if sb.BlockSize == 0 {
+			block++
+		}
+		block += int(sb.BlocksPerGroup) * g
+
+		err = iio.writeBlock(block, buf.Bytes())
+		if err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
+
+// allocateBlocks claims n free blocks in the block bitmaps and returns their
+// addresses in ascending order. Nothing is claimed unless all n blocks can be.
+func (iio *IO) allocateBlocks(n int) ([]uint32, error) {
+
+	sb, bgdt, err := iio.superblockAndBGDT()
+	if err != nil {
+		return nil, err
+	}
+
+	if n == 0 {
+		return nil, nil
+	}
+
+	if int(sb.UnallocatedBlocks) < n {
+		return nil, ErrNoSpace
+	}
+
+	var addrs []uint32
+	bitmaps := make(map[int][]byte)
+	claimed := make(map[int]int)
+
+	for g, bgdte := range bgdt {
+
+		if len(addrs) == n {
+			break
+		}
+
+		if bgdte.UnallocatedBlocks == 0 {
+			continue
+		}
+
+		bitmap, err := iio.loadBlock(int(bgdte.BlockBitmapBlockAddr))
+		if err != nil {
+			return nil, err
+		}
+
+		first := int(sb.SuperblockNumber) + g*int(sb.BlocksPerGroup)
+		for i := 0; i < int(sb.BlocksPerGroup) && first+i < int(sb.TotalBlocks) && len(addrs) < n; i++ {
+			if bitmap[i/8]&(1<<(i%8)) != 0 {
+				continue
+			}
+			bitmap[i/8] |= 1 << (i % 8)
+			addrs = append(addrs, uint32(first+i))
+			bitmaps[g] = bitmap
+			claimed[g]++
+		}
+
+	}
+
+	if len(addrs) < n {
+		return nil, ErrNoSpace
+	}
+
+	for g, bitmap := range bitmaps {
+
+		err = iio.writeBlock(int(bgdt[g].BlockBitmapBlockAddr), bitmap)
+		if err != nil {
+			return nil, err
+		}
+
+		bgdt[g].UnallocatedBlocks -= uint16(claimed[g])
+		sb.UnallocatedBlocks -= uint32(claimed[g])
+
+	}
+
+	return addrs, nil
+
+}
+
+// freeBlocks releases blocks in the block bitmaps. Zero addresses are ignored,
+// so that the block lists of sparse files can be passed in directly.
+func (iio *IO) freeBlocks(addrs []uint32) error {
+
+	sb, bgdt, err := iio.superblockAndBGDT()
+	if err != nil {
+		return err
+	}
+
+	bitmaps := make(map[int][]byte)
+	for _, addr := range addrs {
+
+		if addr == 0 {
+			continue
+		}
+
+		if addr < sb.SuperblockNumber || addr >= sb.TotalBlocks {
+			return fmt.Errorf("block out of bounds: %d", addr)
+		}
+
+		g := int(addr-sb.SuperblockNumber) / int(sb.BlocksPerGroup)
+		i := int(addr-sb.SuperblockNumber) % int(sb.BlocksPerGroup)
+
+		bitmap, ok := bitmaps[g]
+		if !ok {
+			bitmap, err = iio.loadBlock(int(bgdt[g].BlockBitmapBlockAddr))
+			if err != nil {
+				return err
+			}
+			bitmaps[g] = bitmap
+		}
+
+		if bitmap[i/8]&(1<<(i%8)) == 0 {
+			return fmt.Errorf("block already free: %d", addr)
+		}
+
+		bitmap[i/8] &^= 1 << (i % 8)
+		bgdt[g].UnallocatedBlocks++
+		sb.UnallocatedBlocks++
+
+	}
+
+	for g, bitmap := range bitmaps {
+		err = iio.writeBlock(int(bgdt[g].BlockBitmapBlockAddr), bitmap)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// allocateInode claims a free inode in the inode bitmaps and returns its
+// number.
+func (iio *IO) allocateInode(dir bool) (int, error) {
+
+	sb, bgdt, err := iio.superblockAndBGDT()
+	if err != nil {
+		return 0, err
+	}
+
+	if sb.UnallocatedInodes == 0 {
+		return 0, ErrNoSpace
+	}
+
+	for g, bgdte := range bgdt {
+
+		if bgdte.UnallocatedInodes == 0 {
+			continue
+		}
+
+		bitmap, err := iio.loadBlock(int(bgdte.InodeBitmapBlockAddr))
+		if err != nil {
+			return 0, err
+		}
+
+		for i := 0; i < int(sb.InodesPerGroup); i++ {
+
+			ino := g*int(sb.InodesPerGroup) + i + 1
+			if ino < iio.firstInode() || bitmap[i/8]&(1<<(i%8)) != 0 {
+				continue
+			}
+
+			bitmap[i/8] |= 1 << (i % 8)
+			err = iio.writeBlock(int(bgdte.InodeBitmapBlockAddr), bitmap)
+			if err != nil {
+				return 0, err
+			}
+
+			bgdte.UnallocatedInodes--
+			sb.UnallocatedInodes--
+			if dir {
+				bgdte.Directories++
+			}
+
+			return ino, nil
+
+		}
+
+	}
+
+	return 0, ErrNoSpace
+
+}
+
+// freeInode releases an inode in the inode bitmaps.
+func (iio *IO) freeInode(ino int, dir bool) error {
+
+	sb, bgdt, err := iio.superblockAndBGDT()
+	if err != nil {
+		return err
+	}
+
+	g := (ino - 1) / int(sb.InodesPerGroup)
+	i := (ino - 1) % int(sb.InodesPerGroup)
+
+	bitmap, err := iio.loadBlock(int(bgdt[g].InodeBitmapBlockAddr))
+	if err != nil {
+		return err
+	}
+
+	if bitmap[i/8]&(1<<(i%8)) == 0 {
+		return fmt.Errorf("inode already free: %d", ino)
+	}
+
+	bitmap[i/8] &^= 1 << (i % 8)
+	err = iio.writeBlock(int(bgdt[g].InodeBitmapBlockAddr), bitmap)
+	if err != nil {
+		return err
+	}
+
+	bgdt[g].UnallocatedInodes++
+	sb.UnallocatedInodes++
+	if dir {
+		bgdt[g].Directories--
+	}
+
+	return nil
+
+}
+
+func (iio *IO) walkBlockPointers(addr uint32, depth int, data, indirect []uint32) ([]uint32, []uint32, error) {
+
+	if addr == 0 {
+		return data, indirect, nil
+	}
+
+	if depth < 0 {
+		return append(data, addr), indirect, nil
+	}
+
+	indirect = append(indirect, addr)
+
+	block, err := iio.loadBlock(int(addr))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pointers := make([]uint32, len(block)/4)
+	_ = binary.Read(bytes.NewReader(block), binary.LittleEndian, pointers)
+
+	for _, ptr := range pointers {
+		data, indirect, err = iio.walkBlockPointers(ptr, depth-1, data, indirect)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return data, indirect, nil
+
+}
+
+// inodeBlocks returns the addresses of the data blocks mapped by an inode in
+// order, skipping holes, and the addresses of the indirect blocks that map
+// them.
+func (iio *IO) inodeBlocks(inode *ext.Inode) (data, indirect []uint32, err error) {
+
+	if InodeIsSymlink(inode) && inode.Sectors == 0 {
+		return nil, nil, nil
+	}
+
+	if inode.Flags&inodeFlagExtents != 0 {
+		return nil, nil, errors.New("modifying inodes that use extents is not supported")
+	}
+
+	for _, ptr := range inode.DirectPointer {
+		data, indirect, err = iio.walkBlockPointers(ptr, -1, data, indirect)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for depth, ptr := range []uint32{inode.SinglyIndirect, inode.DoublyIndirect, inode.TriplyIndirect} {
+		data, indirect, err = iio.walkBlockPointers(ptr, depth, data, indirect)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return data, indirect, nil
+
+}
+
+// pointerBlocks returns the number of indirect blocks needed to map n data
+// blocks.
+func (iio *IO) pointerBlocks(n int) (int, error) {
+
+	ppb := iio.blockSize() / 4
+	n -= len(ext.Inode{}.DirectPointer)
+
+	blocks := 0
+	span := 1
+	for depth := 0; depth < 3 && n > 0; depth++ {
+
+		span *= ppb
+		m := n
+		if m > span {
+			m = span
+		}
+		n -= m
+
+		// each level of the tree needs a block per ppb pointers below it
+		for level := 0; level <= depth; level++ {
+			m = (m + ppb - 1) / ppb
+			blocks += m
+		}
+
+	}
+
+	if n > 0 {
+		return 0, errors.New("file too large for file-system")
+	}
+
+	return blocks, nil
+
+}
+
+// allocateMappedBlocks claims n data blocks along with the indirect blocks
+// needed to map them.
+func (iio *IO) allocateMappedBlocks(n int) (data, indirect []uint32, err error) {
+
+	p, err := iio.pointerBlocks(n)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	addrs, err := iio.allocateBlocks(n + p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return addrs[:n], addrs[n:], nil
+
+}
+
+func (iio *IO) writePointerBlock(data []uint32, depth int, indirect *[]uint32) (uint32, []uint32, error) {
+
+	if len(data) == 0 {
+		return 0, data, nil
+	}
+
+	if len(*indirect) == 0 {
+		return 0, nil, errors.New("not enough indirect blocks to map file")
+	}
+	addr := (*indirect)[0]
+	*indirect = (*indirect)[1:]
+
+	var err error
+	pointers := make([]uint32, iio.blockSize()/4)
+	for i := 0; i < len(pointers) && len(data) > 0; i++ {
+		if depth == 0 {
+			pointers[i] = data[0]
+			data = data[1:]
+			continue
+		}
+		pointers[i], data, err = iio.writePointerBlock(data, depth-1, indirect)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, pointers)
+
+	err = iio.writeBlock(int(addr), buf.Bytes())
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return addr, data, nil
+
+}
+
+// mapInodeBlocks points an inode at a list of data blocks, using the already
+// allocated indirect blocks to do so, as counted by pointerBlocks. Any indirect
+// blocks the inode used before are left for the caller to free.
+func (iio *IO) mapInodeBlocks(inode *ext.Inode, data, indirect []uint32) error {
+
+	blocks := len(data) + len(indirect)
+
+	inode.DirectPointer = [12]uint32{}
+	inode.SinglyIndirect = 0
+	inode.DoublyIndirect = 0
+	inode.TriplyIndirect = 0
+
+	n := copy(inode.DirectPointer[:], data)
+	data = data[n:]
+
+	var err error
+	for depth, ptr := range []*uint32{&inode.SinglyIndirect, &inode.DoublyIndirect, &inode.TriplyIndirect} {
+		*ptr, data, err = iio.writePointerBlock(data, depth, &indirect)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(data) > 0 {
+		return errors.New("file too large for file-system")
+	}
+
+	if inode.FileACL != 0 {
+		blocks++
+	}
+
+	inode.Sectors = uint32(blocks * iio.blockSize() / ext.SectorSize)
+
+	return nil
+
+}
+
+// freeInodeBlocks releases all of the blocks used to store an inode's data.
+func (iio *IO) freeInodeBlocks(inode *ext.Inode) error {
+
+	data, indirect, err := iio.inodeBlocks(inode)
+	if err != nil {
+		return err
+	}
+
+	err = iio.freeBlocks(append(data, indirect...))
+	if err != nil {
+		return err
+	}
+
+	return iio.mapInodeBlocks(inode, nil, nil)
+
+}
+
+// freeXattrBlock drops an inode's reference to its extended attribute block,
+// freeing the block if nothing else refers to it.
+func (iio *IO) freeXattrBlock(inode *ext.Inode) error {
+
+	if inode.FileACL == 0 {
+		return nil
+	}
+
+	block, err := iio.loadBlock(int(inode.FileACL))
+	if err != nil {
+		return err
+	}
+
+	hdr := new(ext.XattrHeader)
+	_ = binary.Read(bytes.NewReader(block), binary.LittleEndian, hdr)
+
+	if hdr.Magic == ext.XattrMagic && hdr.RefCount > 1 {
+		hdr.RefCount--
+		buf := new(bytes.Buffer)
+		_ = binary.Write(buf, binary.LittleEndian, hdr)
+		copy(block, buf.Bytes())
+		err = iio.writeBlock(int(inode.FileACL), block)
+	} else {
+		err = iio.freeBlocks([]uint32{inode.FileACL})
+	}
+	if err != nil {
+		return err
+	}
+
+	inode.FileACL = 0
+	inode.Sectors -= uint32(iio.blockSize() / ext.SectorSize)
+
+	return nil
+
+}
+
+// writeInodeData allocates blocks for size bytes read from r and points
+// inode at them. The blocks the inode used before are left for the caller to
+// free once the inode has been written, and the new blocks are freed again if
+// anything goes wrong.
+func (iio *IO) writeInodeData(inode *ext.Inode, r io.Reader, size int64) error {
+
+	bs := int64(iio.blockSize())
+
+	addrs, indirect, err := iio.allocateMappedBlocks(int((size + bs - 1) / bs))
+	if err != nil {
+		return err
+	}
+
+	err = iio.writeInodeBlocks(inode, r, size, addrs, indirect)
+	if err != nil {
+		_ = iio.freeBlocks(append(addrs, indirect...))
+		return err
+	}
+
+	return nil
+
+}
+
+// writeInodeBlocks fills already allocated blocks with size bytes read from r
+// and points inode at them.
+func (iio *IO) writeInodeBlocks(inode *ext.Inode, r io.Reader, size int64, addrs, indirect []uint32) error {
+
+	bs := int64(iio.blockSize())
+
+	buf := make([]byte, bs)
+	for i, addr := range addrs {
+
+		l := bs
+		if remaining := size - int64(i)*bs; remaining < bs {
+			l = remaining
+			for j := range buf[l:] {
+				buf[l+int64(j)] = 0
+			}
+		}
+
+		_, err := io.ReadFull(r, buf[:l])
+		if err != nil {
+			return err
+		}
+
+		err = iio.writeBlock(int(addr), buf)
+		if err != nil {
+			return err
+		}
+
+	}
+
+	err := iio.mapInodeBlocks(inode, addrs, indirect)
+	if err != nil {
+		return err
+	}
+
+	inode.SizeLower = uint32(size)
+	inode.SizeUpper = uint32(size >> 32)
+
+	return nil
+
+}
+
+func direntLength(nameLen int) int {
+	return (direntHeaderSize + nameLen + 3) &^ 3
+}
+
+func readDirent(block []byte, offset int) (*Dirent, error) {
+
+	dirent := new(Dirent)
+	if offset+direntHeaderSize > len(block) {
+		return nil, errors.New("corrupt directory entry")
+	}
+
+	_ = binary.Read(bytes.NewReader(block[offset:]), binary.LittleEndian, dirent)
+	if dirent.Size < direntHeaderSize || offset+int(dirent.Size) > len(block) ||
+		direntHeaderSize+int(dirent.NameLen) > int(dirent.Size) {
+		return nil, errors.New("corrupt directory entry")
+	}
+
+	return dirent, nil
+
+}
+
+func putDirent(block []byte, offset int, dirent *Dirent, name string) {
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, dirent)
+	_, _ = buf.WriteString(name)
+
+	copy(block[offset:], buf.Bytes())
+
+}
+
+// addDirectoryEntry links ino into the directory dir under name, extending
+// the directory by a block if none of its existing blocks have room for the
+// new entry. The directory's inode is written back to the disk.
+func (iio *IO) addDirectoryEntry(dirIno int, dir *ext.Inode, name string, ino int, ftype uint8) error {
+
+	data, indirect, err := iio.inodeBlocks(dir)
+	if err != nil {
+		return err
+	}
+
+	entry := &Dirent{
+		Inode:   uint32(ino),
+		NameLen: uint8(len(name)),
+		Type:    ftype,
+	}
+	needed := direntLength(len(name))
+
+	added := false
+	for _, addr := range data {
+
+		block, err := iio.loadBlock(int(addr))
+		if err != nil {
+			return err
+		}
+
+		for offset := 0; offset < len(block) && !added; {
+
+			dirent, err := readDirent(block, offset)
+			if err != nil {
+				return err
+			}
+
+			used := 0
+			if dirent.Inode != 0 {
+				used = direntLength(int(dirent.NameLen))
+			}
+
+			if int(dirent.Size)-used < needed {
+				offset += int(dirent.Size)
+				continue
+			}
+
+			entry.Size = dirent.Size - uint16(used)
+			if used > 0 {
+				dirent.Size = uint16(used)
+				binary.LittleEndian.PutUint16(block[offset+4:], dirent.Size)
+			}
+			putDirent(block, offset+used, entry, name)
+			added = true
+
+		}
+
+		if added {
+			err = iio.writeBlock(int(addr), block)
+			if err != nil {
+				return err
+			}
+			break
+		}
+
+	}
+
+	// the directory's old indirect blocks are only freed once it has been
+	// written pointing at its new ones
+	var old []uint32
+
+	if !added {
+
+		p, err := iio.pointerBlocks(len(data) + 1)
+		if err != nil {
+			return err
+		}
+
+		addrs, err := iio.allocateBlocks(1 + p)
+		if err != nil {
+			return err
+		}
+
+		block := make([]byte, iio.blockSize())
+		entry.Size = uint16(len(block))
+		putDirent(block, 0, entry, name)
+
+		err = iio.writeBlock(int(addrs[0]), block)
+		if err == nil {
+			err = iio.mapInodeBlocks(dir, append(data, addrs[0]), addrs[1:])
+		}
+		if err != nil {
+			_ = iio.freeBlocks(addrs)
+			return err
+		}
+
+		dir.SizeLower += uint32(len(block))
+		old = indirect
+
+	}
+
+	// hashed indexes aren't maintained, so fall back to a linear directory
+	dir.Flags &^= inodeFlagIndex
+	dir.ModificationTime = uint32(time.Now().Unix())
+
+	err = iio.writeInode(dirIno, dir)
+	if err != nil {
+		return err
+	}
+
+	return iio.freeBlocks(old)
+
+}
+
+// removeDirectoryEntry unlinks name from the directory dir, merging the space
+// it used into the previous entry. The directory's inode is written back to
+// the disk.
+func (iio *IO) removeDirectoryEntry(dirIno int, dir *ext.Inode, name string) error {
+
+	data, _, err := iio.inodeBlocks(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range data {
+
+		block, err := iio.loadBlock(int(addr))
+		if err != nil {
+			return err
+		}
+
+		prev := -1
+		for offset := 0; offset < len(block); {
+
+			dirent, err := readDirent(block, offset)
+			if err != nil {
+				return err
+			}
+
+			if dirent.Inode == 0 || string(block[offset+direntHeaderSize:offset+direntHeaderSize+int(dirent.NameLen)]) != name {
+				prev = offset
+				offset += int(dirent.Size)
+				continue
+			}
+
+			if prev < 0 {
+				binary.LittleEndian.PutUint32(block[offset:], 0)
+			} else {
+				size := binary.LittleEndian.Uint16(block[prev+4:])
+				binary.LittleEndian.PutUint16(block[prev+4:], size+dirent.Size)
+			}
+
+			err = iio.writeBlock(int(addr), block)
+			if err != nil {
+				return err
+			}
+
+			dir.Flags &^= inodeFlagIndex
+			dir.ModificationTime = uint32(time.Now().Unix())
+
+			return iio.writeInode(dirIno, dir)
+
+		}
+
+	}
+
+	return fmt.Errorf("file not found: %s", name)
+
+}
+
+// resolveParent finds the directory that should contain the file at path,
+// returning its inode number and inode along with the file's name.
+func (iio *IO) resolveParent(fpath string) (int, *ext.Inode, string, error) {
+
+	fpath = path.Join("/", fpath)
+	dir, base := path.Split(fpath)
+	if base == "" {
+		return 0, nil, "", errors.New("cannot modify the root directory")
+	}
+
+	if len(base) > direntMaxNameLength {
+		return 0, nil, "", fmt.Errorf("file name too long: %s", base)
+	}
+
+	ino, err := iio.ResolvePathToInodeNo(dir)
+	if err != nil {
+		return 0, nil, "", err
+	}
+
+	inode, err := iio.ResolveInode(ino)
+	if err != nil {
+		return 0, nil, "", err
+	}
+
+	if !InodeIsDirectory(inode) {
+		return 0, nil, "", fmt.Errorf("not a directory: %s", dir)
+	}
+
+	return ino, inode, base, nil
+
+}
+
+func (iio *IO) lookupChild(dir *ext.Inode, name string) (int, error) {
+
+	list, err := iio.Readdir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, entry := range list {
+		if entry.Name == name {
+			return entry.Inode, nil
+		}
+	}
+
+	return 0, nil
+
+}
+
+func inodePermissions(mode os.FileMode) uint16 {
+
+	perms := uint16(mode & os.ModePerm)
+	if mode&os.ModeSetuid != 0 {
+		perms |= ext.InodeSetUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		perms |= ext.InodeSetGID
+	}
+	if mode&os.ModeSticky != 0 {
+		perms |= ext.InodeSticky
+	}
+
+	return perms
+
+}
+
+func newInode(ftype, perms uint16) *ext.Inode {
+
+	now := uint32(time.Now().Unix())
+
+	inode := &ext.Inode{
+		Permissions:      ftype | perms,
+		UID:              ext.SuperUID,
+		GID:              ext.SuperGID,
+		LastAccessTime:   now,
+		CreationTime:     now,
+		ModificationTime: now,
+		Links:            1,
+	}
+
+	return inode
+
+}
+
+func (iio *IO) writeFile(fpath string, r io.Reader, size int64, mode os.FileMode) error {
+
+	dirIno, dir, name, err := iio.resolveParent(fpath)
+	if err != nil {
+		return err
+	}
+
+	ino, err := iio.lookupChild(dir, name)
+	if err != nil {
+		return err
+	}
+
+	if ino != 0 {
+
+		inode, err := iio.ResolveInode(ino)
+		if err != nil {
+			return err
+		}
+
+		if !InodeIsRegularFile(inode) || InodeIsSymlink(inode) {
+			return fmt.Errorf("not a regular file: %s", fpath)
+		}
+
+		// the new contents are written to new blocks before the old ones
+		// are freed, so a failure leaves the file as it was
+		data, indirect, err := iio.inodeBlocks(inode)
+		if err != nil {
+			return err
+		}
+
+		err = iio.writeInodeData(inode, r, size)
+		if err != nil {
+			return err
+		}
+
+		inode.ModificationTime = uint32(time.Now().Unix())
+
+		err = iio.writeInode(ino, inode)
+		if err != nil {
+			return err
+		}
+
+		return iio.freeBlocks(append(data, indirect...))
+
+	}
+
+	ino, err = iio.allocateInode(false)
+	if err != nil {
+		return err
+	}
+
+	inode := newInode(ext.InodeTypeRegularFile, inodePermissions(mode))
+	err = iio.writeInodeData(inode, r, size)
+	if err != nil {
+		_ = iio.freeInode(ino, false)
+		return err
+	}
+
+	err = iio.initInode(ino, inode)
+	if err != nil {
+		return err
+	}
+
+	return iio.addDirectoryEntry(dirIno, dir, name, ino, direntTypeRegularFile)
+
+}
+
+// WriteFile writes size bytes from r to the file at path on the root
+// file-system, replacing its contents if it already exists. Replaced files
+// keep their existing permissions and ownership. New files are given the
+// permission bits in mode and belong to the default user.
+func (iio *IO) WriteFile(path string, r io.Reader, size int64, mode os.FileMode) error {
+
+	err := iio.checkWritableFS()
+	if err != nil {
+		return err
+	}
+
+	err = iio.writeFile(path, r, size, mode)
+	if err != nil {
+		return err
+	}
+
+	return iio.flushFSMetadata()
+
+}
+
+func (iio *IO) mkdir(fpath string, mode os.FileMode) error {
+
+	parentIno, parent, name, err := iio.resolveParent(fpath)
+	if err != nil {
+		return err
+	}
+
+	ino, err := iio.lookupChild(parent, name)
+	if err != nil {
+		return err
+	}
+
+	if ino != 0 {
+		return fmt.Errorf("file exists: %s", fpath)
+	}
+
+	ino, err = iio.allocateInode(true)
+	if err != nil {
+		return err
+	}
+
+	// a new directory contains only the "." and ".." entries
+	block := make([]byte, iio.blockSize())
+	dot := direntLength(1)
+	putDirent(block, 0, &Dirent{Inode: uint32(ino), Size: uint16(dot), NameLen: 1, Type: direntTypeDirectory}, ".")
+	putDirent(block, dot, &Dirent{Inode: uint32(parentIno), Size: uint16(len(block) - dot), NameLen: 2, Type: direntTypeDirectory}, "..")
+
+	inode := newInode(ext.InodeTypeDirectory, inodePermissions(mode))
+	inode.Links = 2
+	err = iio.writeInodeData(inode, bytes.NewReader(block), int64(len(block)))
+	if err != nil {
+		_ = iio.freeInode(ino, true)
+		return err
+	}
+
+	err = iio.initInode(ino, inode)
+	if err != nil {
+		return err
+	}
+
+	parent.Links++
+
+	return iio.addDirectoryEntry(parentIno, parent, name, ino, direntTypeDirectory)
+
+}
+
+// Mkdir creates an empty directory at path on the root file-system, with the
+// permission bits in mode. The parent directory must already exist.
+func (iio *IO) Mkdir(path string, mode os.FileMode) error {
+
+	err := iio.checkWritableFS()
+	if err != nil {
+		return err
+	}
+
+	err = iio.mkdir(path, mode)
+	if err != nil {
+		return err
+	}
+
+	return iio.flushFSMetadata()
+
+}
+
+func (iio *IO) remove(fpath string) error {
+
+	parentIno, parent, name, err := iio.resolveParent(fpath)
+	if err != nil {
+		return err
+	}
+
+	ino, err := iio.lookupChild(parent, name)
+	if err != nil {
+		return err
+	}
+
+	if ino == 0 {
+		return fmt.Errorf("file not found: %s", fpath)
+	}
+
+	inode, err := iio.ResolveInode(ino)
+	if err != nil {
+		return err
+	}
+
+	isDir := InodeIsDirectory(inode)
+	if isDir {
+
+		list, err := iio.Readdir(inode)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range list {
+			if entry.Name != "." && entry.Name != ".." {
+				return fmt.Errorf("directory not empty: %s", fpath)
+			}
+		}
+
+		parent.Links--
+		inode.Links = 0
+
+	} else if inode.Links > 0 {
+		inode.Links--
+	}
+
+	err = iio.removeDirectoryEntry(parentIno, parent, name)
+	if err != nil {
+		return err
+	}
+
+	if inode.Links > 0 {
+		return iio.writeInode(ino, inode)
+	}
+
+	err = iio.freeInodeBlocks(inode)
+	if err != nil {
+		return err
+	}
+
+	err = iio.freeXattrBlock(inode)
+	if err != nil {
+		return err
+	}
+
+	inode.SizeLower = 0
+	inode.SizeUpper = 0
+	inode.DeletionTime = uint32(time.Now().Unix())
+
+	err = iio.writeInode(ino, inode)
+	if err != nil {
+		return err
+	}
+
+	return iio.freeInode(ino, isDir)
+
+}
+
+// Remove deletes the file, symlink, or empty directory at path from the root
+// file-system, freeing its blocks and inode once nothing links to it.
+func (iio *IO) Remove(path string) error {
+
+	err := iio.checkWritableFS()
+	if err != nil {
+		return err
+	}
+
+	err = iio.remove(path)
+	if err != nil {
+		return err
+	}
+
+	return iio.flushFSMetadata()
+
+}
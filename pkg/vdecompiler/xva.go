@@ -0,0 +1,157 @@
+package vdecompiler
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	xvaOVAXML    = "ova.xml"
+	xvaChunkSize = 0x100000
+)
+
+var xvaVirtualSizeRegexp = regexp.MustCompile(`<name>\s*virtual_size\s*</name>\s*<value>\s*(\d+)\s*</value>`)
+
+// isXVA returns true if buf, the first sector of the source image, is the
+// header of a tar archive that starts with an XVA's ova.xml.
+func isXVA(buf []byte) bool {
+	return len(buf) >= 512 && strings.HasPrefix(string(buf[257:]), "ustar") && cstring(buf[:100]) == xvaOVAXML
+}
+
+// xvaIO reads an XVA, which is an uncompressed tar archive holding the raw
+// image in 1 MiB chunks named after their index. Chunks that are entirely
+// empty are left out of the archive.
+type xvaIO struct {
+	iio    *IO
+	size   int64
+	chunks map[int64]int64
+}
+
+func (xio *xvaIO) scan() error {
+
+	_, err := xio.iio.src.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(xio.iio.src)
+
+	for {
+
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.Name == xvaOVAXML {
+			err = xio.readOVAXML(tr)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		dir, base := path.Split(hdr.Name)
+		if dir == "" || strings.Contains(base, ".") {
+			// checksums and anything else we don't care about
+			continue
+		}
+
+		chunk, err := strconv.ParseInt(base, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if hdr.Size != xvaChunkSize {
+			return fmt.Errorf("XVA chunk '%s' has unexpected size: %d", hdr.Name, hdr.Size)
+		}
+
+		offset, err := xio.iio.src.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+
+		xio.chunks[chunk] = offset
+
+	}
+
+	if xio.size == 0 {
+		return errors.New("XVA does not specify a virtual disk size")
+	}
+
+	return nil
+
+}
+
+func (xio *xvaIO) readOVAXML(r io.Reader) error {
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	match := xvaVirtualSizeRegexp.FindSubmatch(data)
+	if match == nil {
+		return errors.New("XVA ova.xml does not specify a virtual disk size")
+	}
+
+	xio.size, err = strconv.ParseInt(string(match[1]), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+func (xio *xvaIO) loadChunk(chunk int64) ([]byte, error) {
+
+	offset, ok := xio.chunks[chunk]
+	if !ok {
+		return nil, nil
+	}
+
+	data := make([]byte, xvaChunkSize)
+	err := xio.iio.readSrcAt(data, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+
+}
+
+func (iio *IO) xvaIO() (*partialIO, error) {
+
+	if iio.src.seeker == nil {
+		return nil, fmt.Errorf("reading an XVA from %s: %w", iio.src.name, ErrSeek)
+	}
+
+	xio := &xvaIO{
+		iio:    iio,
+		chunks: make(map[int64]int64),
+	}
+
+	err := xio.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	return iio.chunkedPartialIO(newChunkedIO(xio.size, xvaChunkSize, xio.loadChunk)), nil
+
+}
@@ -9,13 +9,18 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"math/rand"
+	"time"
 
 	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/gcparchive"
+	"github.com/vorteil/vorteil/pkg/qcow2"
 	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vhd"
+	"github.com/vorteil/vorteil/pkg/vhdx"
 	"github.com/vorteil/vorteil/pkg/vimg"
 	"github.com/vorteil/vorteil/pkg/vio"
+	"github.com/vorteil/vorteil/pkg/vkern"
 	"github.com/vorteil/vorteil/pkg/vmdk"
 	"github.com/vorteil/vorteil/pkg/vpkg"
 	"github.com/vorteil/vorteil/pkg/xva"
@@ -35,6 +40,20 @@ type BuildArgs struct {
 	KernelOptions    KernelOptions
 	Logger           elog.View
 	WithVCFGDefaults bool
+
+	// Reproducible makes every value in the image that would otherwise
+	// be random or taken from the clock deterministic, so that building
+	// the same package twice produces identical images.
+	Reproducible bool
+
+	// Seed is used to derive every random value in a reproducible build.
+	// If it is zero the seed is derived from the contents of the package.
+	Seed int64
+
+	// Timestamp replaces the current time in a reproducible build, and no
+	// file in the image will have a modification time later than it. If
+	// it is zero the Unix epoch is used. See SourceDateEpoch.
+	Timestamp time.Time
 }
 
 // NegotiateSize prebuilds the minimum amount for a disk.
@@ -78,12 +97,51 @@ func build(ctx context.Context, w io.WriteSeeker, cfg *vcfg.VCFG, args *BuildArg
 
 	log := args.Logger
 
-	fsCompiler, err := NewFilesystemCompiler(string(cfg.System.Filesystem), log, args.PackageReader.FS(), nil)
+	seed := time.Now().UnixNano()
+	var timestamp time.Time
+	var fsArgs *FilesystemCompilerArgs
+
+	if args.Reproducible {
+
+		seed = args.Seed
+		if seed == 0 {
+			var err error
+			var cleanup func()
+			seed, cleanup, err = packageSeed(cfg, args.PackageReader.FS())
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+		}
+
+		timestamp = args.Timestamp
+		if timestamp.IsZero() {
+			timestamp = time.Unix(0, 0)
+		}
+
+		if _, err := vkern.Parse(cfg.VM.Kernel); err != nil {
+			log.Warnf("vm.kernel is not set to a specific kernel version, so the image may change when a new kernel is released")
+		}
+
+		// the file-system and the disk draw from different streams so
+		// that their IDs don't collide
+		rng := rand.New(rand.NewSource(seed))
+		seed = rng.Int63()
+		fsArgs = &FilesystemCompilerArgs{
+			Rand:      rng,
+			Timestamp: timestamp,
+		}
+
+	}
+
+	fsCompiler, err := NewFilesystemCompiler(string(cfg.System.Filesystem), log, args.PackageReader.FS(), fsArgs)
 	if err != nil {
 		return err
 	}
 
 	vimgBuilder, err := CreateBuilder(ctx, &vimg.BuilderArgs{
+		Seed:      seed,
+		Timestamp: timestamp,
 		Kernel: vimg.KernelOptions{
 			Shell: args.KernelOptions.Shell,
 		},
@@ -108,10 +166,19 @@ func build(ctx context.Context, w io.WriteSeeker, cfg *vcfg.VCFG, args *BuildArg
 		return err
 	}
 
+	cfg.VM.Kernel = string(vimgBuilder.KernelUsed())
+
 	return nil
 
 }
 
+// BuildVCFG writes a virtual disk image to w like Build, but with cfg in place
+// of the VCFG in the package. When it returns cfg.VM.Kernel holds the version
+// of the kernel the image was built with.
+func BuildVCFG(ctx context.Context, w io.WriteSeeker, cfg *vcfg.VCFG, args *BuildArgs) error {
+	return build(ctx, w, cfg, args)
+}
+
 // Build writes a virtual disk image to w using the provided args.
 func Build(ctx context.Context, w io.WriteSeeker, args *BuildArgs) error {
 
@@ -188,3 +255,15 @@ func buildFixedVHD(w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG) (io.WriteS
 func buildDynamicVHD(w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG) (io.WriteSeeker, error) {
 	return vhd.NewDynamicWriter(w, b)
 }
+
+func buildVHDX(w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG) (io.WriteSeeker, error) {
+	return vhdx.NewWriter(w, b)
+}
+
+func buildQCOW2(w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG) (io.WriteSeeker, error) {
+	return qcow2.NewWriter(w, b)
+}
+
+func buildCompressedQCOW2(w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG) (io.WriteSeeker, error) {
+	return qcow2.NewCompressedWriter(w, b)
+}
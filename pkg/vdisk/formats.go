@@ -41,6 +41,12 @@ const (
 	VHDFixedFormat Format = "vhd-fixed"
 	// VHDDynamicFormat is a disk type that returns "vhd-dynamic"
 	VHDDynamicFormat Format = "vhd-dynamic"
+	// VHDXFormat is a disk type that returns "vhdx"
+	VHDXFormat Format = "vhdx"
+	// QCOW2Format is a disk type that returns "qcow2"
+	QCOW2Format Format = "qcow2"
+	// QCOW2CompressedFormat is a disk type that returns "qcow2-compressed"
+	QCOW2CompressedFormat Format = "qcow2-compressed"
 )
 
 // AllFormatStrings returns a list of all supported disk image formats.
@@ -66,6 +72,9 @@ var (
 		VHDFormat:                 ".vhd",
 		VHDFixedFormat:            ".vhd",
 		VHDDynamicFormat:          ".vhd",
+		VHDXFormat:                ".vhdx",
+		QCOW2Format:               ".qcow2",
+		QCOW2CompressedFormat:     ".qcow2",
 	}
 
 	alignments = map[Format]int64{
@@ -78,6 +87,9 @@ var (
 		VHDFormat:                 0x200000,
 		VHDFixedFormat:            0x200000,
 		VHDDynamicFormat:          0x200000,
+		VHDXFormat:                0x200000,
+		QCOW2Format:               0x200000,
+		QCOW2CompressedFormat:     0x200000,
 	}
 
 	defaultMTUs = map[Format]uint{
@@ -90,6 +102,9 @@ var (
 		VHDFormat:                 1500,
 		VHDFixedFormat:            1500,
 		VHDDynamicFormat:          1500,
+		VHDXFormat:                1500,
+		QCOW2Format:               1500,
+		QCOW2CompressedFormat:     1500,
 	}
 
 	buildFuncs = map[Format]BuildWriterInstantiator{
@@ -102,6 +117,9 @@ var (
 		VHDFormat:                 buildFixedVHD,
 		VHDFixedFormat:            buildFixedVHD,
 		VHDDynamicFormat:          buildDynamicVHD,
+		VHDXFormat:                buildVHDX,
+		QCOW2Format:               buildQCOW2,
+		QCOW2CompressedFormat:     buildCompressedQCOW2,
 	}
 )
 
@@ -7,14 +7,34 @@ package vdisk
 
 import (
 	"fmt"
+	"io"
 	"sort"
+	"time"
 
 	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/ext4"
+	"github.com/vorteil/vorteil/pkg/squashfs"
 	"github.com/vorteil/vorteil/pkg/vimg"
 	"github.com/vorteil/vorteil/pkg/vio"
+	"github.com/vorteil/vorteil/pkg/xfs"
 )
 
+// FilesystemCompilerArgs can be passed to NewFilesystemCompiler as its 'args'
+// to control the values the built-in file-system compilers would otherwise
+// take from the current time and a random number generator.
+type FilesystemCompilerArgs struct {
+	Rand      io.Reader
+	Timestamp time.Time
+}
+
+func filesystemCompilerArgs(args interface{}) *FilesystemCompilerArgs {
+	if x, ok := args.(*FilesystemCompilerArgs); ok && x != nil {
+		return x
+	}
+	return new(FilesystemCompilerArgs)
+}
+
 func init() {
 
 	if len(FilesystemCompilers()) != 0 {
@@ -22,9 +42,11 @@ func init() {
 	}
 
 	fn := func(log elog.Logger, tree vio.FileTree, args interface{}) (vimg.FSCompiler, error) {
+		x := filesystemCompilerArgs(args)
 		return ext.NewCompiler(&ext.CompilerArgs{
-			Logger:   log,
-			FileTree: tree,
+			Logger:    log,
+			FileTree:  tree,
+			Timestamp: x.Timestamp,
 		}), nil
 	}
 
@@ -43,6 +65,73 @@ func init() {
 		panic(err)
 	}
 
+	err = RegisterFilesystemCompiler("ext4", func(log elog.Logger, tree vio.FileTree, args interface{}) (vimg.FSCompiler, error) {
+		err := warnDroppedXattrs(log, "ext4", tree)
+		if err != nil {
+			return nil, err
+		}
+		x := filesystemCompilerArgs(args)
+		return ext4.NewCompiler(&ext4.CompilerArgs{
+			Logger:    log,
+			FileTree:  tree,
+			Rand:      x.Rand,
+			Timestamp: x.Timestamp,
+		}), nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	err = RegisterFilesystemCompiler("xfs", func(log elog.Logger, tree vio.FileTree, args interface{}) (vimg.FSCompiler, error) {
+		err := warnDroppedXattrs(log, "xfs", tree)
+		if err != nil {
+			return nil, err
+		}
+		x := filesystemCompilerArgs(args)
+		return xfs.NewCompiler(&xfs.CompilerArgs{
+			Logger:    log,
+			FileTree:  tree,
+			Rand:      x.Rand,
+			Timestamp: x.Timestamp,
+		}), nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	err = RegisterFilesystemCompiler("squashfs", func(log elog.Logger, tree vio.FileTree, args interface{}) (vimg.FSCompiler, error) {
+		err := warnDroppedXattrs(log, "squashfs", tree)
+		if err != nil {
+			return nil, err
+		}
+		x := filesystemCompilerArgs(args)
+		return squashfs.NewCompiler(&squashfs.CompilerArgs{
+			Logger:    log,
+			FileTree:  tree,
+			Timestamp: x.Timestamp,
+		}), nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+}
+
+// warnDroppedXattrs warns about files in tree carrying extended attributes,
+// for file-system compilers that don't write them.
+func warnDroppedXattrs(log elog.Logger, fs string, tree vio.FileTree) error {
+
+	paths, err := vio.XattrPaths(tree)
+	if err != nil {
+		return err
+	}
+
+	if len(paths) > 0 {
+		log.Warnf("vorteil's %s compiler doesn't write extended attributes: dropping those of %d file(s), including '%s'", fs, len(paths), paths[0])
+	}
+
+	return nil
+
 }
 
 // FSCompilerInstantiator is a function that returns a new file-system compiler
@@ -0,0 +1,134 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// SourceDateEpochEnv is the environment variable used by reproducible build
+// tools to agree on a timestamp, as the number of seconds since the Unix epoch.
+const SourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// SourceDateEpoch returns the time in the SOURCE_DATE_EPOCH environment
+// variable, which can be used as the Timestamp of a reproducible build. It
+// returns the zero time if the variable isn't set.
+func SourceDateEpoch() (time.Time, error) {
+
+	s := os.Getenv(SourceDateEpochEnv)
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || secs < 0 {
+		return time.Time{}, fmt.Errorf("invalid %s: '%s'", SourceDateEpochEnv, s)
+	}
+
+	return time.Unix(secs, 0).UTC(), nil
+
+}
+
+// packageSeed derives a seed for a reproducible build from the configuration
+// and the contents of the file-system. The file tree can only be read once, so
+// the files are spooled to a temporary file as they are hashed and replaced in
+// the tree by readers of their spooled copies. The returned function removes
+// the spool, and must only be called once the tree is no longer needed.
+func packageSeed(cfg *vcfg.VCFG, tree vio.FileTree) (int64, func(), error) {
+
+	hasher := sha256.New()
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return 0, nil, err
+	}
+	_, _ = hasher.Write(data)
+
+	spool, err := ioutil.TempFile("", "vorteil-seed-")
+	if err != nil {
+		return 0, nil, err
+	}
+
+	cleanup := func() {
+		_ = spool.Close()
+		_ = os.Remove(spool.Name())
+	}
+
+	var offset int64
+
+	err = tree.WalkNode(func(path string, n *vio.TreeNode) error {
+
+		f := n.File
+		md := vio.MetadataOf(f)
+
+		var xattrs []string
+		if md != nil {
+			for k := range md.Xattrs {
+				xattrs = append(xattrs, k)
+			}
+			sort.Strings(xattrs)
+		}
+
+		_, _ = fmt.Fprintf(hasher, "%s\x00%d\x00%t\x00%t\x00%s\x00", path, f.Size(), f.IsDir(), f.IsSymlink(), f.Symlink())
+		if md != nil {
+			_, _ = fmt.Fprintf(hasher, "%o\x00%d\x00%d\x00", md.Mode, md.UID, md.GID)
+			for _, k := range xattrs {
+				_, _ = fmt.Fprintf(hasher, "%s\x00%x\x00", k, md.Xattrs[k])
+			}
+		}
+
+		if f.IsDir() || f.IsSymlink() {
+			return nil
+		}
+
+		size, err := io.Copy(io.MultiWriter(hasher, spool), f)
+		if err != nil {
+			return err
+		}
+
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+
+		start := offset
+		offset += size
+
+		n.File = vio.CustomFile(vio.CustomFileArgs{
+			Name:     f.Name(),
+			Size:     int(size),
+			ModTime:  f.ModTime(),
+			Metadata: md,
+			ReadCloser: vio.LazyReadCloser(func() (io.Reader, error) {
+				return io.NewSectionReader(spool, start, size), nil
+			}, func() error {
+				return nil
+			}),
+		})
+
+		return nil
+
+	})
+	if err != nil {
+		cleanup()
+		return 0, nil, err
+	}
+
+	return int64(binary.LittleEndian.Uint64(hasher.Sum(nil))), cleanup, nil
+
+}
@@ -0,0 +1,69 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+func TestPackageSeed(t *testing.T) {
+
+	seed := func(content string) int64 {
+
+		tree := vio.NewFileTree()
+		defer tree.Close()
+
+		err := tree.Map("/app", vio.CustomFile(vio.CustomFileArgs{
+			Name:       "app",
+			Size:       len(content),
+			ReadCloser: ioutil.NopCloser(strings.NewReader(content)),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		x, cleanup, err := packageSeed(new(vcfg.VCFG), tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cleanup()
+
+		// the tree must still be readable afterwards
+		err = tree.Walk(func(path string, f vio.File) error {
+			if f.IsDir() {
+				return nil
+			}
+			data, err := ioutil.ReadAll(f)
+			if err != nil {
+				return err
+			}
+			if string(data) != content {
+				t.Errorf("file read back after seeding is '%s', expected '%s'", data, content)
+			}
+			return f.Close()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return x
+
+	}
+
+	if seed("alpha") != seed("alpha") {
+		t.Errorf("packageSeed isn't stable")
+	}
+
+	if seed("alpha") == seed("bravo") {
+		t.Errorf("packageSeed ignores file contents")
+	}
+
+}
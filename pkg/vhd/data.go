@@ -5,7 +5,20 @@ package vhd
  * Copyright 2020 vorteil.io Pty Ltd
  */
 
-type footer struct { // 512 bytes
+// Various VHD constants. Everything on disk is big-endian.
+const (
+	FooterCookie    = 0x636F6E6563746978 // conectix
+	HeaderCookie    = 0x6378737061727365 // cxsparse
+	DiskTypeFixed   = 2
+	DiskTypeDynamic = 3
+	FooterSize      = 512
+	SectorSize      = 512
+	UnusedBATEntry  = 0xFFFFFFFF
+)
+
+// Footer is the structure found at the end of every VHD image, and also at the
+// start of dynamic VHD images.
+type Footer struct { // 512 bytes
 	Cookie             uint64
 	Features           uint32
 	FileFormatVersion  uint32
@@ -24,7 +37,9 @@ type footer struct { // 512 bytes
 	Reserved           [427]byte
 }
 
-type header struct { // 1024 bytes
+// Header is the dynamic disk header of a dynamic VHD image, which locates its
+// block allocation table.
+type Header struct { // 1024 bytes
 	Cookie              uint64
 	DataOffset          uint64
 	TableOffset         uint64
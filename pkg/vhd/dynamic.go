@@ -10,7 +10,6 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
-	"time"
 )
 
 const chunkSize = 0x200000
@@ -18,7 +17,7 @@ const chunkSize = 0x200000
 type DynamicWriter struct {
 	w             io.WriteSeeker
 	h             HolePredictor
-	header        *header
+	header        *Header
 	footer        *bytes.Buffer
 	cursor        int64
 	chunkOffsets  []int64
@@ -53,7 +52,7 @@ func NewDynamicWriter(w io.WriteSeeker, h HolePredictor) (*DynamicWriter, error)
 
 func (w *DynamicWriter) writeRedundantFooter() error {
 	conectix := uint64(0x636F6E6563746978)
-	timestamp := time.Now().Unix() - 946684800 // 2000 offset
+	uid, timestamp := identify(w.h)
 
 	// CHS crap
 	var cylinders, heads, sectorsPerTrack int64
@@ -89,7 +88,7 @@ func (w *DynamicWriter) writeRedundantFooter() error {
 	cylinders = cylinderTimesHeads / heads
 
 	// copy of hard disk footer
-	footer := &footer{
+	footer := &Footer{
 		Cookie:             conectix,
 		Features:           0x00000002,
 		FileFormatVersion:  0x00010000,
@@ -102,7 +101,7 @@ func (w *DynamicWriter) writeRedundantFooter() error {
 		CurrentSize:        uint64(w.h.Size()),
 		DiskGeometry:       uint32(cylinders<<16 | heads<<8 | sectorsPerTrack),
 		DiskType:           3,
-		// TODO: UniqueID
+		UniqueID:           uid,
 	}
 
 	buf := new(bytes.Buffer)
@@ -143,7 +142,7 @@ func (w *DynamicWriter) writeRedundantFooter() error {
 func (w *DynamicWriter) writeHeader() error {
 	// sparse drive header
 	cxsparse := uint64(0x6378737061727365)
-	header := &header{
+	header := &Header{
 		Cookie:          cxsparse,
 		DataOffset:      0xFFFFFFFFFFFFFFFF,
 		TableOffset:     1536,
@@ -20,8 +20,34 @@ type HolePredictor interface {
 	RegionIsHole(begin, size int64) bool
 }
 
+// Identifier can be implemented by the HolePredictor given to a writer to
+// decide the disk's unique ID and creation time, which otherwise are left
+// empty and set to the current time. Note that our vimg.Builder implements
+// this interface so that reproducible builds produce identical VHDs.
+type Identifier interface {
+	DiskUID() []byte
+	Timestamp() time.Time
+}
+
+// identify returns the unique ID and the timestamp (relative to the year 2000)
+// that should be written into the footer of a VHD for h.
+func identify(h HolePredictor) ([16]byte, int64) {
+
+	var uid [16]byte
+	t := time.Now()
+
+	if id, ok := h.(Identifier); ok {
+		copy(uid[:], id.DiskUID())
+		t = id.Timestamp()
+	}
+
+	return uid, t.Unix() - 946684800 // 2000 offset
+
+}
+
 type FixedWriter struct {
 	w      io.WriteSeeker
+	h      HolePredictor
 	cursor int64
 	length int64
 }
@@ -29,6 +55,7 @@ type FixedWriter struct {
 func NewFixedWriter(w io.WriteSeeker, h HolePredictor) (*FixedWriter, error) {
 	return &FixedWriter{
 		w:      w,
+		h:      h,
 		length: h.Size(),
 	}, nil
 }
@@ -58,7 +85,7 @@ func (w *FixedWriter) writeFooter() error {
 	}
 
 	conectix := uint64(0x636F6E6563746978)
-	timestamp := time.Now().Unix() - 946684800 // 2000 offset
+	uid, timestamp := identify(w.h)
 
 	// CHS crap
 	var cylinders, heads, sectorsPerTrack int64
@@ -94,7 +121,7 @@ func (w *FixedWriter) writeFooter() error {
 	cylinders = cylinderTimesHeads / heads
 
 	// copy of hard disk footer
-	footer := &footer{
+	footer := &Footer{
 		Cookie:             conectix,
 		Features:           0x00000002,
 		FileFormatVersion:  0x00010000,
@@ -107,7 +134,7 @@ func (w *FixedWriter) writeFooter() error {
 		CurrentSize:        uint64(w.length),
 		DiskGeometry:       uint32(cylinders<<16 | heads<<8 | sectorsPerTrack),
 		DiskType:           2, // fixed vhd
-		// TODO: UniqueID
+		UniqueID:           uid,
 	}
 
 	buf := new(bytes.Buffer)
@@ -203,7 +230,7 @@ func (w *fixedStreamWrapper) wrap() error {
 	cylinders = cylinderTimesHeads / heads
 
 	// copy of hard disk footer
-	footer := &footer{
+	footer := &Footer{
 		Cookie:             conectix,
 		Features:           0x00000002,
 		FileFormatVersion:  0x00010000,
@@ -0,0 +1,188 @@
+package vhdx
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// Various VHDX constants. Everything on disk is little-endian.
+const (
+	FileSignature     = 0x656C696678646876 // vhdxfile
+	HeaderSignature   = 0x64616568         // head
+	RegionSignature   = 0x69676572         // regi
+	MetadataSignature = 0x617461646174656D // metadata
+
+	KiB = 0x400
+	MiB = 0x100000
+
+	FileIdentifierOffset = 0
+	Header1Offset        = 64 * KiB
+	Header2Offset        = 128 * KiB
+	RegionTable1Offset   = 192 * KiB
+	RegionTable2Offset   = 256 * KiB
+	HeaderSize           = 4 * KiB
+	RegionTableSize      = 64 * KiB
+	MetadataTableSize    = 64 * KiB
+
+	// Everything after the first MiB is allocated in whole MiBs.
+	LogOffset      = 1 * MiB
+	LogSize        = 1 * MiB
+	MetadataOffset = 2 * MiB
+	MetadataSize   = 1 * MiB
+	BATOffset      = 3 * MiB
+
+	// BlockSize matches the 2 MiB blocks of our dynamic VHDs, which keeps
+	// images small at the cost of a slightly larger BAT.
+	BlockSize          = 2 * MiB
+	LogicalSectorSize  = 512
+	PhysicalSectorSize = 4096
+
+	// BAT entries hold the block's state in their low bits and its file
+	// offset in MiB above BATOffsetShift.
+	BATStateMask   = 0x7
+	BATOffsetShift = 20
+
+	PayloadBlockNotPresent       = 0
+	PayloadBlockUndefined        = 1
+	PayloadBlockZero             = 2
+	PayloadBlockUnmapped         = 3
+	PayloadBlockFullyPresent     = 6
+	PayloadBlockPartiallyPresent = 7
+
+	MetadataFlagIsUser        = 0x1
+	MetadataFlagIsVirtualDisk = 0x2
+	MetadataFlagIsRequired    = 0x4
+
+	FileParametersFlagHasParent = 0x2
+)
+
+// GUIDs are stored with their first three fields little-endian.
+var (
+	// 2DC27766-F623-4200-9D64-115E9BFD4A08
+	BATRegionGUID = [16]byte{0x66, 0x77, 0xC2, 0x2D, 0x23, 0xF6, 0x00, 0x42,
+		0x9D, 0x64, 0x11, 0x5E, 0x9B, 0xFD, 0x4A, 0x08}
+	// 8B7CA206-4790-4B9A-B8FE-575F050F886E
+	MetadataRegionGUID = [16]byte{0x06, 0xA2, 0x7C, 0x8B, 0x90, 0x47, 0x9A, 0x4B,
+		0xB8, 0xFE, 0x57, 0x5F, 0x05, 0x0F, 0x88, 0x6E}
+	// CAA16737-FA36-4D43-B3B6-33F0AA44E76B
+	FileParametersGUID = [16]byte{0x37, 0x67, 0xA1, 0xCA, 0x36, 0xFA, 0x43, 0x4D,
+		0xB3, 0xB6, 0x33, 0xF0, 0xAA, 0x44, 0xE7, 0x6B}
+	// 2FA54224-CD1B-4876-B211-5DBED83BF4B8
+	VirtualDiskSizeGUID = [16]byte{0x24, 0x42, 0xA5, 0x2F, 0x1B, 0xCD, 0x76, 0x48,
+		0xB2, 0x11, 0x5D, 0xBE, 0xD8, 0x3B, 0xF4, 0xB8}
+	// BECA12AB-B2E6-4523-93EF-C309E000C746
+	VirtualDiskIDGUID = [16]byte{0xAB, 0x12, 0xCA, 0xBE, 0xE6, 0xB2, 0x23, 0x45,
+		0x93, 0xEF, 0xC3, 0x09, 0xE0, 0x00, 0xC7, 0x46}
+	// 8141BF1D-A96F-4709-BA47-F233A8FAAB5F
+	LogicalSectorSizeGUID = [16]byte{0x1D, 0xBF, 0x41, 0x81, 0x6F, 0xA9, 0x09, 0x47,
+		0xBA, 0x47, 0xF2, 0x33, 0xA8, 0xFA, 0xAB, 0x5F}
+	// CDA348C7-445D-4471-9CC9-E9885251C556
+	PhysicalSectorSizeGUID = [16]byte{0xC7, 0x48, 0xA3, 0xCD, 0x5D, 0x44, 0x71, 0x44,
+		0x9C, 0xC9, 0xE9, 0x88, 0x52, 0x51, 0xC5, 0x56}
+)
+
+// FileIdentifier is found at the very start of a VHDX.
+type FileIdentifier struct {
+	Signature uint64
+	Creator   [256]uint16
+}
+
+// Header is stored twice, and the valid one with the highest sequence number
+// is current.
+type Header struct { // 4 KiB
+	Signature      uint32
+	Checksum       uint32
+	SequenceNumber uint64
+	FileWriteGUID  [16]byte
+	DataWriteGUID  [16]byte
+	LogGUID        [16]byte
+	LogVersion     uint16
+	Version        uint16
+	LogLength      uint32
+	LogOffset      uint64
+	Reserved       [4016]byte
+}
+
+// RegionTableHeader is followed by EntryCount RegionTableEntry structures, and
+// is also stored twice.
+type RegionTableHeader struct {
+	Signature  uint32
+	Checksum   uint32
+	EntryCount uint32
+	Reserved   uint32
+}
+
+// RegionTableEntry locates a region such as the BAT or metadata region.
+type RegionTableEntry struct {
+	GUID       [16]byte
+	FileOffset uint64
+	Length     uint32
+	Required   uint32
+}
+
+// MetadataTableHeader is found at the start of the metadata region, followed
+// by EntryCount MetadataTableEntry structures.
+type MetadataTableHeader struct {
+	Signature  uint64
+	Reserved   uint16
+	EntryCount uint16
+	Reserved2  [20]byte
+}
+
+// MetadataTableEntry locates a metadata item, relative to the start of the
+// metadata region.
+type MetadataTableEntry struct {
+	ItemID   [16]byte
+	Offset   uint32
+	Length   uint32
+	Flags    uint32
+	Reserved uint32
+}
+
+// FileParameters is the value of the file parameters metadata item.
+type FileParameters struct {
+	BlockSize uint32
+	Flags     uint32
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum returns the crc32c of buf with its checksum field, which is always
+// at offset 4, zeroed.
+func Checksum(buf []byte) uint32 {
+	x := make([]byte, len(buf))
+	copy(x, buf)
+	binary.LittleEndian.PutUint32(x[4:], 0)
+	return crc32.Checksum(x, crcTable)
+}
+
+// ChunkRatio returns the number of payload blocks that share a sector bitmap
+// block, which determines how they are interleaved in the BAT.
+func ChunkRatio(blockSize, logicalSectorSize int64) int64 {
+	return (1 << 23) * logicalSectorSize / blockSize
+}
+
+// marshal encodes a structure and pads it out to size bytes.
+func marshal(size int, data ...interface{}) ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+	for _, x := range data {
+		err := binary.Write(buf, binary.LittleEndian, x)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if buf.Len() < size {
+		buf.Write(make([]byte, size-buf.Len()))
+	}
+
+	return buf.Bytes(), nil
+
+}
@@ -0,0 +1,426 @@
+package vhdx
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"unicode/utf16"
+)
+
+const creator = "vorteil.io"
+
+type HolePredictor interface {
+	Size() int64
+	RegionIsHole(begin, size int64) bool
+}
+
+// Identifier can be implemented by the HolePredictor given to a writer to
+// decide the disk's GUIDs, which are otherwise random. Note that our
+// vimg.Builder implements this interface so that reproducible builds produce
+// identical VHDXs.
+type Identifier interface {
+	DiskUID() []byte
+}
+
+// identify returns the virtual disk ID, file write GUID and data write GUID
+// that should be written into a VHDX for h.
+func identify(h HolePredictor) ([3][16]byte, error) {
+
+	var guids [3][16]byte
+
+	id, ok := h.(Identifier)
+	if !ok || len(id.DiskUID()) == 0 {
+		for i := range guids {
+			_, err := io.ReadFull(rand.Reader, guids[i][:])
+			if err != nil {
+				return guids, err
+			}
+		}
+		return guids, nil
+	}
+
+	uid := id.DiskUID()
+	copy(guids[0][:], uid)
+	for i, label := range []string{"file", "data"} {
+		sum := sha256.Sum256(append(append([]byte{}, uid...), label...))
+		copy(guids[i+1][:], sum[:])
+		guids[i+1][7] = guids[i+1][7]&0x0F | 0x40 // version 4
+		guids[i+1][8] = guids[i+1][8]&0x3F | 0x80 // variant
+	}
+
+	return guids, nil
+
+}
+
+// Writer implements io.Closer, io.Writer, and io.Seeker interfaces. Creating a
+// VHDX image is as simple as getting one of these writers and copying a raw
+// image into it. Every block predicted to be a hole by the HolePredictor is
+// left out of the image. The image is written without a log, so nothing needs
+// to be replayed when it is opened.
+type Writer struct {
+	w io.WriteSeeker
+	h HolePredictor
+
+	cursor       int64
+	end          int64
+	written      int64
+	blockOffsets []int64
+}
+
+func (w *Writer) writeAt(offset int64, data []byte) error {
+
+	_, err := w.w.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.w.Write(data)
+	return err
+
+}
+
+func (w *Writer) writeFileIdentifier() error {
+
+	id := &FileIdentifier{
+		Signature: FileSignature,
+	}
+	copy(id.Creator[:], utf16.Encode([]rune(creator)))
+
+	buf, err := marshal(0, id)
+	if err != nil {
+		return err
+	}
+
+	return w.writeAt(FileIdentifierOffset, buf)
+
+}
+
+func (w *Writer) writeHeaders(guids [3][16]byte) error {
+
+	for i, offset := range []int64{Header1Offset, Header2Offset} {
+
+		hdr := &Header{
+			Signature:      HeaderSignature,
+			SequenceNumber: uint64(i),
+			FileWriteGUID:  guids[1],
+			DataWriteGUID:  guids[2],
+			Version:        1,
+			LogLength:      LogSize,
+			LogOffset:      LogOffset,
+		}
+
+		buf, err := marshal(HeaderSize, hdr)
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint32(buf[4:], Checksum(buf))
+
+		err = w.writeAt(offset, buf)
+		if err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
+
+func (w *Writer) writeRegionTables(batSize int64) error {
+
+	hdr := &RegionTableHeader{
+		Signature:  RegionSignature,
+		EntryCount: 2,
+	}
+
+	entries := []RegionTableEntry{{
+		GUID:       BATRegionGUID,
+		FileOffset: BATOffset,
+		Length:     uint32(batSize),
+		Required:   1,
+	}, {
+		GUID:       MetadataRegionGUID,
+		FileOffset: MetadataOffset,
+		Length:     MetadataSize,
+		Required:   1,
+	}}
+
+	buf, err := marshal(RegionTableSize, hdr, entries)
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(buf[4:], Checksum(buf))
+
+	for _, offset := range []int64{RegionTable1Offset, RegionTable2Offset} {
+		err = w.writeAt(offset, buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+func (w *Writer) writeMetadata(guids [3][16]byte) error {
+
+	type item struct {
+		id    [16]byte
+		flags uint32
+		value interface{}
+	}
+
+	items := []item{
+		{FileParametersGUID, MetadataFlagIsRequired, &FileParameters{BlockSize: BlockSize}},
+		{VirtualDiskSizeGUID, MetadataFlagIsVirtualDisk | MetadataFlagIsRequired, uint64(w.h.Size())},
+		{VirtualDiskIDGUID, MetadataFlagIsVirtualDisk | MetadataFlagIsRequired, guids[0]},
+		{LogicalSectorSizeGUID, MetadataFlagIsVirtualDisk | MetadataFlagIsRequired, uint32(LogicalSectorSize)},
+		{PhysicalSectorSizeGUID, MetadataFlagIsVirtualDisk | MetadataFlagIsRequired, uint32(PhysicalSectorSize)},
+	}
+
+	hdr := &MetadataTableHeader{
+		Signature:  MetadataSignature,
+		EntryCount: uint16(len(items)),
+	}
+
+	var entries []MetadataTableEntry
+	var values []interface{}
+	offset := uint32(MetadataTableSize)
+
+	for _, x := range items {
+		length := uint32(binary.Size(x.value))
+		entries = append(entries, MetadataTableEntry{
+			ItemID: x.id,
+			Offset: offset,
+			Length: length,
+			Flags:  x.flags,
+		})
+		values = append(values, x.value)
+		offset += length
+	}
+
+	table, err := marshal(MetadataTableSize, hdr, entries)
+	if err != nil {
+		return err
+	}
+
+	data, err := marshal(0, values...)
+	if err != nil {
+		return err
+	}
+
+	return w.writeAt(MetadataOffset, append(table, data...))
+
+}
+
+func (w *Writer) writeBAT() error {
+
+	blocks := int64(len(w.blockOffsets))
+	ratio := ChunkRatio(BlockSize, LogicalSectorSize)
+
+	// a sector bitmap entry follows every chunk of payload entries, but they
+	// are only used by differencing disks
+	bat := make([]uint64, blocks+(blocks-1)/ratio)
+	for i, offset := range w.blockOffsets {
+		if offset < 0 {
+			continue
+		}
+		bat[int64(i)+int64(i)/ratio] = uint64(offset/MiB)<<BATOffsetShift | PayloadBlockFullyPresent
+	}
+
+	buf, err := marshal(0, bat)
+	if err != nil {
+		return err
+	}
+
+	return w.writeAt(BATOffset, buf)
+
+}
+
+func (w *Writer) init() error {
+
+	guids, err := identify(w.h)
+	if err != nil {
+		return err
+	}
+
+	blocks := (w.h.Size() + BlockSize - 1) / BlockSize
+	ratio := ChunkRatio(BlockSize, LogicalSectorSize)
+	batEntries := blocks + (blocks-1)/ratio
+	batSize := (8*batEntries + MiB - 1) / MiB * MiB
+
+	w.blockOffsets = make([]int64, blocks)
+	offset := int64(BATOffset + batSize)
+	for i := range w.blockOffsets {
+		if w.h.RegionIsHole(int64(i)*BlockSize, BlockSize) {
+			w.blockOffsets[i] = -1
+			continue
+		}
+		w.blockOffsets[i] = offset
+		offset += BlockSize
+	}
+	w.end = offset
+
+	err = w.writeFileIdentifier()
+	if err != nil {
+		return err
+	}
+
+	err = w.writeHeaders(guids)
+	if err != nil {
+		return err
+	}
+
+	err = w.writeRegionTables(batSize)
+	if err != nil {
+		return err
+	}
+
+	err = w.writeMetadata(guids)
+	if err != nil {
+		return err
+	}
+
+	err = w.writeBAT()
+	if err != nil {
+		return err
+	}
+
+	w.written = BATOffset + 8*batEntries
+
+	return w.seek(0)
+
+}
+
+// seek moves the underlying writer to the file offset of the virtual disk
+// offset abs, if it is in a block that is present.
+func (w *Writer) seek(abs int64) error {
+
+	w.cursor = abs
+
+	block := abs / BlockSize
+	if block >= int64(len(w.blockOffsets)) || w.blockOffsets[block] < 0 {
+		return nil
+	}
+
+	_, err := w.w.Seek(w.blockOffsets[block]+abs%BlockSize, io.SeekStart)
+	return err
+
+}
+
+// Write implements io.Writer.
+func (w *Writer) Write(p []byte) (int, error) {
+
+	var n int
+
+	for len(p) > 0 {
+
+		if w.cursor >= w.h.Size() {
+			return n, io.EOF
+		}
+
+		block := w.cursor / BlockSize
+		k := BlockSize - w.cursor%BlockSize
+		if remaining := w.h.Size() - w.cursor; remaining < k {
+			k = remaining
+		}
+		if int64(len(p)) < k {
+			k = int64(len(p))
+		}
+
+		if w.blockOffsets[block] < 0 {
+			for _, x := range p[:k] {
+				if x != 0 {
+					return n, errors.New("vhdx writer received data for a region that was predicted to be a hole")
+				}
+			}
+		} else {
+			_, err := w.w.Write(p[:k])
+			if err != nil {
+				return n, err
+			}
+			if x := w.blockOffsets[block] + w.cursor%BlockSize + k; x > w.written {
+				w.written = x
+			}
+		}
+
+		n += int(k)
+		p = p[k:]
+
+		// the next block isn't necessarily the next one in the file
+		if (w.cursor+k)%BlockSize == 0 {
+			err := w.seek(w.cursor + k)
+			if err != nil {
+				return n, err
+			}
+		} else {
+			w.cursor += k
+		}
+
+	}
+
+	return n, nil
+
+}
+
+// Seek implements io.Seeker.
+func (w *Writer) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = w.cursor + offset
+	case io.SeekEnd:
+		abs = w.h.Size() + offset
+	default:
+		panic("bad seek whence")
+	}
+
+	err := w.seek(abs)
+	if err != nil {
+		return 0, err
+	}
+
+	return abs, nil
+
+}
+
+// Close implements io.Closer. It makes sure the file is long enough to hold
+// the last block, even if the end of that block was never written to.
+func (w *Writer) Close() error {
+
+	if w.written >= w.end {
+		return nil
+	}
+
+	return w.writeAt(w.end-1, []byte{0})
+
+}
+
+// NewWriter returns a Writer to which a RAW image can be copied in order to
+// create a VHDX format disk image. The HolePredictor 'h' must accurately
+// return the true and final RAW size of the image, and predict which regions
+// of it will be empty.
+func NewWriter(w io.WriteSeeker, h HolePredictor) (*Writer, error) {
+
+	x := &Writer{
+		w: w,
+		h: h,
+	}
+
+	err := x.init()
+	if err != nil {
+		return nil, err
+	}
+
+	return x, nil
+
+}
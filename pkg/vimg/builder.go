@@ -10,6 +10,7 @@ import (
 	"errors"
 	"io"
 	"math/rand"
+	"time"
 
 	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/vcfg"
@@ -40,6 +41,7 @@ type KernelOptions struct {
 // BuilderArgs collects all of the arguments needed to call NewBuilder into one place.
 type BuilderArgs struct {
 	Seed       int64
+	Timestamp  time.Time
 	Kernel     KernelOptions
 	FSCompiler FSCompiler
 	VCFG       *vcfg.VCFG
@@ -54,6 +56,7 @@ type Builder struct {
 	// The following variables need to be calculated in the NewBuilder step.
 	log           elog.View
 	rng           io.Reader
+	timestamp     time.Time
 	minSize       int64
 	fs            FSCompiler
 	kernelOptions KernelOptions
@@ -96,6 +99,10 @@ func NewBuilder(ctx context.Context, args *BuilderArgs) (*Builder, error) {
 
 	b := new(Builder)
 	b.rng = rand.New(rand.NewSource(args.Seed))
+	b.timestamp = args.Timestamp
+	if b.timestamp.IsZero() {
+		b.timestamp = time.Now()
+	}
 	b.fs = args.FSCompiler
 	b.vcfg = args.VCFG
 	b.kernelOptions = args.Kernel
@@ -164,6 +171,14 @@ func (b *Builder) Close() error {
 		}
 	}
 
+	// some file-system compilers hold onto temporary files
+	if closer, ok := b.fs.(io.Closer); ok {
+		err := closer.Close()
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 
 }
@@ -246,6 +261,21 @@ func (b *Builder) Size() int64 {
 	return b.size
 }
 
+// DiskUID returns the GUID of the disk as it appears in the GPT header. It is
+// derived from the Seed in BuilderArgs, and is only available after a
+// successful call to Prebuild. Virtual disk image formats that need an ID of
+// their own should derive it from this so that builds can be reproduced.
+func (b *Builder) DiskUID() []byte {
+	return b.diskUID
+}
+
+// Timestamp returns the time the image should be considered to have been
+// created, which is the Timestamp in BuilderArgs or the time the Builder was
+// created if that wasn't set.
+func (b *Builder) Timestamp() time.Time {
+	return b.timestamp
+}
+
 func (b *Builder) isGPTHole(first, last int64) bool {
 
 	if last < P0FirstLBA && first >= PrimaryGPTEntriesLBA+1 {
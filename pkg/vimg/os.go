@@ -17,6 +17,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/vcfg"
 
 	"github.com/mattn/go-shellwords"
@@ -226,6 +227,23 @@ func (b *Builder) validateConfig() error {
 
 	}
 
+	if overlay := b.vcfg.System.Overlay; overlay != 0 {
+
+		if overlay.IsDelta() {
+			return fmt.Errorf("invalid system.overlay: %s (should be an absolute size)", overlay)
+		}
+
+		if b.vcfg.System.Filesystem != vcfg.SquashFS {
+			return fmt.Errorf("system.overlay is only supported with system.filesystem '%s'", vcfg.SquashFS)
+		}
+
+		// the overlay is a tmpfs, so it can only ever be filled out of memory
+		if ram := b.vcfg.VM.RAM; ram != 0 && !ram.IsDelta() && overlay >= ram {
+			return fmt.Errorf("system.overlay (%s) must be smaller than vm.ram (%s)", overlay, ram)
+		}
+
+	}
+
 	return nil
 
 }
@@ -252,6 +270,55 @@ func (b *Builder) generateConfig() error {
 	return nil
 }
 
+// KernelConfig is everything a Builder derives from a VCFG and writes into the
+// os partition: the config data itself, the Linux arguments stored with the
+// bootloader config, and the kernel bundle tags the VCFG depends on.
+type KernelConfig struct {
+	Data       []byte
+	LinuxArgs  string
+	KernelTags []string
+}
+
+// KernelTags returns the kernel bundle tags a Builder would select for cfg.
+// The shell tag is not included, because it is not part of the VCFG.
+func KernelTags(cfg *vcfg.VCFG) []string {
+	b := &Builder{vcfg: cfg}
+	b.determineKernelTags()
+	return b.kernelTags
+}
+
+// GenerateKernelConfig applies the same defaults and validation rules to cfg
+// as a Builder would, and returns the resulting KernelConfig. It makes it
+// possible to replace the config of an existing image without rebuilding it.
+func GenerateKernelConfig(cfg *vcfg.VCFG, logger elog.View) (*KernelConfig, error) {
+
+	b := &Builder{
+		log:        logger,
+		vcfg:       cfg,
+		defaultMTU: 1500,
+	}
+
+	err := b.generateConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	b.linuxArgs = b.vcfg.System.KernelArgs
+	b.determineKernelTags()
+
+	err = b.processLinuxArgs()
+	if err != nil {
+		return nil, err
+	}
+
+	return &KernelConfig{
+		Data:       b.configData,
+		LinuxArgs:  b.linuxArgs,
+		KernelTags: b.kernelTags,
+	}, nil
+
+}
+
 // BootloaderConfig is the structure of the bootloader config as it appears on the disk.
 type BootloaderConfig struct {
 	Version        [16]byte     // 0
@@ -478,20 +545,28 @@ func (b *Builder) processLinuxArgs() error {
 		m[strings.SplitN(s, "=", 2)[0]] = i
 	}
 
-	_, ok1 := m["ro"]
-	_, ok2 := m["rw"]
-	if !ok1 && !ok2 {
-		args = append(args, "ro")
-	}
-
 	// if the fs is not set here we assume it is ext2
 	fs := b.vcfg.System.Filesystem
 	if fs == "" || fs == "ext" {
 		fs = "ext2"
 	}
 
+	_, ok1 := m["ro"]
+	_, ok2 := m["rw"]
+	if !ok1 && !ok2 {
+		args = append(args, "ro")
+	} else if ok2 && fs == vcfg.SquashFS {
+		return errors.New("system.kernel-args cannot mount a squashfs root file-system 'rw' (use system.overlay for a writable root)")
+	}
+
 	args = append(args, fmt.Sprintf("rootfstype=%s", fs))
 
+	if overlay := b.vcfg.System.Overlay; fs == vcfg.SquashFS && overlay > 0 {
+		if _, ok := m["vorteil.overlay"]; !ok {
+			args = append(args, fmt.Sprintf("vorteil.overlay=%d", overlay))
+		}
+	}
+
 	if _, ok := m["loglevel"]; !ok {
 		args = append(args, "loglevel=4")
 	}
@@ -0,0 +1,58 @@
+package vimg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+func TestSystemOverlay(t *testing.T) {
+
+	newCfg := func(fs vcfg.Filesystem, overlay, ram string) *vcfg.VCFG {
+		cfg := &vcfg.VCFG{
+			Programs: []vcfg.Program{{Binary: "/app"}},
+		}
+		cfg.System.Filesystem = fs
+		cfg.System.Overlay, _ = vcfg.ParseBytes(overlay)
+		cfg.VM.RAM, _ = vcfg.ParseBytes(ram)
+		return cfg
+	}
+
+	kc, err := GenerateKernelConfig(newCfg(vcfg.SquashFS, "64 MiB", "256 MiB"), &elog.CLI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(kc.LinuxArgs, "rootfstype=squashfs vorteil.overlay=67108864") {
+		t.Fatalf("overlay missing from kernel args: %s", kc.LinuxArgs)
+	}
+
+	kc, err = GenerateKernelConfig(newCfg(vcfg.SquashFS, "0", "256 MiB"), &elog.CLI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(kc.LinuxArgs, "vorteil.overlay") {
+		t.Fatalf("unexpected overlay in kernel args: %s", kc.LinuxArgs)
+	}
+
+	for _, cfg := range []*vcfg.VCFG{
+		newCfg("", "64 MiB", "256 MiB"),
+		newCfg(vcfg.Filesystem("ext4"), "64 MiB", "256 MiB"),
+		newCfg(vcfg.SquashFS, "+64 MiB", "256 MiB"),
+		newCfg(vcfg.SquashFS, "256 MiB", "256 MiB"),
+	} {
+		_, err = GenerateKernelConfig(cfg, &elog.CLI{})
+		if err == nil {
+			t.Errorf("expected an error for overlay %s on '%s' with %s of ram", cfg.System.Overlay, cfg.System.Filesystem, cfg.VM.RAM)
+		}
+	}
+
+}
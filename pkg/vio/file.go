@@ -52,6 +52,71 @@ type File interface {
 	Symlink() string
 }
 
+// Metadata holds the POSIX attributes of a file that aren't covered by the
+// File interface. Files without Metadata are given the default permissions
+// and owner of whichever file-system they end up in.
+type Metadata struct {
+
+	// Mode holds the permission bits of the file, including the
+	// setuid, setgid and sticky bits (07777), but not its type.
+	Mode uint32
+
+	// UID and GID identify the owner of the file. A negative value
+	// means the file belongs to the file-system's default owner.
+	UID int
+	GID int
+
+	// Xattrs maps the full names of extended attributes (e.g.
+	// "user.mime_type") to their values.
+	Xattrs map[string][]byte `json:",omitempty"`
+}
+
+// MetadataFile is implemented by any File able to report its own Metadata.
+type MetadataFile interface {
+	File
+
+	// Metadata returns the file's POSIX attributes, or nil if it has
+	// none.
+	Metadata() *Metadata
+}
+
+// MetadataOf returns the Metadata of f if it implements MetadataFile, or nil
+// otherwise.
+func MetadataOf(f File) *Metadata {
+	if mf, ok := f.(MetadataFile); ok {
+		return mf.Metadata()
+	}
+	return nil
+}
+
+func posixMode(mode os.FileMode) uint32 {
+	x := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		x |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		x |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		x |= 01000
+	}
+	return x
+}
+
+func fileMode(mode uint32) os.FileMode {
+	x := os.FileMode(mode) & os.ModePerm
+	if mode&04000 != 0 {
+		x |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		x |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		x |= os.ModeSticky
+	}
+	return x
+}
+
 // Open mimics the os.Open function but returns an
 // implementation of File.
 func Open(path string) (File, error) {
@@ -71,16 +136,27 @@ func Open(path string) (File, error) {
 		rdr := strings.NewReader(lpath)
 		rc := ioutil.NopCloser(rdr)
 
+		md, err := readMetadata(path, fi)
+		if err != nil {
+			return nil, err
+		}
+
 		return CustomFile(CustomFileArgs{
 			Name:       fi.Name(),
 			Size:       len(lpath),
 			ModTime:    fi.ModTime(),
 			IsDir:      fi.IsDir(),
 			IsSymlink:  true,
+			Metadata:   md,
 			ReadCloser: rc,
 		}), nil
 	}
 
+	md, err := readMetadata(path, fi)
+	if err != nil {
+		return nil, err
+	}
+
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -92,6 +168,7 @@ func Open(path string) (File, error) {
 		ModTime:    fi.ModTime(),
 		IsDir:      fi.IsDir(),
 		IsSymlink:  false,
+		Metadata:   md,
 		ReadCloser: f,
 	}), nil
 }
@@ -106,6 +183,7 @@ type CustomFileArgs struct {
 	IsSymlink          bool
 	IsSymlinkNotCached bool
 	Symlink            string
+	Metadata           *Metadata
 	ReadCloser         io.ReadCloser
 }
 
@@ -121,6 +199,7 @@ func CustomFile(args CustomFileArgs) File {
 		isSymlink:       args.IsSymlink,
 		isSymlinkCached: !args.IsSymlinkNotCached,
 		symlink:         args.Symlink,
+		metadata:        args.Metadata,
 		rc:              args.ReadCloser,
 	}
 }
@@ -133,6 +212,7 @@ type customFile struct {
 	isSymlink       bool
 	isSymlinkCached bool
 	symlink         string
+	metadata        *Metadata
 	rc              io.ReadCloser
 }
 
@@ -164,6 +244,10 @@ func (f *customFile) Symlink() string {
 	return f.symlink
 }
 
+func (f *customFile) Metadata() *Metadata {
+	return f.metadata
+}
+
 func (f *customFile) Read(p []byte) (n int, err error) {
 	return f.rc.Read(p)
 }
@@ -212,6 +296,9 @@ func (fi *finfo) Sys() interface{} {
 // implementation of File.
 func Info(f File) os.FileInfo {
 	mode := os.ModePerm
+	if md := MetadataOf(f); md != nil {
+		mode = fileMode(md.Mode)
+	}
 	if f.IsDir() {
 		mode |= os.ModeDir
 	}
@@ -328,6 +415,11 @@ func LazyOpen(path string) (File, error) {
 		fsize = len(p)
 	}
 
+	md, err := readMetadata(path, fi)
+	if err != nil {
+		return nil, err
+	}
+
 	return CustomFile(CustomFileArgs{
 		Name:               fi.Name(),
 		Size:               fsize,
@@ -336,6 +428,7 @@ func LazyOpen(path string) (File, error) {
 		IsSymlink:          islink,
 		IsSymlinkNotCached: false,
 		Symlink:            lpath,
+		Metadata:           md,
 		ReadCloser:         LazyReadCloser(openFunc, closeFunc),
 	}), nil
 }
@@ -0,0 +1,113 @@
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// hostXattrCapabilities is the only extended attribute outside the "user."
+// namespace read from the host. Others, like "security.selinux", describe
+// the host's policies rather than the file and would be meaningless in an
+// image.
+const hostXattrCapabilities = "security.capability"
+
+// keepHostXattr returns true if the extended attribute name should be
+// carried from a host file into a FileTree.
+func keepHostXattr(name string) bool {
+	return strings.HasPrefix(name, "user.") || name == hostXattrCapabilities
+}
+
+// readMetadata returns the Metadata of the file at path as it exists on the
+// host. Files owned by the user running this process are treated as belonging
+// to the default owner, so that building from a local directory doesn't carry
+// the builder's own account into an image.
+func readMetadata(path string, fi os.FileInfo) (*Metadata, error) {
+
+	md := &Metadata{
+		Mode: posixMode(fi.Mode()),
+		UID:  -1,
+		GID:  -1,
+	}
+
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if int(stat.Uid) != os.Getuid() {
+			md.UID = int(stat.Uid)
+		}
+		if int(stat.Gid) != os.Getgid() {
+			md.GID = int(stat.Gid)
+		}
+	}
+
+	// the syscall package has no way to read the extended attributes of
+	// a symlink itself, and Linux only allows trusted or security
+	// attributes on them anyway.
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return md, nil
+	}
+
+	xattrs, err := readXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+	md.Xattrs = xattrs
+
+	return md, nil
+
+}
+
+func readXattrs(path string) (map[string][]byte, error) {
+
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil {
+		if err == syscall.ENOTSUP {
+			return nil, nil
+		}
+		return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+	}
+
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+
+		if len(name) == 0 || !keepHostXattr(string(name)) {
+			continue
+		}
+
+		n, err := syscall.Getxattr(path, string(name), nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+
+		val := make([]byte, n)
+		n, err = syscall.Getxattr(path, string(name), val)
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+
+		xattrs[string(name)] = val[:n]
+
+	}
+
+	if len(xattrs) == 0 {
+		return nil, nil
+	}
+
+	return xattrs, nil
+
+}
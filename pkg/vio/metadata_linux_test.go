@@ -0,0 +1,61 @@
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestKeepHostXattr(t *testing.T) {
+
+	for name, keep := range map[string]bool{
+		"user.mime_type":          true,
+		"security.capability":     true,
+		"security.selinux":        false,
+		"security.ima":            false,
+		"trusted.overlay.opaque":  false,
+		"system.posix_acl_access": false,
+	} {
+		if keepHostXattr(name) != keep {
+			t.Errorf("keepHostXattr(%s) should return %v", name, keep)
+		}
+	}
+
+}
+
+func TestReadXattrs(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "vtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	err = syscall.Setxattr(f.Name(), "user.mime_type", []byte("text/plain"), 0)
+	if err != nil {
+		t.Skipf("temporary directory doesn't support user xattrs: %v", err)
+	}
+
+	xattrs, err := readXattrs(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name := range xattrs {
+		if !keepHostXattr(name) {
+			t.Errorf("readXattrs read host attribute %s", name)
+		}
+	}
+
+	if string(xattrs["user.mime_type"]) != "text/plain" {
+		t.Errorf("readXattrs lost user.mime_type: %v", xattrs)
+	}
+
+}
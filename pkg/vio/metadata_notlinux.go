@@ -0,0 +1,30 @@
+// +build !linux
+
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"os"
+	"runtime"
+)
+
+// readMetadata returns the Metadata of the file at path as it exists on the
+// host. Ownership and extended attributes are only read on Linux, and Windows
+// has no meaningful permission bits, so files from there get the defaults.
+func readMetadata(path string, fi os.FileInfo) (*Metadata, error) {
+
+	if runtime.GOOS == "windows" {
+		return nil, nil
+	}
+
+	return &Metadata{
+		Mode: posixMode(fi.Mode()),
+		UID:  -1,
+		GID:  -1,
+	}, nil
+
+}
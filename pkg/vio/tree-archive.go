@@ -213,6 +213,7 @@ func (a *archiveLoader) reconstructArchiveNode(parent *TreeNode, x map[string]in
 		IsSymlink:          fi.IsSymlink,
 		IsSymlinkNotCached: fi.Symlink == "",
 		Symlink:            fi.Symlink,
+		Metadata:           fi.Metadata,
 		ReadCloser:         rc,
 	})
 
@@ -137,6 +137,7 @@ type fi struct {
 	IsSymlink bool
 	Symlink   string
 	ModTime   time.Time
+	Metadata  *Metadata `json:",omitempty"`
 }
 
 // MarshalJSON implements json.Marshaler.
@@ -158,6 +159,7 @@ func (n *TreeNode) MarshalJSON() ([]byte, error) {
 		IsDir:     n.File.IsDir(),
 		IsSymlink: n.File.IsSymlink(),
 		ModTime:   time.Time{},
+		Metadata:  MetadataOf(n.File),
 	}
 
 	if n.File.IsSymlink() && n.File.SymlinkIsCached() {
@@ -562,6 +564,7 @@ func (t *tree) Map(path string, f File) error {
 		IsSymlinkNotCached: !f.SymlinkIsCached(),
 		Symlink:            f.Symlink(),
 		ModTime:            f.ModTime(),
+		Metadata:           MetadataOf(f),
 		ReadCloser:         f,
 	})
 
@@ -585,6 +588,7 @@ func (t *tree) MapSubTree(path string, sub FileTree) error {
 		IsSymlinkNotCached: !f.SymlinkIsCached(),
 		Symlink:            f.Symlink(),
 		ModTime:            f.ModTime(),
+		Metadata:           MetadataOf(f),
 		ReadCloser:         f,
 	})
 
@@ -618,6 +622,27 @@ func (t *tree) Walk(fn WalkFunc) error {
 	return t.root.walk(fn)
 }
 
+// XattrPaths returns the paths of every file in tree that carries extended
+// attributes, so that compilers for file-systems unable to store them can
+// report what is being lost.
+func XattrPaths(tree FileTree) ([]string, error) {
+
+	var paths []string
+
+	err := tree.Walk(func(path string, f File) error {
+		if md := MetadataOf(f); md != nil && len(md.Xattrs) > 0 {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return paths, nil
+
+}
+
 func (t *tree) SubTree(path string) (FileTree, error) {
 
 	path = unixpath.Clean(path)
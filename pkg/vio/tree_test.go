@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -105,6 +106,130 @@ func TestFileTreeArchive(t *testing.T) {
 
 }
 
+func TestFileTreeArchiveMetadata(t *testing.T) {
+
+	tree := NewFileTree()
+
+	md := &Metadata{
+		Mode: 04750,
+		UID:  0,
+		GID:  -1,
+		Xattrs: map[string][]byte{
+			"user.mime_type": []byte("text/plain"),
+		},
+	}
+
+	err := tree.Map("A", CustomFile(CustomFileArgs{
+		Name:       "A",
+		Size:       1,
+		Metadata:   md,
+		ReadCloser: ioutil.NopCloser(strings.NewReader("A")),
+	}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = tree.Map("B", CustomFile(CustomFileArgs{
+		Name:       "B",
+		Size:       1,
+		ReadCloser: ioutil.NopCloser(strings.NewReader("B")),
+	}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	err = tree.Archive(buf, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tree, err = LoadArchive(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	err = tree.Walk(func(path string, f File) error {
+
+		got := MetadataOf(f)
+
+		switch path {
+		case "./A":
+			if got == nil {
+				return fmt.Errorf("metadata of %s lost", path)
+			}
+			if got.Mode != md.Mode || got.UID != md.UID || got.GID != md.GID {
+				return fmt.Errorf("bad metadata of %s: expected %+v, but got %+v", path, md, got)
+			}
+			if string(got.Xattrs["user.mime_type"]) != "text/plain" {
+				return fmt.Errorf("bad xattrs of %s: %v", path, got.Xattrs)
+			}
+			if Info(f).Mode() != os.ModeSetuid|0750 {
+				return fmt.Errorf("bad file info mode of %s: %v", path, Info(f).Mode())
+			}
+		case "./B":
+			if got != nil {
+				return fmt.Errorf("unexpected metadata of %s: %+v", path, got)
+			}
+		}
+
+		_, err := io.Copy(ioutil.Discard, f)
+		if err != nil {
+			return err
+		}
+
+		return f.Close()
+
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+}
+
+func TestXattrPaths(t *testing.T) {
+
+	tree := NewFileTree()
+	defer tree.Close()
+
+	for _, name := range []string{"A", "B"} {
+		args := CustomFileArgs{
+			Name:       name,
+			Size:       1,
+			ReadCloser: ioutil.NopCloser(strings.NewReader(name)),
+		}
+		if name == "A" {
+			args.Metadata = &Metadata{
+				Xattrs: map[string][]byte{
+					"security.capability": []byte("cap"),
+				},
+			}
+		}
+		err := tree.Map(name, CustomFile(args))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	paths, err := XattrPaths(tree)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(paths) != 1 || paths[0] != "./A" {
+		t.Errorf("expected only ./A to carry xattrs, but got %v", paths)
+	}
+
+}
+
 func TestFileTreeCloseOrder(t *testing.T) {
 
 	var err error
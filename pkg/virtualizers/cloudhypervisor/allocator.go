@@ -0,0 +1,105 @@
+package cloudhypervisor
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+)
+
+// VirtualizerID is a unique identifier for Cloud Hypervisor
+var VirtualizerID = "cloud-hypervisor"
+
+type allocator struct{}
+
+// Config to run the virtualizer. Vms boot directly into the vmlinux of the
+// kernel their disk was built with, the same one firecracker boots, unless
+// another vmlinux or firmware such as rust-hypervisor-firmware, which boots
+// the disk the same way a BIOS would, is configured. Each network interface
+// of a vm is given a tap device attached to the vorteil-bridge, which
+// requires root.
+type Config struct {
+	Kernel   string `json:"kernel,omitempty"`   // path of a vmlinux to boot directly in place of the vm's kernel
+	Firmware string `json:"firmware,omitempty"` // path of firmware to boot the disk with
+}
+
+// Validate checks that the config doesn't boot vms two ways at once.
+func (c *Config) Validate() error {
+	if c.Kernel != "" && c.Firmware != "" {
+		return errors.New("kernel and firmware can't both be configured")
+	}
+	return nil
+}
+
+// Marshal the config into a byte[]
+func (c *Config) Marshal() []byte {
+	data, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// Unmarshal the byte[] array into a config struct
+func (c *Config) Unmarshal(data []byte) error {
+	err := json.Unmarshal(data, c)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Allocator for Cloud Hypervisor
+var Allocator virtualizers.VirtualizerAllocator = &allocator{}
+
+// Alloc returns a new virtualizer
+func (a *allocator) Alloc() virtualizers.Virtualizer {
+	return new(Virtualizer)
+}
+
+// DiskAlignment returns the alignment Cloud Hypervisor requires to run properly
+func (a *allocator) DiskAlignment() vcfg.Bytes {
+	return 2 * vcfg.MiB
+}
+
+// DiskFormat return the format the hypervisor should be using
+func (a *allocator) DiskFormat() vdisk.Format {
+	return vdisk.RAWFormat
+}
+
+// IsAvailable returns true if the hypervisor is installed
+func (a *allocator) IsAvailable() bool {
+	installed, _ := virtualizers.Backends()
+	for _, platform := range installed {
+		if platform == VirtualizerID {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateArgs check if valid args are passed to create a valid Virtualizer
+func (a *allocator) ValidateArgs(data []byte) error {
+	c := new(Config)
+	err := c.Unmarshal(data)
+	if err != nil {
+		return err
+	}
+	return c.Validate()
+}
+
+// Create creates a virtualizer using the provided manager
+func Create(mgr *virtualizers.Manager, name string, c *Config) error {
+	err := mgr.CreateVirtualizer(name, VirtualizerID, c.Marshal())
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package cloudhypervisor
+
+import (
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+)
+
+func TestRegister(t *testing.T) {
+	virtualizers.Register(VirtualizerID, Allocator)
+	alloc := virtualizers.RegisteredVirtualizers()
+	if alloc[VirtualizerID] == nil {
+		t.Errorf("registering virtualizer failed, as map lookup returned nil")
+	}
+}
+
+func TestMarshalAndUnmarshal(t *testing.T) {
+	c := &Config{
+		Kernel: "/opt/vorteil/vmlinux",
+	}
+	config := new(Config)
+	err := config.Unmarshal(c.Marshal())
+	if err != nil {
+		t.Errorf("unmarshal failed, recevied error \"%v\"", err)
+	}
+	if config.Kernel != c.Kernel {
+		t.Errorf("marshal on umarshal failed, expected %s but got %s", c.Kernel, config.Kernel)
+	}
+}
+
+func TestValidateArgs(t *testing.T) {
+	tests := []struct {
+		name  string
+		c     *Config
+		valid bool
+	}{
+		{"kernel", &Config{Kernel: "/opt/vorteil/vmlinux"}, true},
+		{"firmware", &Config{Firmware: "/opt/vorteil/hypervisor-fw"}, true},
+		{"neither", &Config{}, true},
+		{"both", &Config{Kernel: "/opt/vorteil/vmlinux", Firmware: "/opt/vorteil/hypervisor-fw"}, false},
+	}
+
+	for _, tt := range tests {
+		err := Allocator.ValidateArgs(tt.c.Marshal())
+		if tt.valid && err != nil {
+			t.Errorf("%s: expected config to be valid but got err: %v", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: expected config to be invalid", tt.name)
+		}
+	}
+}
+
+func TestAlloc(t *testing.T) {
+	virt := Allocator.Alloc()
+	if virt == nil {
+		t.Errorf("attempting to alloc virtualizer ended up in getting nil object")
+	}
+}
+
+func TestDiskAlignment(t *testing.T) {
+	size := 2 * vcfg.MiB
+	align := Allocator.DiskAlignment()
+
+	if align != size {
+		t.Errorf("disk alignment does not match expected %v but got %v", size, align)
+	}
+}
+
+func TestDiskFormat(t *testing.T) {
+	format := Allocator.DiskFormat()
+	exactFormat := vdisk.RAWFormat
+	if format != exactFormat {
+		t.Errorf("disk format does not match %v got %v instead", exactFormat, format)
+	}
+}
@@ -0,0 +1,169 @@
+// +build linux
+
+package cloudhypervisor
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/milosgajdos/tenus"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+	"github.com/vorteil/vorteil/pkg/virtualizers/iputil"
+)
+
+const vorteilBridge = "vorteil-bridge"
+
+// bridgeDevices creates a tap device attached to the vorteil-bridge for each
+// of the vm's network interfaces.
+func (o *operation) bridgeDevices() error {
+
+	if len(o.config.Networks) == 0 {
+		return nil
+	}
+
+	bridge, err := tenus.BridgeFromName(vorteilBridge)
+	if err != nil {
+		return err
+	}
+
+	for i := range o.config.Networks {
+		ifceName := fmt.Sprintf("ch%s%v", o.id, i)
+
+		err = iputil.CreateTap(ifceName)
+		if err != nil {
+			return err
+		}
+		o.tapDevicesName = append(o.tapDevicesName, ifceName)
+
+		ifc, err := net.InterfaceByName(ifceName)
+		if err != nil {
+			return err
+		}
+
+		err = bridge.AddSlaveIfc(ifc)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// releaseDevices deletes the tap devices created for the vm.
+func (v *Virtualizer) releaseDevices() error {
+
+	for _, ifname := range v.tapDevicesName {
+		err := tenus.DeleteLink(ifname)
+		if err != nil {
+			return err
+		}
+	}
+	v.tapDevicesName = nil
+
+	return nil
+
+}
+
+// forwardPorts binds a port on the host for each of the vm's tcp, http and
+// https ports and forwards connections to it, so its routes are reachable on
+// localhost the same way they are for QEMU's user networking. Udp isn't
+// forwarded, so its routes point to the vm's address on the vorteil-bridge.
+func (o *operation) forwardPorts() error {
+
+	for i, route := range o.routes {
+		ip := o.config.Networks[i].IP
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("network interface %d needs a static address on the vorteil-bridge, not '%s'", i, ip)
+		}
+
+		for j, port := range route.HTTP {
+			addr, err := o.forward(ip, port.Port)
+			if err != nil {
+				return err
+			}
+			o.routes[i].HTTP[j].Address = addr
+		}
+		for j, port := range route.HTTPS {
+			addr, err := o.forward(ip, port.Port)
+			if err != nil {
+				return err
+			}
+			o.routes[i].HTTPS[j].Address = addr
+		}
+		for j, port := range route.TCP {
+			addr, err := o.forward(ip, port.Port)
+			if err != nil {
+				return err
+			}
+			o.routes[i].TCP[j].Address = addr
+		}
+		for j, port := range route.UDP {
+			o.routes[i].UDP[j].Address = net.JoinHostPort(ip, port.Port)
+		}
+	}
+
+	return nil
+
+}
+
+// forward binds port on the host, or a random port if it is taken, and
+// forwards connections to it to the same port at ip.
+func (v *Virtualizer) forward(ip, port string) (string, error) {
+
+	bind, addr, err := virtualizers.BindPort("nat", "tcp", port)
+	if err != nil {
+		return "", err
+	}
+
+	l, err := net.Listen("tcp4", fmt.Sprintf(":%s", bind))
+	if err != nil {
+		return "", err
+	}
+	v.listeners = append(v.listeners, l)
+
+	go proxy(l, net.JoinHostPort(ip, port))
+
+	return addr, nil
+
+}
+
+// proxy copies connections accepted by l to and from addr until l is closed.
+func proxy(l net.Listener, addr string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			upstream, err := net.Dial("tcp", addr)
+			if err != nil {
+				return
+			}
+			defer upstream.Close()
+
+			go func() {
+				io.Copy(upstream, conn)
+				upstream.(*net.TCPConn).CloseWrite()
+			}()
+			io.Copy(conn, upstream)
+		}()
+	}
+}
+
+// closeListeners stops forwarding the vm's ports.
+func (v *Virtualizer) closeListeners() {
+	for _, l := range v.listeners {
+		l.Close()
+	}
+	v.listeners = nil
+}
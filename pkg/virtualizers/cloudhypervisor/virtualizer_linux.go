@@ -0,0 +1,531 @@
+// +build linux
+
+package cloudhypervisor
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vimg"
+	"github.com/vorteil/vorteil/pkg/vio"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+	"github.com/vorteil/vorteil/pkg/virtualizers/firecracker"
+	logger "github.com/vorteil/vorteil/pkg/virtualizers/logging"
+	"github.com/vorteil/vorteil/pkg/virtualizers/util"
+)
+
+// kernelArgs are passed to a vmlinux booted directly, formatted with the
+// PARTUUID of the root partition.
+const kernelArgs = "init=/vorteil/vinitd console=ttyS0 loglevel=2 reboot=k panic=1 i8042.noaux i8042.nomux i8042.nopnp i8042.dumbkbd vt.color=0x00 root=PARTUUID=%s"
+
+// Virtualizer is a struct which will implement the interface so the manager can control it
+type Virtualizer struct {
+	// VM related stuff
+	id    string // random hash for tap device names
+	name  string // name of vm
+	pname string // name of virtualizer
+	state string // status of vm
+
+	created      time.Time      // time the vm was created
+	folder       string         // folder to store vm details
+	diskpath     string         // path to the disk of the machine
+	source       interface{}    // details about how the vm was made
+	logger       elog.View      // logger
+	serialLogger *logger.Logger // logs for the serial of the vm
+
+	routes []virtualizers.NetworkInterface // api network interface that displays ports
+	config *vcfg.VCFG                      // config for the vm
+
+	// Cloud Hypervisor specific
+	vconfig        *Config        // how the virtualizer boots its vms
+	kernel         string         // vmlinux the vm boots, unless it boots firmware
+	command        *exec.Cmd      // cloud-hypervisor process running the vm
+	exited         chan struct{}  // closed when the process exits
+	tapDevicesName []string       // tap devices created that are slaves to vorteil-bridge
+	listeners      []net.Listener // host ports forwarded to the vm
+
+	vmdrive string // store disks in this directory
+}
+
+// Type returns the type of virtualizer
+func (v *Virtualizer) Type() string {
+	return VirtualizerID
+}
+
+// Initialize passes the arguments from creation to create a virtualizer
+func (v *Virtualizer) Initialize(data []byte) error {
+	c := new(Config)
+	err := c.Unmarshal(data)
+	if err != nil {
+		return err
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return err
+	}
+
+	v.vconfig = c
+	return nil
+}
+
+// operation is the job progress that gets tracked via APIs
+type operation struct {
+	finishedLock sync.Mutex
+	isFinished   bool
+	*Virtualizer
+	Logs   chan string
+	Status chan string
+	Error  chan error
+	ctx    context.Context
+}
+
+// log writes a log to the channel for the job
+func (o *operation) log(text string, v ...interface{}) {
+	o.Logs <- fmt.Sprintf(text, v...)
+}
+
+// finished completes the operation and lets the user know and cleans up channels
+func (o *operation) finished(err error) {
+	o.finishedLock.Lock()
+	defer o.finishedLock.Unlock()
+	if o.isFinished {
+		return
+	}
+	o.isFinished = true
+
+	if err != nil {
+		o.Logs <- fmt.Sprintf("Error: %v", err)
+		o.Status <- fmt.Sprintf("Failed: %v", err)
+		o.Error <- err
+	}
+
+	close(o.Logs)
+	close(o.Status)
+	close(o.Error)
+}
+
+// updateStatus updates the status of the job to provide more feedback to the user currently reading the job.
+func (o *operation) updateStatus(text string) {
+	o.Status <- text
+	o.Logs <- text
+}
+
+// Serial returns the serial logger which contains the serial output of the app.
+func (v *Virtualizer) Serial() *logger.Logger {
+	return v.serialLogger
+}
+
+// State returns the state of the virtual machine
+func (v *Virtualizer) State() string {
+	return v.state
+}
+
+// Details returns data to for the ConverToVM function on util
+func (v *Virtualizer) Details() (string, string, string, []virtualizers.NetworkInterface, time.Time, *vcfg.VCFG, interface{}) {
+	return v.name, v.pname, v.state, v.routes, v.created, v.config, v.source
+}
+
+// Download returns the disk
+func (v *Virtualizer) Download() (vio.File, error) {
+	v.logger.Debugf("Downloading Disk")
+
+	if !(v.state == virtualizers.Ready) {
+		return nil, fmt.Errorf("the machine must be in a stopped or ready state")
+	}
+
+	f, err := vio.LazyOpen(v.diskpath)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// socketPath is the path of the vm's API socket.
+func (v *Virtualizer) socketPath() string {
+	return filepath.Join(v.folder, "api.sock")
+}
+
+// mac returns the address of the vm's i'th network interface. Vms share the
+// vorteil-bridge, so addresses are derived from the vm's id to keep them
+// apart.
+func (v *Virtualizer) mac(i int) string {
+	h := fnv.New32a()
+	h.Write([]byte(v.id))
+	sum := h.Sum(nil)
+	return fmt.Sprintf("26:%02x:%02x:%02x:%02x:%02x", sum[0], sum[1], sum[2], sum[3], i)
+}
+
+// args returns the arguments cloud-hypervisor is started with. Serial output
+// goes to the process' stdout, where it is captured by the serial logger.
+func (v *Virtualizer) args() []string {
+
+	cpus := v.config.VM.CPUs
+	if cpus == 0 {
+		cpus = 1
+	}
+
+	args := []string{
+		"--api-socket", v.socketPath(),
+		"--cpus", fmt.Sprintf("boot=%d", cpus),
+		"--memory", fmt.Sprintf("size=%dM", v.config.VM.RAM.Units(vcfg.MiB)),
+	}
+
+	// firmware is loaded in place of a kernel, and boots from the disk
+	if v.vconfig.Firmware != "" {
+		args = append(args, "--kernel", v.vconfig.Firmware)
+	} else {
+		args = append(args, "--kernel", v.kernel, "--cmdline", fmt.Sprintf(kernelArgs, vimg.Part2UUIDString))
+	}
+
+	args = append(args, "--disk", fmt.Sprintf("path=%s", v.diskpath))
+
+	if len(v.tapDevicesName) > 0 {
+		args = append(args, "--net")
+		for i, tap := range v.tapDevicesName {
+			args = append(args, fmt.Sprintf("tap=%s,mac=%s", tap, v.mac(i)))
+		}
+	}
+
+	return append(args, "--serial", "tty", "--console", "off")
+
+}
+
+// api sends a request without a body to the cloud-hypervisor API socket.
+func (v *Virtualizer) api(method, path string) error {
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", v.socketPath())
+			},
+		},
+		Timeout: time.Minute,
+	}
+
+	req, err := http.NewRequest(method, "http://localhost/api/v1"+path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("cloud-hypervisor %s %s: %s", method, path, bytes.TrimSpace(msg))
+	}
+
+	return nil
+
+}
+
+// Start creates the virtualmachine and runs it
+func (v *Virtualizer) Start() error {
+	v.logger.Debugf("Starting VM")
+	switch v.State() {
+	case virtualizers.Ready:
+		v.state = virtualizers.Changing
+
+		executable, err := virtualizers.GetExecutable(VirtualizerID)
+		if err != nil {
+			v.state = virtualizers.Ready
+			return err
+		}
+
+		// a socket left behind by a killed process stops a new one binding
+		err = os.Remove(v.socketPath())
+		if err != nil && !os.IsNotExist(err) {
+			v.state = virtualizers.Ready
+			return err
+		}
+
+		cmd := exec.Command(executable, v.args()...)
+		cmd.Stdout = v.serialLogger
+		cmd.Stderr = v.serialLogger
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Setpgid: true,
+		}
+
+		v.logger.Infof("Starting Cloud Hypervisor VM with Args: %s", strings.Join(cmd.Args, " "))
+
+		err = cmd.Start()
+		if err != nil {
+			v.state = virtualizers.Ready
+			return err
+		}
+
+		exited := make(chan struct{})
+		v.command = cmd
+		v.exited = exited
+		v.state = virtualizers.Alive
+
+		go func() {
+			defer close(exited)
+			err := cmd.Wait()
+			if err != nil && v.state != virtualizers.Deleted {
+				v.logger.Errorf("Error Wait Command: %s", err.Error())
+			}
+			if v.state != virtualizers.Deleted {
+				v.state = virtualizers.Ready
+			}
+		}()
+	}
+	return nil
+}
+
+// Stop presses the vm's power button, which shuts it down and changes it back
+// to ready once the process exits.
+func (v *Virtualizer) Stop() error {
+	v.logger.Debugf("Stopping VM")
+
+	switch v.state {
+	case virtualizers.Ready:
+		return errors.New("vm is already stopped")
+	case virtualizers.Paused:
+		// a paused vm can't respond to the power button
+		err := v.Resume()
+		if err != nil {
+			return err
+		}
+	}
+
+	v.state = virtualizers.Changing
+
+	return v.api(http.MethodPut, "/vm.power-button")
+}
+
+// Pause stops the vcpus of a running vm.
+func (v *Virtualizer) Pause() error {
+	v.logger.Debugf("Pausing VM")
+
+	if v.state != virtualizers.Alive {
+		return fmt.Errorf("vm not in a state to be paused currently in: %s", v.state)
+	}
+
+	err := v.api(http.MethodPut, "/vm.pause")
+	if err != nil {
+		return err
+	}
+
+	v.state = virtualizers.Paused
+
+	return nil
+}
+
+// Resume restarts the vcpus of a paused vm.
+func (v *Virtualizer) Resume() error {
+	v.logger.Debugf("Resuming VM")
+
+	if v.state != virtualizers.Paused {
+		return fmt.Errorf("vm not in a state to be resumed currently in: %s", v.state)
+	}
+
+	err := v.api(http.MethodPut, "/vm.resume")
+	if err != nil {
+		return err
+	}
+
+	v.state = virtualizers.Alive
+
+	return nil
+}
+
+// Close shuts down the virtual machine and cleans up the tap devices and
+// forwarded ports
+func (v *Virtualizer) Close(force bool) error {
+	v.logger.Debugf("Deleting VM")
+
+	if !force && v.state != virtualizers.Ready && v.command != nil {
+		err := v.Stop()
+		if err != nil {
+			return err
+		}
+
+		// give the vm a chance to shut down before it is killed
+		select {
+		case <-v.exited:
+		case <-time.After(time.Second * 10):
+			v.logger.Warnf("VM did not shut down in time, killing it")
+		}
+	}
+
+	v.state = virtualizers.Deleted
+
+	if v.command != nil && v.command.Process != nil {
+		v.logger.Debugf("Killing Process")
+		if err := v.command.Process.Kill(); err != nil && !strings.Contains(err.Error(), "process already finished") {
+			return err
+		}
+	}
+
+	v.closeListeners()
+
+	err := v.releaseDevices()
+	if err != nil {
+		return err
+	}
+
+	// remove virtualizer from active vms
+	virtualizers.ActiveVMs.Delete(v.name)
+
+	return nil
+}
+
+// Prepare prepares the virtualizer with the appropriate fields to run the virtual machine
+func (v *Virtualizer) Prepare(args *virtualizers.PrepareArgs) *virtualizers.VirtualizeOperation {
+
+	op := new(operation)
+	op.Virtualizer = v
+	v.name = args.Name
+	v.pname = args.PName
+	v.created = time.Now()
+	v.config = args.Config
+	v.source = args.Source
+	v.vmdrive = args.VMDrive
+	v.diskpath = args.ImagePath
+	v.logger = args.Logger
+	v.serialLogger = logger.NewLogger(2048 * 10)
+	v.logger.Debugf("Preparing VM")
+	v.routes = util.Routes(args.Config.Networks)
+	if v.vconfig == nil {
+		v.vconfig = new(Config)
+	}
+	op.Logs = make(chan string, 128)
+	op.Error = make(chan error, 1)
+	op.Status = make(chan string, 10)
+	op.ctx = args.Context
+
+	o := new(virtualizers.VirtualizeOperation)
+	o.Logs = op.Logs
+	o.Error = op.Error
+	o.Status = op.Status
+
+	go op.prepare(args)
+
+	return o
+}
+
+// fetchKernel finds the vmlinux the vm boots. Unless the virtualizer is
+// configured with one, it is the vmlinux of the kernel the vm's disk was built
+// with, shared with firecracker in dir.
+func (o *operation) fetchKernel(dir string) error {
+
+	switch {
+	case o.vconfig.Firmware != "":
+		return nil
+	case o.vconfig.Kernel != "":
+		o.kernel = o.vconfig.Kernel
+		return nil
+	}
+
+	if o.config.VM.Kernel == "" {
+		return errors.New("vm.kernel must be set to the kernel the disk was built with")
+	}
+
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	o.updateStatus(fmt.Sprintf("Fetching VMLinux for kernel %s...", o.config.VM.Kernel))
+
+	o.kernel, err = firecracker.FetchVMLinux(o.logger, dir, fmt.Sprintf("firecracker-%s", o.config.VM.Kernel))
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// prepare creates the vm's tap devices and forwards its ports
+func (o *operation) prepare(args *virtualizers.PrepareArgs) {
+	var returnErr error
+	defer func() {
+		o.finished(returnErr)
+	}()
+
+	// nothing is left behind for Close to clean up if the vm never made it
+	defer func() {
+		if returnErr != nil {
+			o.closeListeners()
+			err := o.releaseDevices()
+			if err != nil {
+				o.logger.Errorf("Error releasing tap devices: %v", err)
+			}
+		}
+	}()
+
+	o.updateStatus(fmt.Sprintf("Building cloud-hypervisor command and tap interfaces..."))
+
+	err := o.vconfig.Validate()
+	if err != nil {
+		returnErr = err
+		return
+	}
+
+	err = o.fetchKernel(args.FCPath)
+	if err != nil {
+		returnErr = err
+		return
+	}
+
+	o.state = "initializing"
+	o.folder = filepath.Dir(args.ImagePath)
+	s := strings.Split(filepath.Base(o.folder), "-")
+	o.id = s[len(s)-1]
+
+	err = o.bridgeDevices()
+	if err != nil {
+		returnErr = err
+		return
+	}
+
+	err = o.forwardPorts()
+	if err != nil {
+		returnErr = err
+		return
+	}
+
+	o.state = virtualizers.Ready
+
+	_, loaded := virtualizers.ActiveVMs.LoadOrStore(o.name, o.Virtualizer)
+	if loaded {
+		returnErr = errors.New("virtual machine already exists")
+		return
+	}
+
+	if args.Start {
+		err = o.Start()
+		if err != nil {
+			returnErr = err
+			return
+		}
+	}
+}
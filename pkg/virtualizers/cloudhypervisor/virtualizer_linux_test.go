@@ -0,0 +1,187 @@
+// +build linux
+
+package cloudhypervisor
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vimg"
+)
+
+func TestType(t *testing.T) {
+	v := &Virtualizer{}
+
+	typeSt := v.Type()
+	if typeSt != "cloud-hypervisor" {
+		t.Errorf("expected %s but got %s", "cloud-hypervisor", typeSt)
+	}
+}
+
+func TestInitialize(t *testing.T) {
+	v := &Virtualizer{}
+
+	err := v.Initialize((&Config{Kernel: "/opt/vorteil/vmlinux", Firmware: "/opt/vorteil/hypervisor-fw"}).Marshal())
+	if err == nil {
+		t.Errorf("initialize succeeded with both a kernel and firmware")
+	}
+
+	err = v.Initialize((&Config{Firmware: "/opt/vorteil/hypervisor-fw"}).Marshal())
+	if err != nil {
+		t.Errorf("initialize failed, expected to be successful but ended up with an error %v", err)
+	}
+}
+
+func TestArgs(t *testing.T) {
+	v := &Virtualizer{
+		id:     "0123456789",
+		folder: "/tmp/vorteil-0123456789",
+		config: &vcfg.VCFG{
+			VM: vcfg.VMSettings{
+				CPUs: 2,
+				RAM:  256 * vcfg.MiB,
+			},
+		},
+		vconfig:        &Config{},
+		kernel:         "/opt/vorteil/vmlinux",
+		diskpath:       "/tmp/vorteil-0123456789/disk.raw",
+		tapDevicesName: []string{"ch01234567890"},
+	}
+
+	exact := []string{
+		"--api-socket", "/tmp/vorteil-0123456789/api.sock",
+		"--cpus", "boot=2",
+		"--memory", "size=256M",
+		"--kernel", "/opt/vorteil/vmlinux",
+		"--cmdline", fmt.Sprintf(kernelArgs, vimg.Part2UUIDString),
+		"--disk", "path=/tmp/vorteil-0123456789/disk.raw",
+		"--net", fmt.Sprintf("tap=ch01234567890,mac=%s", v.mac(0)),
+		"--serial", "tty",
+		"--console", "off",
+	}
+
+	args := v.args()
+	if !reflect.DeepEqual(args, exact) {
+		t.Errorf("expected args %v but got %v", exact, args)
+	}
+
+	v.vconfig = &Config{Firmware: "/opt/vorteil/hypervisor-fw"}
+	args = v.args()
+	if args[6] != "--kernel" || args[7] != v.vconfig.Firmware || args[8] != "--disk" {
+		t.Errorf("expected firmware to be loaded without a cmdline but got %v", args)
+	}
+}
+
+func TestFetchKernel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the vmlinux of the vm's kernel is shared with firecracker
+	vmlinux := filepath.Join(dir, "firecracker-20.9.1")
+	err = ioutil.WriteFile(vmlinux, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := &operation{
+		Virtualizer: &Virtualizer{
+			logger:  &elog.CLI{},
+			config:  &vcfg.VCFG{VM: vcfg.VMSettings{Kernel: "20.9.1"}},
+			vconfig: &Config{},
+		},
+		Logs:   make(chan string, 8),
+		Status: make(chan string, 8),
+	}
+
+	err = o.fetchKernel(dir)
+	if err != nil {
+		t.Fatalf("unable to fetch kernel: %v", err)
+	}
+	if o.kernel != vmlinux {
+		t.Errorf("expected kernel %s but got %s", vmlinux, o.kernel)
+	}
+
+	o.vconfig = &Config{Kernel: "/opt/vorteil/vmlinux"}
+	err = o.fetchKernel(dir)
+	if err != nil || o.kernel != o.vconfig.Kernel {
+		t.Errorf("expected the configured kernel to be used but got %s (%v)", o.kernel, err)
+	}
+
+	o.kernel = ""
+	o.config.VM.Kernel = ""
+	o.vconfig = &Config{}
+	err = o.fetchKernel(dir)
+	if err == nil {
+		t.Errorf("expected fetching a kernel without vm.kernel to fail")
+	}
+}
+
+func TestMac(t *testing.T) {
+	a := &Virtualizer{id: "0123456789"}
+	b := &Virtualizer{id: "9876543210"}
+
+	if a.mac(0) == a.mac(1) || a.mac(0) == b.mac(0) {
+		t.Errorf("expected unique mac addresses but got %s, %s and %s", a.mac(0), a.mac(1), b.mac(0))
+	}
+
+	mac, err := net.ParseMAC(a.mac(0))
+	if err != nil {
+		t.Fatalf("invalid mac address %s: %v", a.mac(0), err)
+	}
+	if mac[0]&0x02 == 0 || mac[0]&0x01 != 0 {
+		t.Errorf("expected a locally administered unicast address but got %s", mac)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	upstream, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte("echo " + line))
+	}()
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go proxy(l, upstream.Addr().String())
+
+	conn, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "echo hello\n" {
+		t.Errorf("expected \"echo hello\" to be forwarded back but got \"%s\": %v", line, err)
+	}
+}
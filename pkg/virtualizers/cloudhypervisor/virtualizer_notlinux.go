@@ -0,0 +1,98 @@
+// +build windows darwin
+
+package cloudhypervisor
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+	logger "github.com/vorteil/vorteil/pkg/virtualizers/logging"
+)
+
+var errNotSupported = errors.New("cloud hypervisor is only available on linux")
+
+// Virtualizer is a struct which will implement the interface so the manager can control it
+type Virtualizer struct {
+	vconfig *Config
+}
+
+// Type returns the type of virtualizer
+func (v *Virtualizer) Type() string {
+	return VirtualizerID
+}
+
+// Initialize passes the arguments from creation to create a virtualizer
+func (v *Virtualizer) Initialize(data []byte) error {
+	c := new(Config)
+	err := c.Unmarshal(data)
+	if err != nil {
+		return err
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return err
+	}
+
+	v.vconfig = c
+	return nil
+}
+
+// Details returns data to for the ConverToVM function on util
+func (v *Virtualizer) Details() (string, string, string, []virtualizers.NetworkInterface, time.Time, *vcfg.VCFG, interface{}) {
+	return "", "", "", nil, time.Now(), nil, nil
+}
+
+// Serial returns the serial logger which contains the serial output of the application
+func (v *Virtualizer) Serial() *logger.Logger {
+	return nil
+}
+
+// State returns the state of the virtual machine
+func (v *Virtualizer) State() string {
+	return ""
+}
+
+// Download returns the disk
+func (v *Virtualizer) Download() (vio.File, error) {
+	return nil, errNotSupported
+}
+
+// Start create the virtualmachine and runs it
+func (v *Virtualizer) Start() error {
+	return errNotSupported
+}
+
+// Stop stops the vm and changes it back to ready
+func (v *Virtualizer) Stop() error {
+	return errNotSupported
+}
+
+// Close shuts down the virtual machine and cleans up the disk and folders
+func (v *Virtualizer) Close(force bool) error {
+	return nil
+}
+
+// Prepare prepares the virtualizer with the appropriate fields to run the virtualizer
+func (v *Virtualizer) Prepare(args *virtualizers.PrepareArgs) *virtualizers.VirtualizeOperation {
+	logs := make(chan string)
+	status := make(chan string)
+	errs := make(chan error, 1)
+	errs <- errNotSupported
+	close(logs)
+	close(status)
+	close(errs)
+	return &virtualizers.VirtualizeOperation{
+		Logs:   logs,
+		Status: status,
+		Error:  errs,
+	}
+}
@@ -7,6 +7,10 @@ package firecracker
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
 
 	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vdisk"
@@ -18,8 +22,85 @@ var VirtualizerID = "firecracker"
 
 type allocator struct{}
 
-// Config to run the virtualizer
-type Config struct{}
+// Config to run the virtualizer. By default each network interface of a vm
+// is given a tap device attached to the vorteil-bridge, which requires root.
+// Setting TapDevices or CNI avoids touching the host's networking.
+type Config struct {
+	TapDevices []string      `json:"tapDevices,omitempty"` // pool of pre-created tap devices, one for each network interface of every running vm
+	CNI        *CNIConfig    `json:"cni,omitempty"`        // create network interfaces with CNI plugins
+	Jailer     *JailerConfig `json:"jailer,omitempty"`     // isolate vms with the firecracker jailer
+}
+
+// CNIConfig configures the CNI plugins invoked to network a vm. The plugin
+// chain must end with a plugin that provides firecracker with a tap device,
+// such as tc-redirect-tap. CNI supports a single network interface per vm.
+type CNIConfig struct {
+	ConfList string   `json:"conflist"`          // path to the network configuration list
+	BinPath  []string `json:"binPath,omitempty"` // directories to search for plugins, /opt/cni/bin if empty
+	IfName   string   `json:"ifName,omitempty"`  // CNI_IFNAME passed to the plugins, eth0 if empty
+}
+
+// JailerConfig runs firecracker under the jailer, which starts it in a chroot
+// with seccomp filters, in its own cgroups, as an unprivileged user. The vm's
+// kernel and disk are hard linked into the chroot, so ChrootBaseDir must be on
+// the same filesystem as them. Cgroup limits require a jailer that supports
+// the --cgroup flag.
+type JailerConfig struct {
+	UID           int        `json:"uid"`
+	GID           int        `json:"gid"`
+	ChrootBaseDir string     `json:"chrootBaseDir,omitempty"` // /srv/jailer if empty
+	JailerBinary  string     `json:"jailerBinary,omitempty"`  // jailer from the PATH if empty
+	NetNS         string     `json:"netns,omitempty"`         // path of a network namespace to run the vm in
+	NumaNode      int        `json:"numaNode,omitempty"`
+	CPUSet        string     `json:"cpuset,omitempty"`      // cpus the vm may run on, e.g. "0-3,6"
+	CPUShares     int        `json:"cpuShares,omitempty"`   // relative cpu weight
+	CPUQuota      int        `json:"cpuQuota,omitempty"`    // microseconds of cpu time per 100ms period
+	MemoryLimit   vcfg.Bytes `json:"memoryLimit,omitempty"` // memory available to the firecracker process
+}
+
+var cpusetRegexp = regexp.MustCompile(`^[0-9]+(-[0-9]+)?(,[0-9]+(-[0-9]+)?)*$`)
+
+func (j *JailerConfig) validate() error {
+	if j.UID < 0 || j.GID < 0 {
+		return errors.New("jailer uid and gid can't be negative")
+	}
+	if j.ChrootBaseDir != "" && !filepath.IsAbs(j.ChrootBaseDir) {
+		return fmt.Errorf("jailer chroot base dir must be an absolute path: %s", j.ChrootBaseDir)
+	}
+	if j.NumaNode < 0 {
+		return errors.New("jailer numa node can't be negative")
+	}
+	if j.CPUSet != "" && !cpusetRegexp.MatchString(j.CPUSet) {
+		return fmt.Errorf("invalid jailer cpuset: %s", j.CPUSet)
+	}
+	if j.CPUShares < 0 || j.CPUQuota < 0 || j.MemoryLimit < 0 {
+		return errors.New("jailer cgroup limits can't be negative")
+	}
+	return nil
+}
+
+// UsesBridge returns true if vms are networked through the vorteil-bridge.
+func (c *Config) UsesBridge() bool {
+	return len(c.TapDevices) == 0 && c.CNI == nil
+}
+
+// Validate checks that the config doesn't ask for conflicting networking, and
+// that the jailer's settings are sensible.
+func (c *Config) Validate() error {
+	if len(c.TapDevices) > 0 && c.CNI != nil {
+		return errors.New("tap devices and cni can't both be configured")
+	}
+	if c.CNI != nil && c.CNI.ConfList == "" {
+		return errors.New("cni requires a network configuration list")
+	}
+	if c.Jailer != nil {
+		if c.Jailer.NetNS != "" && c.CNI != nil {
+			return errors.New("cni creates its own network namespace, so the jailer can't be given one")
+		}
+		return c.Jailer.validate()
+	}
+	return nil
+}
 
 // Marshal the config into a byte[]
 func (c *Config) Marshal() []byte {
@@ -70,8 +151,12 @@ func (a *allocator) IsAvailable() bool {
 
 // ValidateArgs check if valid args are passed to create a valid Virtualizer
 func (a *allocator) ValidateArgs(data []byte) error {
-	// nothing to validate return nil
-	return nil
+	c := new(Config)
+	err := c.Unmarshal(data)
+	if err != nil {
+		return err
+	}
+	return c.Validate()
 }
 
 // Create creates a virtualizer using the provided manager
@@ -48,3 +48,35 @@ func TestDiskFormat(t *testing.T) {
 // 		t.Errorf("Is available didn't return a 'bool' but returned '%s'", tt)
 // 	}
 // }
+
+func TestValidateArgs(t *testing.T) {
+	tests := []struct {
+		config  Config
+		valid   bool
+		bridged bool
+	}{
+		{Config{}, true, true},
+		{Config{TapDevices: []string{"tap0"}}, true, false},
+		{Config{CNI: &CNIConfig{ConfList: "/etc/cni/conf.d/vorteil.conflist"}}, true, false},
+		{Config{CNI: &CNIConfig{}}, false, false},
+		{Config{TapDevices: []string{"tap0"}, CNI: &CNIConfig{ConfList: "/etc/cni/conf.d/vorteil.conflist"}}, false, false},
+		{Config{Jailer: &JailerConfig{UID: 1000, GID: 1000, CPUSet: "0-3,6", MemoryLimit: 512 * vcfg.MiB}}, true, true},
+		{Config{Jailer: &JailerConfig{UID: -1}}, false, true},
+		{Config{Jailer: &JailerConfig{ChrootBaseDir: "jails"}}, false, true},
+		{Config{Jailer: &JailerConfig{CPUSet: "0-"}}, false, true},
+		{Config{Jailer: &JailerConfig{NetNS: "/var/run/netns/vm"}, CNI: &CNIConfig{ConfList: "/etc/cni/conf.d/vorteil.conflist"}}, false, false},
+	}
+
+	for i, tt := range tests {
+		err := Allocator.ValidateArgs(tt.config.Marshal())
+		if tt.valid && err != nil {
+			t.Errorf("config %d: expected to be valid but got an error %v", i, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("config %d: expected to be invalid", i)
+		}
+		if tt.config.UsesBridge() != tt.bridged {
+			t.Errorf("config %d: expected bridged to be %v", i, tt.bridged)
+		}
+	}
+}
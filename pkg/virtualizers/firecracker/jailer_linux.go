@@ -0,0 +1,177 @@
+// +build linux
+
+package firecracker
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+)
+
+const defaultChrootBaseDir = "/srv/jailer"
+
+// jailed returns true if the vm runs under the jailer.
+func (v *Virtualizer) jailed() bool {
+	return v.vconfig != nil && v.vconfig.Jailer != nil
+}
+
+// jailDir is the directory the jailer builds the vm's chroot in, laid out the
+// way firecracker-go-sdk expects.
+func (v *Virtualizer) jailDir() string {
+	base := v.vconfig.Jailer.ChrootBaseDir
+	if base == "" {
+		base = defaultChrootBaseDir
+	}
+	executable, _ := virtualizers.GetExecutable(VirtualizerID)
+	return filepath.Join(base, filepath.Base(executable), v.id)
+}
+
+// jailSocket is the path of the API socket of a jailed vm.
+func (v *Virtualizer) jailSocket() string {
+	return filepath.Join(v.jailDir(), "root", "run", "firecracker.socket")
+}
+
+// jailerConfig returns the firecracker-go-sdk configuration that jails the vm.
+func (v *Virtualizer) jailerConfig() (*firecracker.JailerConfig, error) {
+
+	executable, err := virtualizers.GetExecutable(VirtualizerID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the jailer needs the full path of the binary it executes
+	executable, err = exec.LookPath(executable)
+	if err != nil {
+		return nil, err
+	}
+
+	j := v.vconfig.Jailer
+	uid, gid, node := j.UID, j.GID, j.NumaNode
+
+	return &firecracker.JailerConfig{
+		UID:            &uid,
+		GID:            &gid,
+		NumaNode:       &node,
+		ID:             v.id,
+		ExecFile:       executable,
+		JailerBinary:   j.JailerBinary,
+		ChrootBaseDir:  j.ChrootBaseDir,
+		ChrootStrategy: firecracker.NewNaiveChrootStrategy(v.jailDir(), v.kip),
+		Stdout:         v.serialLogger,
+		Stderr:         v.serialLogger,
+	}, nil
+
+}
+
+// cgroups returns the cgroup settings the jailer applies to the vm.
+func (j *JailerConfig) cgroups() []string {
+
+	var cgroups []string
+
+	if j.CPUSet != "" {
+		cgroups = append(cgroups, fmt.Sprintf("cpuset.cpus=%s", j.CPUSet))
+	}
+	if j.CPUShares > 0 {
+		cgroups = append(cgroups, fmt.Sprintf("cpu.shares=%d", j.CPUShares))
+	}
+	if j.CPUQuota > 0 {
+		cgroups = append(cgroups, "cpu.cfs_period_us=100000")
+		cgroups = append(cgroups, fmt.Sprintf("cpu.cfs_quota_us=%d", j.CPUQuota))
+	}
+	if j.MemoryLimit > 0 {
+		cgroups = append(cgroups, fmt.Sprintf("memory.limit_in_bytes=%d", j.MemoryLimit.Units(vcfg.Byte)))
+	}
+
+	return cgroups
+
+}
+
+// jail configures the machine configured by fcfg to run under the jailer,
+// returning the command that starts it.
+func (v *Virtualizer) jail(fcfg *firecracker.Config) (*exec.Cmd, error) {
+
+	err := v.prepareJail()
+	if err != nil {
+		return nil, err
+	}
+
+	fcfg.JailerCfg, err = v.jailerConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return v.jailerCommand(fcfg), nil
+
+}
+
+// jailerCommand builds the command that starts a jailed machine. It replaces
+// the one firecracker-go-sdk would build, which has no way to set cgroups.
+func (v *Virtualizer) jailerCommand(fcfg *firecracker.Config) *exec.Cmd {
+
+	jcfg := fcfg.JailerCfg
+	b := firecracker.NewJailerCommandBuilder().
+		WithID(jcfg.ID).
+		WithUID(*jcfg.UID).
+		WithGID(*jcfg.GID).
+		WithNumaNode(*jcfg.NumaNode).
+		WithExecFile(jcfg.ExecFile).
+		WithChrootBaseDir(jcfg.ChrootBaseDir).
+		WithFirecrackerArgs("--seccomp-level", fcfg.SeccompLevel.String()).
+		WithStdout(jcfg.Stdout).
+		WithStderr(jcfg.Stderr)
+
+	if jcfg.JailerBinary != "" {
+		b = b.WithBin(jcfg.JailerBinary)
+	}
+
+	if fcfg.NetNS != "" {
+		b = b.WithNetNS(fcfg.NetNS)
+	}
+
+	cmd := b.Build(v.gctx)
+
+	var cgroups []string
+	for _, cg := range v.vconfig.Jailer.cgroups() {
+		cgroups = append(cgroups, "--cgroup", cg)
+	}
+
+	// jailer arguments must come before the separator from firecracker's
+	for i, arg := range cmd.Args {
+		if arg == "--" {
+			cmd.Args = append(cmd.Args[:i], append(cgroups, cmd.Args[i:]...)...)
+			break
+		}
+	}
+
+	return cmd
+
+}
+
+// prepareJail removes what's left of the chroot from the last time the vm
+// ran, as the jailer won't reuse it, and hands the vm's disk to the jailed
+// user.
+func (v *Virtualizer) prepareJail() error {
+
+	err := os.RemoveAll(v.jailDir())
+	if err != nil {
+		return err
+	}
+
+	return os.Chown(v.diskpath, v.vconfig.Jailer.UID, v.vconfig.Jailer.GID)
+
+}
+
+// releaseJail removes the vm's chroot.
+func (v *Virtualizer) releaseJail() error {
+	return os.RemoveAll(v.jailDir())
+}
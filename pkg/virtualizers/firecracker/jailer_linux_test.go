@@ -0,0 +1,126 @@
+// +build linux
+
+package firecracker
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+func TestCgroups(t *testing.T) {
+	j := &JailerConfig{
+		CPUSet:      "0-1",
+		CPUShares:   512,
+		CPUQuota:    50000,
+		MemoryLimit: 256 * vcfg.MiB,
+	}
+
+	expect := []string{
+		"cpuset.cpus=0-1",
+		"cpu.shares=512",
+		"cpu.cfs_period_us=100000",
+		"cpu.cfs_quota_us=50000",
+		"memory.limit_in_bytes=268435456",
+	}
+
+	if cgroups := j.cgroups(); !reflect.DeepEqual(cgroups, expect) {
+		t.Errorf("expected cgroups %v but got %v", expect, cgroups)
+	}
+
+	if cgroups := new(JailerConfig).cgroups(); len(cgroups) != 0 {
+		t.Errorf("expected no cgroups but got %v", cgroups)
+	}
+}
+
+func TestJailerCommand(t *testing.T) {
+	uid, gid, node := 1000, 1000, 0
+	v := &Virtualizer{
+		gctx: context.Background(),
+		vconfig: &Config{
+			Jailer: &JailerConfig{
+				UID:       uid,
+				GID:       gid,
+				CPUShares: 512,
+			},
+		},
+	}
+
+	cmd := v.jailerCommand(&firecracker.Config{
+		SeccompLevel: firecracker.SeccompLevelAdvanced,
+		NetNS:        "/var/run/netns/vorteil-abcde",
+		JailerCfg: &firecracker.JailerConfig{
+			UID:      &uid,
+			GID:      &gid,
+			NumaNode: &node,
+			ID:       "abcde",
+			ExecFile: "/usr/bin/firecracker",
+		},
+	})
+
+	expect := []string{
+		"jailer",
+		"--id", "abcde",
+		"--uid", "1000",
+		"--gid", "1000",
+		"--exec-file", "/usr/bin/firecracker",
+		"--node", "0",
+		"--netns", "/var/run/netns/vorteil-abcde",
+		"--cgroup", "cpu.shares=512",
+		"--", "--seccomp-level", "2",
+	}
+
+	if !reflect.DeepEqual(cmd.Args, expect) {
+		t.Errorf("expected jailer command %v but got %v", expect, cmd.Args)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	if rateLimiter(0, 0) != nil {
+		t.Errorf("expected no rate limiter without limits")
+	}
+
+	limiter := rateLimiter(vcfg.MiB, 0)
+	if limiter == nil || limiter.Bandwidth == nil || limiter.Ops != nil {
+		t.Fatalf("expected a bandwidth limit only")
+	}
+	if *limiter.Bandwidth.Size != int64(vcfg.MiB) || *limiter.Bandwidth.RefillTime != 1000 {
+		t.Errorf("expected %d bytes per second but got %d per %dms", vcfg.MiB, *limiter.Bandwidth.Size, *limiter.Bandwidth.RefillTime)
+	}
+
+	limiter = rateLimiter(0, 100)
+	if limiter == nil || limiter.Ops == nil || limiter.Bandwidth != nil || *limiter.Ops.Size != 100 {
+		t.Errorf("expected an operations limit only")
+	}
+}
+
+func TestDriveRateLimiter(t *testing.T) {
+	cfg := new(vcfg.VCFG)
+	cfg.VM.CPUs = 1
+	cfg.VM.RAM = 128 * vcfg.MiB
+	cfg.VM.DiskBandwidth = vcfg.MiB
+	cfg.VM.DiskIOPS = 100
+
+	o := &operation{Virtualizer: &Virtualizer{
+		name:    "vm",
+		folder:  "/tmp/vorteil-vm",
+		config:  cfg,
+		vconfig: new(Config),
+	}}
+
+	fcfg, _ := o.generateFirecrackerConfig("/tmp/vorteil-vm/disk.raw")
+	if len(fcfg.Drives) != 1 {
+		t.Fatalf("expected a single drive but got %d", len(fcfg.Drives))
+	}
+
+	limiter := fcfg.Drives[0].RateLimiter
+	if limiter == nil || limiter.Bandwidth == nil || limiter.Ops == nil {
+		t.Fatalf("expected the root drive to be rate limited")
+	}
+	if *limiter.Bandwidth.Size != int64(vcfg.MiB) || *limiter.Ops.Size != 100 {
+		t.Errorf("expected %d bytes and 100 operations per second but got %d and %d", vcfg.MiB, *limiter.Bandwidth.Size, *limiter.Ops.Size)
+	}
+}
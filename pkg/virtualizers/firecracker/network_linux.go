@@ -0,0 +1,276 @@
+// +build linux
+
+package firecracker
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/milosgajdos/tenus"
+	"github.com/vorteil/vorteil/pkg/virtualizers/iputil"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultCNIBinPath = "/opt/cni/bin"
+	defaultCNIIfName  = "eth0"
+	cniCacheDir       = "/var/lib/cni"
+	netnsDir          = "/var/run/netns"
+)
+
+// claimedTaps maps each tap device from a virtualizer's config that is in use
+// to the vm using it, so that vms sharing a virtualizer never share a tap.
+var claimedTaps = struct {
+	sync.Mutex
+	vms map[string]string
+}{vms: make(map[string]string)}
+
+// claimTaps claims the first n of the tap devices in pool that no other vm is
+// using for the vm named vm.
+func claimTaps(vm string, pool []string, n int) ([]string, error) {
+
+	claimedTaps.Lock()
+	defer claimedTaps.Unlock()
+
+	var taps []string
+	for _, tap := range pool {
+		if len(taps) == n {
+			break
+		}
+		if _, ok := claimedTaps.vms[tap]; !ok {
+			taps = append(taps, tap)
+		}
+	}
+
+	if len(taps) < n {
+		return nil, fmt.Errorf("vm has %d network interfaces but only %d of the %d tap devices provided are free", n, len(taps), len(pool))
+	}
+
+	for _, tap := range taps {
+		claimedTaps.vms[tap] = vm
+	}
+
+	return taps, nil
+
+}
+
+// releaseTaps returns tap devices claimed by claimTaps to the pool.
+func releaseTaps(taps []string) {
+
+	claimedTaps.Lock()
+	defer claimedTaps.Unlock()
+
+	for _, tap := range taps {
+		delete(claimedTaps.vms, tap)
+	}
+
+}
+
+// useTapDevices hands free tap devices from the virtualizer's config to the
+// vm's network interfaces. They belong to the user, so they are only returned
+// to the pool when the vm is closed.
+func (o *operation) useTapDevices() error {
+
+	taps, err := claimTaps(o.name, o.vconfig.TapDevices, len(o.config.Networks))
+	if err != nil {
+		return err
+	}
+
+	for _, ifceName := range taps {
+		ifc, err := net.InterfaceByName(ifceName)
+		if err != nil {
+			releaseTaps(taps)
+			o.tapDevicesName, o.tapDevices = nil, nil
+			return fmt.Errorf("tap device %s: %w", ifceName, err)
+		}
+		o.tapDevicesName = append(o.tapDevicesName, ifceName)
+		o.tapDevices = append(o.tapDevices, ifc)
+	}
+
+	return nil
+
+}
+
+// bridgeDevices creates a tap device attached to the vorteil-bridge for each
+// of the vm's network interfaces.
+func (o *operation) bridgeDevices() error {
+
+	var err error
+
+	// get bridge device
+	o.bridgeDevice, err = tenus.BridgeFromName(vorteilBridge)
+	if err != nil {
+		return err
+	}
+
+	for i := range o.config.Networks {
+		ifceName := fmt.Sprintf("eth%s%v", o.id, i)
+
+		// create interface
+		err = iputil.CreateTap(ifceName)
+		if err != nil {
+			return err
+		}
+
+		// attach to bridge
+		ifc, err := net.InterfaceByName(ifceName)
+		if err != nil {
+			return err
+		}
+
+		// Add tap device to bridge
+		err = o.bridgeDevice.AddSlaveIfc(ifc)
+		if err != nil {
+			return err
+		}
+
+		o.tapDevicesName = append(o.tapDevicesName, ifceName)
+		o.tapDevices = append(o.tapDevices, ifc)
+	}
+
+	o.ownsTaps = true
+
+	return nil
+
+}
+
+// loadCNI reads the network configuration list from the virtualizer's config.
+// The plugins themselves are invoked by firecracker-go-sdk each time the vm
+// starts, and their resources released when it stops.
+func (o *operation) loadCNI() error {
+
+	if len(o.config.Networks) > 1 {
+		return fmt.Errorf("cni supports a single network interface but the vm has %d", len(o.config.Networks))
+	}
+
+	list, err := libcni.ConfListFromFile(o.vconfig.CNI.ConfList)
+	if err != nil {
+		return fmt.Errorf("failed to load cni configuration: %w", err)
+	}
+
+	o.cniConfList = list
+
+	return nil
+
+}
+
+// usesCNI returns true if the vm's network interface is created by CNI.
+func (v *Virtualizer) usesCNI() bool {
+	return v.cniConfList != nil && len(v.config.Networks) > 0
+}
+
+// netnsPath is the network namespace a vm networked by CNI runs in.
+func (v *Virtualizer) netnsPath() string {
+	return filepath.Join(netnsDir, fmt.Sprintf("vorteil-%s", v.id))
+}
+
+func (v *Virtualizer) cniBinPath() []string {
+	if len(v.vconfig.CNI.BinPath) == 0 {
+		return []string{defaultCNIBinPath}
+	}
+	return v.vconfig.CNI.BinPath
+}
+
+func (v *Virtualizer) cniIfName() string {
+	if v.vconfig.CNI.IfName == "" {
+		return defaultCNIIfName
+	}
+	return v.vconfig.CNI.IfName
+}
+
+// networkInterfaces returns the network interfaces to start the vm with. They
+// are generated fresh for every start because firecracker-go-sdk fills in the
+// tap device of a CNI interface once the plugins have run.
+func (v *Virtualizer) networkInterfaces() []firecracker.NetworkInterface {
+
+	var interfaces []firecracker.NetworkInterface
+
+	if v.usesCNI() {
+		nic := v.config.Networks[0]
+		return append(interfaces, firecracker.NetworkInterface{
+			CNIConfiguration: &firecracker.CNIConfiguration{
+				NetworkConfig: v.cniConfList,
+				BinPath:       v.cniBinPath(),
+				IfName:        v.cniIfName(),
+			},
+			InRateLimiter:  rateLimiter(nic.Bandwidth, nic.PacketRate),
+			OutRateLimiter: rateLimiter(nic.Bandwidth, nic.PacketRate),
+		})
+	}
+
+	for i := 0; i < len(v.tapDevices); i++ {
+		nic := v.config.Networks[i]
+		interfaces = append(interfaces,
+			firecracker.NetworkInterface{
+				StaticConfiguration: &firecracker.StaticNetworkConfiguration{
+					HostDevName: v.tapDevicesName[i],
+				},
+				InRateLimiter:  rateLimiter(nic.Bandwidth, nic.PacketRate),
+				OutRateLimiter: rateLimiter(nic.Bandwidth, nic.PacketRate),
+			},
+		)
+	}
+
+	return interfaces
+
+}
+
+// releaseCNI deletes the CNI network of a vm that was reattached to, which
+// firecracker-go-sdk can't clean up because it didn't start the process.
+func (v *Virtualizer) releaseCNI() error {
+
+	// firecracker-go-sdk caches results in a directory per vm
+	cni := libcni.NewCNIConfigWithCacheDir(v.cniBinPath(), filepath.Join(cniCacheDir, v.id), nil)
+	err := cni.DelNetworkList(context.Background(), v.cniConfList, &libcni.RuntimeConf{
+		ContainerID: v.id,
+		NetNS:       v.netnsPath(),
+		IfName:      v.cniIfName(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete cni network: %w", err)
+	}
+
+	err = unix.Unmount(v.netnsPath(), unix.MNT_DETACH)
+	if err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return err
+	}
+
+	err = os.Remove(v.netnsPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+
+}
+
+// releaseDevices deletes the tap devices created for the vm. Tap devices
+// provided by the user are left for them to clean up, and freed for other vms.
+func (v *Virtualizer) releaseDevices() error {
+
+	if !v.ownsTaps {
+		releaseTaps(v.tapDevicesName)
+		return nil
+	}
+
+	for _, ifname := range v.tapDevicesName {
+		err := tenus.DeleteLink(ifname)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
@@ -0,0 +1,44 @@
+// +build linux
+
+package firecracker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClaimTaps(t *testing.T) {
+	pool := []string{"tap0", "tap1", "tap2"}
+
+	a, err := claimTaps("a", pool, 2)
+	if err != nil {
+		t.Fatalf("unable to claim taps: %v", err)
+	}
+	defer releaseTaps(a)
+
+	if !reflect.DeepEqual(a, []string{"tap0", "tap1"}) {
+		t.Errorf("expected vm a to get tap0 and tap1 but got %v", a)
+	}
+
+	_, err = claimTaps("b", pool, 2)
+	if err == nil {
+		t.Errorf("expected claiming taps in use by another vm to fail")
+	}
+
+	b, err := claimTaps("b", pool, 1)
+	if err != nil {
+		t.Fatalf("unable to claim taps: %v", err)
+	}
+
+	if !reflect.DeepEqual(b, []string{"tap2"}) {
+		t.Errorf("expected vm b to get tap2 but got %v", b)
+	}
+
+	releaseTaps(b)
+
+	b, err = claimTaps("b", pool, 1)
+	if err != nil {
+		t.Fatalf("released taps weren't returned to the pool: %v", err)
+	}
+	releaseTaps(b)
+}
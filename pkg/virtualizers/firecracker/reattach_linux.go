@@ -0,0 +1,153 @@
+// +build linux
+
+package firecracker
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+	logger "github.com/vorteil/vorteil/pkg/virtualizers/logging"
+)
+
+// instanceData is what the manager persists for a firecracker vm beyond the
+// generic instance fields.
+type instanceData struct {
+	ID              string        `json:"id"`
+	Kernel          string        `json:"kernel"`
+	FirecrackerPath string        `json:"firecrackerPath"`
+	TapDevices      []string      `json:"tapDevices"`
+	UserTaps        bool          `json:"userTaps,omitempty"` // tap devices were provided by the user
+	CNI             *CNIConfig    `json:"cni,omitempty"`
+	Jailer          *JailerConfig `json:"jailer,omitempty"`
+}
+
+// Instance describes the vm so that the manager can persist it.
+func (v *Virtualizer) Instance() *virtualizers.VMInstance {
+	inst := &virtualizers.VMInstance{
+		Name:        v.name,
+		Type:        VirtualizerID,
+		Virtualizer: v.pname,
+		State:       v.state,
+		Folder:      v.folder,
+		Disk:        v.diskpath,
+		Routes:      v.routes,
+		Config:      v.config,
+		Created:     v.created,
+	}
+
+	if v.process != nil {
+		inst.PID = v.process.Pid
+	} else if v.machine != nil && v.state != virtualizers.Ready {
+		inst.PID, _ = v.machine.PID()
+	}
+
+	inst.Data, _ = json.Marshal(&instanceData{
+		ID:              v.id,
+		Kernel:          v.kip,
+		FirecrackerPath: v.firecrackerPath,
+		TapDevices:      v.tapDevicesName,
+		UserTaps:        !v.ownsTaps,
+		CNI:             v.vconfig.CNI,
+		Jailer:          v.vconfig.Jailer,
+	})
+
+	return inst
+}
+
+// Reattach takes control of a vm described by an instance persisted by a
+// previous manager. If the vm is running it is controlled through its API
+// socket, but anything it wrote to its serial port in the meantime is lost.
+func (v *Virtualizer) Reattach(inst *virtualizers.VMInstance, log elog.View) error {
+
+	data := new(instanceData)
+	err := json.Unmarshal(inst.Data, data)
+	if err != nil {
+		return err
+	}
+
+	v.name = inst.Name
+	v.pname = inst.Virtualizer
+	v.folder = inst.Folder
+	v.diskpath = inst.Disk
+	v.routes = inst.Routes
+	v.config = inst.Config
+	v.created = inst.Created
+	v.id = data.ID
+	v.kip = data.Kernel
+	v.firecrackerPath = data.FirecrackerPath
+	v.logger = log
+	v.serialLogger = logger.NewLogger(2048 * 10)
+	v.gctx = context.Background()
+	v.vmmCtx, v.vmmCancel = context.WithCancel(v.gctx)
+	v.vconfig = &Config{CNI: data.CNI, Jailer: data.Jailer}
+	v.ownsTaps = !data.UserTaps
+
+	if data.CNI != nil {
+		v.cniConfList, err = libcni.ConfListFromFile(data.CNI.ConfList)
+		if err != nil {
+			return fmt.Errorf("failed to load cni configuration: %w", err)
+		}
+	}
+
+	if data.UserTaps {
+		_, err = claimTaps(v.name, data.TapDevices, len(data.TapDevices))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, ifname := range data.TapDevices {
+		ifc, err := net.InterfaceByName(ifname)
+		if err != nil {
+			return fmt.Errorf("tap device %s: %w", ifname, err)
+		}
+		v.tapDevicesName = append(v.tapDevicesName, ifname)
+		v.tapDevices = append(v.tapDevices, ifc)
+	}
+
+	v.fconfig, v.machineOpts = (&operation{Virtualizer: v}).generateFirecrackerConfig(v.diskpath)
+	v.state = virtualizers.Ready
+
+	if inst.PID == 0 {
+		return nil
+	}
+
+	proc, err := os.FindProcess(inst.PID)
+	if err != nil {
+		return err
+	}
+
+	info := new(struct {
+		State string `json:"state"`
+	})
+	err = v.api(http.MethodGet, "/", nil, info)
+	if err != nil {
+		return fmt.Errorf("unable to reconnect to API socket: %w", err)
+	}
+
+	v.process = proc
+	v.state = virtualizers.Alive
+	if info.State == "Paused" {
+		v.state = virtualizers.Paused
+	}
+
+	go func() {
+		virtualizers.WaitProcess(proc.Pid)
+		v.process = nil
+		v.state = virtualizers.Ready
+	}()
+
+	return nil
+}
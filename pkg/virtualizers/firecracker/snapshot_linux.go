@@ -0,0 +1,286 @@
+// +build linux
+
+package firecracker
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+)
+
+// Names of the files firecracker saves a snapshot to.
+const (
+	snapshotState  = "vmstate"
+	snapshotMemory = "memory"
+)
+
+// api sends a request to the firecracker API socket and decodes the response
+// into ret, if it isn't nil. The SDK we use predates firecracker's pause and
+// snapshot endpoints, so we talk to them directly.
+func (v *Virtualizer) api(method, path string, body, ret interface{}) error {
+
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", v.fconfig.SocketPath)
+			},
+		},
+		Timeout: time.Minute,
+	}
+
+	req, err := http.NewRequest(method, "http://localhost"+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		fault := new(struct {
+			FaultMessage string `json:"fault_message"`
+		})
+		msg, _ := ioutil.ReadAll(resp.Body)
+		if json.Unmarshal(msg, fault) == nil && fault.FaultMessage != "" {
+			msg = []byte(fault.FaultMessage)
+		}
+		return fmt.Errorf("firecracker %s %s: %s", method, path, msg)
+	}
+
+	if ret != nil {
+		return json.NewDecoder(resp.Body).Decode(ret)
+	}
+
+	return nil
+
+}
+
+// Pause stops the vm's vcpus.
+func (v *Virtualizer) Pause() error {
+	v.logger.Debugf("Pausing VM")
+
+	if v.state != virtualizers.Alive {
+		return fmt.Errorf("vm not in a state to be paused currently in: %s", v.state)
+	}
+
+	err := v.api(http.MethodPatch, "/vm", map[string]string{"state": "Paused"}, nil)
+	if err != nil {
+		return err
+	}
+
+	v.state = virtualizers.Paused
+
+	return nil
+}
+
+// Resume restarts the vcpus of a paused vm.
+func (v *Virtualizer) Resume() error {
+	v.logger.Debugf("Resuming VM")
+
+	if v.state != virtualizers.Paused {
+		return fmt.Errorf("vm not in a state to be resumed currently in: %s", v.state)
+	}
+
+	err := v.api(http.MethodPatch, "/vm", map[string]string{"state": "Resumed"}, nil)
+	if err != nil {
+		return err
+	}
+
+	v.state = virtualizers.Alive
+
+	return nil
+}
+
+// Snapshot saves a full snapshot of the vm's memory and device state to dir,
+// and copies its disk alongside it. The vm is paused while this happens, and
+// resumed afterwards unless it was already paused. Snapshots require
+// firecracker v0.24 or later, and aren't supported for jailed vms, which
+// can only write inside their chroot.
+func (v *Virtualizer) Snapshot(dir string) error {
+	v.logger.Debugf("Snapshotting VM")
+
+	if v.jailed() {
+		return errors.New("jailed vms can't be snapshotted")
+	}
+
+	if v.state != virtualizers.Alive && v.state != virtualizers.Paused {
+		return fmt.Errorf("vm not in a state to be snapshotted currently in: %s", v.state)
+	}
+
+	if v.state == virtualizers.Alive {
+		err := v.Pause()
+		if err != nil {
+			return err
+		}
+		defer v.Resume()
+	}
+
+	err := v.api(http.MethodPut, "/snapshot/create", map[string]string{
+		"snapshot_type": "Full",
+		"snapshot_path": filepath.Join(dir, snapshotState),
+		"mem_file_path": filepath.Join(dir, snapshotMemory),
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	return virtualizers.CopyDisk(filepath.Join(dir, virtualizers.SnapshotDisk), v.diskpath)
+}
+
+// stopVMM kills the firecracker process and waits for the vm to be ready.
+func (v *Virtualizer) stopVMM() error {
+
+	if v.process != nil {
+		err := v.process.Kill()
+		if err != nil {
+			return err
+		}
+	} else if v.machine != nil {
+		err := v.machine.StopVMM()
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := 0; v.state != virtualizers.Ready; i++ {
+		if i == 100 {
+			return errors.New("timed out waiting for vm to stop")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	return nil
+
+}
+
+// Restore replaces the vm's disk with the one saved in dir and loads the
+// snapshot saved alongside it into a new firecracker process, instead of
+// booting. A vm that is already running is killed first. Firecracker
+// snapshots record the paths of the disk and tap devices, so they can only be
+// restored into the vm they were taken from. Vms networked by CNI can't be
+// restored, as their tap device is released when the vm stops.
+func (v *Virtualizer) Restore(dir string) error {
+	v.logger.Debugf("Restoring VM")
+
+	if v.usesCNI() {
+		return errors.New("snapshots can't be restored into vms networked by cni")
+	}
+
+	if v.jailed() {
+		return errors.New("snapshots can't be restored into jailed vms")
+	}
+
+	switch v.state {
+	case virtualizers.Ready:
+	case virtualizers.Alive, virtualizers.Paused:
+		err := v.stopVMM()
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("vm not in a state to be restored currently in: %s", v.state)
+	}
+
+	v.state = virtualizers.Changing
+
+	err := v.restore(dir)
+	if err != nil {
+		v.state = virtualizers.Ready
+		return err
+	}
+
+	return nil
+}
+
+func (v *Virtualizer) restore(dir string) error {
+
+	err := virtualizers.CopyDisk(v.diskpath, filepath.Join(dir, virtualizers.SnapshotDisk))
+	if err != nil {
+		return err
+	}
+
+	executable, err := virtualizers.GetExecutable(VirtualizerID)
+	if err != nil {
+		return err
+	}
+
+	os.Remove(v.fconfig.SocketPath)
+
+	cmd := firecracker.VMCommandBuilder{}.WithBin(executable).WithSocketPath(v.fconfig.SocketPath).WithStdout(v.serialLogger).WithStderr(v.serialLogger).Build(v.gctx)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+		Pgid:    0,
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; ; i++ {
+		if _, err = os.Stat(v.fconfig.SocketPath); err == nil {
+			break
+		}
+		if i == 100 {
+			cmd.Process.Kill()
+			return errors.New("firecracker socket wasn't created in time")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	err = v.api(http.MethodPut, "/snapshot/load", map[string]interface{}{
+		"snapshot_path": filepath.Join(dir, snapshotState),
+		"mem_file_path": filepath.Join(dir, snapshotMemory),
+		"resume_vm":     true,
+	}, nil)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	v.process = cmd.Process
+	v.state = virtualizers.Alive
+
+	go func() {
+		err := cmd.Wait()
+		if err != nil && err.Error() != "signal: killed" {
+			v.logger.Errorf("Wait returned an error: %s", err.Error())
+		}
+		v.process = nil
+		v.state = virtualizers.Ready
+	}()
+
+	return nil
+}
@@ -16,84 +16,12 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-	"syscall"
-	"unsafe"
 
 	"github.com/milosgajdos/tenus"
-	"github.com/vishvananda/netlink"
 	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/virtualizers/iputil"
 )
 
-const (
-	tunPath = "/dev/net/tun"
-
-	cIFFTAP  = 0x0002
-	cIFFNOPI = 0x1000
-)
-
-type ifReq struct {
-	Name  [0x10]byte
-	Flags uint16
-	pad   [0x28 - 0x10 - 2]byte
-}
-
-func ioctl(fd uintptr, request uintptr, argp uintptr) error {
-	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(request), argp)
-	if errno != 0 {
-		return os.NewSyscallError("ioctl", errno)
-	}
-	return nil
-}
-
-// createIfc creates an interface and returns an error if unsuccessful
-func createIfc(name string) error {
-
-	var (
-		tunfd int
-		err   error
-	)
-	// delete the interface if something failed
-	defer func() {
-		if err != nil {
-			tenus.DeleteLink(name)
-		}
-	}()
-
-	if tunfd, err = syscall.Open(tunPath, os.O_RDWR|syscall.O_NONBLOCK, 0); err != nil {
-		return err
-	}
-	defer syscall.Close(tunfd)
-
-	var req ifReq
-	req.Flags = cIFFTAP | cIFFNOPI
-	copy(req.Name[:], name)
-
-	err = ioctl(uintptr(tunfd), syscall.TUNSETIFF, uintptr(unsafe.Pointer(&req)))
-	if err != nil {
-		return err
-	}
-
-	req2 := 1
-	err = ioctl(uintptr(tunfd), syscall.TUNSETPERSIST, uintptr(unsafe.Pointer(&req2)))
-	if err != nil {
-		return err
-	}
-
-	link, err := netlink.LinkByName(name)
-	if err != nil {
-		return err
-	}
-
-	err = netlink.LinkSetUp(link)
-	if err != nil {
-		return err
-	}
-
-	return nil
-
-}
-
 // FetchBridgeDevice check if the bridge exists
 func FetchBridgeDevice() error {
 	_, err := tenus.BridgeFromName(vorteilBridge)
@@ -169,7 +97,7 @@ func newWriter(size int64, onProgress func(downloaded, total int64)) io.Writer {
 	return &writeCounter{total: size, onProgress: onProgress}
 }
 
-func (o *operation) fetchLength(file *os.File, client *http.Client, url string, kernel string) (int, error) {
+func fetchLength(file *os.File, client *http.Client, url string, kernel string) (int, error) {
 	// Determinate the file size
 	resp, err := client.Head(url)
 	if err != nil {
@@ -186,15 +114,15 @@ func (o *operation) fetchLength(file *os.File, client *http.Client, url string,
 	}
 	return length, nil
 }
-func (o *operation) createFileAndGetLength(kernel string, client *http.Client, url string) (*os.File, int, error) {
+func createFileAndGetLength(dir, kernel string, client *http.Client, url string) (*os.File, int, error) {
 	// Create file locally to download
-	file, err := os.Create(filepath.Join(o.firecrackerPath, kernel))
+	file, err := os.Create(filepath.Join(dir, kernel))
 	if err != nil {
 		return nil, 0, err
 	}
 	// defer file.Close()
 
-	length, err := o.fetchLength(file, client, url, kernel)
+	length, err := fetchLength(file, client, url, kernel)
 	if err != nil {
 		os.Remove(file.Name())
 		return nil, 0, err
@@ -207,16 +135,23 @@ func (o *operation) createFileAndGetLength(kernel string, client *http.Client, u
 // Will download the vmlinux if it doesn't exist
 func (o *operation) fetchVMLinux(kernel string) (string, error) {
 	o.updateStatus(fmt.Sprintf("Fetching VMLinux searching %s for %s", o.firecrackerPath, kernel))
+	return FetchVMLinux(o.logger, o.firecrackerPath, kernel)
+}
+
+// FetchVMLinux returns the path of the vmlinux named kernel (e.g.
+// firecracker-20.9.1) in dir, downloading it first if it doesn't exist. Other
+// virtualizers able to boot a vmlinux directly share it with firecracker.
+func FetchVMLinux(log elog.View, dir, kernel string) (string, error) {
 	// check if vmlinux is on system at valid path
-	_, err := os.Stat(filepath.Join(o.firecrackerPath, kernel))
+	_, err := os.Stat(filepath.Join(dir, kernel))
 	if err != nil {
 		// file doesn't exist must download from bucket
-		o.updateStatus(fmt.Sprintf("'%s' does not exist, downloading...", kernel))
+		log.Infof("'%s' does not exist, downloading...", kernel)
 		// Download vmlinux from google
 		url := DownloadPath + kernel
 		client := http.DefaultClient
 
-		file, length, err := o.createFileAndGetLength(kernel, client, url)
+		file, length, err := createFileAndGetLength(dir, kernel, client, url)
 		if err != nil {
 			return "", err
 		}
@@ -228,7 +163,7 @@ func (o *operation) fetchVMLinux(kernel string) (string, error) {
 			return "", err
 		}
 		defer resp.Body.Close()
-		p := o.logger.NewProgress("Downloading VMLinux", "Bytes", int64(length))
+		p := log.NewProgress("Downloading VMLinux", "Bytes", int64(length))
 		defer p.Finish(false)
 		// pipe stream
 		var pDownloaded = int64(0)
@@ -244,7 +179,7 @@ func (o *operation) fetchVMLinux(kernel string) (string, error) {
 		defer file.Close()
 	}
 
-	return filepath.Join(o.firecrackerPath, kernel), nil
+	return filepath.Join(dir, kernel), nil
 }
 
 // log writes a log to the channel for the job
@@ -12,13 +12,16 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/containernetworking/cni/libcni"
 	"github.com/firecracker-microvm/firecracker-go-sdk"
 	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
 	"github.com/milosgajdos/tenus"
@@ -73,10 +76,15 @@ type Virtualizer struct {
 	fconfig     firecracker.Config   // config for virtual machine manager
 	machine     *firecracker.Machine // machine firecracker spawned
 	machineOpts []firecracker.Opt    // options provided to spawn machine
-
-	bridgeDevice   tenus.Bridger    // bridge device e.g vorteil-bridge
-	tapDevices     []*net.Interface // tap devices created that are slaves to vorteil-bridge
-	tapDevicesName []string         //array of tap device names
+	process     *os.Process          // firecracker process a snapshot was restored or reattached into
+	diskpath    string               // path to the disk of the machine
+
+	vconfig        *Config                   // networking options the virtualizer was created with
+	bridgeDevice   tenus.Bridger             // bridge device e.g vorteil-bridge
+	tapDevices     []*net.Interface          // tap devices created that are slaves to vorteil-bridge
+	tapDevicesName []string                  //array of tap device names
+	ownsTaps       bool                      // tap devices were created for the vm and should be deleted with it
+	cniConfList    *libcni.NetworkConfigList // cni network to attach the vm to
 	// tapDevice    Devices       // tap device for the machine
 
 	vmdrive string // store disks in this directory
@@ -87,8 +95,20 @@ func (v *Virtualizer) Type() string {
 	return VirtualizerID
 }
 
-// Initialize passes the arguments from creation to create a virtualizer. No arguments apart from name so no need to do anything
+// Initialize passes the arguments from creation to create a virtualizer
 func (v *Virtualizer) Initialize(data []byte) error {
+	c := new(Config)
+	err := c.Unmarshal(data)
+	if err != nil {
+		return err
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return err
+	}
+
+	v.vconfig = c
 	return nil
 }
 
@@ -110,6 +130,12 @@ func (v *Virtualizer) Serial() *logger.Logger {
 
 // Stop stops the vm and changes it back to ready
 func (v *Virtualizer) Stop() error {
+	if v.process != nil {
+		v.logger.Debugf("Stopping VM")
+		v.state = virtualizers.Changing
+		return v.api(http.MethodPut, "/actions", map[string]string{"action_type": "SendCtrlAltDel"}, nil)
+	}
+
 	// Error might've happened before in the prepare so machine would be nil
 	if v.machine != nil {
 		v.logger.Debugf("Stopping VM")
@@ -150,8 +176,8 @@ func (v *Virtualizer) Download() (vio.File, error) {
 
 // Close shuts down the virtual machine and cleans up the disk and folders
 func (v *Virtualizer) Close(force bool) error {
-	// Error might've happened before in the prepare so machine would be nil
-	if v.machine != nil {
+	// Error might've happened before in the prepare so config would be empty
+	if v.fconfig.SocketPath != "" {
 		v.logger.Debugf("Deleting VM")
 
 		if !force {
@@ -166,14 +192,35 @@ func (v *Virtualizer) Close(force bool) error {
 		}
 
 		// stopVMM
-		err := v.machine.StopVMM()
+		var err error
+		if v.process != nil {
+			err = v.process.Kill()
+			if err != nil && strings.Contains(err.Error(), "process already finished") {
+				err = nil
+			}
+		} else if v.machine != nil {
+			err = v.machine.StopVMM()
+		}
 		if err != nil {
 			return err
 		}
 
+		// a machine releases its cni network itself when it exits
+		if v.usesCNI() && v.process != nil {
+			err = v.releaseCNI()
+			if err != nil {
+				return err
+			}
+		}
+
 		// Cleanup tap devices
-		for _, ifname := range v.tapDevicesName {
-			err = tenus.DeleteLink(ifname)
+		err = v.releaseDevices()
+		if err != nil {
+			return err
+		}
+
+		if v.jailed() {
+			err = v.releaseJail()
 			if err != nil {
 				return err
 			}
@@ -197,6 +244,9 @@ func (v *Virtualizer) Prepare(args *virtualizers.PrepareArgs) *virtualizers.Virt
 	v.pname = args.PName
 	v.vmdrive = args.VMDrive
 	v.firecrackerPath = args.FCPath
+	if v.vconfig == nil {
+		v.vconfig = new(Config)
+	}
 
 	v.created = time.Now()
 	v.config = args.Config
@@ -248,11 +298,6 @@ func (o *operation) initializeVM(args *virtualizers.PrepareArgs) error {
 	}
 	o.folder = filepath.Dir(args.ImagePath)
 	o.id = strings.Split(filepath.Base(o.folder), "-")[1]
-	// get bridge device
-	o.bridgeDevice, err = tenus.BridgeFromName(vorteilBridge)
-	if err != nil {
-		return err
-	}
 	o.gctx = context.Background()
 	o.vmmCtx, o.vmmCancel = context.WithCancel(o.gctx)
 
@@ -272,6 +317,7 @@ func (o *operation) prepare(args *virtualizers.PrepareArgs) {
 	}()
 
 	diskpath := filepath.ToSlash(args.ImagePath)
+	o.diskpath = diskpath
 
 	err := o.initializeVM(args)
 	if err != nil {
@@ -293,6 +339,7 @@ func (o *operation) prepare(args *virtualizers.PrepareArgs) {
 
 	_, loaded := virtualizers.ActiveVMs.LoadOrStore(o.name, o.Virtualizer)
 	if loaded {
+		_ = o.releaseDevices()
 		returnErr = errors.New("virtual machine already exists")
 		return
 	}
@@ -321,23 +368,29 @@ func (o *operation) generateFirecrackerConfig(diskpath string) (firecracker.Conf
 		IsRootDevice: firecracker.Bool(true),
 		IsReadOnly:   firecracker.Bool(false),
 		Partuuid:     vimg.Part2UUIDString,
+		RateLimiter:  rateLimiter(o.config.VM.DiskBandwidth, o.config.VM.DiskIOPS),
 	}
 
 	devices = append(devices, rootDrive)
-	var interfaces []firecracker.NetworkInterface
-
-	for i := 0; i < len(o.tapDevices); i++ {
-		interfaces = append(interfaces,
-			firecracker.NetworkInterface{
-				StaticConfiguration: &firecracker.StaticNetworkConfiguration{
-					HostDevName: o.tapDevicesName[i],
-				},
-			},
-		)
+
+	var netns string
+	if o.usesCNI() {
+		netns = o.netnsPath()
+	} else if o.jailed() {
+		netns = o.vconfig.Jailer.NetNS
+	}
+
+	socket := filepath.Join(o.folder, fmt.Sprintf("%s.%s", o.name, "socket"))
+	seccomp := firecracker.SeccompLevelDisable
+	if o.jailed() {
+		socket = o.jailSocket()
+		seccomp = firecracker.SeccompLevelAdvanced
 	}
 
 	return firecracker.Config{
-			SocketPath:      filepath.Join(o.folder, fmt.Sprintf("%s.%s", o.name, "socket")),
+			VMID:            o.id,
+			SocketPath:      socket,
+			SeccompLevel:    seccomp,
 			KernelImagePath: o.kip,
 			KernelArgs:      fmt.Sprintf("init=/vorteil/vinitd console=ttyS0 loglevel=2 reboot=k panic=1 pci=off i8042.noaux i8042.nomux i8042.nopnp i8042.dumbkbd vt.color=0x00 root=PARTUUID=%s", vimg.Part2UUIDString),
 			Drives:          devices,
@@ -346,41 +399,56 @@ func (o *operation) generateFirecrackerConfig(diskpath string) (firecracker.Conf
 				HtEnabled:  firecracker.Bool(false),
 				MemSizeMib: firecracker.Int64(int64(o.config.VM.RAM.Units(vcfg.MiB))),
 			},
-			NetworkInterfaces: interfaces,
+			NetworkInterfaces: o.networkInterfaces(),
+			NetNS:             netns,
 			ForwardSignals:    []os.Signal{},
 		}, []firecracker.Opt{
 			firecracker.WithLogger(log.NewEntry(logger)),
 		}
 }
 
-func (o *operation) deviceCreation() error {
-
-	for i := range o.config.Networks {
-		ifceName := fmt.Sprintf("eth%s%v", o.id, i)
+// rateLimiter limits bytes and operations per second, returning nil if
+// neither is limited.
+func rateLimiter(bandwidth vcfg.Bytes, ops uint) *models.RateLimiter {
 
-		// create interface
-		err := createIfc(ifceName)
-		if err != nil {
-			return err
-		}
+	if bandwidth <= 0 && ops == 0 {
+		return nil
+	}
 
-		// attach to bridge
-		ifc, err := net.InterfaceByName(ifceName)
-		if err != nil {
-			return err
-		}
+	limiter := new(models.RateLimiter)
 
-		// Add tap device to bridge
-		err = o.bridgeDevice.AddSlaveIfc(ifc)
-		if err != nil {
-			return err
-		}
+	if bandwidth > 0 {
+		bucket := firecracker.TokenBucketBuilder{}.
+			WithBucketSize(int64(bandwidth.Units(vcfg.Byte))).
+			WithRefillDuration(time.Second).
+			Build()
+		limiter.Bandwidth = &bucket
+	}
 
-		o.tapDevicesName = append(o.tapDevicesName, ifceName)
-		o.tapDevices = append(o.tapDevices, ifc)
+	if ops > 0 {
+		bucket := firecracker.TokenBucketBuilder{}.
+			WithBucketSize(int64(ops)).
+			WithRefillDuration(time.Second).
+			Build()
+		limiter.Ops = &bucket
 	}
 
-	return nil
+	return limiter
+
+}
+
+// deviceCreation provides the vm's network interfaces with the tap devices
+// from the virtualizer's config, a CNI network, or tap devices attached to the
+// vorteil-bridge.
+func (o *operation) deviceCreation() error {
+	switch {
+	case len(o.vconfig.TapDevices) > 0:
+		return o.useTapDevices()
+	case o.vconfig.CNI != nil:
+		return o.loadCNI()
+	default:
+		return o.bridgeDevices()
+	}
 }
 
 // Start create the virtualmachine and runs it
@@ -396,7 +464,22 @@ func (v *Virtualizer) Start() error {
 				v.logger.Errorf("Error Fetching executable: %s", err.Error())
 			}
 
-			cmd := firecracker.VMCommandBuilder{}.WithBin(executable).WithSocketPath(v.fconfig.SocketPath).WithStdout(v.serialLogger).WithStderr(v.serialLogger).Build(v.gctx)
+			fcfg := v.fconfig
+			fcfg.NetworkInterfaces = v.networkInterfaces()
+			// firecracker-go-sdk rewrites the paths of drives linked into a jail
+			fcfg.Drives = append([]models.Drive(nil), v.fconfig.Drives...)
+
+			var cmd *exec.Cmd
+			if v.jailed() {
+				cmd, err = v.jail(&fcfg)
+				if err != nil {
+					v.logger.Errorf("Error jailing virtual machine: %s", err.Error())
+					v.state = virtualizers.Ready
+					return
+				}
+			} else {
+				cmd = firecracker.VMCommandBuilder{}.WithBin(executable).WithSocketPath(v.fconfig.SocketPath).WithStdout(v.serialLogger).WithStderr(v.serialLogger).Build(v.gctx)
+			}
 			cmd.SysProcAttr = &syscall.SysProcAttr{
 				Setpgid: true,
 				Pgid:    0,
@@ -404,7 +487,7 @@ func (v *Virtualizer) Start() error {
 
 			v.machineOpts = append(v.machineOpts, firecracker.WithProcessRunner(cmd))
 
-			v.machine, err = firecracker.NewMachine(v.vmmCtx, v.fconfig, v.machineOpts...)
+			v.machine, err = firecracker.NewMachine(v.vmmCtx, fcfg, v.machineOpts...)
 			if err != nil {
 				v.logger.Errorf("Error creating machine: %s", err.Error())
 			}
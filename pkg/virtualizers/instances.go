@@ -0,0 +1,316 @@
+package virtualizers
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+// vmSyncInterval is how often the manager persists changes to its vms.
+const vmSyncInterval = time.Second
+
+// vmTable stores an instance for each vm spawned by a virtualizer that
+// implements Reattacher.
+var vmTable = map[string]string{
+	"Table":       "vms",
+	"Name":        "name",
+	"Type":        "type",
+	"Virtualizer": "virtualizer",
+	"State":       "state",
+	"Folder":      "folder",
+	"PID":         "pid",
+	"Disk":        "disk",
+	"Routes":      "routes",
+	"VCFG":        "vcfg",
+	"Created":     "created",
+	"Data":        "data",
+}
+
+// VMInstance describes a vm persisted in the Manager's database.
+type VMInstance struct {
+	Name        string             `json:"name"`
+	Type        string             `json:"type"`        // type of virtualizer running the vm
+	Virtualizer string             `json:"virtualizer"` // name of virtualizer spawned from
+	State       string             `json:"state"`
+	Folder      string             `json:"folder"` // folder storing the vm's files
+	PID         int                `json:"pid"`    // pid of the process running the vm, or zero if it isn't running
+	Disk        string             `json:"disk"`
+	Routes      []NetworkInterface `json:"routes"`
+	Config      *vcfg.VCFG         `json:"vcfg"`
+	Created     time.Time          `json:"created"`
+	Data        []byte             `json:"-"` // anything else the virtualizer needs to reattach
+}
+
+func vmQuery(name, s string) string {
+	tmpl := template.Must(template.New(name).Parse(s))
+	buf := new(bytes.Buffer)
+	err := tmpl.Execute(buf, vmTable)
+	if err != nil {
+		panic(err)
+	}
+	return buf.String()
+}
+
+// initVMTable creates the table vms are persisted in.
+func (mgr *Manager) initVMTable() error {
+	query := vmQuery("vmTableInit", "CREATE TABLE IF NOT EXISTS {{.Table}} ({{.Name}} TEXT, {{.Type}} TEXT, {{.Virtualizer}} TEXT, {{.State}} TEXT, {{.Folder}} TEXT, {{.PID}} INTEGER, {{.Disk}} TEXT, {{.Routes}} BLOB, {{.VCFG}} BLOB, {{.Created}} INTEGER, {{.Data}} BLOB, PRIMARY KEY ({{.Name}}))")
+	_, err := mgr.database.Exec(query)
+	if err != nil {
+		return err
+	}
+	mgr.log("Created vm table.")
+	return nil
+}
+
+func (mgr *Manager) saveVM(inst *VMInstance) error {
+	routes, err := json.Marshal(inst.Routes)
+	if err != nil {
+		return err
+	}
+	config, err := json.Marshal(inst.Config)
+	if err != nil {
+		return err
+	}
+	query := vmQuery("vmTableSave", "INSERT OR REPLACE INTO {{.Table}} ({{.Name}}, {{.Type}}, {{.Virtualizer}}, {{.State}}, {{.Folder}}, {{.PID}}, {{.Disk}}, {{.Routes}}, {{.VCFG}}, {{.Created}}, {{.Data}}) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	_, err = mgr.database.Exec(query, inst.Name, inst.Type, inst.Virtualizer, inst.State, inst.Folder, inst.PID, inst.Disk, routes, config, inst.Created.UnixNano(), inst.Data)
+	return err
+}
+
+func (mgr *Manager) deleteVM(name string) error {
+	query := vmQuery("vmTableDelete", "DELETE FROM {{.Table}} WHERE {{.Name}}=?")
+	_, err := mgr.database.Exec(query, name)
+	return err
+}
+
+func (mgr *Manager) setVMState(name, state string) error {
+	query := vmQuery("vmTableState", "UPDATE {{.Table}} SET {{.State}}=? WHERE {{.Name}}=?")
+	_, err := mgr.database.Exec(query, state, name)
+	return err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanVM(row scanner) (*VMInstance, error) {
+	inst := new(VMInstance)
+	var routes, config []byte
+	var created int64
+	err := row.Scan(&inst.Name, &inst.Type, &inst.Virtualizer, &inst.State, &inst.Folder, &inst.PID, &inst.Disk, &routes, &config, &created, &inst.Data)
+	if err != nil {
+		return nil, err
+	}
+	inst.Created = time.Unix(0, created)
+	err = json.Unmarshal(routes, &inst.Routes)
+	if err != nil {
+		return nil, fmt.Errorf("vm '%s' has corrupt routes: %v", inst.Name, err)
+	}
+	err = json.Unmarshal(config, &inst.Config)
+	if err != nil {
+		return nil, fmt.Errorf("vm '%s' has a corrupt vcfg: %v", inst.Name, err)
+	}
+	return inst, nil
+}
+
+// ListVMs returns every vm persisted in the database, including those that
+// could not be reattached to.
+func (mgr *Manager) ListVMs() ([]VMInstance, error) {
+	query := vmQuery("vmTableList", "SELECT {{.Name}}, {{.Type}}, {{.Virtualizer}}, {{.State}}, {{.Folder}}, {{.PID}}, {{.Disk}}, {{.Routes}}, {{.VCFG}}, {{.Created}}, {{.Data}} FROM {{.Table}} ORDER BY {{.Name}}")
+	rows, err := mgr.database.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list = make([]VMInstance, 0)
+	for rows.Next() {
+		inst, err := scanVM(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *inst)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// GetVM returns the vm persisted in the database with the given name.
+func (mgr *Manager) GetVM(name string) (*VMInstance, error) {
+	query := vmQuery("vmTableGet", "SELECT {{.Name}}, {{.Type}}, {{.Virtualizer}}, {{.State}}, {{.Folder}}, {{.PID}}, {{.Disk}}, {{.Routes}}, {{.VCFG}}, {{.Created}}, {{.Data}} FROM {{.Table}} WHERE {{.Name}}=?")
+	inst, err := scanVM(mgr.database.QueryRow(query, name))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no vm named '%s'", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return inst, nil
+}
+
+// ForgetVM removes a broken vm from the database. Active vms are removed
+// automatically when they are closed.
+func (mgr *Manager) ForgetVM(name string) error {
+	inst, err := mgr.GetVM(name)
+	if err != nil {
+		return err
+	}
+	if inst.State != Broken {
+		return fmt.Errorf("vm '%s' is not broken", name)
+	}
+	return mgr.deleteVM(name)
+}
+
+// syncVMs persists changes to the active vms, and removes vms that have been
+// closed since the last sync.
+func (mgr *Manager) syncVMs() error {
+	mgr.persistLock.Lock()
+	defer mgr.persistLock.Unlock()
+
+	var err error
+	seen := make(map[string]bool)
+
+	ActiveVMs.Range(func(key, value interface{}) bool {
+		r, ok := value.(Reattacher)
+		if !ok {
+			return true
+		}
+		inst := r.Instance()
+		seen[inst.Name] = true
+
+		data, merr := json.Marshal(inst)
+		if merr != nil {
+			err = merr
+			return true
+		}
+		data = append(data, inst.Data...)
+		if bytes.Equal(data, mgr.persisted[inst.Name]) {
+			return true
+		}
+
+		serr := mgr.saveVM(inst)
+		if serr != nil {
+			err = serr
+			return true
+		}
+		mgr.persisted[inst.Name] = data
+		return true
+	})
+
+	for name := range mgr.persisted {
+		if seen[name] {
+			continue
+		}
+		derr := mgr.deleteVM(name)
+		if derr != nil {
+			err = derr
+			continue
+		}
+		delete(mgr.persisted, name)
+	}
+
+	return err
+}
+
+// watchVMs syncs the active vms with the database until the manager closes.
+func (mgr *Manager) watchVMs() {
+	defer close(mgr.watching)
+
+	ticker := time.NewTicker(vmSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mgr.done:
+			return
+		case <-ticker.C:
+			err := mgr.syncVMs()
+			if err != nil {
+				mgr.log("Failed to persist vms: %v.", err)
+			}
+		}
+	}
+}
+
+func (mgr *Manager) reattach(inst *VMInstance) error {
+	palloc, ok := registeredVirtualizers[inst.Type]
+	if !ok {
+		return fmt.Errorf("unrecognized virtualizer type: %s", inst.Type)
+	}
+
+	v := palloc.Alloc()
+	r, ok := v.(Reattacher)
+	if !ok {
+		return fmt.Errorf("%s virtualizer does not support reattaching to vms", inst.Type)
+	}
+
+	if inst.PID != 0 && !ProcessAlive(inst.PID) {
+		return fmt.Errorf("process %d is no longer running", inst.PID)
+	}
+
+	if _, ok := ActiveVMs.Load(inst.Name); ok {
+		return errors.New("virtual machine already exists")
+	}
+
+	err := r.Reattach(inst, mgr.vmLogger)
+	if err != nil {
+		return err
+	}
+
+	ActiveVMs.Store(inst.Name, v)
+
+	return nil
+}
+
+// reattachVMs takes control of the vms persisted by a previous manager. Any
+// that can't be reattached to are marked broken.
+func (mgr *Manager) reattachVMs() error {
+	list, err := mgr.ListVMs()
+	if err != nil {
+		return err
+	}
+
+	for i := range list {
+		inst := &list[i]
+		if inst.State == Broken {
+			continue
+		}
+
+		err = mgr.reattach(inst)
+		if err != nil {
+			mgr.log("Unable to reattach to vm '%s', marking it broken: %v.", inst.Name, err)
+			err = mgr.setVMState(inst.Name, Broken)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		mgr.log("Reattached to vm '%s'.", inst.Name)
+	}
+
+	return mgr.syncVMs()
+}
+
+// WaitProcess blocks until the process with the given pid exits. It is used
+// for processes reattached to, which can't be waited on normally because they
+// aren't children of this process.
+func WaitProcess(pid int) {
+	for ProcessAlive(pid) {
+		time.Sleep(time.Millisecond * 500)
+	}
+}
@@ -0,0 +1,86 @@
+// +build linux
+
+package iputil
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/milosgajdos/tenus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	tunPath = "/dev/net/tun"
+
+	cIFFTAP  = 0x0002
+	cIFFNOPI = 0x1000
+)
+
+type ifReq struct {
+	Name  [0x10]byte
+	Flags uint16
+	pad   [0x28 - 0x10 - 2]byte
+}
+
+func ioctl(fd uintptr, request uintptr, argp uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(request), argp)
+	if errno != 0 {
+		return os.NewSyscallError("ioctl", errno)
+	}
+	return nil
+}
+
+// CreateTap creates a persistent tap device and sets it up, returning an error if unsuccessful
+func CreateTap(name string) error {
+
+	var (
+		tunfd int
+		err   error
+	)
+	// delete the interface if something failed
+	defer func() {
+		if err != nil {
+			tenus.DeleteLink(name)
+		}
+	}()
+
+	if tunfd, err = syscall.Open(tunPath, os.O_RDWR|syscall.O_NONBLOCK, 0); err != nil {
+		return err
+	}
+	defer syscall.Close(tunfd)
+
+	var req ifReq
+	req.Flags = cIFFTAP | cIFFNOPI
+	copy(req.Name[:], name)
+
+	err = ioctl(uintptr(tunfd), syscall.TUNSETIFF, uintptr(unsafe.Pointer(&req)))
+	if err != nil {
+		return err
+	}
+
+	req2 := 1
+	err = ioctl(uintptr(tunfd), syscall.TUNSETPERSIST, uintptr(unsafe.Pointer(&req2)))
+	if err != nil {
+		return err
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+
+	err = netlink.LinkSetUp(link)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
@@ -0,0 +1,123 @@
+package libvirt
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/json"
+	"net/url"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+)
+
+// VirtualizerID is a unique identifier for libvirt
+var VirtualizerID = "libvirt"
+
+const (
+	defaultURI        = "qemu:///system"
+	defaultNetwork    = "default"
+	defaultDomainType = "kvm"
+)
+
+type allocator struct{}
+
+// Config to run the virtualizer. Vms are defined as persistent domains on the
+// libvirtd URI connects to, over libvirt's RPC protocol, so they show up in
+// virsh and other libvirt tools while they exist.
+type Config struct {
+	URI        string `json:"uri,omitempty"`        // libvirt connection URI, qemu:///system if empty
+	Network    string `json:"network,omitempty"`    // libvirt network the vm's network interfaces are attached to, default if empty
+	DomainType string `json:"domainType,omitempty"` // hypervisor of the domain, kvm if empty
+}
+
+func (c *Config) uri() string {
+	if c.URI == "" {
+		return defaultURI
+	}
+	return c.URI
+}
+
+func (c *Config) network() string {
+	if c.Network == "" {
+		return defaultNetwork
+	}
+	return c.Network
+}
+
+func (c *Config) domainType() string {
+	if c.DomainType == "" {
+		return defaultDomainType
+	}
+	return c.DomainType
+}
+
+// Marshal the config into a byte[]
+func (c *Config) Marshal() []byte {
+	data, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// Unmarshal the byte[] array into a config struct
+func (c *Config) Unmarshal(data []byte) error {
+	err := json.Unmarshal(data, c)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Allocator for libvirt
+var Allocator virtualizers.VirtualizerAllocator = &allocator{}
+
+// Alloc returns a new virtualizer
+func (a *allocator) Alloc() virtualizers.Virtualizer {
+	return new(Virtualizer)
+}
+
+// DiskAlignment returns the alignment libvirt requires to run properly
+func (a *allocator) DiskAlignment() vcfg.Bytes {
+	return 2 * vcfg.MiB
+}
+
+// DiskFormat return the format the hypervisor should be using
+func (a *allocator) DiskFormat() vdisk.Format {
+	return vdisk.QCOW2Format
+}
+
+// IsAvailable returns true if libvirtd can be connected to at the default URI
+func (a *allocator) IsAvailable() bool {
+	l, err := connect(defaultURI)
+	if err != nil {
+		return false
+	}
+	l.Disconnect()
+	return true
+}
+
+// ValidateArgs check if valid args are passed to create a valid Virtualizer
+func (a *allocator) ValidateArgs(data []byte) error {
+	c := new(Config)
+	err := c.Unmarshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = url.Parse(c.uri())
+	return err
+}
+
+// Create creates a virtualizer using the provided manager
+func Create(mgr *virtualizers.Manager, name string, c *Config) error {
+	err := mgr.CreateVirtualizer(name, VirtualizerID, c.Marshal())
+	if err != nil {
+		return err
+	}
+	return nil
+}
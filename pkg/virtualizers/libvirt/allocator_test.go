@@ -0,0 +1,80 @@
+package libvirt
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+)
+
+func TestRegister(t *testing.T) {
+	virtualizers.Register(VirtualizerID, Allocator)
+	alloc := virtualizers.RegisteredVirtualizers()
+	if alloc[VirtualizerID] == nil {
+		t.Errorf("registering virtualizer failed, as map lookup returned nil")
+	}
+}
+
+func TestMarshalAndUnmarshal(t *testing.T) {
+	c := &Config{
+		URI:     "qemu+ssh://root@host/system",
+		Network: "vorteil",
+	}
+	config := new(Config)
+	err := config.Unmarshal(c.Marshal())
+	if err != nil {
+		t.Errorf("unmarshal failed, recevied error \"%v\"", err)
+	}
+	if *config != *c {
+		t.Errorf("marshal on umarshal failed, expected %v but got %v", c, config)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	c := new(Config)
+	if c.uri() != "qemu:///system" || c.network() != "default" || c.domainType() != "kvm" {
+		t.Errorf("unexpected defaults %s, %s and %s", c.uri(), c.network(), c.domainType())
+	}
+}
+
+func TestValidateArgs(t *testing.T) {
+	err := Allocator.ValidateArgs((&Config{}).Marshal())
+	if err != nil {
+		t.Errorf("validating args failed, unable to validate config struct got err: %v", err)
+	}
+
+	err = Allocator.ValidateArgs((&Config{URI: "qemu+ssh://host:port/system"}).Marshal())
+	if err == nil {
+		t.Errorf("expected validating a config with an invalid uri to fail")
+	}
+}
+
+func TestAlloc(t *testing.T) {
+	virt := Allocator.Alloc()
+	if virt == nil {
+		t.Errorf("attempting to alloc virtualizer ended up in getting nil object")
+	}
+}
+
+func TestDiskAlignment(t *testing.T) {
+	size := 2 * vcfg.MiB
+	align := Allocator.DiskAlignment()
+
+	if align != size {
+		t.Errorf("disk alignment does not match expected %v but got %v", size, align)
+	}
+}
+
+func TestDiskFormat(t *testing.T) {
+	format := Allocator.DiskFormat()
+	exactFormat := vdisk.QCOW2Format
+	if format != exactFormat {
+		t.Errorf("disk format does not match %v got %v instead", exactFormat, format)
+	}
+}
@@ -0,0 +1,263 @@
+package libvirt
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alessio/shellescape"
+	"github.com/digitalocean/go-libvirt"
+)
+
+// where libvirt's own clients look for libvirtd
+const (
+	defaultSocket  = "/var/run/libvirt/libvirt-sock"
+	defaultTCPPort = "16509"
+	defaultTLSPort = "16514"
+	defaultNetcat  = "nc"
+)
+
+// connect opens a connection to the libvirtd uri refers to, the same way
+// virsh would.
+func connect(uri string) (*libvirt.Libvirt, error) {
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dial(u)
+	if err != nil {
+		return nil, err
+	}
+
+	l := libvirt.New(conn)
+
+	// libvirtd expects clients to ask how to authenticate before opening
+	_, err = l.AuthList()
+	if err == nil {
+		err = l.ConnectOpen(libvirt.OptString{remoteName(u)}, 0)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to connect to libvirt at %s: %w", uri, err)
+	}
+
+	return l, nil
+
+}
+
+// remoteName returns the URI libvirtd opens once connected to, which is uri
+// without its transport or host, unless a name is given in its query.
+func remoteName(uri *url.URL) string {
+
+	if name := uri.Query().Get("name"); name != "" {
+		return name
+	}
+
+	return (&url.URL{
+		Scheme: strings.SplitN(uri.Scheme, "+", 2)[0],
+		Path:   uri.Path,
+	}).String()
+
+}
+
+// dial connects to libvirtd over the transport uri names, which is a unix
+// socket unless it has a host, in which case it's tls.
+func dial(uri *url.URL) (net.Conn, error) {
+
+	transport := "unix"
+	if s := strings.SplitN(uri.Scheme, "+", 2); len(s) == 2 {
+		transport = s[1]
+	} else if uri.Host != "" {
+		transport = "tls"
+	}
+
+	socket := uri.Query().Get("socket")
+	if socket == "" {
+		socket = defaultSocket
+		if dir := os.Getenv("XDG_RUNTIME_DIR"); uri.Path == "/session" && dir != "" {
+			socket = filepath.Join(dir, "libvirt", "libvirt-sock")
+		}
+	}
+
+	switch transport {
+	case "unix":
+		return net.Dial("unix", socket)
+	case "tcp":
+		return net.Dial("tcp", hostPort(uri, defaultTCPPort))
+	case "tls":
+		return dialTLS(uri)
+	case "ssh":
+		return dialSSH(uri, socket)
+	default:
+		return nil, fmt.Errorf("unsupported libvirt transport '%s'", transport)
+	}
+
+}
+
+func hostPort(uri *url.URL, port string) string {
+
+	if p := uri.Port(); p != "" {
+		port = p
+	}
+
+	return net.JoinHostPort(uri.Hostname(), port)
+
+}
+
+// dialTLS connects with the client certificate libvirt's own clients use,
+// from /etc/pki or the uri's pkipath.
+func dialTLS(uri *url.URL) (net.Conn, error) {
+
+	ca := "/etc/pki/CA/cacert.pem"
+	cert := "/etc/pki/libvirt/clientcert.pem"
+	key := "/etc/pki/libvirt/private/clientkey.pem"
+	if dir := uri.Query().Get("pkipath"); dir != "" {
+		ca = filepath.Join(dir, "cacert.pem")
+		cert = filepath.Join(dir, "clientcert.pem")
+		key = filepath.Join(dir, "clientkey.pem")
+	}
+
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(ca)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", ca)
+	}
+
+	return tls.Dial("tcp", hostPort(uri, defaultTLSPort), &tls.Config{
+		Certificates:       []tls.Certificate{pair},
+		RootCAs:            pool,
+		ServerName:         uri.Hostname(),
+		InsecureSkipVerify: uri.Query().Get("no_verify") == "1",
+	})
+
+}
+
+// dialSSH runs netcat against libvirtd's socket on another host through the
+// system's ssh client, which is how libvirt tunnels over ssh, so the user's
+// ssh config, agent and known hosts all apply.
+func dialSSH(uri *url.URL, socket string) (net.Conn, error) {
+
+	args := []string{"-e", "none"}
+	if p := uri.Port(); p != "" {
+		args = append(args, "-p", p)
+	}
+	if u := uri.User.Username(); u != "" {
+		args = append(args, "-l", u)
+	}
+	if k := uri.Query().Get("keyfile"); k != "" {
+		args = append(args, "-i", k)
+	}
+
+	netcat := uri.Query().Get("netcat")
+	if netcat == "" {
+		netcat = defaultNetcat
+	}
+
+	args = append(args, "--", uri.Hostname(), shellescape.Quote(netcat), "-U", shellescape.Quote(socket))
+
+	cmd := exec.Command("ssh", args...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	return &sshConn{
+		cmd:    cmd,
+		host:   uri.Hostname(),
+		stdin:  stdin,
+		stdout: stdout,
+	}, nil
+
+}
+
+// sshConn is a connection to libvirtd through the stdin and stdout of ssh.
+type sshConn struct {
+	cmd    *exec.Cmd
+	host   string
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+}
+
+type sshAddr string
+
+func (a sshAddr) Network() string {
+	return "ssh"
+}
+
+func (a sshAddr) String() string {
+	return string(a)
+}
+
+func (c *sshConn) Read(p []byte) (int, error) {
+	return c.stdout.Read(p)
+}
+
+func (c *sshConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+// Close ends the ssh session.
+func (c *sshConn) Close() error {
+	c.stdin.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return nil
+}
+
+func (c *sshConn) LocalAddr() net.Addr {
+	return sshAddr("localhost")
+}
+
+func (c *sshConn) RemoteAddr() net.Addr {
+	return sshAddr(c.host)
+}
+
+func (c *sshConn) SetDeadline(t time.Time) error {
+	return errors.New("deadlines are not supported over ssh")
+}
+
+func (c *sshConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *sshConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
@@ -0,0 +1,173 @@
+package libvirt
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/xml"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+)
+
+// domain is the subset of libvirt's domain XML vorteil vms are defined with.
+type domain struct {
+	XMLName    xml.Name `xml:"domain"`
+	Type       string   `xml:"type,attr"`
+	Name       string   `xml:"name"`
+	Memory     memory   `xml:"memory"`
+	VCPU       uint     `xml:"vcpu"`
+	OS         domainOS `xml:"os"`
+	Features   features `xml:"features"`
+	OnPoweroff string   `xml:"on_poweroff"`
+	OnReboot   string   `xml:"on_reboot"`
+	OnCrash    string   `xml:"on_crash"`
+	Devices    devices  `xml:"devices"`
+}
+
+type memory struct {
+	Unit  string `xml:"unit,attr"`
+	Value int    `xml:",chardata"`
+}
+
+type domainOS struct {
+	Type osType `xml:"type"`
+	Boot boot   `xml:"boot"`
+}
+
+type osType struct {
+	Arch  string `xml:"arch,attr"`
+	Value string `xml:",chardata"`
+}
+
+type boot struct {
+	Dev string `xml:"dev,attr"`
+}
+
+type features struct {
+	ACPI *struct{} `xml:"acpi"`
+	APIC *struct{} `xml:"apic"`
+}
+
+type devices struct {
+	Disks      []disk   `xml:"disk"`
+	Interfaces []iface  `xml:"interface"`
+	Serials    []serial `xml:"serial"`
+}
+
+type disk struct {
+	Type   string     `xml:"type,attr"`
+	Device string     `xml:"device,attr"`
+	Driver diskDriver `xml:"driver"`
+	Source diskSource `xml:"source"`
+	Target diskTarget `xml:"target"`
+}
+
+type diskDriver struct {
+	Name string `xml:"name,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type diskSource struct {
+	File string `xml:"file,attr"`
+}
+
+type diskTarget struct {
+	Dev string `xml:"dev,attr"`
+	Bus string `xml:"bus,attr"`
+}
+
+type iface struct {
+	Type   string      `xml:"type,attr"`
+	Source ifaceSource `xml:"source"`
+	Model  ifaceModel  `xml:"model"`
+}
+
+type ifaceSource struct {
+	Network string `xml:"network,attr"`
+}
+
+type ifaceModel struct {
+	Type string `xml:"type,attr"`
+}
+
+type serial struct {
+	Type   string       `xml:"type,attr"`
+	Target serialTarget `xml:"target"`
+}
+
+type serialTarget struct {
+	Port int `xml:"port,attr"`
+}
+
+// driverType returns the name libvirt gives the disk format.
+func driverType(format vdisk.Format) string {
+	switch format {
+	case vdisk.QCOW2Format, vdisk.QCOW2CompressedFormat:
+		return "qcow2"
+	case vdisk.VMDKFormat, vdisk.VMDKSparseFormat, vdisk.VMDKStreamOptimizedFormat:
+		return "vmdk"
+	case vdisk.VHDFormat, vdisk.VHDFixedFormat, vdisk.VHDDynamicFormat:
+		return "vpc"
+	default:
+		return string(format)
+	}
+}
+
+// domain describes the vm as a libvirt domain. The serial port is a pty,
+// which libvirt also makes the domain's console for the virtualizer to read
+// the vm's output from, and the domain is destroyed rather than rebooted, the same as a QEMU
+// vm run with -no-reboot.
+func (v *Virtualizer) domain() *domain {
+
+	cpus := v.config.VM.CPUs
+	if cpus == 0 {
+		cpus = 1
+	}
+
+	d := &domain{
+		Type: v.vconfig.domainType(),
+		Name: v.name,
+		Memory: memory{
+			Unit:  "MiB",
+			Value: v.config.VM.RAM.Units(vcfg.MiB),
+		},
+		VCPU: cpus,
+		OS: domainOS{
+			Type: osType{Arch: "x86_64", Value: "hvm"},
+			Boot: boot{Dev: "hd"},
+		},
+		Features: features{
+			ACPI: &struct{}{},
+			APIC: &struct{}{},
+		},
+		OnPoweroff: "destroy",
+		OnReboot:   "destroy",
+		OnCrash:    "destroy",
+	}
+
+	d.Devices.Disks = append(d.Devices.Disks, disk{
+		Type:   "file",
+		Device: "disk",
+		Driver: diskDriver{Name: "qemu", Type: driverType(Allocator.DiskFormat())},
+		Source: diskSource{File: v.diskpath},
+		Target: diskTarget{Dev: "vda", Bus: "virtio"},
+	})
+
+	for range v.config.Networks {
+		d.Devices.Interfaces = append(d.Devices.Interfaces, iface{
+			Type:   "network",
+			Source: ifaceSource{Network: v.vconfig.network()},
+			Model:  ifaceModel{Type: "virtio"},
+		})
+	}
+
+	d.Devices.Serials = append(d.Devices.Serials, serial{
+		Type: "pty",
+	})
+
+	return d
+
+}
@@ -0,0 +1,120 @@
+package libvirt
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+)
+
+func testVirtualizer() *Virtualizer {
+	return &Virtualizer{
+		name:     "vorteil-test",
+		diskpath: "/tmp/vorteil-test/disk.qcow2",
+		config: &vcfg.VCFG{
+			VM: vcfg.VMSettings{
+				CPUs: 2,
+				RAM:  256 * vcfg.MiB,
+			},
+			Networks: []vcfg.NetworkInterface{{}, {}},
+		},
+		vconfig: &Config{DomainType: "test"},
+	}
+}
+
+func TestDriverType(t *testing.T) {
+	tests := map[vdisk.Format]string{
+		vdisk.RAWFormat:             "raw",
+		vdisk.QCOW2Format:           "qcow2",
+		vdisk.QCOW2CompressedFormat: "qcow2",
+		vdisk.VMDKSparseFormat:      "vmdk",
+		vdisk.VHDDynamicFormat:      "vpc",
+		vdisk.VHDXFormat:            "vhdx",
+	}
+
+	for format, exact := range tests {
+		if driverType(format) != exact {
+			t.Errorf("expected %s disks to have driver type %s but got %s", format, exact, driverType(format))
+		}
+	}
+}
+
+func TestDomain(t *testing.T) {
+	d := testVirtualizer().domain()
+
+	if d.Type != "test" || d.Name != "vorteil-test" || d.VCPU != 2 || d.Memory.Value != 256 || d.Memory.Unit != "MiB" {
+		t.Errorf("domain doesn't match the vcfg: %+v", d)
+	}
+
+	if len(d.Devices.Disks) != 1 || d.Devices.Disks[0].Driver.Type != "qcow2" || d.Devices.Disks[0].Source.File != "/tmp/vorteil-test/disk.qcow2" {
+		t.Errorf("unexpected disks %+v", d.Devices.Disks)
+	}
+
+	if len(d.Devices.Interfaces) != 2 {
+		t.Fatalf("expected 2 network interfaces but got %d", len(d.Devices.Interfaces))
+	}
+	for _, ifc := range d.Devices.Interfaces {
+		if ifc.Source.Network != "default" || ifc.Model.Type != "virtio" {
+			t.Errorf("unexpected network interface %+v", ifc)
+		}
+	}
+
+	if len(d.Devices.Serials) != 1 || d.Devices.Serials[0].Type != "pty" {
+		t.Errorf("unexpected serial ports %+v", d.Devices.Serials)
+	}
+
+	data, err := xml.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), `<domain type="test"><name>vorteil-test</name>`) {
+		t.Errorf("unexpected domain xml %s", data)
+	}
+}
+
+// TestDefine checks that libvirt accepts the domain by defining and starting
+// it with libvirt's test driver, which keeps its state for a single
+// connection.
+func TestDefine(t *testing.T) {
+	virsh, err := exec.LookPath("virsh")
+	if err != nil {
+		t.Skip("virsh is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "vorteil-libvirt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, err := xml.MarshalIndent(testVirtualizer().domain(), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "domain.xml")
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command(virsh, "--quiet", "--connect", "test:///default",
+		"define "+path+"; start vorteil-test; domstate vorteil-test").CombinedOutput()
+	if err != nil {
+		t.Fatalf("libvirt rejected the domain: %v: %s", err, out)
+	}
+	if !strings.Contains(string(out), "running") {
+		t.Errorf("expected domain to be running but got: %s", out)
+	}
+}
@@ -0,0 +1,458 @@
+package libvirt
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+	logger "github.com/vorteil/vorteil/pkg/virtualizers/logging"
+	"github.com/vorteil/vorteil/pkg/virtualizers/util"
+)
+
+// Virtualizer is a struct which will implement the interface so the manager can control it
+type Virtualizer struct {
+	// VM related stuff
+	name  string // name of vm and of its libvirt domain
+	pname string // name of virtualizer
+	state string // status of vm
+
+	created      time.Time      // time the vm was created
+	folder       string         // folder to store vm details
+	diskpath     string         // path to the disk of the machine
+	source       interface{}    // details about how the vm was made
+	logger       elog.View      // logger
+	serialLogger *logger.Logger // logs for the serial of the vm
+
+	routes []virtualizers.NetworkInterface // api network interface that displays ports
+	config *vcfg.VCFG                      // config for the vm
+
+	// libvirt specific
+	vconfig *Config          // how to connect to libvirtd and network vms
+	conn    *libvirt.Libvirt // connection to libvirtd
+	dom     libvirt.Domain   // the vm's domain
+	console *libvirt.Libvirt // connection the domain's console is streamed over
+
+	vmdrive string // store disks in this directory
+}
+
+// Type returns the type of virtualizer
+func (v *Virtualizer) Type() string {
+	return VirtualizerID
+}
+
+// Initialize passes the arguments from creation to create a virtualizer
+func (v *Virtualizer) Initialize(data []byte) error {
+	c := new(Config)
+	err := c.Unmarshal(data)
+	if err != nil {
+		return err
+	}
+
+	v.vconfig = c
+	return nil
+}
+
+// operation is the job progress that gets tracked via APIs
+type operation struct {
+	finishedLock sync.Mutex
+	isFinished   bool
+	*Virtualizer
+	Logs   chan string
+	Status chan string
+	Error  chan error
+	ctx    context.Context
+}
+
+// log writes a log to the channel for the job
+func (o *operation) log(text string, v ...interface{}) {
+	o.Logs <- fmt.Sprintf(text, v...)
+}
+
+// finished completes the operation and lets the user know and cleans up channels
+func (o *operation) finished(err error) {
+	o.finishedLock.Lock()
+	defer o.finishedLock.Unlock()
+	if o.isFinished {
+		return
+	}
+	o.isFinished = true
+
+	if err != nil {
+		o.Logs <- fmt.Sprintf("Error: %v", err)
+		o.Status <- fmt.Sprintf("Failed: %v", err)
+		o.Error <- err
+	}
+
+	close(o.Logs)
+	close(o.Status)
+	close(o.Error)
+}
+
+// updateStatus updates the status of the job to provide more feedback to the user currently reading the job.
+func (o *operation) updateStatus(text string) {
+	o.Status <- text
+	o.Logs <- text
+}
+
+// Serial returns the serial logger which contains the serial output of the app.
+func (v *Virtualizer) Serial() *logger.Logger {
+	return v.serialLogger
+}
+
+// State returns the state of the virtual machine
+func (v *Virtualizer) State() string {
+	return v.state
+}
+
+// Details returns data to for the ConverToVM function on util
+func (v *Virtualizer) Details() (string, string, string, []virtualizers.NetworkInterface, time.Time, *vcfg.VCFG, interface{}) {
+	return v.name, v.pname, v.state, v.routes, v.created, v.config, v.source
+}
+
+// Download returns the disk
+func (v *Virtualizer) Download() (vio.File, error) {
+	v.logger.Debugf("Downloading Disk")
+
+	if !(v.state == virtualizers.Ready) {
+		return nil, fmt.Errorf("the machine must be in a stopped or ready state")
+	}
+
+	f, err := vio.LazyOpen(v.diskpath)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// connect opens a connection to the libvirtd the virtualizer's URI points
+// at, which may be on another host.
+func (v *Virtualizer) connect() (*libvirt.Libvirt, error) {
+	return connect(v.vconfig.uri())
+}
+
+// domainState maps the state libvirt reports for a domain to a vm state.
+func domainState(state libvirt.DomainState) string {
+	switch state {
+	case libvirt.DomainRunning:
+		return virtualizers.Alive
+	case libvirt.DomainPaused:
+		return virtualizers.Paused
+	case libvirt.DomainShutoff:
+		return virtualizers.Ready
+	case libvirt.DomainCrashed:
+		return virtualizers.Broken
+	default:
+		return virtualizers.Changing
+	}
+}
+
+// checkState polls the state of the domain, which may be changed by other
+// libvirt tools, until the vm is deleted.
+func (v *Virtualizer) checkState() {
+	for v.state != virtualizers.Deleted {
+		state, _, err := v.conn.DomainGetState(v.dom, 0)
+		if err != nil {
+			// the domain was undefined
+			if libvirt.IsNotFound(err) {
+				break
+			}
+			v.logger.Errorf("Getting VM State: %s", err.Error())
+		} else if v.state != virtualizers.Deleted && v.state != virtualizers.Changing {
+			v.state = domainState(libvirt.DomainState(state))
+		}
+		time.Sleep(time.Second * 1)
+	}
+}
+
+// initLogging streams the domain's console into the serial logger over its
+// own connection to libvirtd, so it works wherever the domain runs.
+func (v *Virtualizer) initLogging() error {
+	v.logger.Debugf("Initializing Serial Logger...")
+
+	console, err := v.connect()
+	if err != nil {
+		v.logger.Errorf("Error: unable to open console: %v", err)
+		return err
+	}
+	v.console = console
+
+	go func() {
+		err := console.DomainOpenConsole(v.dom, nil, v.serialLogger, uint32(libvirt.DomainConsoleForce))
+		if err != nil && v.console == console {
+			v.logger.Errorf("Error: streaming console: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// Start starts the domain
+func (v *Virtualizer) Start() error {
+	v.logger.Debugf("Starting VM")
+	switch v.State() {
+	case virtualizers.Ready:
+		v.state = virtualizers.Changing
+
+		err := v.conn.DomainCreate(v.dom)
+		if err != nil {
+			v.state = virtualizers.Ready
+			return err
+		}
+
+		go v.initLogging()
+		go func() {
+			v.routes = util.LookForIP(v.serialLogger, v.routes)
+		}()
+
+		v.state = virtualizers.Alive
+	default:
+		return fmt.Errorf("vm not in a state to be started currently in: %s", v.State())
+	}
+	return nil
+}
+
+// Stop sends the domain an ACPI shutdown, and destroys it if it hasn't shut
+// off within 10 seconds
+func (v *Virtualizer) Stop() error {
+	v.logger.Debugf("Stopping VM")
+	if v.state == virtualizers.Ready {
+		return errors.New("vm is already stopped")
+	}
+
+	v.state = virtualizers.Changing
+
+	err := v.conn.DomainShutdown(v.dom)
+	if err != nil {
+		return err
+	}
+
+	for count := 0; ; count++ {
+		state, _, err := v.conn.DomainGetState(v.dom, 0)
+		if err != nil {
+			return err
+		}
+		if libvirt.DomainState(state) == libvirt.DomainShutoff {
+			break
+		}
+		if count > 10 {
+			v.logger.Errorf("Unable to stop virtual machine within 10 seconds powering off...")
+			return v.ForceStop()
+		}
+		time.Sleep(time.Second * 1)
+	}
+
+	v.closeSerial()
+	v.state = virtualizers.Ready
+
+	return nil
+}
+
+// ForceStop destroys the running domain, which is the equivalent of pulling
+// its power cord
+func (v *Virtualizer) ForceStop() error {
+	state, _, err := v.conn.DomainGetState(v.dom, 0)
+	if err != nil {
+		return err
+	}
+
+	if libvirt.DomainState(state) != libvirt.DomainShutoff {
+		err = v.conn.DomainDestroy(v.dom)
+		if err != nil {
+			return err
+		}
+	}
+
+	v.closeSerial()
+	v.state = virtualizers.Ready
+
+	return nil
+}
+
+// Pause suspends the domain.
+func (v *Virtualizer) Pause() error {
+	v.logger.Debugf("Pausing VM")
+
+	if v.state != virtualizers.Alive {
+		return fmt.Errorf("vm not in a state to be paused currently in: %s", v.state)
+	}
+
+	err := v.conn.DomainSuspend(v.dom)
+	if err != nil {
+		return err
+	}
+
+	v.state = virtualizers.Paused
+
+	return nil
+}
+
+// Resume resumes a suspended domain.
+func (v *Virtualizer) Resume() error {
+	v.logger.Debugf("Resuming VM")
+
+	if v.state != virtualizers.Paused {
+		return fmt.Errorf("vm not in a state to be resumed currently in: %s", v.state)
+	}
+
+	err := v.conn.DomainResume(v.dom)
+	if err != nil {
+		return err
+	}
+
+	v.state = virtualizers.Alive
+
+	return nil
+}
+
+func (v *Virtualizer) closeSerial() {
+	if v.console != nil {
+		console := v.console
+		v.console = nil
+		console.Disconnect()
+	}
+}
+
+// Close stops the domain and undefines it, leaving the disk for the manager
+// to clean up
+func (v *Virtualizer) Close(force bool) error {
+	v.logger.Debugf("Deleting VM")
+
+	if force && v.state != virtualizers.Ready {
+		err := v.ForceStop()
+		if err != nil {
+			return err
+		}
+	} else if v.state != virtualizers.Ready {
+		err := v.Stop()
+		if err != nil {
+			return err
+		}
+	}
+
+	v.state = virtualizers.Deleted
+
+	err := v.conn.DomainUndefine(v.dom)
+	if err != nil && !libvirt.IsNotFound(err) {
+		return err
+	}
+
+	v.closeSerial()
+	v.conn.Disconnect()
+
+	// remove virtualizer from active vms
+	virtualizers.ActiveVMs.Delete(v.name)
+
+	return nil
+}
+
+// Prepare prepares the virtualizer with the appropriate fields to run the virtual machine
+func (v *Virtualizer) Prepare(args *virtualizers.PrepareArgs) *virtualizers.VirtualizeOperation {
+
+	op := new(operation)
+	op.Virtualizer = v
+	v.name = args.Name
+	v.pname = args.PName
+	v.created = time.Now()
+	v.config = args.Config
+	v.source = args.Source
+	v.vmdrive = args.VMDrive
+	v.diskpath = args.ImagePath
+	v.logger = args.Logger
+	v.serialLogger = logger.NewLogger(2048 * 10)
+	v.logger.Debugf("Preparing VM")
+	v.routes = util.Routes(args.Config.Networks)
+	if v.vconfig == nil {
+		v.vconfig = new(Config)
+	}
+	op.Logs = make(chan string, 128)
+	op.Error = make(chan error, 1)
+	op.Status = make(chan string, 10)
+	op.ctx = args.Context
+
+	o := new(virtualizers.VirtualizeOperation)
+	o.Logs = op.Logs
+	o.Error = op.Error
+	o.Status = op.Status
+
+	go op.prepare(args)
+
+	return o
+}
+
+// define connects to libvirtd and defines the vm's domain on it.
+func (o *operation) define() error {
+
+	conn, err := o.connect()
+	if err != nil {
+		return err
+	}
+
+	data, err := xml.MarshalIndent(o.domain(), "", "  ")
+	if err != nil {
+		conn.Disconnect()
+		return err
+	}
+
+	o.dom, err = conn.DomainDefineXML(string(data))
+	if err != nil {
+		conn.Disconnect()
+		return err
+	}
+
+	o.conn = conn
+
+	return nil
+
+}
+
+// prepare defines the vm's domain
+func (o *operation) prepare(args *virtualizers.PrepareArgs) {
+	var returnErr error
+	defer func() {
+		o.finished(returnErr)
+	}()
+
+	o.updateStatus(fmt.Sprintf("Defining libvirt domain..."))
+
+	o.state = "initializing"
+	o.folder = filepath.Dir(args.ImagePath)
+
+	_, loaded := virtualizers.ActiveVMs.LoadOrStore(o.name, o.Virtualizer)
+	if loaded {
+		returnErr = errors.New("virtual machine already exists")
+		return
+	}
+
+	err := o.define()
+	if err != nil {
+		virtualizers.ActiveVMs.Delete(o.name)
+		returnErr = err
+		return
+	}
+
+	o.state = virtualizers.Ready
+	go o.checkState()
+
+	if args.Start {
+		err = o.Start()
+		if err != nil {
+			returnErr = err
+			return
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package libvirt
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+)
+
+func TestDomainState(t *testing.T) {
+	tests := map[libvirt.DomainState]string{
+		libvirt.DomainRunning:  virtualizers.Alive,
+		libvirt.DomainPaused:   virtualizers.Paused,
+		libvirt.DomainShutoff:  virtualizers.Ready,
+		libvirt.DomainCrashed:  virtualizers.Broken,
+		libvirt.DomainShutdown: virtualizers.Changing,
+	}
+
+	for state, exact := range tests {
+		if domainState(state) != exact {
+			t.Errorf("expected domain state %d to be %s but got %s", state, exact, domainState(state))
+		}
+	}
+}
+
+func TestRemoteName(t *testing.T) {
+	tests := map[string]string{
+		"qemu:///system":                           "qemu:///system",
+		"qemu+ssh://root@example.com/system":       "qemu:///system",
+		"qemu+tls://example.com:1234/session":      "qemu:///session",
+		"test:///default":                          "test:///default",
+		"qemu+unix:///system?name=qemu:///session": "qemu:///session",
+	}
+
+	for uri, exact := range tests {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name := remoteName(u); name != exact {
+			t.Errorf("expected remote name of %s to be %s but got %s", uri, exact, name)
+		}
+	}
+}
+
+func TestDialUnsupportedTransport(t *testing.T) {
+	u, err := url.Parse("qemu+libssh2://example.com/system")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = dial(u)
+	if err == nil || !strings.Contains(err.Error(), "libssh2") {
+		t.Errorf("expected unsupported transport error but got %v", err)
+	}
+}
+
+func wait(t *testing.T, op *virtualizers.VirtualizeOperation) {
+	for range op.Status {
+	}
+	err := <-op.Error
+	if err != nil {
+		t.Fatalf("unable to prepare vm: %v", err)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	l, err := connect("test:///default")
+	if err != nil {
+		t.Skipf("libvirtd not reachable: %v", err)
+	}
+	l.Disconnect()
+
+	v := &Virtualizer{
+		vconfig: &Config{URI: "test:///default", DomainType: "test"},
+	}
+
+	wait(t, v.Prepare(&virtualizers.PrepareArgs{
+		Name:      "vorteil-lifecycle-test",
+		PName:     "libvirt",
+		Logger:    &elog.CLI{},
+		Context:   context.Background(),
+		ImagePath: "/tmp/vorteil-lifecycle-test/disk.qcow2",
+		Config: &vcfg.VCFG{
+			VM: vcfg.VMSettings{
+				CPUs: 1,
+				RAM:  128 * vcfg.MiB,
+			},
+		},
+	}))
+
+	steps := []struct {
+		name  string
+		fn    func() error
+		state string
+	}{
+		{"start", v.Start, virtualizers.Alive},
+		{"pause", v.Pause, virtualizers.Paused},
+		{"resume", v.Resume, virtualizers.Alive},
+		{"stop", v.Stop, virtualizers.Ready},
+	}
+
+	for _, step := range steps {
+		err = step.fn()
+		if err != nil {
+			v.Close(true)
+			t.Fatalf("unable to %s vm: %v", step.name, err)
+		}
+		if v.State() != step.state {
+			t.Errorf("expected vm to be %s after %s but got %s", step.state, step.name, v.State())
+		}
+	}
+
+	err = v.Close(false)
+	if err != nil {
+		t.Fatalf("unable to close vm: %v", err)
+	}
+
+	if _, ok := virtualizers.ActiveVMs.Load("vorteil-lifecycle-test"); ok {
+		t.Errorf("expected vm to be removed from active vms")
+	}
+}
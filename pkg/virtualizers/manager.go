@@ -13,8 +13,10 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sync"
 	"text/template"
 
+	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vdisk"
 )
@@ -25,7 +27,8 @@ type ManagerArgs struct {
 	DatabaseAddress string
 	FirecrackerPath string // path to folder for vmlinux binaries
 	Passphrase      string
-	VMDrive         string // path to store vms will be /tmp if not provided
+	VMDrive         string    // path to store vms will be /tmp if not provided
+	VMLogger        elog.View // logger given to vms reattached to when the manager is created
 	// Subserver       *graph.Graph
 }
 
@@ -38,6 +41,14 @@ type Manager struct {
 	passphrase      string
 	// subserver       *graph.Graph
 	vmdrive string
+
+	vmLogger    elog.View
+	persistLock sync.Mutex
+	persisted   map[string][]byte // last instance persisted for each vm
+	done        chan struct{}
+	watching    chan struct{}
+	closeOnce   sync.Once
+	closeErr    error
 }
 
 // virtualizerTable a generic json object which we will marshal and store under one field for the database
@@ -54,7 +65,7 @@ type virtualizerTuple struct {
 	Data []byte
 }
 
-// VState a type to call for the virtualizers. (ready, alive, broken, deleted, changing)
+// VState a type to call for the virtualizers. (ready, alive, broken, deleted, changing, paused)
 type VState string
 
 // Different states for the virtualizer
@@ -65,10 +76,11 @@ const (
 	Broken          = "broken"
 	Deleted         = "deleted"
 	Changing        = "changing"
+	Paused          = "paused"
 )
 
 // supportedVirtualizers is an array of hypervisors we currently support.
-var supportedVirtualizers = []string{"qemu", "virtualbox", "vmware", "hyperv", "firecracker"}
+var supportedVirtualizers = []string{"qemu", "virtualbox", "vmware", "hyperv", "firecracker", "cloud-hypervisor", "libvirt"}
 
 // default values set for linux
 var qemu = "/usr/bin"
@@ -185,6 +197,11 @@ func (mgr *Manager) initDB() error {
 	}
 	mgr.log("Created virtualizer table.")
 
+	err = mgr.initVMTable()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -201,6 +218,11 @@ func New(args *ManagerArgs) (*Manager, error) {
 	mgr.passphrase = args.Passphrase
 	mgr.databaseAddr = args.DatabaseAddress
 	mgr.firecrackerPath = args.FirecrackerPath
+	mgr.vmLogger = args.VMLogger
+	if mgr.vmLogger == nil {
+		mgr.vmLogger = &elog.CLI{DisableTTY: true}
+	}
+	mgr.persisted = make(map[string][]byte)
 	// mgr.subserver = args.Subserver
 
 	// Set drive to store vms if not provided default is temp
@@ -227,6 +249,16 @@ func New(args *ManagerArgs) (*Manager, error) {
 		return nil, err
 	}
 
+	err = mgr.reattachVMs()
+	if err != nil {
+		mgr.database.Close()
+		return nil, err
+	}
+
+	mgr.done = make(chan struct{})
+	mgr.watching = make(chan struct{})
+	go mgr.watchVMs()
+
 	return mgr, nil
 }
 
@@ -248,14 +280,30 @@ func (mgr *Manager) checkForCloseVirtualizer() error {
 	return err
 }
 
-// Close loops through the current active vms to close them as the manager is closing.
+// Close loops through the current active vms to close them as the manager is
+// closing. Only the first call does anything, later calls return its error.
 func (mgr *Manager) Close() error {
+	mgr.closeOnce.Do(func() {
+		mgr.closeErr = mgr.close()
+	})
+	return mgr.closeErr
+}
+
+func (mgr *Manager) close() error {
 	var err error
 
+	close(mgr.done)
+	<-mgr.watching
+
 	err = mgr.checkForCloseVirtualizer()
 	if err != nil {
 		return err
 	}
+	// remove the closed vms from the database
+	err = mgr.syncVMs()
+	if err != nil {
+		return err
+	}
 	err = mgr.database.Close()
 	if err != nil {
 		return err
@@ -264,6 +312,11 @@ func (mgr *Manager) Close() error {
 	return err
 }
 
+// VMDrive returns the directory the manager stores vms in.
+func (mgr *Manager) VMDrive() string {
+	return mgr.vmdrive
+}
+
 // ListTuple is an object stored in the database easier to reference through a struct
 type ListTuple struct {
 	Name string `json:"name"`
@@ -435,18 +488,18 @@ func (mgr *Manager) deleteVirtualizerData(tx *sql.Tx, name string) error {
 	return nil
 }
 
-//DeleteVirtualizer removes a virtualizer from the database with the appropriate name
+// DeleteVirtualizer removes a virtualizer from the database with the appropriate name
 func (mgr *Manager) DeleteVirtualizer(name string) error {
-	tx, err := mgr.database.Begin()
+	_, _, err := mgr.prepareVirtualizerData(name)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
 
-	err = mgr.selectVirtualizerData(tx, name)
+	tx, err := mgr.database.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
 	err = mgr.deleteVirtualizerData(tx, name)
 	if err != nil {
@@ -456,7 +509,7 @@ func (mgr *Manager) DeleteVirtualizer(name string) error {
 	return nil
 }
 
-//RegisteredVirtualizers returns the map purely for testing the register function
+// RegisteredVirtualizers returns the map purely for testing the register function
 func RegisteredVirtualizers() map[string]VirtualizerAllocator {
 	return registeredVirtualizers
 }
@@ -0,0 +1,122 @@
+package qemu
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// qmp is a minimal client for the QEMU Machine Protocol, which unlike the
+// human monitor returns structured results we can rely on.
+type qmp struct {
+	lock    sync.Mutex
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+type qmpCommand struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+type qmpResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+	Event string `json:"event"`
+}
+
+// newQMP negotiates capabilities on a newly connected QMP socket, which must
+// be done before it will accept any other commands.
+func newQMP(conn net.Conn) (*qmp, error) {
+
+	q := &qmp{
+		conn:    conn,
+		scanner: bufio.NewScanner(conn),
+	}
+	q.scanner.Buffer(make([]byte, 0x10000), 0x1000000)
+
+	// greeting
+	if !q.scanner.Scan() {
+		err := q.scanner.Err()
+		if err == nil {
+			err = errors.New("connection closed")
+		}
+		return nil, fmt.Errorf("failed to read QMP greeting: %w", err)
+	}
+
+	err := q.execute("qmp_capabilities", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return q, nil
+
+}
+
+// execute runs a command and decodes its result into ret, if it isn't nil.
+// Asynchronous events that arrive while waiting for the result are discarded.
+func (q *qmp) execute(command string, args interface{}, ret interface{}) error {
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	data, err := json.Marshal(&qmpCommand{
+		Execute:   command,
+		Arguments: args,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = q.conn.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+
+	for q.scanner.Scan() {
+
+		resp := new(qmpResponse)
+		err = json.Unmarshal(q.scanner.Bytes(), resp)
+		if err != nil {
+			return err
+		}
+
+		if resp.Event != "" {
+			continue
+		}
+
+		if resp.Error != nil {
+			return fmt.Errorf("qmp %s: %s", command, resp.Error.Desc)
+		}
+
+		if ret == nil {
+			return nil
+		}
+
+		return json.Unmarshal(resp.Return, ret)
+
+	}
+
+	err = q.scanner.Err()
+	if err == nil {
+		err = errors.New("connection closed")
+	}
+
+	return fmt.Errorf("qmp %s: %w", command, err)
+
+}
+
+func (q *qmp) Close() error {
+	return q.conn.Close()
+}
@@ -0,0 +1,143 @@
+// +build linux darwin
+
+package qemu
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+	logger "github.com/vorteil/vorteil/pkg/virtualizers/logging"
+)
+
+// instanceData is what the manager persists for a QEMU vm beyond the generic
+// instance fields.
+type instanceData struct {
+	ID          string   `json:"id"`
+	Headless    bool     `json:"headless"`
+	NetworkType string   `json:"networkType"`
+	Args        []string `json:"args"`
+}
+
+// Instance describes the vm so that the manager can persist it.
+func (v *Virtualizer) Instance() *virtualizers.VMInstance {
+	inst := &virtualizers.VMInstance{
+		Name:        v.name,
+		Type:        VirtualizerID,
+		Virtualizer: v.pname,
+		State:       v.state,
+		Folder:      v.folder,
+		Disk:        v.diskpath,
+		Routes:      v.routes,
+		Config:      v.config,
+		Created:     v.created,
+	}
+
+	if v.command == nil {
+		return inst
+	}
+
+	if v.state != virtualizers.Ready && v.command.Process != nil {
+		inst.PID = v.command.Process.Pid
+	}
+
+	inst.Data, _ = json.Marshal(&instanceData{
+		ID:          v.id,
+		Headless:    v.headless,
+		NetworkType: v.networkType,
+		Args:        withoutIncoming(v.command.Args),
+	})
+
+	return inst
+}
+
+// Reattach takes control of a vm described by an instance persisted by a
+// previous manager. If the vm is running its monitor sockets are reconnected,
+// but anything it wrote to its serial port in the meantime is lost.
+func (v *Virtualizer) Reattach(inst *virtualizers.VMInstance, log elog.View) error {
+
+	data := new(instanceData)
+	err := json.Unmarshal(inst.Data, data)
+	if err != nil {
+		return err
+	}
+	if len(data.Args) == 0 {
+		return errors.New("vm has no qemu command")
+	}
+
+	v.name = inst.Name
+	v.pname = inst.Virtualizer
+	v.folder = inst.Folder
+	v.diskpath = inst.Disk
+	v.routes = inst.Routes
+	v.config = inst.Config
+	v.created = inst.Created
+	v.id = data.ID
+	v.headless = data.Headless
+	v.networkType = data.NetworkType
+	v.command = exec.Command(data.Args[0], data.Args[1:]...)
+	v.logger = log
+	v.serialLogger = logger.NewLogger(2048 * 10)
+	v.state = virtualizers.Ready
+
+	if inst.PID == 0 {
+		return nil
+	}
+
+	proc, err := os.FindProcess(inst.PID)
+	if err != nil {
+		return err
+	}
+
+	v.sock, err = net.Dial("unix", filepath.ToSlash(filepath.Join(v.folder, "monitor.sock")))
+	if err != nil {
+		return fmt.Errorf("unable to reconnect to monitor socket: %w", err)
+	}
+
+	qmpConn, err := net.Dial("unix", filepath.ToSlash(filepath.Join(v.folder, "qmp.sock")))
+	if err == nil {
+		v.qmp, err = newQMP(qmpConn)
+	}
+	if err != nil {
+		v.sock.Close()
+		return fmt.Errorf("unable to reconnect to QMP socket: %w", err)
+	}
+
+	status := new(struct {
+		Status string `json:"status"`
+	})
+	err = v.qmp.execute("query-status", nil, status)
+	if err != nil {
+		v.qmp.Close()
+		v.sock.Close()
+		return err
+	}
+
+	v.command.Process = proc
+	v.state = virtualizers.Alive
+	if status.Status == "paused" {
+		v.state = virtualizers.Paused
+	}
+
+	go func() {
+		virtualizers.WaitProcess(proc.Pid)
+
+		v.qmp.Close()
+		v.qmp = nil
+		v.sock.Close()
+		v.state = virtualizers.Ready
+	}()
+
+	return nil
+}
@@ -0,0 +1,54 @@
+// +build linux darwin
+
+package qemu
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+)
+
+func TestInstanceReattach(t *testing.T) {
+	v := &Virtualizer{
+		id:          "abc",
+		name:        "vm",
+		pname:       "qemu",
+		state:       virtualizers.Ready,
+		headless:    true,
+		networkType: "nat",
+		folder:      "/tmp/vm-abc",
+		diskpath:    "/tmp/vm-abc/vm.raw",
+		created:     time.Now(),
+		config:      &vcfg.VCFG{},
+		command:     exec.Command("qemu-system-x86_64", "-m", "256", "-incoming", "exec:cat 'memory'"),
+	}
+
+	inst := v.Instance()
+	if inst.PID != 0 {
+		t.Errorf("expected a ready vm to have no pid but got %d", inst.PID)
+	}
+
+	x := new(Virtualizer)
+	err := x.Reattach(inst, &elog.CLI{})
+	if err != nil {
+		t.Fatalf("unable to reattach to vm: %v", err)
+	}
+
+	if x.State() != virtualizers.Ready {
+		t.Errorf("expected state %s but got %s", virtualizers.Ready, x.State())
+	}
+
+	if x.name != v.name || x.pname != v.pname || x.folder != v.folder || x.diskpath != v.diskpath || x.id != v.id || !x.headless {
+		t.Errorf("reattached vm does not match the original")
+	}
+
+	expected := "qemu-system-x86_64 -m 256"
+	if strings.Join(x.command.Args, " ") != expected {
+		t.Errorf("expected command '%s' but got '%s'", expected, strings.Join(x.command.Args, " "))
+	}
+}
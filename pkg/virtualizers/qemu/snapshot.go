@@ -0,0 +1,221 @@
+package qemu
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+)
+
+// snapshotMemory is the name of the file the vm's memory and device state
+// are migrated to when taking a snapshot.
+const snapshotMemory = "memory"
+
+// shellQuote quotes s so that QEMU's exec: migration URIs, which are run by
+// the shell, treat it as a single word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// withoutIncoming returns args with any '-incoming' option left over from
+// restoring a snapshot removed.
+func withoutIncoming(args []string) []string {
+	var x []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-incoming" {
+			i++
+			continue
+		}
+		x = append(x, args[i])
+	}
+	return x
+}
+
+func (v *Virtualizer) monitor() (*qmp, error) {
+	if v.qmp == nil {
+		return nil, errors.New("vm has no QMP connection")
+	}
+	return v.qmp, nil
+}
+
+// Pause stops the vm's vcpus.
+func (v *Virtualizer) Pause() error {
+	v.logger.Debugf("Pausing VM")
+
+	if v.state != virtualizers.Alive {
+		return fmt.Errorf("vm not in a state to be paused currently in: %s", v.state)
+	}
+
+	q, err := v.monitor()
+	if err != nil {
+		return err
+	}
+
+	err = q.execute("stop", nil, nil)
+	if err != nil {
+		return err
+	}
+
+	v.state = virtualizers.Paused
+
+	return nil
+}
+
+// Resume restarts the vcpus of a paused vm.
+func (v *Virtualizer) Resume() error {
+	v.logger.Debugf("Resuming VM")
+
+	if v.state != virtualizers.Paused {
+		return fmt.Errorf("vm not in a state to be resumed currently in: %s", v.state)
+	}
+
+	q, err := v.monitor()
+	if err != nil {
+		return err
+	}
+
+	err = q.execute("cont", nil, nil)
+	if err != nil {
+		return err
+	}
+
+	v.state = virtualizers.Alive
+
+	return nil
+}
+
+// Snapshot migrates the vm's memory and device state to a file in dir and
+// copies its disk alongside it. The vm is paused while this happens, and
+// resumed afterwards unless it was already paused.
+func (v *Virtualizer) Snapshot(dir string) error {
+	v.logger.Debugf("Snapshotting VM")
+
+	if v.state != virtualizers.Alive && v.state != virtualizers.Paused {
+		return fmt.Errorf("vm not in a state to be snapshotted currently in: %s", v.state)
+	}
+
+	q, err := v.monitor()
+	if err != nil {
+		return err
+	}
+
+	paused := v.state == virtualizers.Paused
+	if !paused {
+		err = v.Pause()
+		if err != nil {
+			return err
+		}
+		defer v.Resume()
+	}
+
+	uri := fmt.Sprintf("exec:cat > %s", shellQuote(filepath.Join(dir, snapshotMemory)))
+	err = q.execute("migrate", map[string]string{"uri": uri}, nil)
+	if err != nil {
+		return err
+	}
+
+	for {
+		status := new(struct {
+			Status    string `json:"status"`
+			ErrorDesc string `json:"error-desc"`
+		})
+
+		err = q.execute("query-migrate", nil, status)
+		if err != nil {
+			return err
+		}
+
+		if status.Status == "completed" {
+			break
+		}
+
+		if status.Status == "failed" || status.Status == "cancelled" {
+			return fmt.Errorf("failed to save vm memory: %s %s", status.Status, status.ErrorDesc)
+		}
+
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	// QEMU flushes the disk once the migration completes
+	return virtualizers.CopyDisk(filepath.Join(dir, virtualizers.SnapshotDisk), v.diskpath)
+}
+
+// finishRestore waits for QEMU to load the memory of a restored snapshot and
+// makes sure the vm runs afterwards, since QEMU leaves the vcpus stopped after
+// an incoming migration unless it is allowed to start them on its own.
+func (v *Virtualizer) finishRestore() error {
+
+	q, err := v.monitor()
+	if err != nil {
+		return err
+	}
+
+	for {
+		status := new(struct {
+			Status  string `json:"status"`
+			Running bool   `json:"running"`
+		})
+
+		err = q.execute("query-status", nil, status)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case status.Running:
+			return nil
+		case status.Status == "inmigrate" || status.Status == "restore-vm":
+			time.Sleep(time.Millisecond * 100)
+		case status.Status == "paused" || status.Status == "postmigrate" || status.Status == "prelaunch":
+			return q.execute("cont", nil, nil)
+		default:
+			return fmt.Errorf("failed to restore vm memory: vm is %s", status.Status)
+		}
+	}
+}
+
+// Restore replaces the vm's disk with the one saved in dir and starts it with
+// the memory and device state saved alongside it, instead of booting. A vm that
+// is already running is killed first.
+func (v *Virtualizer) Restore(dir string) error {
+	v.logger.Debugf("Restoring VM")
+
+	if runtime.GOOS == "windows" {
+		return errors.New("snapshots require QMP, which is not available on windows")
+	}
+
+	switch v.state {
+	case virtualizers.Ready:
+	case virtualizers.Alive, virtualizers.Paused:
+		err := v.command.Process.Kill()
+		if err != nil {
+			return err
+		}
+		for i := 0; v.state != virtualizers.Ready; i++ {
+			if i == 100 {
+				return errors.New("timed out waiting for vm to stop")
+			}
+			time.Sleep(time.Millisecond * 100)
+		}
+	default:
+		return fmt.Errorf("vm not in a state to be restored currently in: %s", v.state)
+	}
+
+	err := virtualizers.CopyDisk(v.diskpath, filepath.Join(dir, virtualizers.SnapshotDisk))
+	if err != nil {
+		return err
+	}
+
+	v.incoming = filepath.Join(dir, snapshotMemory)
+
+	return v.Start()
+}
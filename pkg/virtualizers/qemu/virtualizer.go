@@ -63,6 +63,10 @@ type Virtualizer struct {
 	errPipe io.ReadCloser // Stderr for this Virtual Machine
 	outPipe io.ReadCloser // Stdout for this Virtual Machine
 	sock    net.Conn      // net connection
+	qmp     *qmp          // QMP connection used to pause and snapshot the vm
+
+	diskpath string // path to the disk of the machine
+	incoming string // memory of a snapshot to restore on the next start
 
 	// VCFG Stuff
 	routes []virtualizers.NetworkInterface // api network interface that displays ports and network types
@@ -176,9 +180,12 @@ func (v *Virtualizer) ForceStop() error {
 
 			v.sock.Close()
 
-			// vm should be stopped by now so close the pipes
-			v.errPipe.Close()
-			v.outPipe.Close()
+			// vm should be stopped by now so close the pipes, which vms
+			// that were reattached to don't have
+			if v.errPipe != nil {
+				v.errPipe.Close()
+				v.outPipe.Close()
+			}
 			// v.disk.Close()
 		}
 	} else {
@@ -387,6 +394,7 @@ func (v *Virtualizer) Prepare(args *virtualizers.PrepareArgs) *virtualizers.Virt
 	v.config = args.Config
 	// v.source = args.Source
 	v.vmdrive = args.VMDrive
+	v.diskpath = args.ImagePath
 	v.logger = args.Logger
 	v.serialLogger = logger.NewLogger(2048 * 10)
 	v.logger.Debugf("Preparing VM")
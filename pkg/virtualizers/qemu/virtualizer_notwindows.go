@@ -26,7 +26,13 @@ import (
 // Start creates the virtualmachine and runs it
 func (v *Virtualizer) Start() error {
 	v.logger.Debugf("Starting VM")
-	v.command = exec.Command(v.command.Args[0], v.command.Args[1:]...)
+	args := withoutIncoming(v.command.Args)
+	restoring := v.incoming != ""
+	if restoring {
+		args = append(args, "-incoming", fmt.Sprintf("exec:cat %s", shellQuote(v.incoming)))
+		v.incoming = ""
+	}
+	v.command = exec.Command(args[0], args[1:]...)
 	v.command.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true,
 	}
@@ -65,7 +71,25 @@ func (v *Virtualizer) Start() error {
 				count++
 				time.Sleep(time.Second * 1)
 			}
-			v.state = virtualizers.Alive
+
+			qmpConn, err := net.Dial("unix", filepath.ToSlash(filepath.Join(v.folder, "qmp.sock")))
+			if err == nil {
+				v.qmp, err = newQMP(qmpConn)
+			}
+			if err != nil {
+				v.logger.Warnf("Unable to connect to QMP socket, pausing and snapshots will be unavailable: %s", err.Error())
+			}
+
+			state := virtualizers.Alive
+			if restoring {
+				err = v.finishRestore()
+				if err != nil {
+					v.logger.Errorf("Unable to resume restored VM: %s", err.Error())
+					state = virtualizers.Paused
+				}
+			}
+
+			v.state = state
 
 			_, err = v.command.Process.Wait()
 			if err == nil || err.Error() != fmt.Errorf("wait: no child processes").Error() {
@@ -74,6 +98,11 @@ func (v *Virtualizer) Start() error {
 				}
 			}
 
+			if v.qmp != nil {
+				v.qmp.Close()
+				v.qmp = nil
+			}
+
 			v.state = virtualizers.Ready
 
 			if v.sock != nil {
@@ -118,6 +147,7 @@ func (o *operation) prepare(args *virtualizers.PrepareArgs) {
 
 	argsCommand := createArgs(o.config.VM.CPUs, o.config.VM.RAM.Units(vcfg.MiB), o.headless, diskpath, diskformat)
 	argsCommand += fmt.Sprintf(" -monitor unix:%s,server,nowait", filepath.ToSlash(filepath.Join(o.folder, "monitor.sock")))
+	argsCommand += fmt.Sprintf(" -qmp unix:%s,server,nowait", filepath.ToSlash(filepath.Join(o.folder, "qmp.sock")))
 
 	params, err := shellwords.Parse(argsCommand)
 	if err != nil {
@@ -166,11 +196,12 @@ func (v *Virtualizer) GenerateScript(source string) error {
 		return err
 	}
 
-	args := strings.Join(v.command.Args, " ")
+	args := strings.Join(withoutIncoming(v.command.Args), " ")
 	//replace diskpath
 	args = strings.ReplaceAll(args, filepath.ToSlash(filepath.Join(v.folder, fmt.Sprintf("%s.raw", v.name))), fmt.Sprintf("\"%s\"", filepath.ToSlash(filepath.Join(source, name, fmt.Sprintf("%s.raw", v.name)))))
-	// replace monitor with nothing
+	// replace monitor and qmp with nothing
 	args = strings.ReplaceAll(args, fmt.Sprintf("-monitor unix:%s/monitor.sock,server,nowait", v.folder), "")
+	args = strings.ReplaceAll(args, fmt.Sprintf("-qmp unix:%s/qmp.sock,server,nowait", v.folder), "")
 
 	f, err := os.Create(filepath.Join(source, name, "start.sh"))
 	if err != nil {
@@ -1,12 +1,16 @@
 package qemu
 
 import (
+	"encoding/json"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
 
 	logger "github.com/vorteil/vorteil/pkg/virtualizers/logging"
 	"github.com/vorteil/vorteil/pkg/virtualizers/util"
@@ -131,3 +135,154 @@ func TestRoutes(t *testing.T) {
 		}
 	}
 }
+
+// fakeQMP answers QMP commands on conn, recording each one it executes.
+func fakeQMP(conn net.Conn, commands chan<- string) {
+	defer conn.Close()
+
+	conn.Write([]byte(`{"QMP": {"version": {}, "capabilities": []}}` + "\n"))
+
+	dec := json.NewDecoder(conn)
+	for {
+		cmd := new(qmpCommand)
+		if err := dec.Decode(cmd); err != nil {
+			close(commands)
+			return
+		}
+		commands <- cmd.Execute
+		// an event should be skipped by the client
+		conn.Write([]byte(`{"event": "STOP", "timestamp": {}}` + "\n"))
+		conn.Write([]byte(`{"return": {}}` + "\n"))
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	client, server := net.Pipe()
+	commands := make(chan string, 8)
+	go fakeQMP(server, commands)
+
+	q, err := newQMP(client)
+	if err != nil {
+		t.Fatalf("unable to negotiate qmp: %v", err)
+	}
+
+	v := &Virtualizer{
+		logger: &elog.CLI{},
+		state:  virtualizers.Alive,
+		qmp:    q,
+	}
+
+	err = v.Resume()
+	if err == nil {
+		t.Errorf("expected resuming a running vm to fail")
+	}
+
+	err = v.Pause()
+	if err != nil {
+		t.Fatalf("unable to pause vm: %v", err)
+	}
+	if v.State() != virtualizers.Paused {
+		t.Errorf("expected state %s but got %s", virtualizers.Paused, v.State())
+	}
+
+	err = v.Resume()
+	if err != nil {
+		t.Fatalf("unable to resume vm: %v", err)
+	}
+	if v.State() != virtualizers.Alive {
+		t.Errorf("expected state %s but got %s", virtualizers.Alive, v.State())
+	}
+
+	q.Close()
+
+	var executed []string
+	for cmd := range commands {
+		executed = append(executed, cmd)
+	}
+
+	expected := []string{"qmp_capabilities", "stop", "cont"}
+	if strings.Join(executed, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected qmp commands %v but got %v", expected, executed)
+	}
+}
+
+func TestWithoutIncoming(t *testing.T) {
+	args := withoutIncoming([]string{"qemu", "-m", "256", "-incoming", "exec:cat 'memory'", "-display", "none"})
+	expected := []string{"qemu", "-m", "256", "-display", "none"}
+	if strings.Join(args, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected %v but got %v", expected, args)
+	}
+}
+
+// fakeQMPStatus answers query-status with each of statuses in turn, and any
+// other command with an empty result, recording each command it executes.
+func fakeQMPStatus(conn net.Conn, statuses []string, commands chan<- string) {
+	defer conn.Close()
+
+	conn.Write([]byte(`{"QMP": {"version": {}, "capabilities": []}}` + "\n"))
+
+	dec := json.NewDecoder(conn)
+	for {
+		cmd := new(qmpCommand)
+		if err := dec.Decode(cmd); err != nil {
+			close(commands)
+			return
+		}
+		commands <- cmd.Execute
+		if cmd.Execute == "query-status" && len(statuses) > 0 {
+			conn.Write([]byte(`{"return": {"status": "` + statuses[0] + `", "running": false}}` + "\n"))
+			statuses = statuses[1:]
+			continue
+		}
+		conn.Write([]byte(`{"return": {}}` + "\n"))
+	}
+}
+
+func TestFinishRestore(t *testing.T) {
+	client, server := net.Pipe()
+	commands := make(chan string, 8)
+	go fakeQMPStatus(server, []string{"inmigrate", "paused"}, commands)
+
+	q, err := newQMP(client)
+	if err != nil {
+		t.Fatalf("unable to negotiate qmp: %v", err)
+	}
+
+	v := &Virtualizer{
+		logger: &elog.CLI{},
+		state:  virtualizers.Changing,
+		qmp:    q,
+	}
+
+	err = v.finishRestore()
+	if err != nil {
+		t.Fatalf("unable to finish restoring vm: %v", err)
+	}
+
+	q.Close()
+
+	var executed []string
+	for cmd := range commands {
+		executed = append(executed, cmd)
+	}
+
+	expected := []string{"qmp_capabilities", "query-status", "query-status", "cont"}
+	if strings.Join(executed, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected qmp commands %v but got %v", expected, executed)
+	}
+
+	client, server = net.Pipe()
+	commands = make(chan string, 8)
+	go fakeQMPStatus(server, []string{"internal-error"}, commands)
+
+	v.qmp, err = newQMP(client)
+	if err != nil {
+		t.Fatalf("unable to negotiate qmp: %v", err)
+	}
+	defer v.qmp.Close()
+
+	err = v.finishRestore()
+	if err == nil {
+		t.Errorf("expected restoring a broken vm to fail")
+	}
+}
@@ -0,0 +1,309 @@
+package virtualizers
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotInfoFile is stored alongside the files a virtualizer saves in a
+// snapshot directory, describing where they came from.
+const snapshotInfoFile = "snapshot.json"
+
+// SnapshotDisk is the name virtualizers give the copy of a vm's disk they
+// save in a snapshot directory.
+const SnapshotDisk = "disk.raw"
+
+// SnapshotInfo describes a snapshot persisted by the Manager.
+type SnapshotInfo struct {
+	Name        string    `json:"name"`
+	VM          string    `json:"vm"`
+	Virtualizer string    `json:"virtualizer"`
+	Created     time.Time `json:"created"`
+}
+
+// activeVM returns the active vm with the given name.
+func activeVM(name string) (Virtualizer, error) {
+	x, ok := ActiveVMs.Load(name)
+	if !ok {
+		return nil, fmt.Errorf("no active vm named '%s'", name)
+	}
+	v, ok := x.(Virtualizer)
+	if !ok {
+		return nil, fmt.Errorf("unable to assert to virtualizer")
+	}
+	return v, nil
+}
+
+func (mgr *Manager) snapshotDir(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid snapshot name '%s'", name)
+	}
+	return filepath.Join(mgr.vmdrive, "snapshots", name), nil
+}
+
+// Pause pauses the active vm with the given name.
+func (mgr *Manager) Pause(name string) error {
+	v, err := activeVM(name)
+	if err != nil {
+		return err
+	}
+	p, ok := v.(Pauser)
+	if !ok {
+		return fmt.Errorf("%s virtualizer does not support pausing vms", v.Type())
+	}
+	return p.Pause()
+}
+
+// Resume resumes the paused vm with the given name.
+func (mgr *Manager) Resume(name string) error {
+	v, err := activeVM(name)
+	if err != nil {
+		return err
+	}
+	p, ok := v.(Pauser)
+	if !ok {
+		return fmt.Errorf("%s virtualizer does not support pausing vms", v.Type())
+	}
+	return p.Resume()
+}
+
+// Snapshot saves the memory and disk of the active vm named vm as a new
+// snapshot, which is stored in the manager's VMDrive so that it outlives the
+// vm.
+func (mgr *Manager) Snapshot(vm, snapshot string) (*SnapshotInfo, error) {
+
+	v, err := activeVM(vm)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := v.(Snapshotter)
+	if !ok {
+		return nil, fmt.Errorf("%s virtualizer does not support snapshots", v.Type())
+	}
+
+	dir, err := mgr.snapshotDir(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(dir), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Mkdir(dir, 0700)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("snapshot named '%s' already exists", snapshot)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Snapshot(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	info := &SnapshotInfo{
+		Name:        snapshot,
+		VM:          vm,
+		Virtualizer: v.Type(),
+		Created:     time.Now(),
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, snapshotInfoFile), data, 0600)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	mgr.log("Saved snapshot '%s' of vm '%s'.", snapshot, vm)
+
+	return info, nil
+
+}
+
+// LookupSnapshot returns information about a snapshot.
+func (mgr *Manager) LookupSnapshot(snapshot string) (*SnapshotInfo, error) {
+
+	dir, err := mgr.snapshotDir(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, snapshotInfoFile))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no snapshot named '%s'", snapshot)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info := new(SnapshotInfo)
+	err = json.Unmarshal(data, info)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot '%s' is corrupt: %v", snapshot, err)
+	}
+
+	return info, nil
+
+}
+
+// Snapshots returns information about every snapshot, sorted by name.
+func (mgr *Manager) Snapshots() ([]SnapshotInfo, error) {
+
+	fis, err := ioutil.ReadDir(filepath.Join(mgr.vmdrive, "snapshots"))
+	if os.IsNotExist(err) {
+		return []SnapshotInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list = make([]SnapshotInfo, 0)
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+		info, err := mgr.LookupSnapshot(fi.Name())
+		if err != nil {
+			// incomplete snapshots are skipped
+			continue
+		}
+		list = append(list, *info)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return list, nil
+
+}
+
+// Restore replaces the state of the active vm named vm with a snapshot. The
+// snapshot must have been taken by the same type of virtualizer.
+func (mgr *Manager) Restore(vm, snapshot string) error {
+
+	v, err := activeVM(vm)
+	if err != nil {
+		return err
+	}
+
+	s, ok := v.(Snapshotter)
+	if !ok {
+		return fmt.Errorf("%s virtualizer does not support snapshots", v.Type())
+	}
+
+	info, err := mgr.LookupSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+
+	if info.Virtualizer != v.Type() {
+		return fmt.Errorf("snapshot '%s' was taken by a %s virtualizer and can't be restored by %s", snapshot, info.Virtualizer, v.Type())
+	}
+
+	dir, err := mgr.snapshotDir(snapshot)
+	if err != nil {
+		return err
+	}
+
+	err = s.Restore(dir)
+	if err != nil {
+		return err
+	}
+
+	mgr.log("Restored vm '%s' from snapshot '%s'.", vm, snapshot)
+
+	return nil
+
+}
+
+// DeleteSnapshot removes a snapshot and all of its files.
+func (mgr *Manager) DeleteSnapshot(snapshot string) error {
+
+	_, err := mgr.LookupSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+
+	dir, err := mgr.snapshotDir(snapshot)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(dir)
+
+}
+
+// CopyDisk copies the disk image at src to dst, seeking over empty regions so
+// that the copy is sparse.
+func CopyDisk(dst, src string) error {
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	buf := make([]byte, 0x100000)
+	zeroes := make([]byte, len(buf))
+	var size int64
+
+	for {
+		n, err := io.ReadFull(in, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		if bytes.Equal(buf[:n], zeroes[:n]) {
+			_, err = out.Seek(int64(n), io.SeekCurrent)
+		} else {
+			_, err = out.Write(buf[:n])
+		}
+		if err != nil {
+			return err
+		}
+
+		size += int64(n)
+	}
+
+	err = out.Truncate(size)
+	if err != nil {
+		return err
+	}
+
+	return out.Close()
+
+}
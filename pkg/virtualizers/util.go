@@ -252,6 +252,10 @@ func GetExecutable(virtualizer string) (string, error) {
 		return "vmrun", nil
 	case "firecracker":
 		return "firecracker", nil
+	case "cloud-hypervisor":
+		return "cloud-hypervisor", nil
+	case "libvirt":
+		return "virsh", nil
 	case "hyperv":
 		return Powershell, nil
 	default:
@@ -42,6 +42,29 @@ type Virtualizer interface {
 	Close(bool) error                                                                          // Close the vm is deleting the vm and removing its contents as its not needed anymore.
 }
 
+// Pauser is implemented by virtualizers that can pause a running vm and later
+// resume it where it left off.
+type Pauser interface {
+	Pause() error  // Pause the vm, leaving it in the 'paused' state
+	Resume() error // Resume a paused vm
+}
+
+// Snapshotter is implemented by virtualizers that can save the memory and disk
+// of a running vm to files in a directory, and later restore the vm from them.
+type Snapshotter interface {
+	Snapshot(dir string) error // Save the state of the vm to files in dir
+	Restore(dir string) error  // Replace the state of the vm with one saved in dir, starting it if necessary
+}
+
+// Reattacher is implemented by virtualizers whose vms run in processes that
+// can outlive the process managing them. The Manager persists the instances
+// they describe, and uses them to take control of the vms again when it is
+// next created.
+type Reattacher interface {
+	Instance() *VMInstance                            // Describe the vm so it can be persisted
+	Reattach(inst *VMInstance, logger elog.View) error // Take control of the vm described by inst
+}
+
 // Create two maps one for the virtualizers that get registered the other to track the vms that are currently created
 var registeredVirtualizers map[string]VirtualizerAllocator
 
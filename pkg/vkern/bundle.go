@@ -7,12 +7,18 @@ package vkern
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"os"
 	"sort"
 	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
 )
 
 /*
@@ -392,3 +398,171 @@ func (bundle *Bundle) Reader(tags ...string) io.ReadCloser {
 	return pr
 
 }
+
+// BundleBuilder assembles the files of a kernel into a bundle.
+type BundleBuilder struct {
+	metadata BundleMetadata
+	paths    []string
+}
+
+// NewBundleBuilder ..
+func NewBundleBuilder(version CalVer, compiler string) *BundleBuilder {
+	b := new(BundleBuilder)
+	b.metadata.Version = version
+	b.metadata.EarliestCompatibleCompiler = compiler
+	b.metadata.Files = make([]BundleFileMetadata, 0)
+	return b
+}
+
+// AddFile adds the file at path to the bundle as name. Builds only include it
+// if they need one of its tags, or always if it has none.
+func (b *BundleBuilder) AddFile(name, path string, tags ...string) error {
+
+	if name == "" || name == ManifestName || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid kernel bundle file name '%s'", name)
+	}
+
+	for _, f := range b.metadata.Files {
+		if f.Name == name {
+			return fmt.Errorf("kernel bundle already contains a file named '%s'", name)
+		}
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("kernel bundle file '%s' is not a regular file", path)
+	}
+
+	b.metadata.Files = append(b.metadata.Files, BundleFileMetadata{
+		Name: name,
+		Size: fi.Size(),
+		Tags: tags,
+	})
+	b.paths = append(b.paths, path)
+
+	return nil
+}
+
+// Metadata returns the manifest the bundle will be written with.
+func (b *BundleBuilder) Metadata() BundleMetadata {
+	return b.metadata
+}
+
+// Write writes the bundle to w: a gzipped tar with the manifest first,
+// followed by the files in the order they were added.
+func (b *BundleBuilder) Write(w io.Writer) error {
+
+	data, err := b.metadata.Marshal()
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	now := time.Now()
+
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     ManifestName,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  now,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	for i, file := range b.metadata.Files {
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     file.Name,
+			Mode:     0755,
+			Size:     file.Size,
+			ModTime:  now,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = func() error {
+			f, err := os.Open(b.paths[i])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			n, err := io.Copy(tw, f)
+			if err != nil {
+				return fmt.Errorf("error writing '%s' to kernel bundle: %w", b.paths[i], err)
+			}
+			if n != file.Size {
+				return fmt.Errorf("kernel bundle file '%s' changed size while bundling", b.paths[i])
+			}
+
+			return nil
+		}()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// ReadSigningKey reads the first private key from an armored keyring,
+// decrypting it with passphrase if it's encrypted.
+func ReadSigningKey(r io.Reader, passphrase []byte) (*openpgp.Entity, error) {
+
+	keyring, err := openpgp.ReadArmoredKeyRing(r)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entity := range keyring {
+		if entity.PrivateKey == nil {
+			continue
+		}
+
+		if entity.PrivateKey.Encrypted {
+			if len(passphrase) == 0 {
+				return nil, errors.New("signing key is encrypted but no passphrase was provided")
+			}
+			err = entity.PrivateKey.Decrypt(passphrase)
+			if err != nil {
+				return nil, fmt.Errorf("could not decrypt signing key: %w", err)
+			}
+			for _, subkey := range entity.Subkeys {
+				if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+					err = subkey.PrivateKey.Decrypt(passphrase)
+					if err != nil {
+						return nil, fmt.Errorf("could not decrypt signing key: %w", err)
+					}
+				}
+			}
+		}
+
+		return entity, nil
+	}
+
+	return nil, errors.New("keyring contains no private key")
+}
+
+// SignBundle writes an armored detached signature of the bundle read from r
+// to w, in the form kernel managers check against their trusted keyrings.
+func SignBundle(w io.Writer, r io.Reader, key *openpgp.Entity) error {
+	return openpgp.ArmoredDetachSign(w, key, r, nil)
+}
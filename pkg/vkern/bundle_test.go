@@ -0,0 +1,201 @@
+package vkern
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func TestBundleBuilder(t *testing.T) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "vorteil-test-")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"bzImage": "kernel",
+		"vinitd":  "init",
+		"strace":  "strace",
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	b := NewBundleBuilder(CalVer("20.9.3"), "0.0.0")
+	err = b.AddFile("bzImage", filepath.Join(dir, "bzImage"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = b.AddFile("vinitd", filepath.Join(dir, "vinitd"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = b.AddFile("strace", filepath.Join(dir, "strace"), "strace")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = b.AddFile("vinitd", filepath.Join(dir, "vinitd"))
+	if err == nil {
+		t.Fatal("expected failure; bundle already contains vinitd")
+	}
+	err = b.AddFile(ManifestName, filepath.Join(dir, "vinitd"))
+	if err == nil {
+		t.Fatal("expected failure; manifest is reserved")
+	}
+
+	path := filepath.Join(dir, "kernel-20.9.3")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Close()
+
+	err = b.Write(f)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	bundle, err := NewBundle(f)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if bundle.Version() != CalVer("20.9.3") {
+		t.Errorf("bundle version is %s, expected 20.9.3", bundle.Version())
+	}
+
+	if list := bundle.FilesList(); !reflect.DeepEqual(list, []string{"bzImage", "vinitd"}) {
+		t.Errorf("untagged bundle files are %v, expected [bzImage vinitd]", list)
+	}
+
+	tr := tar.NewReader(bundle.Reader("strace"))
+	for _, name := range []string{"bzImage", "vinitd", "strace"} {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if hdr.Name != name {
+			t.Fatalf("bundle contains %s, expected %s", hdr.Name, name)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(data) != files[name] {
+			t.Errorf("bundle file %s contains '%s', expected '%s'", name, data, files[name])
+		}
+	}
+	_, err = tr.Next()
+	if err != io.EOF {
+		t.Errorf("expected end of bundle, got %v", err)
+	}
+
+}
+
+func TestSignBundle(t *testing.T) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "vorteil-test-")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	buf := new(bytes.Buffer)
+	w, err := armor.Encode(buf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = entity.SerializePrivate(w, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	key, err := ReadSigningKey(buf, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	kernelFile := filepath.Join(dir, "kernel-20.9.3")
+	err = ioutil.WriteFile(kernelFile, []byte("kernel"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	signatureFile := kernelFile + ".asc"
+	sig, err := os.Create(signatureFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer sig.Close()
+
+	ker, err := os.Open(kernelFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ker.Close()
+
+	err = SignBundle(sig, ker, key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// only vorteil.io's key is trusted by default
+	err = validateKernelSignature(nil, kernelFile, signatureFile)
+	if err == nil {
+		t.Fatal("expected failure; signing key isn't trusted")
+	}
+
+	keyringFile := filepath.Join(dir, "keyring.asc")
+	kr, err := os.Create(keyringFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer kr.Close()
+
+	w, err = armor.Encode(kr, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = key.Serialize(w)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	keyring, err := Keyring(keyringFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = validateKernelSignature(keyring, kernelFile, signatureFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+}
@@ -12,7 +12,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -21,7 +20,6 @@ import (
 
 	"github.com/vorteil/vorteil/pkg/elog"
 	"golang.org/x/crypto/openpgp"
-	"gopkg.in/yaml.v2"
 )
 
 var CLIUpdateInterval time.Duration = time.Hour * 24
@@ -32,6 +30,7 @@ type CLIRemoteManager struct {
 	cache      List
 	nextUpdate time.Time
 	log        elog.View
+	keyring    openpgp.EntityList // keys trusted to sign kernels
 }
 
 func (mgr *CLIRemoteManager) updateList(ctx context.Context) (List, error) {
@@ -40,29 +39,9 @@ func (mgr *CLIRemoteManager) updateList(ctx context.Context) (List, error) {
 
 	// request remote manifest
 
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/manifest.txt", mgr.url), nil)
+	manifest, err := fetchManifest(ctx, mgr.url)
 	if err != nil {
-		return list, err
-	}
-
-	req = req.WithContext(ctx)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		mgr.log.Errorf("error in request to remote kernels source: %w", err)
-		return list, nil
-	}
-	defer resp.Body.Close()
-
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		mgr.log.Errorf("error reading response from remote kernels source: %w", err)
-		return list, nil
-	}
-
-	manifest := new(remoteVersionsManifest)
-	err = yaml.Unmarshal(data, manifest)
-	if err != nil {
-		mgr.log.Errorf("unable to parse response from remote kernels source: %w", err)
+		mgr.log.Errorf("error in request to remote kernels source: %v", err)
 		return list, nil
 	}
 
@@ -87,7 +66,8 @@ func (mgr *CLIRemoteManager) updateList(ctx context.Context) (List, error) {
 				list[i].Location += " (cached)"
 			} else {
 				mgr.log.Warnf("detected an unusual remote kernel file update for source '%s' on kernel '%s'", mgr.url, tuple.Version)
-				err = os.Remove(filepath.Join(mgr.dir, filenameFromVersion(tuple.Version)))
+				kernelFile := filepath.Join(mgr.dir, filenameFromVersion(tuple.Version))
+				err = removeFiles(kernelFile, kernelFile+".asc")
 				if err != nil {
 					mgr.log.Errorf("error removing file in remote kernels cache directory '%s': %v", mgr.dir, err)
 				}
@@ -190,8 +170,8 @@ func (mgr *CLIRemoteManager) get(version CalVer) error {
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	defer os.Remove(signatureFile)
 
+	// the signature is kept alongside the kernel so it can be verified later
 	var success bool
 	defer func() {
 		if success {
@@ -218,43 +198,10 @@ func (mgr *CLIRemoteManager) get(version CalVer) error {
 	download := func(src, dest string) {
 		defer wg.Done()
 
-		f, err := os.Create(dest)
-		if err != nil {
-			setFirstError(fmt.Errorf("error creating kernel file '%s': %w", dest, err))
-			return
-		}
-		defer f.Close()
-
-		resp, err := http.Get(src)
+		err := fetchFile(context.Background(), src, dest, mgr.log)
 		if err != nil {
-			setFirstError(fmt.Errorf("error in request for file at url '%s': %w", src, err))
-			return
+			setFirstError(err)
 		}
-
-		if resp.Body != nil {
-			defer resp.Body.Close()
-		}
-
-		p := mgr.log.NewProgress(fmt.Sprintf("Downloading file from url: %s", src), "KiB", resp.ContentLength)
-		defer p.Finish(false)
-
-		r := p.ProxyReader(resp.Body)
-		defer r.Close()
-
-		_, err = io.Copy(f, r)
-		if err != nil {
-			setFirstError(fmt.Errorf("error downloading kernel file '%s': %w", dest, err))
-			return
-		}
-
-		err = f.Close()
-		if err != nil {
-			setFirstError(fmt.Errorf("error saving kernel file '%s': %w", dest, err))
-			return
-		}
-
-		p.Finish(true)
-		return
 	}
 
 	go download(kernelURL, kernelFile)
@@ -266,37 +213,7 @@ func (mgr *CLIRemoteManager) get(version CalVer) error {
 		return firstError
 	}
 
-	krrData := mustGetAsset("vorteil.gpg")
-	krr := bytes.NewReader(krrData)
-
-	ker, err := os.Open(kernelFile)
-	if err != nil {
-		return err
-	}
-	defer ker.Close()
-
-	sig, err := os.Open(signatureFile)
-	if err != nil {
-		return err
-	}
-	defer sig.Close()
-
-	kr, err := openpgp.ReadArmoredKeyRing(krr)
-	if err != nil {
-		return err
-	}
-
-	_, err = openpgp.CheckArmoredDetachedSignature(kr, ker, sig)
-	if err != nil {
-		return err
-	}
-
-	err = ker.Close()
-	if err != nil {
-		return err
-	}
-
-	err = sig.Close()
+	err = validateKernelSignature(mgr.keyring, kernelFile, signatureFile)
 	if err != nil {
 		return err
 	}
@@ -382,6 +299,90 @@ func (mgr *CLIRemoteManager) Get(ctx context.Context, version CalVer) (*ManagedB
 
 }
 
+// Verify checks a cached kernel against the signature it was downloaded with.
+func (mgr *CLIRemoteManager) Verify(ctx context.Context, version CalVer) error {
+
+	kernelFile := filepath.Join(mgr.dir, filenameFromVersion(version))
+	signatureFile := kernelFile + ".asc"
+
+	f, err := os.Open(kernelFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("kernel %s has not been cached from %s", version.String(), mgr.url)
+		}
+		return err
+	}
+	defer f.Close()
+
+	_, err = NewBundle(f)
+	if err != nil {
+		return fmt.Errorf("cached kernel %s is corrupt: %w", version.String(), err)
+	}
+
+	_, err = os.Stat(signatureFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no signature was kept for cached kernel %s, pull it again to verify it", version.String())
+		}
+		return err
+	}
+
+	err = validateKernelSignature(mgr.keyring, kernelFile, signatureFile)
+	if err != nil {
+		return fmt.Errorf("kernel %s failed signature verification: %w", version.String(), err)
+	}
+
+	return nil
+}
+
+// Prune removes the cached kernels for which keep returns false, returning
+// the versions removed. Kernels missing from the cache manifest are removed
+// too, so nothing is left behind by an interrupted download.
+func (mgr *CLIRemoteManager) Prune(keep func(CalVer) bool) ([]CalVer, error) {
+
+	fis, err := ioutil.ReadDir(mgr.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var pruned []CalVer
+	removed := make(map[string]bool)
+
+	for _, fi := range fis {
+		v, err := versionFromFilename(strings.TrimSuffix(fi.Name(), ".asc"))
+		if err != nil || keep(v) {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(mgr.dir, fi.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return pruned, err
+		}
+
+		if !removed[v.String()] {
+			removed[v.String()] = true
+			pruned = append(pruned, v)
+		}
+	}
+
+	if len(pruned) == 0 {
+		return nil, nil
+	}
+
+	for i, tuple := range mgr.cache {
+		if removed[tuple.Version.String()] {
+			mgr.cache[i].Location = strings.TrimSuffix(tuple.Location, " (cached)")
+		}
+	}
+
+	err = mgr.flushCache()
+	if err != nil {
+		return pruned, err
+	}
+
+	return pruned, nil
+}
+
 func (mgr *CLIRemoteManager) List(ctx context.Context) (List, error) {
 
 	err := mgr.update(ctx)
@@ -441,6 +442,7 @@ type CLIArgs struct {
 	Directory          string   `toml:"directory"`
 	DropPath           string   `toml:"drop-path"`
 	RemoteRepositories []string `toml:"remote-repositories"`
+	Keyrings           []string `toml:"keyrings"` // trusted in addition to vorteil.io's key
 }
 
 func CLI(args CLIArgs, logger elog.View) (Manager, error) {
@@ -451,6 +453,11 @@ func CLI(args CLIArgs, logger elog.View) (Manager, error) {
 		return nil, fmt.Errorf("no logger provided")
 	}
 
+	keyring, err := Keyring(args.Keyrings...)
+	if err != nil {
+		return nil, err
+	}
+
 	if args.DropPath != "" {
 		m, err := NewLocalManager(args.DropPath)
 		if err != nil {
@@ -460,10 +467,11 @@ func CLI(args CLIArgs, logger elog.View) (Manager, error) {
 	}
 
 	for _, s := range args.RemoteRepositories {
-		m, err := NewCLIRemoteManager(s, filepath.Join(args.Directory, strings.ReplaceAll(strings.TrimPrefix(strings.TrimPrefix(s, "https://"), "http://"), "/", "_")), logger)
+		m, err := NewCLIRemoteManager(s, cacheDir(args.Directory, s), logger)
 		if err != nil {
 			return nil, err
 		}
+		m.keyring = keyring
 		mgrs = append(mgrs, m)
 	}
 
@@ -7,6 +7,7 @@ package vkern
 
 import (
 	"context"
+	"fmt"
 	"sort"
 )
 
@@ -73,3 +74,47 @@ func (mgr *CompoundManager) List(ctx context.Context) (List, error) {
 
 	return list, nil
 }
+
+// Verify checks the signature of the kernel that best matches version against
+// the one it was downloaded with.
+func (mgr *CompoundManager) Verify(ctx context.Context, version CalVer) error {
+
+	list, err := mgr.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	tuple, err := list.BestMatch(version)
+	if err != nil {
+		return err
+	}
+
+	v, ok := mgr.mgrs[tuple.Idx].(Verifier)
+	if !ok {
+		return fmt.Errorf("kernel %s from %s: %w", tuple.Version.String(), tuple.Location, ErrUnsigned)
+	}
+
+	return v.Verify(ctx, tuple.Version)
+}
+
+// Prune removes the kernels cached by each of its managers for which keep
+// returns false, returning the versions removed.
+func (mgr *CompoundManager) Prune(keep func(CalVer) bool) ([]CalVer, error) {
+
+	var pruned []CalVer
+
+	for _, sub := range mgr.mgrs {
+		p, ok := sub.(Pruner)
+		if !ok {
+			continue
+		}
+
+		versions, err := p.Prune(keep)
+		pruned = append(pruned, versions...)
+		if err != nil {
+			return pruned, err
+		}
+	}
+
+	return pruned, nil
+}
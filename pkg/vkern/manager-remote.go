@@ -20,7 +20,7 @@ import (
 	"time"
 
 	"github.com/cavaliercoder/grab"
-	"gopkg.in/yaml.v2"
+	"golang.org/x/crypto/openpgp"
 )
 
 // RemoteManager ..
@@ -32,6 +32,8 @@ type RemoteManager struct {
 	closed bool
 	ch     chan bool
 	cache  List
+
+	keyring openpgp.EntityList // keys trusted to sign kernels
 }
 
 // NewRemoteManager ..
@@ -81,12 +83,12 @@ func (mgr *RemoteManager) pollOnce(ctx context.Context) error {
 				list[i].Location += " (cached)"
 			} else {
 				Logger("Remote kernels manager '%s' detected an unusual remote kernel file update '%s'", mgr.url, tuple.Version)
-				go func() {
-					err = os.Remove(filepath.Join(mgr.dir, filenameFromVersion(tuple.Version)))
+				go func(version CalVer) {
+					err := os.Remove(filepath.Join(mgr.dir, filenameFromVersion(version)))
 					if err != nil {
 						Logger("Issue in '%s' remote kernels manager's cache directory '%s': %v", mgr.url, mgr.dir, err)
 					}
-				}()
+				}(tuple.Version)
 			}
 		} else if os.IsNotExist(err) {
 			continue
@@ -145,31 +147,16 @@ func (mgr *RemoteManager) remoteList(ctx context.Context) (List, error) {
 
 	// request remote manifest
 
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/manifest.txt", mgr.url), nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req = req.WithContext(ctx)
-	resp, err := http.DefaultClient.Do(req)
+	manifest, err := fetchManifest(ctx, mgr.url)
 	if err != nil {
-		if err == context.DeadlineExceeded {
+		if err == context.DeadlineExceeded || isFileURL(mgr.url) {
 			return nil, err
 		}
 
-		getKernels := func() error {
-			resp, err = http.Get(fmt.Sprintf("%s/manifest.txt", mgr.url))
-			if err != nil {
-				return err
-			}
-
-			return nil
-		}
-
 		for i := 0; i < 5; i++ {
 			// wait 1 second and try again
 			time.Sleep(time.Second * time.Duration(i+1))
-			err = getKernels()
+			manifest, err = fetchManifest(ctx, mgr.url)
 			if err == nil {
 				break
 			}
@@ -180,18 +167,6 @@ func (mgr *RemoteManager) remoteList(ctx context.Context) (List, error) {
 		}
 
 	}
-	defer resp.Body.Close()
-
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	manifest := new(remoteVersionsManifest)
-	err = yaml.Unmarshal(data, manifest)
-	if err != nil {
-		return nil, err
-	}
 
 	for _, kern := range manifest.Kernels {
 		v, err := Parse(kern.Version)
@@ -237,6 +212,39 @@ func (mgr *RemoteManager) get(version CalVer) error {
 		}
 	}()
 
+	// repositories in a local directory are copied from directly
+	if isFileURL(mgr.url) {
+		err = fetchFile(context.Background(), kernelURL, kernelFile, nil)
+		if err == nil {
+			err = fetchFile(context.Background(), signatureURL, signatureFile, nil)
+		}
+	} else {
+		err = mgr.download(kernelURL, signatureURL)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = validateKernelSignature(mgr.keyring, kernelFile, signatureFile)
+	if err == nil {
+		// update to cached
+		mgr.lock.Lock()
+		tuple, err := mgr.cache.BestMatch(version)
+		if err == nil {
+			tuple.Location = strings.TrimSuffix(tuple.Location, " (cached)") + " (cached)"
+			tuple.ModTime = time.Now()
+			success = true
+		}
+		mgr.lock.Unlock()
+	}
+
+	return err
+}
+
+// download fetches a kernel and its signature from a repository served over
+// http(s) into the manager's directory.
+func (mgr *RemoteManager) download(kernelURL, signatureURL string) error {
+
 	ch, err := grab.GetBatch(2, mgr.dir, kernelURL, signatureURL)
 	if err != nil {
 		return err
@@ -285,24 +293,7 @@ func (mgr *RemoteManager) get(version CalVer) error {
 
 	t.Stop()
 
-	if firstError != nil {
-		return firstError
-	}
-
-	err = validateKernelSignature(kernelFile, signatureFile)
-	if err != nil {
-		// update to cached
-		mgr.lock.Lock()
-		tuple, err := mgr.cache.BestMatch(version)
-		if err == nil {
-			tuple.Location = strings.TrimSuffix(tuple.Location, " (cached)") + " (cached)"
-			tuple.ModTime = time.Now()
-			success = true
-		}
-		mgr.lock.Unlock()
-	}
-
-	return err
+	return firstError
 }
 
 // Get ..
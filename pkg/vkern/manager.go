@@ -11,6 +11,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
@@ -118,6 +119,17 @@ func (l List) BestMatch(v CalVer) (*Tuple, error) {
 		return nil, fmt.Errorf("no match for kernel %s", v.String())
 	}
 
+	// if v has no patch it matches the latest patch of its year and month,
+	// which sorts after it
+	if v.Patch() == -1 {
+		for i := l.Len() - 1; i >= 0; i-- {
+			if l[i].Version.Major() == v.Major() && l[i].Version.Minor() == v.Minor() && l[i].Version.Modifier() == "" {
+				return &l[i], nil
+			}
+		}
+		return nil, fmt.Errorf("no match for kernel %s", v.String())
+	}
+
 	var candidate *Tuple
 	var cErr error = fmt.Errorf("no match for kernel %s", v.String()) // Place holder error for if there is no valid candidate
 	if Idx != 0 {
@@ -143,6 +155,21 @@ type Manager interface {
 	Latest() (string, error)
 }
 
+// ErrUnsigned is returned when verifying a kernel that didn't come with a
+// signature, such as one placed in a local drop path.
+var ErrUnsigned = errors.New("kernel is not signed")
+
+// Verifier is implemented by managers that keep the signatures of the kernels
+// they download.
+type Verifier interface {
+	Verify(ctx context.Context, version CalVer) error
+}
+
+// Pruner is implemented by managers that cache kernels and can remove them.
+type Pruner interface {
+	Prune(keep func(CalVer) bool) ([]CalVer, error)
+}
+
 // ConstructGetLastestKernelsFunc : Given a Kernel Manager will construct a function that returns the latest Kernel Version
 func ConstructGetLastestKernelsFunc(ksrc *Manager) func(ctx context.Context) (CalVer, error) {
 	return func(ctx context.Context) (CalVer, error) {
@@ -170,9 +197,46 @@ func removeFiles(files ...string) error {
 	return nil
 }
 
-func validateKernelSignature(kernelFile string, signatureFile string) error {
-	krrData := mustGetAsset("vorteil.gpg")
-	krr := bytes.NewReader(krrData)
+// Keyring returns the keys trusted to sign kernels: vorteil.io's own, and
+// those in the keyring files at paths, which may be armored or binary.
+func Keyring(paths ...string) (openpgp.EntityList, error) {
+
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(mustGetAsset("vorteil.gpg")))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read kernel keyring: %w", err)
+		}
+
+		kr, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+		if err != nil {
+			kr, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+			if err != nil {
+				return nil, fmt.Errorf("invalid kernel keyring '%s': %w", path, err)
+			}
+		}
+
+		keyring = append(keyring, kr...)
+	}
+
+	return keyring, nil
+}
+
+// validateKernelSignature checks the detached signature of a kernel against
+// keyring, or just vorteil.io's key if keyring is nil.
+func validateKernelSignature(keyring openpgp.EntityList, kernelFile string, signatureFile string) error {
+
+	var err error
+	if keyring == nil {
+		keyring, err = Keyring()
+		if err != nil {
+			return err
+		}
+	}
 
 	ker, err := os.Open(kernelFile)
 	if err != nil {
@@ -186,12 +250,7 @@ func validateKernelSignature(kernelFile string, signatureFile string) error {
 	}
 	defer sig.Close()
 
-	kr, err := openpgp.ReadArmoredKeyRing(krr)
-	if err != nil {
-		return err
-	}
-
-	_, err = openpgp.CheckArmoredDetachedSignature(kr, ker, sig)
+	_, err = openpgp.CheckArmoredDetachedSignature(keyring, ker, sig)
 	if err == nil {
 		err = ker.Close()
 		if err == nil {
@@ -207,6 +266,7 @@ type AdvancedArgs struct {
 	Directory          string   `toml:"directory"`
 	DropPath           string   `toml:"drop-path"`
 	RemoteRepositories []string `toml:"remote-repositories"`
+	Keyrings           []string `toml:"keyrings"` // trusted in addition to vorteil.io's key
 	// UpgradeStrategy    string   `toml:"upgrade-strategy"`
 }
 
@@ -215,6 +275,11 @@ func Advanced(args AdvancedArgs) (Manager, error) {
 
 	var mgrs []Manager
 
+	keyring, err := Keyring(args.Keyrings...)
+	if err != nil {
+		return nil, err
+	}
+
 	if args.DropPath != "" {
 		m, err := NewLocalManager(args.DropPath)
 		if err != nil {
@@ -224,10 +289,11 @@ func Advanced(args AdvancedArgs) (Manager, error) {
 	}
 
 	for _, s := range args.RemoteRepositories {
-		m, err := NewRemoteManager(s, filepath.Join(args.Directory, strings.ReplaceAll(strings.TrimPrefix(strings.TrimPrefix(s, "https://"), "http://"), "/", "_")))
+		m, err := NewRemoteManager(s, cacheDir(args.Directory, s))
 		if err != nil {
 			return nil, err
 		}
+		m.keyring = keyring
 		mgrs = append(mgrs, m)
 	}
 
@@ -0,0 +1,321 @@
+package vkern
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"golang.org/x/crypto/openpgp"
+	"gopkg.in/yaml.v2"
+)
+
+// ManifestFile is the name of the file listing the kernels in a kernel
+// repository.
+const ManifestFile = "manifest.txt"
+
+func isFileURL(s string) bool {
+	return strings.HasPrefix(s, "file://")
+}
+
+// pathFromFileURL returns the local path a file:// url refers to.
+func pathFromFileURL(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+
+	path := u.Path
+	// file:///C:/kernels
+	if runtime.GOOS == "windows" && len(path) > 2 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+
+	return filepath.FromSlash(path), nil
+}
+
+// cacheDir returns the directory in dir that kernels from the repository at
+// url are cached in.
+func cacheDir(dir, url string) string {
+	for _, scheme := range []string{"https://", "http://", "file://"} {
+		url = strings.TrimPrefix(url, scheme)
+	}
+	return filepath.Join(dir, strings.ReplaceAll(url, "/", "_"))
+}
+
+// openURL opens a file in a kernel repository, which is either served over
+// http(s) or is a directory referred to by a file:// url. It also returns the
+// size of the file, if known.
+func openURL(ctx context.Context, s string) (io.ReadCloser, int64, error) {
+
+	if isFileURL(s) {
+		path, err := pathFromFileURL(s)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+
+		return f, fi.Size(), nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("error downloading %s: %v -- %s", s, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+// fetchFile copies the file at src in a kernel repository to dest, showing
+// its progress if log isn't nil.
+func fetchFile(ctx context.Context, src, dest string, log elog.View) error {
+
+	r, size, err := openURL(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("error creating kernel file '%s': %w", dest, err)
+	}
+	defer f.Close()
+
+	var p elog.Progress
+	if log != nil {
+		p = log.NewProgress(fmt.Sprintf("Downloading file from url: %s", src), "KiB", size)
+		defer p.Finish(false)
+		r = p.ProxyReader(r)
+		defer r.Close()
+	}
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return fmt.Errorf("error downloading kernel file '%s': %w", dest, err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("error saving kernel file '%s': %w", dest, err)
+	}
+
+	if p != nil {
+		p.Finish(true)
+	}
+
+	return nil
+}
+
+// fetchManifest returns the kernels listed by the repository at url.
+func fetchManifest(ctx context.Context, url string) (*remoteVersionsManifest, error) {
+
+	r, _, err := openURL(ctx, fmt.Sprintf("%s/%s", url, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := new(remoteVersionsManifest)
+	err = yaml.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// MirrorArgs ..
+type MirrorArgs struct {
+	Source   string             // url of the repository to mirror
+	Dir      string             // directory to mirror it into
+	Versions []CalVer           // kernels to mirror, or all of them if empty
+	Keyring  openpgp.EntityList // keys trusted to sign kernels, or just vorteil.io's if nil
+	Logger   elog.View
+}
+
+// Mirror copies kernels from a kernel repository into a directory laid out
+// the same way: a manifest.txt listing the kernels, and a kernels directory
+// holding them and their signatures. The directory can be served over http
+// as a repository, or used directly through a file:// url. Kernels already
+// mirrored are kept, and aren't downloaded again. It returns the versions of
+// the kernels mirrored.
+func Mirror(ctx context.Context, args MirrorArgs) ([]CalVer, error) {
+
+	upstream, err := fetchManifest(ctx, args.Source)
+	if err != nil {
+		return nil, fmt.Errorf("could not get the kernels manifest from %s: %w", args.Source, err)
+	}
+
+	var list List
+	for _, kern := range upstream.Kernels {
+		v, err := Parse(kern.Version)
+		if err != nil {
+			continue
+		}
+		list = append(list, Tuple{
+			Version:  v,
+			Location: args.Source,
+			ModTime:  kern.Timestamp,
+		})
+	}
+	sort.Sort(list)
+
+	selected := list
+	if len(args.Versions) > 0 {
+		selected = nil
+		for _, v := range args.Versions {
+			tuple, err := list.BestMatch(v)
+			if err != nil {
+				return nil, fmt.Errorf("%w in %s", err, args.Source)
+			}
+			selected = append(selected, *tuple)
+		}
+	}
+
+	kernelsDir := filepath.Join(args.Dir, "kernels")
+	err = os.MkdirAll(kernelsDir, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	// keep what has been mirrored before
+	manifest := new(remoteVersionsManifest)
+	manifestFile := filepath.Join(args.Dir, ManifestFile)
+	data, err := ioutil.ReadFile(manifestFile)
+	if err == nil {
+		err = yaml.Unmarshal(data, manifest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid kernels manifest '%s': %w", manifestFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	mirrored := make(map[string]bool)
+	for _, kern := range manifest.Kernels {
+		mirrored[kern.Version] = true
+	}
+
+	var versions []CalVer
+	var mirrorErr error
+
+	for _, tuple := range selected {
+
+		kernelName := filenameFromVersion(tuple.Version)
+		signatureName := kernelName + ".asc"
+		kernelFile := filepath.Join(kernelsDir, kernelName)
+		signatureFile := filepath.Join(kernelsDir, signatureName)
+
+		err = validateKernelSignature(args.Keyring, kernelFile, signatureFile)
+		if err != nil {
+			mirrorErr = mirrorKernel(ctx, args, kernelName, kernelFile)
+			if mirrorErr != nil {
+				// still list the kernels mirrored so far
+				break
+			}
+		}
+
+		if !mirrored[tuple.Version.String()] {
+			mirrored[tuple.Version.String()] = true
+			manifest.Kernels = append(manifest.Kernels, remoteVersionTimestamp{
+				Version:   tuple.Version.String(),
+				Timestamp: tuple.ModTime,
+			})
+		}
+
+		versions = append(versions, tuple.Version)
+	}
+
+	sort.SliceStable(manifest.Kernels, func(i, j int) bool {
+		return CalVer(manifest.Kernels[i].Version).Less(CalVer(manifest.Kernels[j].Version))
+	})
+
+	data, err = yaml.Marshal(manifest)
+	if err != nil {
+		return versions, err
+	}
+
+	err = ioutil.WriteFile(manifestFile+".tmp", data, 0644)
+	if err != nil {
+		return versions, err
+	}
+
+	err = os.Rename(manifestFile+".tmp", manifestFile)
+	if err != nil {
+		return versions, err
+	}
+
+	return versions, mirrorErr
+}
+
+// mirrorKernel downloads a kernel and its signature, and only moves them to
+// kernelFile once the signature has been checked.
+func mirrorKernel(ctx context.Context, args MirrorArgs, kernelName, kernelFile string) error {
+
+	signatureName := kernelName + ".asc"
+	signatureFile := kernelFile + ".asc"
+	tmpKernel := kernelFile + ".part"
+	tmpSignature := signatureFile + ".part"
+	defer removeFiles(tmpKernel, tmpSignature)
+
+	err := fetchFile(ctx, fmt.Sprintf("%s/kernels/%s", args.Source, kernelName), tmpKernel, args.Logger)
+	if err != nil {
+		return err
+	}
+
+	err = fetchFile(ctx, fmt.Sprintf("%s/kernels/%s", args.Source, signatureName), tmpSignature, args.Logger)
+	if err != nil {
+		return err
+	}
+
+	err = validateKernelSignature(args.Keyring, tmpKernel, tmpSignature)
+	if err != nil {
+		return fmt.Errorf("kernel %s failed signature verification: %w", kernelName, err)
+	}
+
+	err = os.Rename(tmpKernel, kernelFile)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpSignature, signatureFile)
+}
@@ -0,0 +1,173 @@
+package vkern
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// writeRepository creates a kernel repository in dir holding a bundle for
+// each of versions signed by key.
+func writeRepository(t *testing.T, dir string, key *openpgp.Entity, versions ...string) {
+
+	err := os.MkdirAll(filepath.Join(dir, "kernels"), 0777)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	manifest := "kernels:\n"
+
+	for _, version := range versions {
+		bzImage := filepath.Join(dir, "bzImage")
+		err = ioutil.WriteFile(bzImage, []byte(version), 0644)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		b := NewBundleBuilder(CalVer(version), "0.0.0")
+		err = b.AddFile("bzImage", bzImage)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		kernelFile := filepath.Join(dir, "kernels", filenameFromVersion(CalVer(version)))
+		f, err := os.Create(kernelFile)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		err = b.Write(f)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		f.Close()
+
+		f, err = os.Open(kernelFile)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		sig, err := os.Create(kernelFile + ".asc")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		err = SignBundle(sig, f, key)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		f.Close()
+		sig.Close()
+
+		manifest += "  - version: " + version + "\n    release: 2020-09-01T00:00:00Z\n"
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, ManifestFile), []byte(manifest), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+}
+
+func TestMirror(t *testing.T) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "vorteil-test-")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	keyringFile := filepath.Join(dir, "keyring.asc")
+	kr, err := os.Create(keyringFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	w, err := armor.Encode(kr, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = key.Serialize(w)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	w.Close()
+	kr.Close()
+
+	keyring, err := Keyring(keyringFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	upstream := filepath.Join(dir, "upstream")
+	writeRepository(t, upstream, key, "20.9.1", "20.9.2", "20.10.1")
+
+	mirror := filepath.Join(dir, "mirror")
+	args := MirrorArgs{
+		Source:   "file://" + filepath.ToSlash(upstream),
+		Dir:      mirror,
+		Versions: []CalVer{CalVer("20.9")},
+	}
+
+	// only vorteil.io's key is trusted by default
+	_, err = Mirror(context.Background(), args)
+	if err == nil {
+		t.Fatal("expected failure; signing key isn't trusted")
+	}
+
+	args.Keyring = keyring
+	versions, err := Mirror(context.Background(), args)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(versions) != 1 || versions[0] != CalVer("20.9.2") {
+		t.Fatalf("mirrored %v, expected [20.9.2]", versions)
+	}
+
+	args.Versions = []CalVer{CalVer("20.10.1")}
+	_, err = Mirror(context.Background(), args)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the mirror is a repository in its own right
+	manifest, err := fetchManifest(context.Background(), "file://"+filepath.ToSlash(mirror))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(manifest.Kernels) != 2 || manifest.Kernels[0].Version != "20.9.2" || manifest.Kernels[1].Version != "20.10.1" {
+		t.Fatalf("mirror manifest lists %v, expected 20.9.2 and 20.10.1", manifest.Kernels)
+	}
+
+	mgr, err := CLI(CLIArgs{
+		Directory:          filepath.Join(dir, "cache"),
+		RemoteRepositories: []string{"file://" + filepath.ToSlash(mirror)},
+		Keyrings:           []string{keyringFile},
+	}, &elog.CLI{DisableTTY: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	b, err := mgr.Get(context.Background(), CalVer("20.10.1"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer b.Close()
+
+	if b.Bundle().Version() != CalVer("20.10.1") {
+		t.Errorf("got kernel %s, expected 20.10.1", b.Bundle().Version())
+	}
+
+	err = mgr.(Verifier).Verify(context.Background(), CalVer("20.10.1"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+}
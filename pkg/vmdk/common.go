@@ -44,6 +44,23 @@ type Header struct {
 	Pad                [433]uint8
 }
 
+// Identifier can be implemented by the Sizer or HolePredictor given to a
+// writer to decide the disk's content ID (CID), which is otherwise random.
+// Note that our vimg.Builder implements this interface, using the GUID from
+// its GPT header, so that reproducible builds produce identical VMDKs.
+type Identifier interface {
+	DiskUID() []byte
+}
+
+func diskUID(x interface{}) string {
+	if id, ok := x.(Identifier); ok {
+		if uid := id.DiskUID(); len(uid) >= 4 {
+			return strings.ToUpper(fmt.Sprintf("%X", uid[:4]))
+		}
+	}
+	return generateDiskUID()
+}
+
 func generateDiskUID() string {
 	rand.Seed(time.Now().UTC().UnixNano())
 	b := [4]byte{}
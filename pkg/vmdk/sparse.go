@@ -32,7 +32,7 @@ type SparseWriter struct {
 	grainOffsets []int64
 }
 
-func sparseDescriptor(name string, totalDataGrains int64) string {
+func sparseDescriptor(name, uid string, totalDataGrains int64) string {
 
 	template := `# Disk DescriptorFile
 version=1
@@ -50,7 +50,6 @@ ddb.virtualHWVersion = "10"
 ddb.adapterType = "ide"
 `
 
-	uid := generateDiskUID()
 	description := fmt.Sprintf(template, uid, totalDataGrains*SectorsPerGrain, name)
 	return description
 }
@@ -218,7 +217,7 @@ func (w *SparseWriter) init() error {
 
 	// write descriptor
 	name := "disk"
-	description := sparseDescriptor(name, w.totalDataGrains)
+	description := sparseDescriptor(name, diskUID(w.h), w.totalDataGrains)
 	_, err = io.Copy(w.w, strings.NewReader(description))
 	if err != nil {
 		return err
@@ -51,7 +51,7 @@ type StreamOptimizedWriter struct {
 	grainCounter       int64
 }
 
-func streamDescriptor(name string, totalDataGrains int64) string {
+func streamDescriptor(name, uid string, totalDataGrains int64) string {
 
 	template := `# Disk DescriptorFile
 version=1
@@ -69,7 +69,6 @@ ddb.virtualHWVersion = "8"
 ddb.adapterType = "ide"
 `
 
-	uid := generateDiskUID()
 	description := fmt.Sprintf(template, uid, totalDataGrains*SectorsPerGrain, name)
 	return description
 }
@@ -130,7 +129,7 @@ func (w *StreamOptimizedWriter) init() error {
 
 	// write descriptor
 	name := "disk"
-	description := streamDescriptor(name, w.totalDataGrains)
+	description := streamDescriptor(name, diskUID(w.h), w.totalDataGrains)
 	_, err = io.Copy(w.w, strings.NewReader(description))
 	if err != nil {
 		return err
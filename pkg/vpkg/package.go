@@ -68,7 +68,7 @@ const (
 // ..
 const (
 	SemverMajor    = 3
-	SemverMinor    = 0
+	SemverMinor    = 1
 	SemverRevision = 0
 )
 
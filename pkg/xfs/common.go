@@ -0,0 +1,441 @@
+package xfs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// Various XFS build constants. Everything on disk is big-endian except for
+// checksums, which are stored little-endian.
+const (
+	BlockSize         = 0x1000
+	BlockLog          = 12
+	SectorSize        = 0x200
+	SectorLog         = 9
+	SectorsPerBlock   = BlockSize / SectorSize
+	InodeSize         = 0x200
+	InodeLog          = 9
+	InodesPerBlock    = BlockSize / InodeSize
+	InodesPerBlockLog = 3
+	InodesPerChunk    = 64
+	BlocksPerChunk    = InodesPerChunk / InodesPerBlock
+	InodeAlignment    = 4 // blocks per inode cluster
+	InodeCoreSize     = 176
+	LiteralAreaSize   = InodeSize - InodeCoreSize
+
+	SuperblockMagic    = 0x58465342 // XFSB
+	AGFMagic           = 0x58414746 // XAGF
+	AGIMagic           = 0x58414749 // XAGI
+	AGFLMagic          = 0x5841464c // XAFL
+	InodeMagic         = 0x494e     // IN
+	BNOBTMagic         = 0x41423342 // AB3B
+	CNTBTMagic         = 0x41423343 // AB3C
+	INOBTMagic         = 0x49414233 // IAB3
+	BMBTMagic          = 0x424d4133 // BMA3
+	SymlinkMagic       = 0x58534c4d // XSLM
+	DirBlockMagic      = 0x58444233 // XDB3
+	DirDataMagic       = 0x58444433 // XDD3
+	DirFreeMagic       = 0x58444633 // XDF3
+	DirLeaf1Magic      = 0x3df1
+	DirLeafNMagic      = 0x3dff
+	DirNodeMagic       = 0x3ebe
+	LogHeaderMagic     = 0xFEEDBABE
+	LogUnmountType     = 0x556e
+	AGFVersion         = 1
+	AGIVersion         = 1
+	InodeVersion       = 3
+	DirFreeTag         = 0xffff
+	NullAGBlock        = 0xffffffff
+	NullAGIno          = 0xffffffff
+	NullFSIno          = 0xffffffffffffffff
+	NullFSBlock        = 0xffffffffffffffff
+	MaxShortIno        = 0xffffffff
+	MaxExtentLength    = 1<<21 - 1
+	MaxSymlinkLength   = 1024
+	MinLogBlocks       = 10 * 1024 * 1024 / BlockSize
+	MaxLogBlocks       = 1024 * 1024 * 1024 / BlockSize
+	MinAGBlocks        = 16 * 1024 * 1024 / BlockSize
+	MaxAGBlocks        = 1 << 40 / BlockSize
+	DefaultInodeMaxPct = 25
+
+	VersionNumber    = 0xb4a5 // v5, nlink, align, logv2, extflg, dirv2, morebits
+	Features2        = 0x18a  // lazysbcount, attr2, projid32, crc
+	FeatureIncompat  = 0x1    // ftype
+	DirLeafBlock     = 1 << 35 / BlockSize
+	DirFreeBlock     = 1 << 36 / BlockSize
+	rtExtentSize     = 1
+	logRecordSize    = 32 * 1024
+	logVersion       = 2
+	logFormatLE      = 1
+	logClientID      = 0xaa
+	logUnmountTrans  = 0x20
+	allocSetAsidePer = 8
+	maxReservedBlock = 8192
+	rtBitmapFlag     = 0x4
+
+	formatLocal   = 1
+	formatExtents = 2
+	formatBTree   = 3
+
+	ftypeRegularFile = 1
+	ftypeDir         = 2
+	ftypeSymlink     = 7
+
+	shortBlockHeaderSize = 56
+	longBlockHeaderSize  = 72
+	dirHeaderSize        = 64
+	symlinkHeaderSize    = 56
+	bmdrHeaderSize       = 4
+
+	// the first four blocks of each AG hold the AG headers and btree roots,
+	// followed by the blocks given to the AG free list
+	agHeaderBlock    = 0
+	bnoRootBlock     = 1
+	cntRootBlock     = 2
+	inoRootBlock     = 3
+	agflFirstBlock   = 4
+	agflBlocks       = 4
+	agPreallocBlocks = agflFirstBlock + agflBlocks
+
+	inodeCRCOffset       = 100
+	superblockCRCOffset  = 224
+	agfCRCOffset         = 216
+	agiCRCOffset         = 312
+	agflCRCOffset        = 32
+	shortBlockCRCOffset  = 52
+	longBlockCRCOffset   = 64
+	dirBlockCRCOffset    = 4
+	daBlockCRCOffset     = 12
+	symlinkCRCOffset     = 12
+	logHeaderCRCOffset   = 32
+	logRecordHeaderBytes = 328
+
+	extentsPerInode   = LiteralAreaSize / 16
+	extentsPerLeaf    = (BlockSize - longBlockHeaderSize) / 16
+	bmdrMaxRecords    = (LiteralAreaSize - bmdrHeaderSize) / 16
+	shortRecsPerBlock = (BlockSize - shortBlockHeaderSize) / 8
+	inobtRecsPerLeaf  = (BlockSize - shortBlockHeaderSize) / 16
+	inobtRecsPerNode  = (BlockSize - shortBlockHeaderSize) / 8
+	agflEntries       = (SectorSize - 36) / 4
+	dirLeafEntries    = (BlockSize - dirHeaderSize) / 8
+	dirNodeEntries    = (BlockSize - dirHeaderSize) / 8
+	dirFreeEntries    = (BlockSize - dirHeaderSize) / 2
+	dirFirstOffset    = dirHeaderSize + 16 + 16 // header, ".", ".."
+)
+
+// Superblock is the structure of an XFS superblock. The primary copy lives
+// at the start of AG 0, and every other AG begins with a secondary copy.
+type Superblock struct {
+	Magic                uint32
+	BlockSize            uint32
+	DataBlocks           uint64
+	RealtimeBlocks       uint64
+	RealtimeExtents      uint64
+	UUID                 [16]byte
+	LogStart             uint64
+	RootInode            uint64
+	RealtimeBitmapInode  uint64
+	RealtimeSummaryInode uint64
+	RealtimeExtentSize   uint32
+	AGBlocks             uint32
+	AGCount              uint32
+	RealtimeBitmapBlock  uint32
+	LogBlocks            uint32
+	VersionNumber        uint16
+	SectorSize           uint16
+	InodeSize            uint16
+	InodesPerBlock       uint16
+	Name                 [12]byte
+	BlockLog             uint8
+	SectorLog            uint8
+	InodeLog             uint8
+	InodesPerBlockLog    uint8
+	AGBlockLog           uint8
+	RealtimeExtentsLog   uint8
+	InProgress           uint8
+	InodeMaxPct          uint8
+	InodeCount           uint64
+	FreeInodes           uint64
+	FreeDataBlocks       uint64
+	FreeRealtimeExtents  uint64
+	UserQuotaInode       uint64
+	GroupQuotaInode      uint64
+	QuotaFlags           uint16
+	Flags                uint8
+	SharedVersion        uint8
+	InodeAlignment       uint32
+	StripeUnit           uint32
+	StripeWidth          uint32
+	DirBlockLog          uint8
+	LogSectorLog         uint8
+	LogSectorSize        uint16
+	LogStripeUnit        uint32
+	Features2            uint32
+	BadFeatures2         uint32
+	FeaturesCompat       uint32
+	FeaturesROCompat     uint32
+	FeaturesIncompat     uint32
+	FeaturesLogIncompat  uint32
+	CRC                  uint32
+	SparseInodeAlign     uint32
+	ProjectQuotaInode    uint64
+	LSN                  uint64
+	MetaUUID             [16]byte
+}
+
+// AGF is the free space header found in the second sector of every AG.
+type AGF struct {
+	Magic          uint32
+	Version        uint32
+	SequenceNumber uint32
+	Length         uint32
+	Roots          [3]uint32
+	Levels         [3]uint32
+	FLFirst        uint32
+	FLLast         uint32
+	FLCount        uint32
+	FreeBlocks     uint32
+	Longest        uint32
+	BTreeBlocks    uint32
+	UUID           [16]byte
+	RmapBlocks     uint32
+	RefcountBlocks uint32
+	RefcountRoot   uint32
+	RefcountLevel  uint32
+	_              [14]uint64
+	LSN            uint64
+	CRC            uint32
+	_              uint32
+}
+
+// AGI is the inode management header found in the third sector of every AG.
+type AGI struct {
+	Magic          uint32
+	Version        uint32
+	SequenceNumber uint32
+	Length         uint32
+	Count          uint32
+	Root           uint32
+	Level          uint32
+	FreeCount      uint32
+	NewInode       uint32
+	DirInode       uint32
+	Unlinked       [64]uint32
+	UUID           [16]byte
+	CRC            uint32
+	_              uint32
+	LSN            uint64
+	FreeRoot       uint32
+	FreeLevel      uint32
+	InodeBlocks    uint32
+	FreeBlocks     uint32
+}
+
+// AGFLHeader precedes the list of free list blocks in the fourth sector of
+// every AG.
+type AGFLHeader struct {
+	Magic          uint32
+	SequenceNumber uint32
+	UUID           [16]byte
+	LSN            uint64
+	CRC            uint32
+}
+
+// ShortBlockHeader is the header of every per-AG btree block.
+type ShortBlockHeader struct {
+	Magic        uint32
+	Level        uint16
+	Records      uint16
+	LeftSibling  uint32
+	RightSibling uint32
+	DiskAddress  uint64
+	LSN          uint64
+	UUID         [16]byte
+	Owner        uint32
+	CRC          uint32
+}
+
+// LongBlockHeader is the header of every block mapping btree block.
+type LongBlockHeader struct {
+	Magic        uint32
+	Level        uint16
+	Records      uint16
+	LeftSibling  uint64
+	RightSibling uint64
+	DiskAddress  uint64
+	LSN          uint64
+	UUID         [16]byte
+	Owner        uint64
+	CRC          uint32
+	_            uint32
+}
+
+// Timestamp is the on-disk format of an inode timestamp.
+type Timestamp struct {
+	Seconds     uint32
+	Nanoseconds uint32
+}
+
+// Inode is the structure of a version 3 inode core. The rest of the inode is
+// taken up by its data fork.
+type Inode struct {
+	Magic          uint16
+	Mode           uint16
+	Version        uint8
+	Format         uint8
+	OldLinks       uint16
+	UID            uint32
+	GID            uint32
+	Links          uint32
+	ProjectIDLo    uint16
+	ProjectIDHi    uint16
+	_              [6]byte
+	FlushIteration uint16
+	AccessTime     Timestamp
+	ModifiedTime   Timestamp
+	ChangeTime     Timestamp
+	Size           uint64
+	Blocks         uint64
+	ExtentSizeHint uint32
+	Extents        uint32
+	AttrExtents    uint16
+	ForkOffset     uint8
+	AttrFormat     uint8
+	DMEventMask    uint32
+	DMState        uint16
+	Flags          uint16
+	Generation     uint32
+	NextUnlinked   uint32
+	CRC            uint32
+	ChangeCount    uint64
+	LSN            uint64
+	Flags2         uint64
+	CowExtentSize  uint32
+	_              [12]byte
+	CreationTime   Timestamp
+	Number         uint64
+	UUID           [16]byte
+}
+
+// DirHeader is the header found at the start of every directory data block
+// and free index block.
+type DirHeader struct {
+	Magic       uint32
+	CRC         uint32
+	DiskAddress uint64
+	LSN         uint64
+	UUID        [16]byte
+	Owner       uint64
+}
+
+// DABlockInfo is the header found at the start of every directory leaf and
+// node block.
+type DABlockInfo struct {
+	Forward     uint32
+	Back        uint32
+	Magic       uint16
+	_           uint16
+	CRC         uint32
+	DiskAddress uint64
+	LSN         uint64
+	UUID        [16]byte
+	Owner       uint64
+}
+
+// SymlinkHeader is the header found at the start of each block belonging to
+// a symlink that doesn't fit inside its inode.
+type SymlinkHeader struct {
+	Magic       uint32
+	Offset      uint32
+	Bytes       uint32
+	CRC         uint32
+	UUID        [16]byte
+	Owner       uint64
+	DiskAddress uint64
+	LSN         uint64
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// setChecksum computes the crc32c of buf with its checksum field zeroed and
+// stores it at offset.
+func setChecksum(buf []byte, offset int) {
+	binary.LittleEndian.PutUint32(buf[offset:], 0)
+	binary.LittleEndian.PutUint32(buf[offset:], crc32.Checksum(buf, crcTable))
+}
+
+func divide(a, b int64) int64 {
+	return (a + b - 1) / b
+}
+
+func align(a, b int64) int64 {
+	return divide(a, b) * b
+}
+
+// log2 returns the number of bits needed to represent x-1, which is how XFS
+// calculates the log of AG sizes that aren't powers of two.
+func log2(x int64) uint8 {
+	var n uint8
+	for (int64(1) << n) < x {
+		n++
+	}
+	return n
+}
+
+func rol32(x uint32, n uint) uint32 {
+	return x<<n | x>>(32-n)
+}
+
+// hashName is the XFS directory name hash.
+func hashName(name []byte) uint32 {
+
+	var hash uint32
+
+	for ; len(name) >= 4; name = name[4:] {
+		hash = uint32(name[0])<<21 ^ uint32(name[1])<<14 ^ uint32(name[2])<<7 ^ uint32(name[3]) ^ rol32(hash, 7*4)
+	}
+
+	switch len(name) {
+	case 3:
+		return uint32(name[0])<<14 ^ uint32(name[1])<<7 ^ uint32(name[2]) ^ rol32(hash, 7*3)
+	case 2:
+		return uint32(name[0])<<7 ^ uint32(name[1]) ^ rol32(hash, 7*2)
+	case 1:
+		return uint32(name[0]) ^ rol32(hash, 7*1)
+	}
+
+	return hash
+
+}
+
+func timestamp(t time.Time) Timestamp {
+	if t.IsZero() || t.Unix() < 0 {
+		return Timestamp{}
+	}
+	return Timestamp{Seconds: uint32(t.Unix())}
+}
+
+func fileType(f vio.File) uint8 {
+	if f.IsDir() {
+		return ftypeDir
+	} else if f.IsSymlink() {
+		return ftypeSymlink
+	}
+	return ftypeRegularFile
+}
+
+// packExtent encodes an extent as a 128-bit block mapping btree record.
+func packExtent(offset, fsblock, length int64) [2]uint64 {
+	return [2]uint64{
+		uint64(offset)<<9 | uint64(fsblock)>>43,
+		uint64(fsblock)<<21 | uint64(length),
+	}
+}
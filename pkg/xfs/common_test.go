@@ -0,0 +1,253 @@
+package xfs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/internal/fstest"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+func TestStructureSizes(t *testing.T) {
+
+	for _, x := range []struct {
+		name string
+		v    interface{}
+		size int
+	}{
+		{"superblock", &Superblock{}, 264},
+		{"AGF", &AGF{}, 224},
+		{"AGI", &AGI{}, 344},
+		{"short btree block header", &ShortBlockHeader{}, shortBlockHeaderSize},
+		{"long btree block header", &LongBlockHeader{}, longBlockHeaderSize},
+		{"inode", &Inode{}, InodeCoreSize},
+		{"directory header", &DirHeader{}, 48},
+		{"directory block info", &DABlockInfo{}, 56},
+		{"symlink header", &SymlinkHeader{}, symlinkHeaderSize},
+	} {
+		if size := binary.Size(x.v); size != x.size {
+			t.Fatalf("%s structure is the wrong size: %d", x.name, size)
+		}
+	}
+
+}
+
+func TestHashName(t *testing.T) {
+
+	for _, x := range []struct {
+		name string
+		hash uint32
+	}{
+		{".", 0x2e},
+		{"..", 0x172e},
+		{"abcd", 0x0c38b1e4},
+	} {
+		if hash := hashName([]byte(x.name)); hash != x.hash {
+			t.Fatalf("hashName(%q) = %#x, expected %#x", x.name, hash, x.hash)
+		}
+	}
+
+}
+
+func TestDirectoryForms(t *testing.T) {
+
+	for _, x := range []struct {
+		children int
+		form     int
+	}{
+		{0, dirShortForm},
+		{3, dirShortForm},
+		{40, dirBlockForm},
+		{200, dirLeafForm},
+		{2000, dirNodeForm},
+	} {
+
+		root := &vio.TreeNode{}
+		for i := 0; i < x.children; i++ {
+			root.Children = append(root.Children, &vio.TreeNode{
+				Parent: root,
+				File: vio.CustomFile(vio.CustomFileArgs{
+					Name: fmt.Sprintf("file-%05d", i),
+				}),
+			})
+		}
+
+		d, err := planDirectory(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if d.form != x.form {
+			t.Fatalf("directory with %d children should be form %d, not %d", x.children, x.form, d.form)
+		}
+
+	}
+
+}
+
+func TestExtentCalculation(t *testing.T) {
+
+	extents := splitExtents(5, []run{
+		{start: 100, length: 10},
+		{start: 1 << 30, length: MaxExtentLength + 1},
+	})
+
+	if len(extents) != 3 {
+		t.Fatalf("splitExtents produced the wrong number of extents: %d", len(extents))
+	}
+
+	if extents[1].offset != 15 || extents[1].block != 1<<30 || extents[1].length != MaxExtentLength {
+		t.Fatalf("splitExtents produced a bad extent: %+v", extents[1])
+	}
+
+	if extents[2].offset != 15+MaxExtentLength || extents[2].length != 1 {
+		t.Fatalf("splitExtents produced a bad extent: %+v", extents[2])
+	}
+
+	rec := packExtent(7, 0x123456789, 42)
+	if rec[0]>>9 != 7 || rec[1]&MaxExtentLength != 42 || (rec[0]&0x1ff)<<43|rec[1]>>21 != 0x123456789 {
+		t.Fatalf("packExtent produced a bad record: %x", rec)
+	}
+
+	if x, _ := leavesNeeded(extentsPerInode); x != 0 {
+		t.Fatalf("leavesNeeded should fit %d extents in the inode", extentsPerInode)
+	}
+
+	if x, _ := leavesNeeded(extentsPerInode + 1); x != 1 {
+		t.Fatalf("leavesNeeded should need one leaf for %d extents", extentsPerInode+1)
+	}
+
+	if _, err := leavesNeeded(extentsPerLeaf*bmdrMaxRecords + 1); err == nil {
+		t.Fatalf("leavesNeeded should fail on excessively fragmented files")
+	}
+
+}
+
+func checkCRC(t *testing.T, what string, buf []byte, offset int) {
+	stored := binary.LittleEndian.Uint32(buf[offset:])
+	x := make([]byte, len(buf))
+	copy(x, buf)
+	binary.LittleEndian.PutUint32(x[offset:], 0)
+	if crc := crc32.Checksum(x, crcTable); crc != stored {
+		t.Fatalf("%s has a bad checksum: %#x, expected %#x", what, stored, crc)
+	}
+}
+
+func TestCompile(t *testing.T) {
+
+	ctx := context.Background()
+
+	tree := vio.NewFileTree()
+	c := NewCompiler(&CompilerArgs{
+		FileTree: tree,
+		Logger:   &elog.CLI{},
+	})
+
+	err := c.Mkdir("/etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("hello, world\n")
+	err = c.AddFile("/etc/hello", ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.IncreaseMinimumFreeSpace(40 * 1024 * 1024)
+
+	err = c.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := c.MinimumSize()
+	if size%BlockSize != 0 || size < 40*1024*1024 {
+		t.Fatalf("bad minimum size: %d", size)
+	}
+
+	err = c.Precompile(ctx, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.RegionIsHole(0, BlockSize) {
+		t.Fatalf("superblock region reported as a hole")
+	}
+
+	if !c.RegionIsHole((c.layout.logStart+1)*BlockSize, BlockSize) {
+		t.Fatalf("log region not reported as a hole")
+	}
+
+	w := new(fstest.WriteSeeker)
+	err = c.Compile(ctx, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Pos != size {
+		t.Fatalf("compiled image is %d bytes, expected %d", w.Pos, size)
+	}
+
+	sb := new(Superblock)
+	err = binary.Read(bytes.NewReader(w.Buf), binary.BigEndian, sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sb.Magic != SuperblockMagic {
+		t.Fatalf("bad superblock magic: %x", sb.Magic)
+	}
+
+	if sb.AGCount != 2 || int64(sb.DataBlocks) > size/BlockSize {
+		t.Fatalf("superblock geometry is wrong: %d blocks in %d AGs", sb.DataBlocks, sb.AGCount)
+	}
+
+	for g := int64(0); g < int64(sb.AGCount); g++ {
+		ag := w.Buf[g*int64(sb.AGBlocks)*BlockSize:]
+		checkCRC(t, "superblock", ag[:SectorSize], superblockCRCOffset)
+		checkCRC(t, "AGF", ag[SectorSize:2*SectorSize], agfCRCOffset)
+		checkCRC(t, "AGI", ag[2*SectorSize:3*SectorSize], agiCRCOffset)
+		checkCRC(t, "AGFL", ag[3*SectorSize:4*SectorSize], agflCRCOffset)
+	}
+
+	// the root directory is the first inode of the first chunk
+	root := c.layout.chunks[0] * BlockSize
+	inode := w.Buf[root : root+InodeSize]
+	checkCRC(t, "root inode", inode, inodeCRCOffset)
+
+	if ino := int64(binary.BigEndian.Uint64(inode[152:])); ino != int64(sb.RootInode) {
+		t.Fatalf("root inode has the wrong inode number: %d", ino)
+	}
+
+	if mode := binary.BigEndian.Uint16(inode[2:]); mode&0xF000 != 0x4000 {
+		t.Fatalf("root inode is not a directory: %o", mode)
+	}
+
+}
+
+func TestReproducibleCompile(t *testing.T) {
+
+	fstest.Reproducible(t, func(tree vio.FileTree, rnd io.Reader, timestamp time.Time) fstest.Compiler {
+		return NewCompiler(&CompilerArgs{
+			FileTree:  tree,
+			Logger:    &elog.CLI{},
+			Rand:      rnd,
+			Timestamp: timestamp,
+		})
+	}, time.Unix(1600000000, 0))
+
+}
@@ -0,0 +1,895 @@
+package xfs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// The realtime bitmap and summary inodes always exist, even though the
+// file-system has no realtime section. They sit immediately after the root
+// directory.
+const (
+	rootInodeIndex      = 0
+	rtBitmapInodeIndex  = 1
+	rtSummaryInodeIndex = 2
+	metaInodes          = 2
+)
+
+type node struct {
+	node         *vio.TreeNode
+	idx          int64
+	dir          *dirLayout
+	localSymlink bool
+	segments     []segment
+}
+
+type compiler struct {
+	tree   vio.FileTree
+	size   int64
+	nodes  []node
+	layout *layout
+
+	rng        io.Reader
+	timestamp  time.Time
+	uuid       [16]byte
+	now        time.Time
+	superblock Superblock
+}
+
+func (c *compiler) scanInodes(ctx context.Context) error {
+
+	idx := int64(metaInodes + 1)
+	c.nodes = make([]node, 0)
+
+	err := c.tree.WalkNode(func(path string, n *vio.TreeNode) error {
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		x := node{node: n}
+
+		if path == "." {
+			x.idx = rootInodeIndex
+		} else {
+			x.idx = idx
+			idx++
+		}
+		n.NodeSequenceNumber = x.idx
+
+		f := n.File
+		switch {
+		case f.IsDir():
+			var err error
+			x.dir, err = planDirectory(n)
+			if err != nil {
+				return err
+			}
+			x.segments = x.dir.segments()
+		case f.IsSymlink():
+			if f.SymlinkIsCached() && len(f.Symlink()) <= LiteralAreaSize {
+				x.localSymlink = true
+			} else if f.Size() > MaxSymlinkLength {
+				return errors.New("symlink target too long")
+			} else {
+				x.segments = []segment{{offset: 0, length: 1}}
+			}
+		default:
+			if blocks := divide(int64(f.Size()), BlockSize); blocks > 0 {
+				x.segments = []segment{{offset: 0, length: blocks}}
+			}
+		}
+
+		c.nodes = append(c.nodes, x)
+		return nil
+
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+func (c *compiler) usedInodes() int64 {
+	return int64(len(c.nodes)) + metaInodes
+}
+
+func (c *compiler) inode(n *vio.TreeNode) int64 {
+	return c.layout.inode(n.NodeSequenceNumber)
+}
+
+// modTime returns the modification time of f, clamped to the compiler's
+// timestamp if it has one.
+func (c *compiler) modTime(f vio.File) time.Time {
+	t := f.ModTime()
+	if !c.timestamp.IsZero() && t.After(c.timestamp) {
+		return c.timestamp
+	}
+	return t
+}
+
+func (c *compiler) generateMetadata() error {
+
+	_, err := io.ReadFull(c.rng, c.uuid[:])
+	if err != nil {
+		return err
+	}
+	c.uuid[6] = (c.uuid[6] & 0x0F) | 0x40
+	c.uuid[8] = (c.uuid[8] & 0x3F) | 0x80
+
+	c.now = time.Now()
+	if !c.timestamp.IsZero() {
+		c.now = c.timestamp
+	}
+
+	c.initSuperblock()
+
+	return nil
+
+}
+
+func (c *compiler) initSuperblock() {
+
+	l := c.layout
+	inodes := uint64(len(l.chunks)) * InodesPerChunk
+
+	c.superblock = Superblock{
+		Magic:                SuperblockMagic,
+		BlockSize:            BlockSize,
+		DataBlocks:           uint64(l.blocks),
+		UUID:                 c.uuid,
+		LogStart:             uint64(l.fsBlock(l.logStart)),
+		RootInode:            uint64(l.inode(rootInodeIndex)),
+		RealtimeBitmapInode:  uint64(l.inode(rtBitmapInodeIndex)),
+		RealtimeSummaryInode: uint64(l.inode(rtSummaryInodeIndex)),
+		RealtimeExtentSize:   rtExtentSize,
+		AGBlocks:             uint32(l.agBlocks),
+		AGCount:              uint32(l.agCount),
+		LogBlocks:            uint32(l.logBlocks),
+		VersionNumber:        VersionNumber,
+		SectorSize:           SectorSize,
+		InodeSize:            InodeSize,
+		InodesPerBlock:       InodesPerBlock,
+		BlockLog:             BlockLog,
+		SectorLog:            SectorLog,
+		InodeLog:             InodeLog,
+		InodesPerBlockLog:    InodesPerBlockLog,
+		AGBlockLog:           l.agBlockLog,
+		InodeMaxPct:          uint8(l.inodeMaxPct),
+		InodeCount:           inodes,
+		FreeInodes:           inodes - uint64(c.usedInodes()),
+		FreeDataBlocks:       uint64(l.freeBlocks),
+		UserQuotaInode:       NullFSIno,
+		GroupQuotaInode:      NullFSIno,
+		InodeAlignment:       InodeAlignment,
+		LogStripeUnit:        1,
+		Features2:            Features2,
+		BadFeatures2:         Features2,
+		FeaturesIncompat:     FeatureIncompat,
+		ProjectQuotaInode:    NullFSIno,
+	}
+
+}
+
+func (c *compiler) regionIsHole(begin, size int64) bool {
+
+	first := begin / BlockSize
+	last := (begin + size - 1) / BlockSize
+
+	for bno := first; bno <= last; bno++ {
+		if c.layout.dirty.get(bno) {
+			return false
+		}
+	}
+
+	return true
+
+}
+
+// putStruct encodes v at the start of buf.
+func putStruct(buf []byte, v interface{}) {
+	b := new(bytes.Buffer)
+	_ = binary.Write(b, binary.BigEndian, v)
+	copy(buf, b.Bytes())
+}
+
+func directoryLinks(n *vio.TreeNode) uint32 {
+
+	links := uint32(2)
+	for _, child := range n.Children {
+		if child.File.IsDir() {
+			links++
+		}
+	}
+
+	return links
+
+}
+
+func (c *compiler) newInode(idx int64) *Inode {
+	return &Inode{
+		Magic:        InodeMagic,
+		Version:      InodeVersion,
+		NextUnlinked: NullAGIno,
+		Number:       uint64(c.layout.inode(idx)),
+		UUID:         c.uuid,
+	}
+}
+
+// dataFork fills in the data fork of an inode that maps its contents with
+// extents, switching to a block map btree if there are too many of them.
+func (c *compiler) dataFork(inode *Inode, nl *nodeLayout) []byte {
+
+	l := c.layout
+	fork := make([]byte, LiteralAreaSize)
+
+	inode.Format = formatExtents
+	inode.Extents = uint32(len(nl.extents))
+	inode.Blocks = uint64(nl.blocks)
+
+	if len(nl.leaves) == 0 {
+		for i, e := range nl.extents {
+			putStruct(fork[i*16:], packExtent(e.offset, l.fsBlock(e.block), e.length))
+		}
+		return fork
+	}
+
+	inode.Format = formatBTree
+	binary.BigEndian.PutUint16(fork[0:], 1)
+	binary.BigEndian.PutUint16(fork[2:], uint16(len(nl.leaves)))
+
+	for i, leaf := range nl.leaves {
+		keys := fork[bmdrHeaderSize:]
+		ptrs := fork[bmdrHeaderSize+bmdrMaxRecords*8:]
+		binary.BigEndian.PutUint64(keys[i*8:], uint64(nl.extents[i*extentsPerLeaf].offset))
+		binary.BigEndian.PutUint64(ptrs[i*8:], uint64(l.fsBlock(leaf)))
+	}
+
+	return fork
+
+}
+
+// nodeInode generates the inode for the i'th node in the tree.
+func (c *compiler) nodeInode(i int) (*Inode, []byte) {
+
+	x := &c.nodes[i]
+	nl := &c.layout.nodes[i]
+
+	f := x.node.File
+	perms, uid, gid := ext.InodeAttributes(f)
+	inode := c.newInode(x.idx)
+	inode.UID = uid
+	inode.GID = gid
+	inode.Links = 1
+	inode.AttrFormat = formatExtents
+
+	t := timestamp(c.modTime(f))
+	inode.AccessTime = t
+	inode.ModifiedTime = t
+	inode.ChangeTime = t
+	inode.CreationTime = t
+
+	var fork []byte
+
+	switch {
+	case f.IsDir():
+		inode.Mode = ext.InodeTypeDirectory | perms
+		inode.Links = directoryLinks(x.node)
+		if x.dir.form == dirShortForm {
+			w := &dirWriter{d: x.dir, inode: c.inode}
+			fork = w.shortForm()
+			inode.Format = formatLocal
+			inode.Size = uint64(len(fork))
+		} else {
+			fork = c.dataFork(inode, nl)
+			inode.Size = uint64(x.dir.size())
+		}
+	case f.IsSymlink():
+		inode.Mode = ext.InodeTypeSymlink | perms
+		if x.localSymlink {
+			fork = []byte(f.Symlink())
+			inode.Format = formatLocal
+			inode.Size = uint64(len(fork))
+		} else {
+			fork = c.dataFork(inode, nl)
+			inode.Size = uint64(f.Size())
+		}
+	default:
+		inode.Mode = ext.InodeTypeRegularFile | perms
+		fork = c.dataFork(inode, nl)
+		inode.Size = uint64(f.Size())
+	}
+
+	return inode, fork
+
+}
+
+func (c *compiler) metaInode(idx int64) *Inode {
+
+	t := timestamp(c.now)
+	inode := c.newInode(idx)
+	inode.Mode = ext.InodeTypeRegularFile
+	inode.Format = formatExtents
+	inode.AttrFormat = formatExtents
+	inode.Links = 1
+	inode.AccessTime = t
+	inode.ModifiedTime = t
+	inode.ChangeTime = t
+	inode.CreationTime = t
+
+	if idx == rtBitmapInodeIndex {
+		inode.Flags = rtBitmapFlag
+	}
+
+	return inode
+
+}
+
+func (c *compiler) inodeByIndex(idx int64) (*Inode, []byte) {
+
+	switch {
+	case idx == rootInodeIndex:
+		return c.nodeInode(0)
+	case idx <= metaInodes:
+		return c.metaInode(idx), nil
+	case idx < c.usedInodes():
+		return c.nodeInode(int(idx - metaInodes))
+	}
+
+	return c.newInode(idx), nil
+
+}
+
+// region is a piece of the file-system image that needs to be written out.
+// Regions are sorted by their location and written in order so that the
+// compiler never needs to seek backwards.
+type region struct {
+	block int64
+	write func(w io.Writer) error
+}
+
+func (c *compiler) writeChunk(w io.Writer, chunk int64) error {
+
+	buf := make([]byte, InodesPerChunk*InodeSize)
+
+	for i := int64(0); i < InodesPerChunk; i++ {
+		inode, fork := c.inodeByIndex(chunk*InodesPerChunk + i)
+		data := buf[i*InodeSize : (i+1)*InodeSize]
+		putStruct(data, inode)
+		copy(data[InodeCoreSize:], fork)
+		setChecksum(data, inodeCRCOffset)
+	}
+
+	_, err := w.Write(buf)
+	return err
+
+}
+
+func (c *compiler) agFreeInodes(g int64) int64 {
+
+	ag := &c.layout.ags[g]
+	first := ag.firstChunk * InodesPerChunk
+	last := (ag.firstChunk + ag.chunks) * InodesPerChunk
+
+	used := c.usedInodes()
+	if used < first {
+		used = first
+	} else if used > last {
+		used = last
+	}
+
+	return last - used
+
+}
+
+func (c *compiler) writeAGHeaders(w io.Writer, g int64) error {
+
+	l := c.layout
+	ag := &l.ags[g]
+	buf := make([]byte, BlockSize)
+
+	sb := buf[0*SectorSize : 1*SectorSize]
+	putStruct(sb, &c.superblock)
+	setChecksum(sb, superblockCRCOffset)
+
+	agf := buf[1*SectorSize : 2*SectorSize]
+	putStruct(agf, &AGF{
+		Magic:          AGFMagic,
+		Version:        AGFVersion,
+		SequenceNumber: uint32(g),
+		Length:         uint32(l.agSize(g)),
+		Roots:          [3]uint32{bnoRootBlock, cntRootBlock, 0},
+		Levels:         [3]uint32{1, 1, 0},
+		FLFirst:        0,
+		FLLast:         agflBlocks - 1,
+		FLCount:        agflBlocks,
+		FreeBlocks:     uint32(ag.freeBlocks),
+		Longest:        uint32(ag.longest),
+		UUID:           c.uuid,
+	})
+	setChecksum(agf, agfCRCOffset)
+
+	agi := buf[2*SectorSize : 3*SectorSize]
+	x := &AGI{
+		Magic:          AGIMagic,
+		Version:        AGIVersion,
+		SequenceNumber: uint32(g),
+		Length:         uint32(l.agSize(g)),
+		Count:          uint32(ag.chunks * InodesPerChunk),
+		Root:           inoRootBlock,
+		Level:          1,
+		FreeCount:      uint32(c.agFreeInodes(g)),
+		NewInode:       NullAGIno,
+		DirInode:       NullAGIno,
+		UUID:           c.uuid,
+	}
+	if len(ag.leaves) > 0 {
+		x.Level = 2
+	}
+	if ag.chunks > 0 {
+		x.NewInode = uint32(l.agInode((ag.firstChunk + ag.chunks - 1) * InodesPerChunk))
+	}
+	for i := range x.Unlinked {
+		x.Unlinked[i] = NullAGIno
+	}
+	putStruct(agi, x)
+	setChecksum(agi, agiCRCOffset)
+
+	agfl := buf[3*SectorSize : 4*SectorSize]
+	putStruct(agfl, &AGFLHeader{
+		Magic:          AGFLMagic,
+		SequenceNumber: uint32(g),
+		UUID:           c.uuid,
+	})
+	for i := 0; i < agflEntries; i++ {
+		bno := uint32(NullAGBlock)
+		if i < agflBlocks {
+			bno = uint32(agflFirstBlock + i)
+		}
+		binary.BigEndian.PutUint32(agfl[36+i*4:], bno)
+	}
+	setChecksum(agfl, agflCRCOffset)
+
+	_, err := w.Write(buf)
+	return err
+
+}
+
+// shortBlock generates a per-AG btree block.
+func (c *compiler) shortBlock(g, block int64, magic uint32, level, records int, left, right uint32, body []byte) []byte {
+
+	buf := make([]byte, BlockSize)
+	putStruct(buf, &ShortBlockHeader{
+		Magic:        magic,
+		Level:        uint16(level),
+		Records:      uint16(records),
+		LeftSibling:  left,
+		RightSibling: right,
+		DiskAddress:  uint64(block * SectorsPerBlock),
+		UUID:         c.uuid,
+		Owner:        uint32(g),
+	})
+	copy(buf[shortBlockHeaderSize:], body)
+	setChecksum(buf, shortBlockCRCOffset)
+
+	return buf
+
+}
+
+func (c *compiler) freeSpaceBlock(g int64, magic uint32, free []run) []byte {
+
+	l := c.layout
+	body := make([]byte, len(free)*8)
+	for i, r := range free {
+		binary.BigEndian.PutUint32(body[i*8:], uint32(l.agBlock(r.start)))
+		binary.BigEndian.PutUint32(body[i*8+4:], uint32(r.length))
+	}
+
+	block := g * l.agBlocks
+	if magic == BNOBTMagic {
+		block += bnoRootBlock
+	} else {
+		block += cntRootBlock
+	}
+
+	return c.shortBlock(g, block, magic, 0, len(free), NullAGBlock, NullAGBlock, body)
+
+}
+
+func (c *compiler) freeSpaceRegions(g int64) []region {
+
+	ag := &c.layout.ags[g]
+	first := g * c.layout.agBlocks
+
+	byCount := make([]run, len(ag.free))
+	copy(byCount, ag.free)
+	sort.SliceStable(byCount, func(i, j int) bool {
+		return byCount[i].length < byCount[j].length
+	})
+
+	return []region{{
+		block: first + bnoRootBlock,
+		write: func(w io.Writer) error {
+			_, err := w.Write(c.freeSpaceBlock(g, BNOBTMagic, ag.free))
+			return err
+		},
+	}, {
+		block: first + cntRootBlock,
+		write: func(w io.Writer) error {
+			_, err := w.Write(c.freeSpaceBlock(g, CNTBTMagic, byCount))
+			return err
+		},
+	}}
+
+}
+
+// inodeRecords generates the inode btree records for every chunk in an AG.
+func (c *compiler) inodeRecords(g int64) []byte {
+
+	l := c.layout
+	ag := &l.ags[g]
+	used := c.usedInodes()
+	body := make([]byte, ag.chunks*16)
+
+	for i := int64(0); i < ag.chunks; i++ {
+
+		chunk := ag.firstChunk + i
+
+		var free uint64
+		var count uint32
+		for j := int64(0); j < InodesPerChunk; j++ {
+			if chunk*InodesPerChunk+j >= used {
+				free |= 1 << uint(j)
+				count++
+			}
+		}
+
+		rec := body[i*16:]
+		binary.BigEndian.PutUint32(rec[0:], uint32(l.agInode(chunk*InodesPerChunk)))
+		binary.BigEndian.PutUint32(rec[4:], count)
+		binary.BigEndian.PutUint64(rec[8:], free)
+
+	}
+
+	return body
+
+}
+
+func (c *compiler) inodeBTreeRegions(g int64) []region {
+
+	l := c.layout
+	ag := &l.ags[g]
+	first := g * l.agBlocks
+	records := c.inodeRecords(g)
+
+	if len(ag.leaves) == 0 {
+		return []region{{
+			block: first + inoRootBlock,
+			write: func(w io.Writer) error {
+				_, err := w.Write(c.shortBlock(g, first+inoRootBlock, INOBTMagic, 0, int(ag.chunks), NullAGBlock, NullAGBlock, records))
+				return err
+			},
+		}}
+	}
+
+	root := make([]byte, BlockSize-shortBlockHeaderSize)
+	keys := root
+	ptrs := root[inobtRecsPerNode*4:]
+
+	var regions []region
+
+	for i, leaf := range ag.leaves {
+
+		lo := int64(i) * inobtRecsPerLeaf
+		hi := lo + inobtRecsPerLeaf
+		if hi > ag.chunks {
+			hi = ag.chunks
+		}
+
+		left := uint32(NullAGBlock)
+		right := uint32(NullAGBlock)
+		if i > 0 {
+			left = uint32(l.agBlock(ag.leaves[i-1]))
+		}
+		if i+1 < len(ag.leaves) {
+			right = uint32(l.agBlock(ag.leaves[i+1]))
+		}
+
+		copy(keys[i*4:], records[lo*16:lo*16+4])
+		binary.BigEndian.PutUint32(ptrs[i*4:], uint32(l.agBlock(leaf)))
+
+		leaf := leaf
+		body := records[lo*16 : hi*16]
+		regions = append(regions, region{
+			block: leaf,
+			write: func(w io.Writer) error {
+				_, err := w.Write(c.shortBlock(g, leaf, INOBTMagic, 0, int(hi-lo), left, right, body))
+				return err
+			},
+		})
+
+	}
+
+	regions = append(regions, region{
+		block: first + inoRootBlock,
+		write: func(w io.Writer) error {
+			_, err := w.Write(c.shortBlock(g, first+inoRootBlock, INOBTMagic, 1, len(ag.leaves), NullAGBlock, NullAGBlock, root))
+			return err
+		},
+	})
+
+	return regions
+
+}
+
+func (c *compiler) agRegions(g int64) []region {
+
+	l := c.layout
+	regions := []region{{
+		block: g * l.agBlocks,
+		write: func(w io.Writer) error { return c.writeAGHeaders(w, g) },
+	}}
+
+	regions = append(regions, c.freeSpaceRegions(g)...)
+	regions = append(regions, c.inodeBTreeRegions(g)...)
+
+	return regions
+
+}
+
+func (c *compiler) chunkRegions() []region {
+
+	var regions []region
+
+	for i, block := range c.layout.chunks {
+		chunk := int64(i)
+		regions = append(regions, region{
+			block: block,
+			write: func(w io.Writer) error { return c.writeChunk(w, chunk) },
+		})
+	}
+
+	return regions
+
+}
+
+func (c *compiler) leafRegions(x *node, nl *nodeLayout) []region {
+
+	l := c.layout
+	var regions []region
+
+	for i, leaf := range nl.leaves {
+
+		first := i * extentsPerLeaf
+		last := first + extentsPerLeaf
+		if last > len(nl.extents) {
+			last = len(nl.extents)
+		}
+
+		left := uint64(NullFSBlock)
+		right := uint64(NullFSBlock)
+		if i > 0 {
+			left = uint64(l.fsBlock(nl.leaves[i-1]))
+		}
+		if i+1 < len(nl.leaves) {
+			right = uint64(l.fsBlock(nl.leaves[i+1]))
+		}
+
+		leaf := leaf
+		extents := nl.extents[first:last]
+		regions = append(regions, region{
+			block: leaf,
+			write: func(w io.Writer) error {
+				buf := make([]byte, BlockSize)
+				putStruct(buf, &LongBlockHeader{
+					Magic:        BMBTMagic,
+					Records:      uint16(len(extents)),
+					LeftSibling:  left,
+					RightSibling: right,
+					DiskAddress:  uint64(leaf * SectorsPerBlock),
+					UUID:         c.uuid,
+					Owner:        uint64(c.inode(x.node)),
+				})
+				for j, e := range extents {
+					putStruct(buf[longBlockHeaderSize+j*16:], packExtent(e.offset, l.fsBlock(e.block), e.length))
+				}
+				setChecksum(buf, longBlockCRCOffset)
+				_, err := w.Write(buf)
+				return err
+			},
+		})
+
+	}
+
+	return regions
+
+}
+
+func (c *compiler) symlinkBlock(x *node, nl *nodeLayout) ([]byte, error) {
+
+	target, err := ioutil.ReadAll(x.node.File)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, BlockSize)
+	putStruct(buf, &SymlinkHeader{
+		Magic:       SymlinkMagic,
+		Bytes:       uint32(len(target)),
+		UUID:        c.uuid,
+		Owner:       uint64(c.inode(x.node)),
+		DiskAddress: uint64(nl.extents[0].block * SectorsPerBlock),
+	})
+	copy(buf[symlinkHeaderSize:], target)
+	setChecksum(buf, symlinkCRCOffset)
+
+	return buf, nil
+
+}
+
+// dataStream tracks the sequential consumption of file contents across all
+// of the extents belonging to the nodes in the file-system.
+type dataStream struct {
+	c      *compiler
+	next   int
+	active int
+	r      io.Reader
+}
+
+func (s *dataStream) advance(idx int) error {
+
+	for s.next <= idx {
+		if s.next > 0 {
+			err := s.c.nodes[s.next-1].node.File.Close()
+			if err != nil {
+				return err
+			}
+		}
+
+		x := &s.c.nodes[s.next]
+		nl := &s.c.layout.nodes[s.next]
+		switch {
+		case x.node.File.IsDir():
+			w := &dirWriter{
+				d:     x.dir,
+				nl:    nl,
+				ino:   s.c.inode(x.node),
+				uuid:  s.c.uuid,
+				inode: s.c.inode,
+			}
+			if x.dir.form != dirShortForm {
+				s.r = bytes.NewReader(w.blocks())
+			}
+		case x.node.File.IsSymlink() && !x.localSymlink:
+			data, err := s.c.symlinkBlock(x, nl)
+			if err != nil {
+				return err
+			}
+			s.r = bytes.NewReader(data)
+		default:
+			s.r = x.node.File
+		}
+
+		s.active = s.next
+		s.next++
+	}
+
+	return nil
+
+}
+
+func (s *dataStream) finish() error {
+
+	first := s.next - 1
+	if first < 0 {
+		first = 0
+	}
+
+	for i := first; i < len(s.c.nodes); i++ {
+		err := s.c.nodes[i].node.File.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+func (s *dataStream) region(idx int, e extent) region {
+	return region{
+		block: e.block,
+		write: func(w io.Writer) error {
+
+			err := s.advance(idx)
+			if err != nil {
+				return err
+			}
+
+			length := e.length * BlockSize
+			k, err := io.CopyN(w, s.r, length)
+			if err != nil && err != io.EOF {
+				return err
+			}
+
+			_, err = io.CopyN(w, vio.Zeroes, length-k)
+			return err
+
+		},
+	}
+}
+
+func (c *compiler) regions(s *dataStream) []region {
+
+	l := c.layout
+	var regions []region
+
+	for g := int64(0); g < l.agCount; g++ {
+		regions = append(regions, c.agRegions(g)...)
+	}
+
+	regions = append(regions, region{
+		block: l.logStart,
+		write: func(w io.Writer) error { return writeLogRecord(w, c.uuid) },
+	})
+
+	regions = append(regions, c.chunkRegions()...)
+
+	for i := range c.nodes {
+		nl := &l.nodes[i]
+		regions = append(regions, c.leafRegions(&c.nodes[i], nl)...)
+		for _, e := range nl.extents {
+			regions = append(regions, s.region(i, e))
+		}
+	}
+
+	sort.SliceStable(regions, func(i, j int) bool {
+		return regions[i].block < regions[j].block
+	})
+
+	return regions
+
+}
+
+func (c *compiler) writeRegions(ctx context.Context, w io.WriteSeeker) error {
+
+	s := &dataStream{c: c}
+
+	for _, r := range c.regions(s) {
+
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Seek(r.block*BlockSize, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		err = r.write(w)
+		if err != nil {
+			return err
+		}
+
+	}
+
+	return s.finish()
+
+}
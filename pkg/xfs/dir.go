@@ -0,0 +1,450 @@
+package xfs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/binary"
+	"errors"
+	"path"
+	"sort"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// XFS stores directories in one of four formats, picking the most compact one
+// that can hold all of the entries.
+const (
+	dirShortForm = iota // entries stored inside the inode
+	dirBlockForm        // entries and hash index in a single block
+	dirLeafForm         // data blocks plus a single hash index block
+	dirNodeForm         // data blocks, a btree of hash index blocks, and free index blocks
+)
+
+type dirEntry struct {
+	name  string
+	node  *vio.TreeNode
+	ftype uint8
+}
+
+// dirLayout is the shape of a directory, which can be determined before any
+// inode numbers or disk addresses are known.
+type dirLayout struct {
+	form    int
+	entries []dirEntry
+	starts  []int // index of the first entry in each data block
+	leaves  int64 // hash index blocks in node form
+	frees   int64 // free index blocks in node form
+}
+
+func dataEntrySize(name string) int64 {
+	// inumber, namelen, name, ftype, tag
+	return align(8+1+int64(len(name))+1+2, 8)
+}
+
+func shortFormEntrySize(name string, inoSize int64) int64 {
+	// namelen, offset, name, ftype, inumber
+	return 1 + 2 + int64(len(name)) + 1 + inoSize
+}
+
+func dirEntries(n *vio.TreeNode) []dirEntry {
+
+	parent := n.Parent
+	if parent == nil {
+		parent = n
+	}
+
+	entries := make([]dirEntry, 0, len(n.Children)+2)
+	entries = append(entries, dirEntry{name: ".", node: n, ftype: ftypeDir})
+	entries = append(entries, dirEntry{name: "..", node: parent, ftype: ftypeDir})
+
+	for _, child := range n.Children {
+		entries = append(entries, dirEntry{
+			name:  path.Base(child.File.Name()),
+			node:  child,
+			ftype: fileType(child.File),
+		})
+	}
+
+	return entries
+
+}
+
+// planDirectory picks a format for the directory and works out how many
+// blocks it needs. Short form sizes are calculated assuming 8-byte inode
+// numbers because the real inode numbers aren't known yet.
+func planDirectory(n *vio.TreeNode) (*dirLayout, error) {
+
+	d := &dirLayout{entries: dirEntries(n)}
+
+	sfSize := int64(2 + 8)
+	for _, e := range d.entries[2:] {
+		sfSize += shortFormEntrySize(e.name, 8)
+	}
+
+	if sfSize <= LiteralAreaSize && len(d.entries)-2 <= 0xFF {
+		d.form = dirShortForm
+		return d, nil
+	}
+
+	blockSize := int64(dirHeaderSize + 8)
+	for _, e := range d.entries {
+		blockSize += dataEntrySize(e.name) + 8
+	}
+
+	if blockSize <= BlockSize {
+		d.form = dirBlockForm
+		d.starts = []int{0}
+		return d, nil
+	}
+
+	used := int64(BlockSize)
+	for i, e := range d.entries {
+		l := dataEntrySize(e.name)
+		if used+l > BlockSize {
+			d.starts = append(d.starts, i)
+			used = dirHeaderSize
+		}
+		used += l
+	}
+
+	dataBlocks := int64(len(d.starts))
+	if dirHeaderSize+8*int64(len(d.entries))+2*dataBlocks+4 <= BlockSize {
+		d.form = dirLeafForm
+		return d, nil
+	}
+
+	d.form = dirNodeForm
+	d.leaves = divide(int64(len(d.entries)), dirLeafEntries)
+	d.frees = divide(dataBlocks, dirFreeEntries)
+	if d.leaves > dirNodeEntries {
+		return nil, errors.New("directory has too many entries")
+	}
+
+	return d, nil
+
+}
+
+func (d *dirLayout) dataBlocks() int64 {
+	return int64(len(d.starts))
+}
+
+// leafSpaceBlocks returns the number of blocks in the hash index section of a
+// node form directory, including the root node if there is more than one leaf.
+func (d *dirLayout) leafSpaceBlocks() int64 {
+	if d.leaves > 1 {
+		return d.leaves + 1
+	}
+	return d.leaves
+}
+
+func (d *dirLayout) segments() []segment {
+
+	switch d.form {
+	case dirBlockForm:
+		return []segment{{offset: 0, length: 1}}
+	case dirLeafForm:
+		return []segment{
+			{offset: 0, length: d.dataBlocks()},
+			{offset: DirLeafBlock, length: 1},
+		}
+	case dirNodeForm:
+		return []segment{
+			{offset: 0, length: d.dataBlocks()},
+			{offset: DirLeafBlock, length: d.leafSpaceBlocks()},
+			{offset: DirFreeBlock, length: d.frees},
+		}
+	}
+
+	return nil
+
+}
+
+func (d *dirLayout) size() int64 {
+	if d.form == dirBlockForm {
+		return BlockSize
+	}
+	return d.dataBlocks() * BlockSize
+}
+
+type leafEntry struct {
+	hash    uint32
+	address uint32
+}
+
+// dirWriter holds everything needed to generate the contents of a single
+// directory once the file-system layout has been locked in.
+type dirWriter struct {
+	d     *dirLayout
+	nl    *nodeLayout
+	ino   int64
+	uuid  [16]byte
+	inode func(n *vio.TreeNode) int64
+}
+
+// diskAddress returns the address, in sectors, of a logical directory block.
+func (w *dirWriter) diskAddress(dablk int64) uint64 {
+	for _, e := range w.nl.extents {
+		if dablk >= e.offset && dablk < e.offset+e.length {
+			return uint64((e.block + dablk - e.offset) * SectorsPerBlock)
+		}
+	}
+	panic("directory block not mapped")
+}
+
+func (w *dirWriter) shortForm() []byte {
+
+	entries := w.d.entries[2:]
+	parent := w.inode(w.d.entries[1].node)
+
+	var i8count int
+	if parent > MaxShortIno {
+		i8count++
+	}
+	for _, e := range entries {
+		if w.inode(e.node) > MaxShortIno {
+			i8count++
+		}
+	}
+
+	inoSize := 4
+	if i8count > 0 {
+		inoSize = 8
+	}
+
+	putIno := func(buf []byte, ino int64) []byte {
+		if inoSize == 8 {
+			return append(buf, byte(ino>>56), byte(ino>>48), byte(ino>>40), byte(ino>>32),
+				byte(ino>>24), byte(ino>>16), byte(ino>>8), byte(ino))
+		}
+		return append(buf, byte(ino>>24), byte(ino>>16), byte(ino>>8), byte(ino))
+	}
+
+	buf := []byte{byte(len(entries)), byte(i8count)}
+	buf = putIno(buf, parent)
+
+	offset := int64(dirFirstOffset)
+	for _, e := range entries {
+		buf = append(buf, byte(len(e.name)), byte(offset>>8), byte(offset))
+		buf = append(buf, e.name...)
+		buf = append(buf, e.ftype)
+		buf = putIno(buf, w.inode(e.node))
+		offset += dataEntrySize(e.name)
+	}
+
+	return buf
+
+}
+
+func (w *dirWriter) putDirHeader(buf []byte, magic uint32, dablk int64) {
+	binary.BigEndian.PutUint32(buf[0:], magic)
+	binary.BigEndian.PutUint64(buf[8:], w.diskAddress(dablk))
+	copy(buf[24:], w.uuid[:])
+	binary.BigEndian.PutUint64(buf[40:], uint64(w.ino))
+}
+
+func (w *dirWriter) putDABlockInfo(buf []byte, magic uint16, dablk, forw, back int64) {
+	binary.BigEndian.PutUint32(buf[0:], uint32(forw))
+	binary.BigEndian.PutUint32(buf[4:], uint32(back))
+	binary.BigEndian.PutUint16(buf[8:], magic)
+	binary.BigEndian.PutUint64(buf[16:], w.diskAddress(dablk))
+	copy(buf[32:], w.uuid[:])
+	binary.BigEndian.PutUint64(buf[48:], uint64(w.ino))
+}
+
+func putLeafEntries(buf []byte, leaves []leafEntry) {
+	for i, l := range leaves {
+		binary.BigEndian.PutUint32(buf[i*8:], l.hash)
+		binary.BigEndian.PutUint32(buf[i*8+4:], l.address)
+	}
+}
+
+// dataBlocks generates every data block of the directory, returning the hash
+// index entries and the length of the free space left in each block.
+func (w *dirWriter) dataBlocks() ([]byte, []leafEntry, []uint16) {
+
+	d := w.d
+	data := make([]byte, d.dataBlocks()*BlockSize)
+	leaves := make([]leafEntry, 0, len(d.entries))
+	bests := make([]uint16, d.dataBlocks())
+
+	magic := uint32(DirDataMagic)
+	limit := int64(BlockSize)
+	if d.form == dirBlockForm {
+		magic = DirBlockMagic
+		limit = BlockSize - 8 - 8*int64(len(d.entries))
+	}
+
+	for i, start := range d.starts {
+
+		end := len(d.entries)
+		if i+1 < len(d.starts) {
+			end = d.starts[i+1]
+		}
+
+		buf := data[int64(i)*BlockSize : int64(i+1)*BlockSize]
+		w.putDirHeader(buf, magic, int64(i))
+
+		pos := int64(dirHeaderSize)
+		for _, e := range d.entries[start:end] {
+			l := dataEntrySize(e.name)
+			binary.BigEndian.PutUint64(buf[pos:], uint64(w.inode(e.node)))
+			buf[pos+8] = byte(len(e.name))
+			copy(buf[pos+9:], e.name)
+			buf[pos+9+int64(len(e.name))] = e.ftype
+			binary.BigEndian.PutUint16(buf[pos+l-2:], uint16(pos))
+			leaves = append(leaves, leafEntry{
+				hash:    hashName([]byte(e.name)),
+				address: uint32((int64(i)*BlockSize + pos) >> 3),
+			})
+			pos += l
+		}
+
+		if free := limit - pos; free > 0 {
+			binary.BigEndian.PutUint16(buf[pos:], DirFreeTag)
+			binary.BigEndian.PutUint16(buf[pos+2:], uint16(free))
+			binary.BigEndian.PutUint16(buf[pos+free-2:], uint16(pos))
+			binary.BigEndian.PutUint16(buf[48:], uint16(pos))
+			binary.BigEndian.PutUint16(buf[50:], uint16(free))
+			bests[i] = uint16(free)
+		}
+
+	}
+
+	sort.SliceStable(leaves, func(i, j int) bool {
+		return leaves[i].hash < leaves[j].hash
+	})
+
+	if d.form == dirBlockForm {
+		putLeafEntries(data[limit:], leaves)
+		binary.BigEndian.PutUint32(data[BlockSize-8:], uint32(len(leaves)))
+	}
+
+	for i := range d.starts {
+		setChecksum(data[int64(i)*BlockSize:int64(i+1)*BlockSize], dirBlockCRCOffset)
+	}
+
+	return data, leaves, bests
+
+}
+
+func (w *dirWriter) leafBlock(leaves []leafEntry, bests []uint16) []byte {
+
+	buf := make([]byte, BlockSize)
+	w.putDABlockInfo(buf, DirLeaf1Magic, DirLeafBlock, 0, 0)
+	binary.BigEndian.PutUint16(buf[56:], uint16(len(leaves)))
+	putLeafEntries(buf[dirHeaderSize:], leaves)
+
+	tail := BlockSize - 4
+	binary.BigEndian.PutUint32(buf[tail:], uint32(len(bests)))
+	for i, b := range bests {
+		binary.BigEndian.PutUint16(buf[tail-2*len(bests)+2*i:], b)
+	}
+
+	setChecksum(buf, daBlockCRCOffset)
+	return buf
+
+}
+
+func (w *dirWriter) nodeBlocks(leaves []leafEntry) []byte {
+
+	d := w.d
+	data := make([]byte, d.leafSpaceBlocks()*BlockSize)
+
+	first := int64(DirLeafBlock)
+	if d.leaves > 1 {
+		first++
+	}
+
+	lastHashes := make([]uint32, d.leaves)
+
+	for i := int64(0); i < d.leaves; i++ {
+
+		lo := i * dirLeafEntries
+		hi := lo + dirLeafEntries
+		if hi > int64(len(leaves)) {
+			hi = int64(len(leaves))
+		}
+
+		var forw, back int64
+		if i > 0 {
+			back = first + i - 1
+		}
+		if i+1 < d.leaves {
+			forw = first + i + 1
+		}
+
+		buf := data[(first-DirLeafBlock+i)*BlockSize : (first-DirLeafBlock+i+1)*BlockSize]
+		w.putDABlockInfo(buf, DirLeafNMagic, first+i, forw, back)
+		binary.BigEndian.PutUint16(buf[56:], uint16(hi-lo))
+		putLeafEntries(buf[dirHeaderSize:], leaves[lo:hi])
+		setChecksum(buf, daBlockCRCOffset)
+
+		lastHashes[i] = leaves[hi-1].hash
+
+	}
+
+	if d.leaves > 1 {
+		buf := data[:BlockSize]
+		w.putDABlockInfo(buf, DirNodeMagic, DirLeafBlock, 0, 0)
+		binary.BigEndian.PutUint16(buf[56:], uint16(d.leaves))
+		binary.BigEndian.PutUint16(buf[58:], 1)
+		for i := int64(0); i < d.leaves; i++ {
+			binary.BigEndian.PutUint32(buf[dirHeaderSize+i*8:], lastHashes[i])
+			binary.BigEndian.PutUint32(buf[dirHeaderSize+i*8+4:], uint32(first+i))
+		}
+		setChecksum(buf, daBlockCRCOffset)
+	}
+
+	return data
+
+}
+
+func (w *dirWriter) freeBlocks(bests []uint16) []byte {
+
+	d := w.d
+	data := make([]byte, d.frees*BlockSize)
+
+	for i := int64(0); i < d.frees; i++ {
+
+		lo := i * dirFreeEntries
+		hi := lo + dirFreeEntries
+		if hi > int64(len(bests)) {
+			hi = int64(len(bests))
+		}
+
+		buf := data[i*BlockSize : (i+1)*BlockSize]
+		w.putDirHeader(buf, DirFreeMagic, DirFreeBlock+i)
+		binary.BigEndian.PutUint32(buf[48:], uint32(lo))
+		binary.BigEndian.PutUint32(buf[52:], uint32(hi-lo))
+		binary.BigEndian.PutUint32(buf[56:], uint32(hi-lo))
+		for j, b := range bests[lo:hi] {
+			binary.BigEndian.PutUint16(buf[dirHeaderSize+2*j:], b)
+		}
+		setChecksum(buf, dirBlockCRCOffset)
+
+	}
+
+	return data
+
+}
+
+// blocks generates the contents of every block belonging to the directory, in
+// the same order as its segments.
+func (w *dirWriter) blocks() []byte {
+
+	data, leaves, bests := w.dataBlocks()
+
+	switch w.d.form {
+	case dirLeafForm:
+		data = append(data, w.leafBlock(leaves, bests)...)
+	case dirNodeForm:
+		data = append(data, w.nodeBlocks(leaves)...)
+		data = append(data, w.freeBlocks(bests)...)
+	}
+
+	return data
+
+}
@@ -0,0 +1,581 @@
+package xfs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+var errInsufficientSpace = errors.New("insufficient size to satisfy minimum data capacity requirements")
+
+type bitmap []uint64
+
+func newBitmap(bits int64) bitmap {
+	return make(bitmap, divide(bits, 64))
+}
+
+func (b bitmap) set(i int64) {
+	b[i/64] |= 1 << uint(i%64)
+}
+
+func (b bitmap) get(i int64) bool {
+	if int(i/64) >= len(b) {
+		return false
+	}
+	return b[i/64]&(1<<uint(i%64)) != 0
+}
+
+func (b bitmap) setRange(first, length int64) {
+	for i := first; i < first+length; i++ {
+		b.set(i)
+	}
+}
+
+func (b bitmap) count(first, length int64) int64 {
+	var n int64
+	for i := first; i < first+length; {
+		if i%64 == 0 && i+64 <= first+length {
+			n += int64(bits.OnesCount64(b[i/64]))
+			i += 64
+			continue
+		}
+		if b.get(i) {
+			n++
+		}
+		i++
+	}
+	return n
+}
+
+// run is a contiguous range of blocks. Blocks are always addressed linearly
+// from the start of the file-system, and converted to the AG-relative forms
+// that XFS uses only when written to disk.
+type run struct {
+	start  int64
+	length int64
+}
+
+// segment is a contiguous range of logical blocks within a file.
+type segment struct {
+	offset int64
+	length int64
+}
+
+// extent maps a run of logical blocks within a file onto the disk.
+type extent struct {
+	offset int64
+	block  int64
+	length int64
+}
+
+// nodeLayout records where on disk the data belonging to a single inode ends
+// up once the file-system has been planned.
+type nodeLayout struct {
+	leaves  []int64
+	extents []extent
+	blocks  int64
+}
+
+// agLayout records the inode chunks, inode btree leaves and free space
+// belonging to a single allocation group.
+type agLayout struct {
+	firstChunk int64
+	chunks     int64
+	leaves     []int64
+	free       []run
+	freeBlocks int64
+	longest    int64
+}
+
+// layout is the product of planning a file-system of a specific size. It is
+// calculated during Commit to find the minimum size, and again during
+// Precompile to lock in the final structure.
+type layout struct {
+	blocks      int64
+	agBlocks    int64
+	agCount     int64
+	agBlockLog  uint8
+	logAG       int64
+	logStart    int64
+	logBlocks   int64
+	inodeMaxPct int64
+	chunks      []int64
+	ags         []agLayout
+	alloc       bitmap // blocks that are in use
+	dirty       bitmap // blocks that contain non-zero data
+	cursor      int64
+	nodes       []nodeLayout
+	freeBlocks  int64
+}
+
+func (l *layout) agSize(g int64) int64 {
+	if g == l.agCount-1 {
+		return l.blocks - g*l.agBlocks
+	}
+	return l.agBlocks
+}
+
+// fsBlock converts a linear block number into the form XFS uses for
+// file-system wide block pointers.
+func (l *layout) fsBlock(block int64) int64 {
+	return (block/l.agBlocks)<<l.agBlockLog | block%l.agBlocks
+}
+
+func (l *layout) agBlock(block int64) int64 {
+	return block % l.agBlocks
+}
+
+// inode returns the inode number of the inode at index idx, where inodes are
+// numbered in the order they appear across all of the inode chunks.
+func (l *layout) inode(idx int64) int64 {
+	chunk := l.chunks[idx/InodesPerChunk]
+	return l.fsBlock(chunk)<<InodesPerBlockLog | idx%InodesPerChunk
+}
+
+func (l *layout) agInode(idx int64) int64 {
+	chunk := l.chunks[idx/InodesPerChunk]
+	return l.agBlock(chunk)<<InodesPerBlockLog | idx%InodesPerChunk
+}
+
+func (l *layout) reserve(first, length int64, dirty bool) {
+	l.alloc.setRange(first, length)
+	if dirty {
+		l.dirty.setRange(first, length)
+	}
+}
+
+// scan walks forward from 'from' looking for 'n' free blocks, without
+// claiming them. It returns the runs it found and the block immediately after
+// the last one. Because the first block of every AG is always in use, runs
+// never cross AG boundaries.
+func (l *layout) scan(from, n int64) ([]run, int64, error) {
+
+	var runs []run
+	pos := from
+
+	for n > 0 {
+
+		for pos < l.blocks && l.alloc.get(pos) {
+			pos++
+		}
+
+		if pos >= l.blocks {
+			return nil, 0, errInsufficientSpace
+		}
+
+		r := run{start: pos}
+		for pos < l.blocks && n > 0 && !l.alloc.get(pos) {
+			r.length++
+			pos++
+			n--
+		}
+
+		runs = append(runs, r)
+
+	}
+
+	return runs, pos, nil
+
+}
+
+func splitExtents(offset int64, runs []run) []extent {
+
+	var extents []extent
+
+	for _, r := range runs {
+		for off := int64(0); off < r.length; off += MaxExtentLength {
+			length := r.length - off
+			if length > MaxExtentLength {
+				length = MaxExtentLength
+			}
+			extents = append(extents, extent{
+				offset: offset,
+				block:  r.start + off,
+				length: length,
+			})
+			offset += length
+		}
+	}
+
+	return extents
+
+}
+
+func leavesNeeded(extents int) (int64, error) {
+
+	if extents <= extentsPerInode {
+		return 0, nil
+	}
+
+	leaves := divide(int64(extents), extentsPerLeaf)
+	if leaves > bmdrMaxRecords {
+		return 0, errors.New("file too fragmented for a two-level block map btree")
+	}
+
+	return leaves, nil
+
+}
+
+// allocate claims blocks for a file's data and any block map btree leaves
+// needed to index it. Blocks are claimed sequentially from the layout cursor
+// so that the data can be streamed to disk in the same order it is planned.
+func (l *layout) allocate(segments []segment) (nodeLayout, error) {
+
+	var nl nodeLayout
+
+	var content int64
+	for _, s := range segments {
+		content += s.length
+	}
+
+	if content == 0 {
+		return nl, nil
+	}
+
+	var leaves int64
+	for {
+		leafRuns, pos, err := l.scan(l.cursor, leaves)
+		if err != nil {
+			return nl, err
+		}
+
+		var extents []extent
+		var dataRuns []run
+		for _, s := range segments {
+			var runs []run
+			runs, pos, err = l.scan(pos, s.length)
+			if err != nil {
+				return nl, err
+			}
+			extents = append(extents, splitExtents(s.offset, runs)...)
+			dataRuns = append(dataRuns, runs...)
+		}
+
+		need, err := leavesNeeded(len(extents))
+		if err != nil {
+			return nl, err
+		}
+
+		if need > leaves {
+			leaves = need
+			continue
+		}
+
+		for _, r := range leafRuns {
+			for i := int64(0); i < r.length; i++ {
+				nl.leaves = append(nl.leaves, r.start+i)
+			}
+			l.reserve(r.start, r.length, true)
+		}
+
+		for _, r := range dataRuns {
+			l.reserve(r.start, r.length, true)
+		}
+
+		nl.extents = extents
+		nl.blocks = content + leaves
+		l.cursor = pos
+		return nl, nil
+	}
+
+}
+
+type planArgs struct {
+	blocks        int64
+	minInodes     int64
+	minPer64      int64
+	minFreeBlocks int64
+	usedInodes    int64
+	content       [][]segment
+}
+
+func (l *layout) setGeometry(args *planArgs) error {
+
+	const mib = 1024 * 1024 / BlockSize
+
+	l.blocks = args.blocks
+
+	// this mirrors the default geometry chosen by mkfs.xfs for a single disk
+	agCount := int64(1)
+	if l.blocks >= 64*mib {
+		agCount = 4
+	} else if l.blocks >= 32*mib {
+		agCount = 2
+	}
+
+	l.agBlocks = divide(l.blocks, agCount)
+	if l.agBlocks > MaxAGBlocks {
+		l.agBlocks = MaxAGBlocks
+	}
+
+	if l.agBlocks < MinAGBlocks {
+		return errInsufficientSpace
+	}
+
+	l.agCount = divide(l.blocks, l.agBlocks)
+
+	// drop the final AG if it's too small to be valid
+	if x := l.agSize(l.agCount - 1); l.agCount > 1 && x < MinAGBlocks {
+		l.agCount--
+		l.blocks = l.agCount * l.agBlocks
+	}
+
+	l.agBlockLog = log2(l.agBlocks)
+
+	l.logBlocks = l.blocks / 2048
+	if l.logBlocks < MinLogBlocks {
+		l.logBlocks = MinLogBlocks
+	} else if l.logBlocks > MaxLogBlocks {
+		l.logBlocks = MaxLogBlocks
+	}
+
+	l.logAG = l.agCount / 2
+	if agPreallocBlocks+l.logBlocks > l.agSize(l.logAG) {
+		return errInsufficientSpace
+	}
+
+	l.logStart = l.logAG*l.agBlocks + agPreallocBlocks
+
+	return nil
+
+}
+
+func inodeBTreeLeaves(chunks int64) int64 {
+	if chunks <= inobtRecsPerLeaf {
+		return 0
+	}
+	return divide(chunks, inobtRecsPerLeaf)
+}
+
+// allocateInodes places enough inode chunks to hold every inode in use. Chunks
+// are packed into each AG in turn, immediately after its fixed metadata, which
+// puts the root directory exactly where xfs_repair expects to find it.
+func (l *layout) allocateInodes(inodes int64) error {
+
+	remaining := divide(inodes, InodesPerChunk)
+	l.ags = make([]agLayout, l.agCount)
+
+	for g := int64(0); g < l.agCount; g++ {
+
+		first := g * l.agBlocks
+		end := first + l.agSize(g)
+		ag := &l.ags[g]
+		ag.firstChunk = int64(len(l.chunks))
+
+		if remaining == 0 {
+			continue
+		}
+
+		pos := first + agPreallocBlocks
+		if g == l.logAG {
+			pos += l.logBlocks
+		}
+		pos = first + align(pos-first, InodeAlignment)
+
+		n := (end - pos) / BlocksPerChunk
+		if n > remaining {
+			n = remaining
+		}
+		if n > inobtRecsPerLeaf*inobtRecsPerNode {
+			n = inobtRecsPerLeaf * inobtRecsPerNode
+		}
+		for n > 0 && n*BlocksPerChunk+inodeBTreeLeaves(n) > end-pos {
+			n--
+		}
+
+		for i := int64(0); i < n; i++ {
+			l.chunks = append(l.chunks, pos)
+			l.reserve(pos, BlocksPerChunk, true)
+			pos += BlocksPerChunk
+		}
+
+		for i := int64(0); i < inodeBTreeLeaves(n); i++ {
+			ag.leaves = append(ag.leaves, pos)
+			l.reserve(pos, 1, true)
+			pos++
+		}
+
+		ag.chunks = n
+		remaining -= n
+		l.cursor = pos
+
+	}
+
+	if remaining > 0 {
+		return errInsufficientSpace
+	}
+
+	return nil
+
+}
+
+func (l *layout) scanFreeSpace() error {
+
+	for g := int64(0); g < l.agCount; g++ {
+
+		ag := &l.ags[g]
+		first := g * l.agBlocks
+		end := first + l.agSize(g)
+
+		for bno := first; bno < end; {
+			if l.alloc.get(bno) {
+				bno++
+				continue
+			}
+			r := run{start: bno}
+			for bno < end && !l.alloc.get(bno) {
+				r.length++
+				bno++
+			}
+			ag.free = append(ag.free, r)
+			ag.freeBlocks += r.length
+			if r.length > ag.longest {
+				ag.longest = r.length
+			}
+		}
+
+		if len(ag.free) > shortRecsPerBlock {
+			return fmt.Errorf("free space in allocation group %d is too fragmented", g)
+		}
+
+		// blocks on the AG free list count as free space too
+		l.freeBlocks += ag.freeBlocks + agflBlocks
+
+	}
+
+	return nil
+
+}
+
+// plan computes the complete structure of a file-system with the given
+// number of blocks, returning errInsufficientSpace if it cannot satisfy all
+// of the requirements.
+func plan(args *planArgs) (*layout, error) {
+
+	l := new(layout)
+
+	err := l.setGeometry(args)
+	if err != nil {
+		return nil, err
+	}
+
+	l.alloc = newBitmap(l.blocks)
+	l.dirty = newBitmap(l.blocks)
+
+	for g := int64(0); g < l.agCount; g++ {
+		l.reserve(g*l.agBlocks, agflFirstBlock, true)
+		l.reserve(g*l.agBlocks+agflFirstBlock, agflBlocks, false)
+	}
+
+	// only the first block of the log has any content
+	l.reserve(l.logStart, l.logBlocks, false)
+	l.dirty.set(l.logStart)
+
+	err = l.allocateInodes(args.usedInodes)
+	if err != nil {
+		return nil, err
+	}
+
+	l.nodes = make([]nodeLayout, len(args.content))
+	for i, segments := range args.content {
+		l.nodes[i], err = l.allocate(segments)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = l.scanFreeSpace()
+	if err != nil {
+		return nil, err
+	}
+
+	// XFS creates inodes on demand, so rather than preallocating free inodes
+	// we guarantee enough free space to hold them
+	inodes := args.minInodes
+	if x := args.minPer64 * divide(l.blocks, 64*1024*1024/BlockSize); x > inodes {
+		inodes = x
+	}
+
+	var inodeBlocks int64
+	if x := inodes - int64(len(l.chunks))*InodesPerChunk; x > 0 {
+		inodeBlocks = divide(x, InodesPerChunk) * BlocksPerChunk
+	}
+
+	// the kernel holds back some free space that can't be used for files
+	reserved := int64(allocSetAsidePer) * l.agCount
+	if x := l.blocks / 20; x < maxReservedBlock {
+		reserved += x
+	} else {
+		reserved += maxReservedBlock
+	}
+
+	if l.freeBlocks < args.minFreeBlocks+inodeBlocks+reserved {
+		return nil, errInsufficientSpace
+	}
+
+	l.inodeMaxPct = DefaultInodeMaxPct
+	inodeBlocks += int64(len(l.chunks)) * BlocksPerChunk
+	if x := divide(inodeBlocks*100, l.blocks); x > l.inodeMaxPct {
+		l.inodeMaxPct = x
+	}
+	if l.inodeMaxPct > 100 {
+		l.inodeMaxPct = 100
+	}
+
+	return l, nil
+
+}
+
+// minimumBlocks searches for the smallest number of blocks that satisfies the
+// planning requirements.
+func minimumBlocks(args *planArgs) (int64, error) {
+
+	var total int64
+	for _, segments := range args.content {
+		for _, s := range segments {
+			total += s.length
+		}
+	}
+
+	lo := int64(0)
+	hi := total + args.minFreeBlocks + MinLogBlocks + 1024
+
+	for {
+		a := *args
+		a.blocks = hi
+		_, err := plan(&a)
+		if err == nil {
+			break
+		}
+		if err != errInsufficientSpace {
+			return 0, err
+		}
+		lo = hi
+		hi *= 2
+		if hi > 1<<48 {
+			return 0, fmt.Errorf("file-system requirements cannot be satisfied: %w", err)
+		}
+	}
+
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		a := *args
+		a.blocks = mid
+		_, err := plan(&a)
+		if err == nil {
+			hi = mid
+		} else if err == errInsufficientSpace {
+			lo = mid
+		} else {
+			return 0, err
+		}
+	}
+
+	return hi, nil
+
+}
@@ -0,0 +1,64 @@
+package xfs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// writeLogRecord writes a log record containing a single unmount record, in
+// the same way as mkfs.xfs. This is what the kernel expects to find at the
+// head of the log of a cleanly unmounted file-system.
+func writeLogRecord(w io.Writer, uuid [16]byte) error {
+
+	const cycle = 1
+
+	// the unmount record: an operation header followed by its payload
+	data := make([]byte, SectorSize)
+	binary.BigEndian.PutUint32(data[0:], 0xb0c0d0d0) // transaction ID
+	binary.BigEndian.PutUint32(data[4:], 8)          // payload length
+	data[8] = logClientID
+	data[9] = logUnmountTrans
+	binary.LittleEndian.PutUint16(data[12:], LogUnmountType)
+	length := 12 + 8
+
+	hdr := make([]byte, SectorSize)
+	binary.BigEndian.PutUint32(hdr[0:], LogHeaderMagic)
+	binary.BigEndian.PutUint32(hdr[4:], cycle)
+	binary.BigEndian.PutUint32(hdr[8:], logVersion)
+	binary.BigEndian.PutUint32(hdr[12:], uint32(length))
+	binary.BigEndian.PutUint64(hdr[16:], cycle<<32)  // lsn
+	binary.BigEndian.PutUint64(hdr[24:], cycle<<32)  // tail lsn
+	binary.BigEndian.PutUint32(hdr[36:], 0xffffffff) // previous block
+	binary.BigEndian.PutUint32(hdr[40:], 1)          // number of operations
+	binary.BigEndian.PutUint32(hdr[300:], logFormatLE)
+	copy(hdr[304:], uuid[:])
+	binary.BigEndian.PutUint32(hdr[320:], logRecordSize)
+
+	// the first word of every block in the record is replaced with the
+	// cycle number, with the original value stashed in the header
+	copy(hdr[44:48], data[0:4])
+	binary.BigEndian.PutUint32(data[0:], cycle)
+
+	crc := crc32.Checksum(hdr[:logRecordHeaderBytes], crcTable)
+	crc = crc32.Update(crc, crcTable, data[:length])
+	binary.LittleEndian.PutUint32(hdr[logHeaderCRCOffset:], crc)
+
+	_, err := w.Write(hdr)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
@@ -32,6 +32,14 @@ type Sizer interface {
 	Size() int64
 }
 
+// Timestamper can be implemented by the Sizer given to NewWriter to decide the
+// modification time of every file in the archive, which is otherwise the
+// current time. Note that our vimg.Builder implements this interface so that
+// reproducible builds produce identical XVAs.
+type Timestamper interface {
+	Timestamp() time.Time
+}
+
 // Writer implements io.Closer, io.Writer, and io.Seeker interfaces. Creating an
 // XVA image is as simple as getting one of these writers and copying a raw
 // image into it.
@@ -73,6 +81,9 @@ func (w *Writer) writeOVAXML() error {
 
 	// timestamp := src.ModTime()
 	timestamp := time.Now()
+	if ts, ok := w.h.(Timestamper); ok {
+		timestamp = ts.Timestamp()
+	}
 
 	hdr := &tar.Header{
 		ModTime:    timestamp,